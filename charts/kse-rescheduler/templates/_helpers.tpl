@@ -67,3 +67,28 @@ Defines the service name for the webhook
 {{- define "kse-rescheduler.serviceName" -}}
 {{- .Release.Name | trunc 63 | trimSuffix "-" }}
 {{- end }}
+
+{{/*
+The version of the webhook configurations, admissionregistration.k8s.io/v1beta1 if the api server doesn't serve v1
+*/}}
+{{- define "kse-rescheduler.admissionRegistrationAPIVersion" -}}
+{{- if .Capabilities.APIVersions.Has "admissionregistration.k8s.io/v1" }}
+{{- "admissionregistration.k8s.io/v1" }}
+{{- else }}
+{{- "admissionregistration.k8s.io/v1beta1" }}
+{{- end }}
+{{- end }}
+
+{{/*
+The AdmissionReview versions the webhooks are called with, the api servers without admissionregistration.k8s.io/v1
+only send v1beta1. It's the check kse-rescheduler reports in /readyz/capabilities
+*/}}
+{{- define "kse-rescheduler.admissionReviewVersions" -}}
+{{- if .Values.webhook.admissionReviewVersions }}
+{{- toJson .Values.webhook.admissionReviewVersions }}
+{{- else if .Capabilities.APIVersions.Has "admissionregistration.k8s.io/v1" }}
+{{- toJson (list "v1" "v1beta1") }}
+{{- else }}
+{{- toJson (list "v1beta1") }}
+{{- end }}
+{{- end }}
@@ -0,0 +1,101 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package app
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	schedv1beta3 "k8s.io/kube-scheduler/config/v1beta3"
+	"kse/kse-rescheduler/pkg/admission"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"time"
+)
+
+// extenderConfigOptions are the settings of the extender in the generated kube-scheduler configuration
+type extenderConfigOptions struct {
+	URLPrefix        string
+	CAFile           string
+	Insecure         bool
+	Weight           int64
+	HTTPTimeout      time.Duration
+	NodeCacheCapable bool
+	Ignorable        bool
+}
+
+var extenderConfig = extenderConfigOptions{
+	URLPrefix:   "https://kse-rescheduler.kse-rescheduler.svc:443" + admission.ExtenderURLPrefix,
+	Weight:      1,
+	HTTPTimeout: 5 * time.Second,
+	Ignorable:   true,
+}
+
+// schedulerConfiguration is the part of KubeSchedulerConfiguration the extender needs, the other fields are left to
+// kube-scheduler's defaults
+type schedulerConfiguration struct {
+	metav1.TypeMeta `json:",inline"`
+	Extenders       []schedv1beta3.Extender `json:"extenders"`
+}
+
+var extenderConfigCmd = &cobra.Command{
+	Use:   "extender-config",
+	Short: "Prints the kube-scheduler configuration calling kse-rescheduler as a scheduler extender",
+	Long: `Prints the KubeSchedulerConfiguration calling kse-rescheduler as a scheduler extender, for the clusters
+where kube-scheduler can't be replaced by the one with the Podrescheduling plugin.
+
+kse-rescheduler serves the extender when it's started with --enable-extender. Merge the extenders into the
+configuration of kube-scheduler, e.g. the one passed by its --config flag.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out, err := extenderConfig.generate()
+		if err != nil {
+			return err
+		}
+		fmt.Print(out)
+		return nil
+	},
+}
+
+// generate returns the KubeSchedulerConfiguration yaml with the kse-rescheduler extender
+func (o extenderConfigOptions) generate() (string, error) {
+	extender := schedv1beta3.Extender{
+		URLPrefix:        strings.TrimSuffix(o.URLPrefix, "/"),
+		FilterVerb:       admission.ExtenderFilterVerb,
+		PrioritizeVerb:   admission.ExtenderPrioritizeVerb,
+		Weight:           o.Weight,
+		EnableHTTPS:      strings.HasPrefix(o.URLPrefix, "https://"),
+		HTTPTimeout:      metav1.Duration{Duration: o.HTTPTimeout},
+		NodeCacheCapable: o.NodeCacheCapable,
+		Ignorable:        o.Ignorable,
+	}
+	if extender.EnableHTTPS && (o.CAFile != "" || o.Insecure) {
+		extender.TLSConfig = &schedv1beta3.ExtenderTLSConfig{CAFile: o.CAFile, Insecure: o.Insecure}
+	}
+	config := schedulerConfiguration{
+		TypeMeta:  metav1.TypeMeta{APIVersion: schedv1beta3.SchemeGroupVersion.String(), Kind: "KubeSchedulerConfiguration"},
+		Extenders: []schedv1beta3.Extender{extender},
+	}
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("marshal the kube-scheduler configuration err: %s", err.Error())
+	}
+	return string(out), nil
+}
+
+func init() {
+	rootCmd.AddCommand(extenderConfigCmd)
+	extenderConfigCmd.Flags().StringVar(&extenderConfig.URLPrefix, "url-prefix", extenderConfig.URLPrefix, "URL kube-scheduler reaches kse-rescheduler's extender at")
+	extenderConfigCmd.Flags().StringVar(&extenderConfig.CAFile, "ca-file", extenderConfig.CAFile, "CA file kube-scheduler verifies kse-rescheduler's TLS certificate with")
+	extenderConfigCmd.Flags().BoolVar(&extenderConfig.Insecure, "insecure", extenderConfig.Insecure, "Skip the verification of kse-rescheduler's TLS certificate")
+	extenderConfigCmd.Flags().Int64Var(&extenderConfig.Weight, "weight", extenderConfig.Weight, "Weight of the extender's node scores")
+	extenderConfigCmd.Flags().DurationVar(&extenderConfig.HTTPTimeout, "http-timeout", extenderConfig.HTTPTimeout, "Timeout of kube-scheduler's calls to the extender")
+	extenderConfigCmd.Flags().BoolVar(&extenderConfig.NodeCacheCapable, "node-cache-capable", extenderConfig.NodeCacheCapable, "Send only the node names, kse-rescheduler reads the nodes from its cache")
+	extenderConfigCmd.Flags().BoolVar(&extenderConfig.Ignorable, "ignorable", extenderConfig.Ignorable, "Keep scheduling pods when kse-rescheduler is unreachable")
+}
@@ -10,8 +10,12 @@
 package app
 
 import (
+	"context"
 	"github.com/spf13/cobra"
+	"k8s.io/component-base/config/options"
 	"kse/kse-rescheduler/pkg/admission"
+	"os/signal"
+	"syscall"
 )
 
 var kseRescheduler = admission.NewKseReschedulerServer()
@@ -29,20 +33,64 @@ The listFunc will periodically list terminated and crashloopback pods, then dele
 TLS certificate and private key is required to receive requests
 from kubernetes controllers. The certificate should have SAN
 and DNS that reflects the webhooks service FQDN, e.g:
-webhook.kserescheduler.svc.
+webhook.kserescheduler.svc. With --manage-certs the certificates are
+generated, rotated and kept in a secret by kse-rescheduler, and the caBundle
+of the webhook configurations is patched, the certificates are reloaded
+without restarting.
+
+Only the leader of --leader-elect runs the listFunc, it stops once the lease
+is lost and campaigns again. On SIGINT or SIGTERM the lease is released and
+the in-flight requests are drained, a second signal exits at once.
+
+The health checks, the metrics and the profiling are served over plain
+HTTP on --ops-addr.
+
+With --watch-namespaces the informers, the webhooks and the listFunc are
+scoped to the namespaces so kse-rescheduler runs with namespaced Roles only,
+the nodes aren't read in this mode.
+
+With --config the settings are read from a KseReschedulerConfiguration file
+overriding their flags, the file is watched and its changes are applied
+without restarting, except clientConnection and leaderElection.
 .`,
    Run: func(cmd *cobra.Command, args []string) {
 	   //klog.V(3).Info("It is debug message")
-	   cobra.CheckErr(kseRescheduler.Start(kubeConfigFile))
+	   ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	   defer stop()
+	   go func() {
+		   // a second signal terminates the process
+		   <-ctx.Done()
+		   stop()
+	   }()
+	   cobra.CheckErr(kseRescheduler.Start(ctx, kubeConfigFile))
    },
 }
 
 func init()  {
 	rootCmd.AddCommand(kseReschedulerCmd)
+	kseReschedulerCmd.Flags().StringVar(&kseRescheduler.ConfigFile, "config", kseRescheduler.ConfigFile, "KseReschedulerConfiguration file overriding the flags of its settings, its changes are applied without a restart")
 	kseReschedulerCmd.Flags().StringVar(&kseRescheduler.TLSCertFile, "tls-crt", kseRescheduler.TLSCertFile, "TLS Certificate file")
 	kseReschedulerCmd.Flags().StringVar(&kseRescheduler.TLSKeyFile, "tls-key", kseRescheduler.TLSKeyFile, "TLS Key file")
+	kseReschedulerCmd.Flags().BoolVar(&kseRescheduler.ManageCerts, "manage-certs", kseRescheduler.ManageCerts, "Generate and rotate the webhook certificates in the secret of --cert-secret instead of reading --tls-crt and --tls-key")
+	kseReschedulerCmd.Flags().StringVar(&kseRescheduler.CertSecretName, "cert-secret", kseRescheduler.CertSecretName, "Secret keeping the managed certificates in the namespace of kse-rescheduler")
+	kseReschedulerCmd.Flags().StringVar(&kseRescheduler.ServiceName, "service-name", kseRescheduler.ServiceName, "Service of the webhook the managed certificates are issued for")
+	kseReschedulerCmd.Flags().StringVar(&kseRescheduler.WebhookConfigName, "webhook-config-name", kseRescheduler.WebhookConfigName, "Mutating and validating webhook configurations whose caBundle is patched with the managed CA")
+	kseReschedulerCmd.Flags().StringSliceVar(&kseRescheduler.WatchNamespaces, "watch-namespaces", kseRescheduler.WatchNamespaces, "Namespaces the informers, the webhooks and the listFunc are scoped to, so only namespaced Roles are needed, all the namespaces if empty")
 	kseReschedulerCmd.Flags().StringVar(&kseRescheduler.Address, "addr", kseRescheduler.Address, "Webhook bind address")
+	kseReschedulerCmd.Flags().StringVar(&kseRescheduler.OpsAddress, "ops-addr", kseRescheduler.OpsAddress, "Plain HTTP bind address of /healthz, /readyz, /metrics and /debug/pprof")
+	kseReschedulerCmd.Flags().BoolVar(&kseRescheduler.EnableProfiling, "enable-profiling", kseRescheduler.EnableProfiling, "Serve /debug/pprof on --ops-addr")
 	kseReschedulerCmd.Flags().DurationVar(&kseRescheduler.ListFuncPeriod, "list-func-period", kseRescheduler.ListFuncPeriod, "kse-rescheduler's execution period to reschedule terminated or crashloopback pods")
+	kseReschedulerCmd.Flags().DurationVar(&kseRescheduler.Handler.RequestTimeout, "request-timeout", kseRescheduler.Handler.RequestTimeout, "Timeout of the lookups of an admission request, shorter than the webhook's timeoutSeconds")
+	kseReschedulerCmd.Flags().BoolVar(&kseRescheduler.Handler.FailOpen, "fail-open", kseRescheduler.Handler.FailOpen, "Admit the pods unpatched if their rescheduling state can't be read, instead of rejecting them")
+	kseReschedulerCmd.Flags().StringVar(&kseRescheduler.Handler.NodeAffinityMode, "node-affinity-mode", kseRescheduler.Handler.NodeAffinityMode, "Inject the excluded nodes into the pods' nodeAffinity for the stock kube-scheduler, required or preferred")
+	kseReschedulerCmd.Flags().StringVar(&kseRescheduler.Handler.SchedulerName, "scheduler-name", kseRescheduler.Handler.SchedulerName, "Scheduler profile running Podrescheduling the pods with rescheduling history are routed to")
+	kseReschedulerCmd.Flags().StringSliceVar(&kseRescheduler.Handler.StateEditors, "state-editors", kseRescheduler.Handler.StateEditors, "Users and groups allowed to edit the kse.com state annotations, e.g. the service account of kse-rescheduler")
+	kseReschedulerCmd.Flags().BoolVar(&kseRescheduler.Handler.AuthorizeStateEdits, "authorize-state-edits", kseRescheduler.Handler.AuthorizeStateEdits, "Allow the other users to edit the state annotations if a SubjectAccessReview allows them to update states.kse.com")
+	kseReschedulerCmd.Flags().BoolVar(&kseRescheduler.EnableExtender, "enable-extender", kseRescheduler.EnableExtender, "Serve the kube-scheduler extender protocol, see the extender-config command")
+	kseReschedulerCmd.Flags().DurationVar(&kseRescheduler.GCPeriod, "gc-period", kseRescheduler.GCPeriod, "kse-rescheduler's period to prune the stale kse.com state of workloads and pods")
+	kseReschedulerCmd.Flags().DurationVar(&kseRescheduler.ShutdownDelay, "shutdown-delay", kseRescheduler.ShutdownDelay, "Time the webhook keeps serving while it's unready on shutdown, so the endpoints are removed before the listener is closed")
+	kseReschedulerCmd.Flags().DurationVar(&kseRescheduler.ShutdownGracePeriod, "shutdown-grace-period", kseRescheduler.ShutdownGracePeriod, "Time the in-flight requests are drained for on shutdown")
+	options.BindLeaderElectionFlags(&kseRescheduler.LeaderElection, kseReschedulerCmd.Flags())
 	//klog.InitFlags(flag.CommandLine)
 	//webhookCmd.Flags().AddGoFlagSet(flag.CommandLine)
 }
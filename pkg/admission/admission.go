@@ -15,18 +15,22 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	admission "k8s.io/api/admission/v1beta1"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	batchv1 "k8s.io/api/batch/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 	"net/http"
+	"strings"
+	"time"
 	"kse/kse-rescheduler/pkg"
-	"kse/kse-rescheduler/pkg/listfunc"
 )
 
 const (
@@ -34,16 +38,66 @@ const (
 )
 
 var (
-	k8sdecode       = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
+	admissionScheme = runtime.NewScheme()
+	k8sdecode       = serializer.NewCodecFactory(admissionScheme).UniversalDeserializer()
 	podResource     = metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
 )
 
+func init() {
+	utilruntime.Must(admissionv1.AddToScheme(admissionScheme))
+	utilruntime.Must(admissionv1beta1.AddToScheme(admissionScheme))
+}
+
 type RequestsHandler struct {
 	K8sClientSet                kubernetes.Interface
+	// WatchNamespaces are the namespaces whose requests are handled, the others are admitted unchanged. All the
+	// namespaces are watched if it's empty
+	WatchNamespaces             []string
+	// NodeAffinityMode injects the exclusions into the pods' nodeAffinity, required or preferred, it's off if empty
+	NodeAffinityMode            string
+	// SchedulerName routes the pods with rescheduling history to the scheduler profile running Podrescheduling
+	SchedulerName               string
+	// RequestTimeout bounds the lookups of an admission request, it should be shorter than the webhook's timeoutSeconds
+	RequestTimeout              time.Duration
+	// FailOpen admits the pods unpatched if their rescheduling state can't be read, instead of rejecting them
+	FailOpen                    bool
+	// Owners reads the pods' owners from the informer cache, the owners are read live if it's nil
+	Owners                      *OwnerCache
+	// StateEditors are the users and groups allowed to edit the kse.com state annotations
+	StateEditors                []string
+	// AuthorizeStateEdits allows the other users to edit the state annotations if a SubjectAccessReview allows them to
+	// update states.kse.com, e.g. the cluster admins
+	AuthorizeStateEdits         bool
 }
 
 func NewRequestsHandler() RequestsHandler {
-	return RequestsHandler{}
+	return RequestsHandler{
+		RequestTimeout:      5 * time.Second,
+		FailOpen:            true,
+		StateEditors:        DefaultStateEditors,
+		AuthorizeStateEdits: true,
+	}
+}
+
+// watched is true if the requests of the namespace are handled
+func (h *RequestsHandler) watched(namespace string) bool {
+	if len(h.WatchNamespaces) == 0 {
+		return true
+	}
+	for _, watched := range h.WatchNamespaces {
+		if watched == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// owners returns the cache reading the pods' owners
+func (h *RequestsHandler) owners() *OwnerCache {
+	if h.Owners == nil {
+		return NewOwnerCache(h.K8sClientSet, nil)
+	}
+	return h.Owners
 }
 
 
@@ -55,16 +109,31 @@ func (h *RequestsHandler) handleFunc(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("failed to parse admission review from request, error=%s", err.Error()), header)
 		return
 	}
-	reviewResponse := admission.AdmissionReview{
+	reviewResponse := admissionv1.AdmissionReview{
 		TypeMeta: review.TypeMeta,
-		Response: &admission.AdmissionResponse{
+		Response: &admissionv1.AdmissionResponse{
 			UID: review.Request.UID,
 		},
 	}
 
 	//klog.Infof("incoming review request=%+v", *review.Request)
 
-	patches, err := h.handleAdmissionReview(review)
+	ctx := r.Context()
+	if h.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.RequestTimeout)
+		defer cancel()
+	}
+	patches, err := h.handleAdmissionReview(ctx, review)
+	if err != nil && h.FailOpen {
+		klog.Errorf("admitting pod unpatched: error=%v, review=%+v\n", err, review.Request.Resource.Resource)
+		// a dry-run request doesn't create the pod, it isn't counted
+		if review.Request.DryRun == nil || !*review.Request.DryRun {
+			webhookFailOpenTotal.Inc()
+		}
+		reviewResponse.Response.Warnings = []string{fmt.Sprintf("kse-rescheduler didn't inject the rescheduling state: %s", err.Error())}
+		patches, err = nil, nil
+	}
 	if err != nil {
 		klog.Errorf("rejecting request: error=%v, review=%+v\n", err, review.Request.Resource.Resource)
 		reviewResponse.Response.Allowed = false
@@ -72,22 +141,25 @@ func (h *RequestsHandler) handleFunc(w http.ResponseWriter, r *http.Request) {
 			Message: err.Error(),
 		}
 	} else {
-		patchBytes, err := json.Marshal(patches)
-		if err != nil {
-			klog.Errorf("failed to marshal json patch: %+v, error=%v\n", patches, err)
-			http.Error(w, fmt.Sprintf("could not marshal JSON patch: %s", err.Error()), http.StatusInternalServerError)
-			return
-		}
+		// a pod without the rescheduling state is admitted without a patch
+		if len(patches) > 0 {
+			patchBytes, err := json.Marshal(patches)
+			if err != nil {
+				klog.Errorf("failed to marshal json patch: %+v, error=%v\n", patches, err)
+				http.Error(w, fmt.Sprintf("could not marshal JSON patch: %s", err.Error()), http.StatusInternalServerError)
+				return
+			}
 
-		reviewResponse.Response.Patch = patchBytes
-		reviewResponse.Response.PatchType = new(admission.PatchType)
-		*reviewResponse.Response.PatchType = admission.PatchTypeJSONPatch
+			reviewResponse.Response.Patch = patchBytes
+			reviewResponse.Response.PatchType = new(admissionv1.PatchType)
+			*reviewResponse.Response.PatchType = admissionv1.PatchTypeJSONPatch
+		}
 		reviewResponse.Response.Allowed = true
 	}
 
 	//klog.Infof("sending response: allowed=%t, result=%+v, patches=%+v", reviewResponse.Response.Allowed, reviewResponse.Response.Result, patches)
 
-	bytes, err := json.Marshal(&reviewResponse)
+	bytes, err := marshalAdmissionReview(&reviewResponse)
 	if err != nil {
 		klog.Errorf("failed to marshal response review: %+v, error=%v\n", reviewResponse, err)
 		http.Error(w, fmt.Sprintf("failed to marshal response review: %s", err.Error()), http.StatusInternalServerError)
@@ -102,7 +174,9 @@ func (h *RequestsHandler) handleFunc(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func (h *RequestsHandler) readAdmissionReview(r *http.Request) (*admission.AdmissionReview, int, error) {
+// readAdmissionReview decodes an admission/v1 or admission/v1beta1 review, the v1beta1 one is converted to v1 and the
+// response keeps its apiVersion
+func (h *RequestsHandler) readAdmissionReview(r *http.Request) (*admissionv1.AdmissionReview, int, error) {
 	if r.Method != http.MethodPost {
 		return nil, http.StatusMethodNotAllowed, fmt.Errorf("invalid method %s, only POST requests are allowed", r.Method)
 	}
@@ -116,18 +190,56 @@ func (h *RequestsHandler) readAdmissionReview(r *http.Request) (*admission.Admis
 		return nil, http.StatusBadRequest, fmt.Errorf("unsupported content type %s, only %s is supported", contentType, jsonContentType)
 	}
 
-	review := &admission.AdmissionReview{}
-	if _, _, err := k8sdecode.Decode(body, nil, review); err != nil {
+	obj, _, err := k8sdecode.Decode(body, nil, nil)
+	if err != nil {
 		return nil, http.StatusBadRequest, fmt.Errorf("could not deserialize request to review object: %v", err)
-	} else if review.Request == nil {
+	}
+	review := &admissionv1.AdmissionReview{}
+	switch obj := obj.(type) {
+	case *admissionv1.AdmissionReview:
+		review = obj
+	case *admissionv1beta1.AdmissionReview:
+		if err := convertAdmissionReview(obj, review); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		review.TypeMeta = obj.TypeMeta
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("unsupported review type %T", obj)
+	}
+	if review.Request == nil {
 		return nil, http.StatusBadRequest, errors.New("review parsed but request is null")
 	}
 
 	return review, http.StatusOK, nil
 }
 
-func (h *RequestsHandler) handleAdmissionReview(review *admission.AdmissionReview) (pkg.Patches, error) {
-	if review.Request.Operation == admission.Create && review.Request.Namespace != metav1.NamespaceSystem {
+// marshalAdmissionReview encodes the response in the apiVersion of the request
+func marshalAdmissionReview(review *admissionv1.AdmissionReview) ([]byte, error) {
+	if review.APIVersion != admissionv1beta1.SchemeGroupVersion.String() {
+		return json.Marshal(review)
+	}
+	v1beta1Review := &admissionv1beta1.AdmissionReview{}
+	if err := convertAdmissionReview(review, v1beta1Review); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v1beta1Review)
+}
+
+// convertAdmissionReview converts between the v1 and v1beta1 reviews, their fields are the same except the types'
+// versions
+func convertAdmissionReview(in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("could not convert review %T: %v", in, err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("could not convert review %T to %T: %v", in, out, err)
+	}
+	return nil
+}
+
+func (h *RequestsHandler) handleAdmissionReview(ctx context.Context, review *admissionv1.AdmissionReview) (pkg.Patches, error) {
+	if review.Request.Operation == admissionv1.Create && review.Request.Namespace != metav1.NamespaceSystem && h.watched(review.Request.Namespace) {
 		if review.Request.Resource == podResource {
 			raw := review.Request.Object.Raw
 			pod := corev1.Pod{}
@@ -135,11 +247,10 @@ func (h *RequestsHandler) handleAdmissionReview(review *admission.AdmissionRevie
 				return nil, fmt.Errorf("could not deserialize pod object: %v", err)
 			}
 			if len(pod.OwnerReferences) > 0 {
-				lf := listfunc.NewListFunc()
-				lf.K8sClientSet = h.K8sClientSet
-				podOwnerInfo, err := lf.GetPodOwnerInfo(&pod)
+				owners := h.owners()
+				podOwnerInfo, err := owners.podOwnerInfo(ctx, &pod)
 				if err != nil {
-					return nil, nil
+					return nil, err
 				}
 				var namespace string
 				if len(pod.Namespace) > 0 {
@@ -149,7 +260,7 @@ func (h *RequestsHandler) handleAdmissionReview(review *admission.AdmissionRevie
 				}
 				switch podOwnerInfo.PodOwnerType {
 				case "Deployment":
-					deploy, err := h.K8sClientSet.AppsV1().Deployments(namespace).Get(context.TODO(), podOwnerInfo.PodOwnerName, metav1.GetOptions{})
+					deploy, err := owners.deployment(ctx, namespace, podOwnerInfo.PodOwnerName)
 					if err != nil {
 						return nil, fmt.Errorf("get pod %s deployment error", pod.Name)
 					}
@@ -158,10 +269,10 @@ func (h *RequestsHandler) handleAdmissionReview(review *admission.AdmissionRevie
 						if err != nil {
 							return nil, err
 						}
-						return patches, nil
+						return h.schedulingPatches(ctx, &pod, ownerAvoidancePatches(&pod, deploy, patches)), nil
 					}
 				case "ReplicaSet":
-					rs, err := h.K8sClientSet.AppsV1().ReplicaSets(namespace).Get(context.TODO(), podOwnerInfo.PodOwnerName, metav1.GetOptions{})
+					rs, err := owners.replicaSet(ctx, namespace, podOwnerInfo.PodOwnerName)
 					if err != nil {
 						return nil, fmt.Errorf("get pod %s replicasets error", pod.Name)
 					}
@@ -170,10 +281,10 @@ func (h *RequestsHandler) handleAdmissionReview(review *admission.AdmissionRevie
 						if err != nil {
 							return nil, err
 						}
-						return patches, nil
+						return h.schedulingPatches(ctx, &pod, ownerAvoidancePatches(&pod, rs, patches)), nil
 					}
 				case "CronJob":
-					cj, err := h.K8sClientSet.BatchV1().CronJobs(namespace).Get(context.TODO(), podOwnerInfo.PodOwnerName, metav1.GetOptions{})
+					cj, err := owners.cronJob(ctx, namespace, podOwnerInfo.PodOwnerName)
 					if err != nil {
 						return nil, fmt.Errorf("get pod %s cronjob error", pod.Name)
 					}
@@ -182,10 +293,10 @@ func (h *RequestsHandler) handleAdmissionReview(review *admission.AdmissionRevie
 						if err != nil {
 							return nil, err
 						}
-						return patches, nil
+						return h.schedulingPatches(ctx, &pod, ownerAvoidancePatches(&pod, cj, patches)), nil
 					}
 				case "Job":
-					jb, err := h.K8sClientSet.BatchV1().Jobs(namespace).Get(context.TODO(), podOwnerInfo.PodOwnerName, metav1.GetOptions{})
+					jb, err := owners.job(ctx, namespace, podOwnerInfo.PodOwnerName)
 					if err != nil {
 						return nil, fmt.Errorf("get pod %s job error", pod.Name)
 					}
@@ -194,10 +305,10 @@ func (h *RequestsHandler) handleAdmissionReview(review *admission.AdmissionRevie
 						if err != nil {
 							return nil, err
 						}
-						return patches, nil
+						return h.schedulingPatches(ctx, &pod, ownerAvoidancePatches(&pod, jb, patches)), nil
 					}
 				case "StatefulSet":
-					sts, err := h.K8sClientSet.AppsV1().StatefulSets(namespace).Get(context.TODO(), podOwnerInfo.PodOwnerName, metav1.GetOptions{})
+					sts, err := owners.statefulSet(ctx, namespace, podOwnerInfo.PodOwnerName)
 					if err != nil {
 						return nil, fmt.Errorf("get pod %s statefulset error", pod.Name)
 					}
@@ -207,7 +318,7 @@ func (h *RequestsHandler) handleAdmissionReview(review *admission.AdmissionRevie
 						if err != nil {
 							return nil, err
 						}
-						return patches, nil
+						return h.schedulingPatches(ctx, &pod, ownerAvoidancePatches(&pod, sts, patches)), nil
 					}
 				}
 			}
@@ -217,7 +328,6 @@ func (h *RequestsHandler) handleAdmissionReview(review *admission.AdmissionRevie
 }
 
 func (h *RequestsHandler) createDeployPatches(pod *corev1.Pod, deploy *appsv1.Deployment) (pkg.Patches, error) {
-	var patches pkg.Patches
 	var deployInfo pkg.DeployInfo
 	if _, ok := deploy.Annotations[pkg.DeployInfoString]; ok {
 		if err := json.Unmarshal([]byte(deploy.Annotations[pkg.DeployInfoString]), &deployInfo); err != nil {
@@ -228,19 +338,13 @@ func (h *RequestsHandler) createDeployPatches(pod *corev1.Pod, deploy *appsv1.De
 			if err != nil {
 				return nil, fmt.Errorf("marshal %s scheduled hosts from deployment %s err: %s", pod.Name, deploy.Name, err.Error())
 			}
-			patches = append(patches, pkg.Patch{
-				Op: "add",
-				Path: "/metadata/annotations",
-				Value: map[string]string{pkg.SchedulinedHostString: string(byteScheduledHost)},
-			})
-			return patches, nil
+			return annotationPatches(pod, map[string]string{pkg.SchedulinedHostString: string(byteScheduledHost)}), nil
 		}
 	}
 	return nil, nil
 }
 
 func (h *RequestsHandler) createRcPatches(pod *corev1.Pod, rs *appsv1.ReplicaSet) (pkg.Patches, error) {
-	var patches pkg.Patches
 	var rsInfo pkg.RsInfo
 	if _, ok := rs.Annotations[pkg.RsInfoString]; ok {
 		if err := json.Unmarshal([]byte(rs.Annotations[pkg.RsInfoString]), &rsInfo); err != nil {
@@ -251,19 +355,13 @@ func (h *RequestsHandler) createRcPatches(pod *corev1.Pod, rs *appsv1.ReplicaSet
 			if err != nil {
 				return nil, fmt.Errorf("marshal %s scheduled hosts from replicaset %s err: %s", pod.Name, rs.Name, err.Error())
 			}
-			patches = append(patches, pkg.Patch{
-				Op: "add",
-				Path: "/metadata/annotations",
-				Value: map[string]string{pkg.SchedulinedHostString: string(byteScheduledHost)},
-			})
-			return patches, nil
+			return annotationPatches(pod, map[string]string{pkg.SchedulinedHostString: string(byteScheduledHost)}), nil
 		}
 	}
 	return nil, nil
 }
 
 func (h *RequestsHandler) createCjPatches(pod *corev1.Pod, cj *batchv1.CronJob) (pkg.Patches, error) {
-	var patches pkg.Patches
 	var cjInfo pkg.CjInfo
 	if _, ok := cj.Annotations[pkg.CjInfoString]; ok {
 		if err := json.Unmarshal([]byte(cj.Annotations[pkg.CjInfoString]), &cjInfo); err != nil {
@@ -274,42 +372,35 @@ func (h *RequestsHandler) createCjPatches(pod *corev1.Pod, cj *batchv1.CronJob)
 			if err != nil {
 				return nil, fmt.Errorf("marshal %s scheduled hosts from cronjob %s err: %s", pod.Name, cj.Name, err.Error())
 			}
-			patches = append(patches, pkg.Patch{
-				Op: "add",
-				Path: "/metadata/annotations",
-				Value: map[string]string{pkg.SchedulinedHostString: string(byteScheduledHost)},
-			})
-			return patches, nil
+			return annotationPatches(pod, map[string]string{pkg.SchedulinedHostString: string(byteScheduledHost)}), nil
 		}
 	}
 	return nil, nil
 }
 
 func (h *RequestsHandler) createJobPatches(pod *corev1.Pod, jb *batchv1.Job) (pkg.Patches, error) {
-	var patches pkg.Patches
 	var jbInfo pkg.JobInfo
 	if _, ok := jb.Annotations[pkg.JobInfoString]; ok {
 		if err := json.Unmarshal([]byte(jb.Annotations[pkg.JobInfoString]), &jbInfo); err != nil {
 			return nil, fmt.Errorf("unmarshal %s kse.com/job err: %s", pod.Name, err.Error())
 		}
-		if len(jbInfo.JobScheduledHosts) > 0 {
-			byteScheduledHost, err := json.Marshal(jbInfo.JobScheduledHosts)
+		jbScheduledHosts := jbInfo.JobScheduledHosts
+		// Indexed Jobs keep the scheduled hosts for every completion index
+		if jb.Spec.CompletionMode != nil && *jb.Spec.CompletionMode == batchv1.IndexedCompletion {
+			jbScheduledHosts = jbInfo.IndexReschedulingMap[pod.Annotations[batchv1.JobCompletionIndexAnnotation]].PodScheduledHosts
+		}
+		if len(jbScheduledHosts) > 0 {
+			byteScheduledHost, err := json.Marshal(jbScheduledHosts)
 			if err != nil {
 				return nil, fmt.Errorf("marshal %s scheduled hosts from job %s err: %s", pod.Name, jb.Name, err.Error())
 			}
-			patches = append(patches, pkg.Patch{
-				Op: "add",
-				Path: "/metadata/annotations",
-				Value: map[string]string{pkg.SchedulinedHostString: string(byteScheduledHost)},
-			})
-			return patches, nil
+			return annotationPatches(pod, map[string]string{pkg.SchedulinedHostString: string(byteScheduledHost)}), nil
 		}
 	}
 	return nil, nil
 }
 
 func (h *RequestsHandler) createStsPatches(pod *corev1.Pod, sts *appsv1.StatefulSet) (pkg.Patches, error) {
-	var patches pkg.Patches
 	var stsPodMap pkg.StsPodsMap
 	podName := pod.Name
 	if _, ok := sts.Annotations[pkg.StsPodMapString]; ok {
@@ -322,14 +413,78 @@ func (h *RequestsHandler) createStsPatches(pod *corev1.Pod, sts *appsv1.Stateful
 				if err != nil {
 					return nil, fmt.Errorf("marshal %s scheduled hosts from statefulset %s err: %s", podName, sts.Name, err.Error())
 				}
-				patches = append(patches, pkg.Patch{
-					Op: "add",
-					Path: "/metadata/annotations",
-					Value: map[string]string{pkg.SchedulinedHostString: string(byteScheduledHost)},
-				})
-				return patches, nil
+				return annotationPatches(pod, map[string]string{pkg.SchedulinedHostString: string(byteScheduledHost)}), nil
 			}
 		}
 	}
 	return nil, nil
-}
\ No newline at end of file
+}
+
+// schedulingPatches routes the pod to the kse profile and injects the exclusions into its nodeAffinity
+func (h *RequestsHandler) schedulingPatches(ctx context.Context, pod *corev1.Pod, patches pkg.Patches) pkg.Patches {
+	return h.schedulerNamePatches(ctx, pod, h.nodeAffinityPatches(ctx, pod, patches))
+}
+
+// ownerAvoidancePatches adds the owner's kse.com/node-failures and kse.com/avoidance-mode to the pod, they are read by
+// the Podrescheduling plugin to score the nodes where the workload failed
+func ownerAvoidancePatches(pod *corev1.Pod, owner metav1.Object, patches pkg.Patches) pkg.Patches {
+	annotations := make(map[string]string)
+	for _, key := range []string{pkg.NodeFailuresString, pkg.AvoidanceModeString, pkg.ExcludedDomainsString} {
+		if value, ok := owner.GetAnnotations()[key]; ok {
+			annotations[key] = value
+		}
+	}
+	return addAnnotationPatches(pod, patches, annotations)
+}
+
+// addAnnotationPatches adds the annotations to the patches, they are merged into the annotations map if the patches
+// add it, e.g. the scheduled hosts patch of a pod without annotations
+func addAnnotationPatches(pod *corev1.Pod, patches pkg.Patches, annotations map[string]string) pkg.Patches {
+	if len(annotations) == 0 {
+		return patches
+	}
+	for _, patch := range patches {
+		if value, ok := patch.Value.(map[string]string); ok && patch.Path == "/metadata/annotations" {
+			for key := range annotations {
+				value[key] = annotations[key]
+			}
+			return patches
+		}
+	}
+	return append(patches, annotationPatches(pod, annotations)...)
+}
+
+// annotationPatches adds the annotations to the pod key by key, so the annotations set by the users and the other
+// webhooks are kept. The annotations map is created only if the pod doesn't have it, and the keys the pod already has
+// with the same value are skipped, so a reinvoked webhook doesn't patch them again. An empty map is created too, it's
+// omitted from the pod the api server sends.
+func annotationPatches(pod *corev1.Pod, annotations map[string]string) pkg.Patches {
+	if len(annotations) == 0 {
+		return nil
+	}
+	if len(pod.Annotations) == 0 {
+		value := make(map[string]string, len(annotations))
+		for key := range annotations {
+			value[key] = annotations[key]
+		}
+		return pkg.Patches{{Op: "add", Path: "/metadata/annotations", Value: value}}
+	}
+	var patches pkg.Patches
+	for _, key := range sets.StringKeySet(annotations).List() {
+		if value, ok := pod.Annotations[key]; ok && value == annotations[key] {
+			continue
+		}
+		patches = append(patches, pkg.Patch{
+			Op:    "add",
+			Path:  "/metadata/annotations/" + escapeJSONPointer(key),
+			Value: annotations[key],
+		})
+	}
+	return patches
+}
+
+// escapeJSONPointer escapes a reference token of a JSON pointer by RFC 6901, e.g. kse.com/node-failures is
+// kse.com~1node-failures
+func escapeJSONPointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
@@ -20,9 +20,12 @@ import (
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	metricstestutil "k8s.io/component-base/metrics/testutil"
+	"kse/kse-rescheduler/pkg"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -255,6 +258,189 @@ func TestAdmissionHandleFunc(t *testing.T) {
 	}
 }
 
+func TestOwnerAvoidancePatches(t *testing.T) {
+	owner := &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{
+		pkg.NodeFailuresString:  `{"node1":{"count":1,"lastFailureTime":"2023-06-01T00:00:00Z"}}`,
+		pkg.AvoidanceModeString: pkg.AvoidanceModeSoft,
+	}}}
+	tests := []struct {
+		name        string
+		pod         *corev1.Pod
+		owner       *appsv1.Deployment
+		patches     pkg.Patches
+		wantPatches pkg.Patches
+	}{
+		{
+			name:  "owner without node failures",
+			pod:   &corev1.Pod{},
+			owner: &appsv1.Deployment{},
+		},
+		{
+			name:  "pod without annotations",
+			pod:   &corev1.Pod{},
+			owner: owner,
+			wantPatches: pkg.Patches{{Op: "add", Path: "/metadata/annotations", Value: map[string]string{
+				pkg.NodeFailuresString:  owner.Annotations[pkg.NodeFailuresString],
+				pkg.AvoidanceModeString: pkg.AvoidanceModeSoft,
+			}}},
+		},
+		{
+			name:  "pod with scheduled hosts patch",
+			pod:   &corev1.Pod{},
+			owner: owner,
+			patches: pkg.Patches{{Op: "add", Path: "/metadata/annotations", Value: map[string]string{
+				pkg.SchedulinedHostString: `["node1"]`,
+			}}},
+			wantPatches: pkg.Patches{{Op: "add", Path: "/metadata/annotations", Value: map[string]string{
+				pkg.SchedulinedHostString: `["node1"]`,
+				pkg.NodeFailuresString:    owner.Annotations[pkg.NodeFailuresString],
+				pkg.AvoidanceModeString:   pkg.AvoidanceModeSoft,
+			}}},
+		},
+		{
+			name:  "pod with annotations",
+			pod:   &corev1.Pod{ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{"app": "nginx"}}},
+			owner: owner,
+			wantPatches: pkg.Patches{
+				{Op: "add", Path: "/metadata/annotations/kse.com~1avoidance-mode", Value: pkg.AvoidanceModeSoft},
+				{Op: "add", Path: "/metadata/annotations/kse.com~1node-failures", Value: owner.Annotations[pkg.NodeFailuresString]},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotPatches := ownerAvoidancePatches(test.pod, test.owner, test.patches)
+			if !reflect.DeepEqual(gotPatches, test.wantPatches) {
+				t.Errorf("test returned wrong patches: got %v want %v", gotPatches, test.wantPatches)
+			}
+		})
+	}
+}
+
+func TestAdmissionReviewVersions(t *testing.T) {
+	rs, err := unMarshalRs("testdata/deploy-rs.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploy, err := unMarshalDeploy("testdata/deploy-with-annotations.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		apiVersion string
+		dryRun     bool
+		failOpen   bool
+		// objects don't have the deployment if its lookup should fail
+		objects     []runtime.Object
+		wantAllowed bool
+		wantPatched bool
+		// wantFailOpen is the increase of the fail open counter
+		wantFailOpen float64
+	}{
+		{
+			name:        "v1beta1 review",
+			apiVersion:  "admission.k8s.io/v1beta1",
+			objects:     []runtime.Object{deploy, rs},
+			wantAllowed: true,
+			wantPatched: true,
+		},
+		{
+			name:         "owner lookup failure with fail open",
+			apiVersion:   "admission.k8s.io/v1",
+			failOpen:     true,
+			objects:      []runtime.Object{rs},
+			wantAllowed:  true,
+			wantFailOpen: 1,
+		},
+		{
+			name:        "owner lookup failure in a dry run",
+			apiVersion:  "admission.k8s.io/v1",
+			dryRun:      true,
+			failOpen:    true,
+			objects:     []runtime.Object{rs},
+			wantAllowed: true,
+		},
+		{
+			name:       "owner lookup failure with fail closed",
+			apiVersion: "admission.k8s.io/v1beta1",
+			objects:    []runtime.Object{rs},
+		},
+		{
+			name:         "replicaset lookup failure with fail open",
+			apiVersion:   "admission.k8s.io/v1",
+			failOpen:     true,
+			wantAllowed:  true,
+			wantFailOpen: 1,
+		},
+		{
+			name:       "replicaset lookup failure with fail closed",
+			apiVersion: "admission.k8s.io/v1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			byteReview, err := ioutil.ReadFile("testdata/review-deploy-pod.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var review map[string]interface{}
+			if err := json.Unmarshal(byteReview, &review); err != nil {
+				t.Fatal(err)
+			}
+			review["apiVersion"] = test.apiVersion
+			review["request"].(map[string]interface{})["dryRun"] = test.dryRun
+			byteReview, err = json.Marshal(review)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := &RequestsHandler{K8sClientSet: fake.NewSimpleClientset(test.objects...), FailOpen: test.failOpen}
+			failOpenBefore, err := metricstestutil.GetCounterMetricValue(webhookFailOpenTotal)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(byteReview))
+			req.Header.Add("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			h.handleFunc(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			var gotReview struct {
+				APIVersion string `json:"apiVersion"`
+				Response   struct {
+					UID     string `json:"uid"`
+					Allowed bool   `json:"allowed"`
+					Patch   []byte `json:"patch"`
+				} `json:"response"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &gotReview); err != nil {
+				t.Fatal(err)
+			}
+			if gotReview.APIVersion != test.apiVersion {
+				t.Errorf("test returned wrong apiVersion: got %s want %s", gotReview.APIVersion, test.apiVersion)
+			}
+			if gotReview.Response.UID != "0c0829ff-c2f5-4634-a1c3-098147304d03" {
+				t.Errorf("test returned wrong uid: %s", gotReview.Response.UID)
+			}
+			if gotReview.Response.Allowed != test.wantAllowed {
+				t.Errorf("test returned allowed %t want %t", gotReview.Response.Allowed, test.wantAllowed)
+			}
+			if gotPatched := len(gotReview.Response.Patch) > 0 && string(gotReview.Response.Patch) != "null"; gotPatched != test.wantPatched {
+				t.Errorf("test returned patch %s, want patched %t", gotReview.Response.Patch, test.wantPatched)
+			}
+			failOpenAfter, err := metricstestutil.GetCounterMetricValue(webhookFailOpenTotal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if failOpenAfter-failOpenBefore != test.wantFailOpen {
+				t.Errorf("test counted %v fail open pods want %v", failOpenAfter-failOpenBefore, test.wantFailOpen)
+			}
+		})
+	}
+}
+
 func doTest(fakeObjects []runtime.Object, fields fields, t *testing.T) {
 	h := &RequestsHandler{
 		K8sClientSet:                fake.NewSimpleClientset(fakeObjects...),
@@ -0,0 +1,200 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	corev1helpers "k8s.io/component-helpers/scheduling/corev1"
+	"k8s.io/component-helpers/scheduling/corev1/nodeaffinity"
+	"k8s.io/klog/v2"
+	"kse/kse-rescheduler/pkg"
+	"strings"
+)
+
+// preferredAvoidanceWeight is the weight of the preferred term avoiding the scheduled hosts, the highest one
+const preferredAvoidanceWeight = 100
+
+// nodeAffinityPatches adds the scheduled hosts and the excluded domains the patches inject into the pod to its
+// nodeAffinity as NotIn requirements, they are recorded in its kse.com/node-affinity-exclusions. The required term falls
+// back to the preferred one if no node the pod may be scheduled to is left out of the exclusions. There is no PostFilter
+// to relax the exclusions without the Podrescheduling plugin, the listFunc relaxes the pods which still can't be
+// scheduled, e.g. for lack of resources.
+func (h *RequestsHandler) nodeAffinityPatches(ctx context.Context, pod *corev1.Pod, patches pkg.Patches) pkg.Patches {
+	if h.NodeAffinityMode == "" || pod.Spec.NodeName != "" {
+		return patches
+	}
+	annotations := patchedAnnotations(pod, patches)
+	var scheduledHosts []string
+	if value, ok := annotations[pkg.SchedulinedHostString]; ok {
+		if err := json.Unmarshal([]byte(value), &scheduledHosts); err != nil {
+			klog.Errorf("unmarshal pod %s scheduled hosts err: %s\n", pod.Name, err.Error())
+		}
+	}
+	var excludedDomains pkg.ExcludedDomains
+	if value, ok := annotations[pkg.ExcludedDomainsString]; ok {
+		if err := json.Unmarshal([]byte(value), &excludedDomains); err != nil {
+			klog.Errorf("unmarshal pod %s excluded domains err: %s\n", pod.Name, err.Error())
+		}
+	}
+	if len(scheduledHosts) == 0 && len(excludedDomains.Domains) == 0 {
+		return patches
+	}
+
+	mode := h.NodeAffinityMode
+	if annotations[pkg.AvoidanceModeString] == pkg.AvoidanceModeSoft {
+		mode = pkg.NodeAffinityModePreferred
+	}
+	var hostnames []string
+	var nodeLeft bool
+	var err error
+	if len(h.WatchNamespaces) > 0 {
+		// the nodes can't be read with namespaced Roles, the node names are excluded without checking the nodes left
+		hostnames, mode = scheduledHosts, pkg.NodeAffinityModePreferred
+	} else if hostnames, nodeLeft, err = h.excludedHostnames(ctx, pod, scheduledHosts, excludedDomains); err != nil {
+		klog.Errorf("list nodes for pod %s node affinity err: %s\n", pod.Name, err.Error())
+		mode = pkg.NodeAffinityModePreferred
+	} else if !nodeLeft && mode == pkg.NodeAffinityModeRequired {
+		klog.Infof("all the nodes are excluded for pod %s, the exclusions are preferred\n", pod.Name)
+		mode = pkg.NodeAffinityModePreferred
+	}
+
+	exclusions := pkg.NodeAffinityExclusions{Mode: mode, Hostnames: hostnames}
+	var requirements []corev1.NodeSelectorRequirement
+	if len(hostnames) > 0 {
+		requirements = append(requirements, corev1.NodeSelectorRequirement{
+			Key:      corev1.LabelHostname,
+			Operator: corev1.NodeSelectorOpNotIn,
+			Values:   hostnames,
+		})
+	}
+	if len(excludedDomains.Domains) > 0 {
+		requirements = append(requirements, corev1.NodeSelectorRequirement{
+			Key:      excludedDomains.TopologyKey,
+			Operator: corev1.NodeSelectorOpNotIn,
+			Values:   excludedDomains.Domains,
+		})
+		exclusions.TopologyKey, exclusions.Domains = excludedDomains.TopologyKey, excludedDomains.Domains
+	}
+	byteExclusions, err := json.Marshal(exclusions)
+	if err != nil {
+		klog.Errorf("marshal pod %s node affinity exclusions err: %s\n", pod.Name, err.Error())
+		return patches
+	}
+	patches = addAnnotationPatches(pod, patches, map[string]string{pkg.NodeAffinityExclusionsString: string(byteExclusions)})
+	nodeAffinity := mergeNodeAffinity(pod.Spec.Affinity, mode, requirements)
+	if pod.Spec.Affinity == nil {
+		return append(patches, pkg.Patch{Op: "add", Path: "/spec/affinity", Value: &corev1.Affinity{NodeAffinity: nodeAffinity}})
+	}
+	return append(patches, pkg.Patch{Op: "add", Path: "/spec/affinity/nodeAffinity", Value: nodeAffinity})
+}
+
+// mergeNodeAffinity returns the pod's nodeAffinity with the requirements. The required terms are ORed, so the
+// requirements are added to every term, and a preferred term with the requirements is appended.
+func mergeNodeAffinity(affinity *corev1.Affinity, mode string, requirements []corev1.NodeSelectorRequirement) *corev1.NodeAffinity {
+	nodeAffinity := &corev1.NodeAffinity{}
+	if affinity != nil && affinity.NodeAffinity != nil {
+		nodeAffinity = affinity.NodeAffinity.DeepCopy()
+	}
+	if mode == pkg.NodeAffinityModePreferred {
+		nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution, corev1.PreferredSchedulingTerm{
+			Weight:     preferredAvoidanceWeight,
+			Preference: corev1.NodeSelectorTerm{MatchExpressions: requirements},
+		})
+		return nodeAffinity
+	}
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil || len(nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms) == 0 {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{MatchExpressions: requirements}},
+		}
+		return nodeAffinity
+	}
+	terms := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	for i := range terms {
+		terms[i].MatchExpressions = append(terms[i].MatchExpressions, requirements...)
+	}
+	return nodeAffinity
+}
+
+// excludedHostnames returns the kubernetes.io/hostname labels of the scheduled hosts, they may differ from the node
+// names, and whether a node the pod may be scheduled to is left out of the exclusions
+func (h *RequestsHandler) excludedHostnames(ctx context.Context, pod *corev1.Pod, scheduledHosts []string, excludedDomains pkg.ExcludedDomains) ([]string, bool, error) {
+	nodeList, err := h.K8sClientSet.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return scheduledHosts, false, err
+	}
+	scheduled := sets.NewString(scheduledHosts...)
+	domains := sets.NewString(excludedDomains.Domains...)
+	hostnames := sets.NewString()
+	nodeLeft := false
+	for _, node := range nodeList.Items {
+		excluded := false
+		if scheduled.Has(node.Name) {
+			hostname, ok := node.Labels[corev1.LabelHostname]
+			if !ok {
+				hostname = node.Name
+			}
+			hostnames.Insert(hostname)
+			scheduled.Delete(node.Name)
+			excluded = true
+		}
+		if domain, ok := node.Labels[excludedDomains.TopologyKey]; ok && domains.Has(domain) {
+			excluded = true
+		}
+		if !excluded && podFitsNode(pod, &node) {
+			nodeLeft = true
+		}
+	}
+	// the deleted nodes are still excluded in case they come back with the same name
+	return hostnames.Union(scheduled).List(), nodeLeft, nil
+}
+
+// podFitsNode is true if the node is schedulable, it matches the pod's nodeSelector and required nodeAffinity, and the
+// pod tolerates its NoSchedule and NoExecute taints. The resources are left to the scheduler.
+func podFitsNode(pod *corev1.Pod, node *corev1.Node) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+	if match, err := nodeaffinity.GetRequiredNodeAffinity(pod).Match(node); err != nil || !match {
+		return false
+	}
+	_, untolerated := corev1helpers.FindMatchingUntoleratedTaint(node.Spec.Taints, pod.Spec.Tolerations, func(taint *corev1.Taint) bool {
+		return taint.Effect == corev1.TaintEffectNoSchedule || taint.Effect == corev1.TaintEffectNoExecute
+	})
+	return !untolerated
+}
+
+// patchedAnnotations returns the pod's annotations after the patches
+func patchedAnnotations(pod *corev1.Pod, patches pkg.Patches) map[string]string {
+	annotations := make(map[string]string)
+	for key, value := range pod.Annotations {
+		annotations[key] = value
+	}
+	for _, patch := range patches {
+		switch value := patch.Value.(type) {
+		case map[string]string:
+			if patch.Path == "/metadata/annotations" {
+				annotations = make(map[string]string)
+				for key := range value {
+					annotations[key] = value[key]
+				}
+			}
+		case string:
+			if strings.HasPrefix(patch.Path, "/metadata/annotations/") {
+				key := strings.TrimPrefix(patch.Path, "/metadata/annotations/")
+				annotations[strings.ReplaceAll(strings.ReplaceAll(key, "~1", "/"), "~0", "~")] = value
+			}
+		}
+	}
+	return annotations
+}
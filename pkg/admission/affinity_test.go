@@ -0,0 +1,195 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"kse/kse-rescheduler/pkg"
+	"testing"
+)
+
+func TestNodeAffinityPatches(t *testing.T) {
+	nodes := []*corev1.Node{
+		{ObjectMeta: v1.ObjectMeta{Name: "node1", Labels: map[string]string{corev1.LabelHostname: "host1", "topology.kubernetes.io/zone": "zone-a"}}},
+		{ObjectMeta: v1.ObjectMeta{Name: "node2", Labels: map[string]string{corev1.LabelHostname: "host2", "topology.kubernetes.io/zone": "zone-a"}}},
+		{ObjectMeta: v1.ObjectMeta{Name: "node3", Labels: map[string]string{corev1.LabelHostname: "host3", "topology.kubernetes.io/zone": "zone-b"}}},
+	}
+	// hostPatches are the patches adding the scheduled hosts, and the exclusions injected into the nodeAffinity
+	hostPatches := func(scheduledHosts, exclusions string) pkg.Patches {
+		annotations := map[string]string{pkg.SchedulinedHostString: scheduledHosts}
+		if exclusions != "" {
+			annotations[pkg.NodeAffinityExclusionsString] = exclusions
+		}
+		return pkg.Patches{{Op: "add", Path: "/metadata/annotations", Value: annotations}}
+	}
+	notInHosts := func(hosts ...string) corev1.NodeSelectorRequirement {
+		return corev1.NodeSelectorRequirement{Key: corev1.LabelHostname, Operator: corev1.NodeSelectorOpNotIn, Values: hosts}
+	}
+	zoneTerm := corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+		{Key: "topology.kubernetes.io/zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"zone-a", "zone-b"}},
+	}}
+	tests := []struct {
+		name    string
+		mode    string
+		pod     *corev1.Pod
+		patches pkg.Patches
+		// cordoned are the nodes set unschedulable, and tainted the nodes with a NoSchedule taint
+		cordoned    []string
+		tainted     []string
+		wantPatches pkg.Patches
+	}{
+		{
+			name:        "mode off",
+			pod:         &corev1.Pod{},
+			patches:     hostPatches(`["node1"]`, ""),
+			wantPatches: hostPatches(`["node1"]`, ""),
+		},
+		{
+			name:    "required without affinity",
+			mode:    pkg.NodeAffinityModeRequired,
+			pod:     &corev1.Pod{},
+			patches: hostPatches(`["node1"]`, ""),
+			wantPatches: append(hostPatches(`["node1"]`, `{"mode":"required","hostnames":["host1"]}`), pkg.Patch{Op: "add", Path: "/spec/affinity", Value: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{MatchExpressions: []corev1.NodeSelectorRequirement{notInHosts("host1")}},
+				}},
+			}}}),
+		},
+		{
+			name: "required merged into every term",
+			mode: pkg.NodeAffinityModeRequired,
+			pod: &corev1.Pod{Spec: corev1.PodSpec{Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					zoneTerm,
+					{MatchFields: []corev1.NodeSelectorRequirement{{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node1", "node3"}}}},
+				}},
+			}}}},
+			patches: hostPatches(`["node1"]`, ""),
+			wantPatches: append(hostPatches(`["node1"]`, `{"mode":"required","hostnames":["host1"]}`), pkg.Patch{Op: "add", Path: "/spec/affinity/nodeAffinity", Value: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{MatchExpressions: append(append([]corev1.NodeSelectorRequirement{}, zoneTerm.MatchExpressions...), notInHosts("host1"))},
+					{
+						MatchExpressions: []corev1.NodeSelectorRequirement{notInHosts("host1")},
+						MatchFields:      []corev1.NodeSelectorRequirement{{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node1", "node3"}}},
+					},
+				}},
+			}}),
+		},
+		{
+			name: "preferred appended with the excluded domain",
+			mode: pkg.NodeAffinityModePreferred,
+			pod: &corev1.Pod{
+				ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{"app": "busybox"}},
+				Spec: corev1.PodSpec{Affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+					PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{{Weight: 10, Preference: zoneTerm}},
+				}}},
+			},
+			patches: pkg.Patches{
+				{Op: "add", Path: "/metadata/annotations/kse.com~1excluded-domains", Value: `{"topologyKey":"topology.kubernetes.io/zone","domains":["zone-a"]}`},
+			},
+			wantPatches: pkg.Patches{
+				{Op: "add", Path: "/metadata/annotations/kse.com~1excluded-domains", Value: `{"topologyKey":"topology.kubernetes.io/zone","domains":["zone-a"]}`},
+				{Op: "add", Path: "/metadata/annotations/kse.com~1node-affinity-exclusions", Value: `{"mode":"preferred","topologyKey":"topology.kubernetes.io/zone","domains":["zone-a"]}`},
+				{Op: "add", Path: "/spec/affinity/nodeAffinity", Value: &corev1.NodeAffinity{
+					PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+						{Weight: 10, Preference: zoneTerm},
+						{Weight: 100, Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+							{Key: "topology.kubernetes.io/zone", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"zone-a"}},
+						}}},
+					},
+				}},
+			},
+		},
+		{
+			name:     "no node left falls back to preferred",
+			mode:     pkg.NodeAffinityModeRequired,
+			pod:      &corev1.Pod{},
+			patches:  hostPatches(`["node1","node2","node4"]`, ""),
+			cordoned: []string{"node3"},
+			wantPatches: append(hostPatches(`["node1","node2","node4"]`, `{"mode":"preferred","hostnames":["host1","host2","node4"]}`), pkg.Patch{Op: "add", Path: "/spec/affinity", Value: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+					{Weight: 100, Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{notInHosts("host1", "host2", "node4")}}},
+				},
+			}}}),
+		},
+		{
+			name:     "node left out of the pod's nodeSelector falls back to preferred",
+			mode:     pkg.NodeAffinityModeRequired,
+			pod:      &corev1.Pod{Spec: corev1.PodSpec{NodeSelector: map[string]string{"topology.kubernetes.io/zone": "zone-a"}}},
+			patches:  hostPatches(`["node1","node2"]`, ""),
+			wantPatches: append(hostPatches(`["node1","node2"]`, `{"mode":"preferred","hostnames":["host1","host2"]}`), pkg.Patch{Op: "add", Path: "/spec/affinity", Value: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+					{Weight: 100, Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{notInHosts("host1", "host2")}}},
+				},
+			}}}),
+		},
+		{
+			name:    "tainted node left falls back to preferred",
+			mode:    pkg.NodeAffinityModeRequired,
+			pod:     &corev1.Pod{},
+			patches: hostPatches(`["node1","node2"]`, ""),
+			tainted: []string{"node3"},
+			wantPatches: append(hostPatches(`["node1","node2"]`, `{"mode":"preferred","hostnames":["host1","host2"]}`), pkg.Patch{Op: "add", Path: "/spec/affinity", Value: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+					{Weight: 100, Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{notInHosts("host1", "host2")}}},
+				},
+			}}}),
+		},
+		{
+			name: "tolerated tainted node left keeps required",
+			mode: pkg.NodeAffinityModeRequired,
+			pod: &corev1.Pod{Spec: corev1.PodSpec{Tolerations: []corev1.Toleration{
+				{Key: "dedicated", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule},
+			}}},
+			patches: hostPatches(`["node1","node2"]`, ""),
+			tainted: []string{"node3"},
+			wantPatches: append(hostPatches(`["node1","node2"]`, `{"mode":"required","hostnames":["host1","host2"]}`), pkg.Patch{Op: "add", Path: "/spec/affinity", Value: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{MatchExpressions: []corev1.NodeSelectorRequirement{notInHosts("host1", "host2")}},
+				}},
+			}}}),
+		},
+		{
+			name:        "pod with a node name",
+			mode:        pkg.NodeAffinityModeRequired,
+			pod:         &corev1.Pod{Spec: corev1.PodSpec{NodeName: "node3"}},
+			patches:     hostPatches(`["node1"]`, ""),
+			wantPatches: hostPatches(`["node1"]`, ""),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			for _, node := range nodes {
+				node = node.DeepCopy()
+				for _, cordoned := range test.cordoned {
+					node.Spec.Unschedulable = node.Spec.Unschedulable || node.Name == cordoned
+				}
+				for _, tainted := range test.tainted {
+					if node.Name == tainted {
+						node.Spec.Taints = append(node.Spec.Taints, corev1.Taint{Key: "dedicated", Value: "gpu", Effect: corev1.TaintEffectNoSchedule})
+					}
+				}
+				if err := client.Tracker().Add(node); err != nil {
+					t.Fatal(err)
+				}
+			}
+			h := &RequestsHandler{K8sClientSet: client, NodeAffinityMode: test.mode}
+			gotPatches := h.nodeAffinityPatches(context.TODO(), test.pod, test.patches)
+			if diff := cmp.Diff(test.wantPatches, gotPatches); diff != "" {
+				t.Errorf("unexpected patches (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
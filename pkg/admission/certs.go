@@ -0,0 +1,403 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/keyutil"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"kse/kse-rescheduler/pkg"
+	"math"
+	"math/big"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// the keys of the Secret keeping the managed certificates, ca.crt is a bundle of the current CA and the previous CAs
+// which are still valid, so the apiserver trusts the replicas still serving a certificate of a previous CA
+const (
+	caCertKey = "ca.crt"
+	caKeyKey  = "ca.key"
+)
+
+// certReloader serves the certificate of the webhook server, it's reloaded without restarting the server once the
+// files or the managed Secret change
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	certPEM  []byte
+	keyPEM   []byte
+}
+
+func newCertReloader(certFile, keyFile string) *certReloader {
+	return &certReloader{certFile: certFile, keyFile: keyFile}
+}
+
+// GetCertificate is the tls.Config.GetCertificate of the webhook server
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return nil, errors.New("no serving certificate loaded")
+	}
+	return r.cert, nil
+}
+
+// reload loads the certificate files if they changed, e.g. the mounted Secret is updated by the kubelet, the current
+// certificate is kept if they can't be loaded
+func (r *certReloader) reload() error {
+	certPEM, err := os.ReadFile(r.certFile)
+	if err != nil {
+		return fmt.Errorf("read certificate file %s err: %s", r.certFile, err.Error())
+	}
+	keyPEM, err := os.ReadFile(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("read key file %s err: %s", r.keyFile, err.Error())
+	}
+	return r.set(certPEM, keyPEM)
+}
+
+// set serves the certificate if it's changed
+func (r *certReloader) set(certPEM, keyPEM []byte) error {
+	r.mu.RLock()
+	unchanged := bytes.Equal(certPEM, r.certPEM) && bytes.Equal(keyPEM, r.keyPEM)
+	r.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("load serving certificate err: %s", err.Error())
+	}
+	r.mu.Lock()
+	r.cert, r.certPEM, r.keyPEM = &certificate, certPEM, keyPEM
+	r.mu.Unlock()
+	if leaf, err := x509.ParseCertificate(certificate.Certificate[0]); err == nil {
+		klog.Infof("serving certificate %v loaded, it expires at %v\n", leaf.DNSNames, leaf.NotAfter)
+	}
+	return nil
+}
+
+// reloadLogged is reload for wait.Until
+func (r *certReloader) reloadLogged() {
+	if err := r.reload(); err != nil {
+		klog.Errorf("keep the current serving certificate: %s\n", err.Error())
+	}
+}
+
+// CertManager generates and rotates the CA and the serving certificate of the webhook, it keeps them in a Secret shared
+// by the replicas and patches the caBundle of the webhook configurations calling the service
+type CertManager struct {
+	client      kubernetes.Interface
+	Namespace   string
+	SecretName  string
+	ServiceName string
+	// WebhookConfigName is the name of the Mutating and ValidatingWebhookConfiguration
+	WebhookConfigName string
+	reloader          *certReloader
+	now               func() time.Time
+}
+
+func NewCertManager(client kubernetes.Interface, namespace, secretName, serviceName, webhookConfigName string, reloader *certReloader) *CertManager {
+	return &CertManager{
+		client:            client,
+		Namespace:         namespace,
+		SecretName:        secretName,
+		ServiceName:       serviceName,
+		WebhookConfigName: webhookConfigName,
+		reloader:          reloader,
+		now:               time.Now,
+	}
+}
+
+// dnsNames are the names the apiserver and kube-scheduler call the service by
+func (m *CertManager) dnsNames() []string {
+	return []string{
+		m.ServiceName,
+		m.ServiceName + "." + m.Namespace,
+		m.ServiceName + "." + m.Namespace + ".svc",
+		m.ServiceName + "." + m.Namespace + ".svc.cluster.local",
+	}
+}
+
+// Sync rotates the certificates in the Secret if they are missing or expiring, serves the serving certificate and
+// patches the caBundles. The replicas racing to rotate converge on the Secret written first.
+func (m *CertManager) Sync(ctx context.Context) error {
+	var secret *corev1.Secret
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		current, err := m.client.CoreV1().Secrets(m.Namespace).Get(ctx, m.SecretName, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("get certificate secret %s err: %w", m.SecretName, err)
+		}
+		if apierrors.IsNotFound(err) {
+			current = nil
+		}
+		var data map[string][]byte
+		if current != nil {
+			data = current.Data
+		}
+		rotated, changed, err := m.rotate(data)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			secret = current
+			return nil
+		}
+		if current == nil {
+			secret, err = m.client.CoreV1().Secrets(m.Namespace).Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: m.SecretName, Namespace: m.Namespace},
+				Type:       corev1.SecretTypeTLS,
+				Data:       rotated,
+			}, metav1.CreateOptions{})
+		} else {
+			updated := current.DeepCopy()
+			updated.Data = rotated
+			secret, err = m.client.CoreV1().Secrets(m.Namespace).Update(ctx, updated, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			return fmt.Errorf("write certificate secret %s err: %w", m.SecretName, err)
+		}
+		klog.Infof("rotated the certificates in secret %s/%s\n", m.Namespace, m.SecretName)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the new CA is trusted before it's served
+	if err := m.patchCABundles(ctx, secret.Data[caCertKey]); err != nil {
+		return err
+	}
+	return m.reloader.set(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+}
+
+// SyncLogged is Sync for wait.Until
+func (m *CertManager) SyncLogged(ctx context.Context) {
+	if err := m.Sync(ctx); err != nil {
+		klog.Errorf("sync the webhook certificates err: %s\n", err.Error())
+	}
+}
+
+// rotate returns the certificates with a new CA if the CA is missing or can't outlive a new serving certificate, and a
+// new serving certificate if it's missing, expiring or not signed by the CA
+func (m *CertManager) rotate(data map[string][]byte) (map[string][]byte, bool, error) {
+	now := m.now()
+	rotated := make(map[string][]byte, 4)
+	for key, value := range data {
+		rotated[key] = value
+	}
+	cas, _ := cert.ParseCertsPEM(data[caCertKey])
+	caKey, _ := keyutil.ParsePrivateKeyPEM(data[caKeyKey])
+	var ca *x509.Certificate
+	if len(cas) > 0 && caKey != nil && cas[0].NotAfter.Sub(now) > pkg.CertValidity {
+		ca = cas[0]
+	} else {
+		var err error
+		ca, caKey, err = newCA(now)
+		if err != nil {
+			return nil, false, err
+		}
+		// the previous CAs are trusted until they expire
+		bundle := []*x509.Certificate{ca}
+		for _, previous := range cas {
+			if previous.NotAfter.After(now) {
+				bundle = append(bundle, previous)
+			}
+		}
+		caCertPEM, err := cert.EncodeCertificates(bundle...)
+		if err != nil {
+			return nil, false, err
+		}
+		caKeyPEM, err := keyutil.MarshalPrivateKeyToPEM(caKey)
+		if err != nil {
+			return nil, false, err
+		}
+		rotated[caCertKey], rotated[caKeyKey] = caCertPEM, caKeyPEM
+	}
+
+	if m.servingCertValid(rotated, ca, now) {
+		return rotated, !reflect.DeepEqual(rotated, data), nil
+	}
+	certPEM, keyPEM, err := newServingCert(ca, caKey, m.dnsNames(), now)
+	if err != nil {
+		return nil, false, err
+	}
+	rotated[corev1.TLSCertKey], rotated[corev1.TLSPrivateKeyKey] = certPEM, keyPEM
+	return rotated, true, nil
+}
+
+// servingCertValid is true if the serving certificate is signed by the CA for the service, and it doesn't expire
+// within CertRenewBefore
+func (m *CertManager) servingCertValid(data map[string][]byte, ca *x509.Certificate, now time.Time) bool {
+	if _, err := tls.X509KeyPair(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey]); err != nil {
+		return false
+	}
+	certs, err := cert.ParseCertsPEM(data[corev1.TLSCertKey])
+	if err != nil {
+		return false
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	if _, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, CurrentTime: now}); err != nil {
+		return false
+	}
+	return certs[0].NotAfter.Sub(now) > pkg.CertRenewBefore && reflect.DeepEqual(certs[0].DNSNames, m.dnsNames())
+}
+
+func newCA(now time.Time) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate CA key err: %s", err.Error())
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(math.MaxInt64))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("kse-rescheduler-ca@%d", now.Unix())},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(pkg.CAValidity),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create CA certificate err: %s", err.Error())
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, key, nil
+}
+
+func newServingCert(ca *x509.Certificate, caKey interface{}, dnsNames []string, now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate serving key err: %s", err.Error())
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(math.MaxInt64))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dnsNames[len(dnsNames)-2]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(pkg.CertValidity),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create serving certificate err: %s", err.Error())
+	}
+	serving, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM, err := cert.EncodeCertificates(serving)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := keyutil.MarshalPrivateKeyToPEM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// patchCABundles sets the caBundle of the webhooks calling the service, a missing configuration is skipped, e.g. the
+// validating webhook is disabled
+func (m *CertManager) patchCABundles(ctx context.Context, caBundle []byte) error {
+	if m.WebhookConfigName == "" {
+		return nil
+	}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		config, err := m.client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, m.WebhookConfigName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		config = config.DeepCopy()
+		changed := false
+		for i := range config.Webhooks {
+			changed = m.setCABundle(&config.Webhooks[i].ClientConfig, caBundle) || changed
+		}
+		if !changed {
+			return nil
+		}
+		_, err = m.client.AdmissionregistrationV1().MutatingWebhookConfigurations().Update(ctx, config, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("patch the caBundle of mutatingwebhookconfiguration %s err: %s", m.WebhookConfigName, err.Error())
+	}
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		config, err := m.client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, m.WebhookConfigName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		config = config.DeepCopy()
+		changed := false
+		for i := range config.Webhooks {
+			changed = m.setCABundle(&config.Webhooks[i].ClientConfig, caBundle) || changed
+		}
+		if !changed {
+			return nil
+		}
+		_, err = m.client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Update(ctx, config, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("patch the caBundle of validatingwebhookconfiguration %s err: %s", m.WebhookConfigName, err.Error())
+	}
+	return nil
+}
+
+// setCABundle sets the caBundle of the webhook if it calls the service, it's false if the caBundle is unchanged
+func (m *CertManager) setCABundle(clientConfig *admissionregistrationv1.WebhookClientConfig, caBundle []byte) bool {
+	service := clientConfig.Service
+	if service == nil || service.Name != m.ServiceName || service.Namespace != m.Namespace || bytes.Equal(clientConfig.CABundle, caBundle) {
+		return false
+	}
+	clientConfig.CABundle = caBundle
+	return true
+}
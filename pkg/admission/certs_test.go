@@ -0,0 +1,177 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"github.com/google/go-cmp/cmp"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/cert"
+	"kse/kse-rescheduler/pkg"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertManagerSync(t *testing.T) {
+	service := func(name string) *admissionregistrationv1.ServiceReference {
+		return &admissionregistrationv1.ServiceReference{Name: name, Namespace: "kse-rescheduler"}
+	}
+	mutating := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: v1.ObjectMeta{Name: "kse-rescheduler"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{Name: "admission-controller.kse-rescheduler.io", ClientConfig: admissionregistrationv1.WebhookClientConfig{Service: service("kse-rescheduler")}},
+			{Name: "other.example.com", ClientConfig: admissionregistrationv1.WebhookClientConfig{Service: service("other"), CABundle: []byte("other")}},
+		},
+	}
+	client := fake.NewSimpleClientset(mutating)
+	start := time.Now()
+	reloader := newCertReloader("", "")
+	m := NewCertManager(client, "kse-rescheduler", "kse-rescheduler-tls", "kse-rescheduler", "kse-rescheduler", reloader)
+	sync := func(now time.Time) (*corev1.Secret, *x509.Certificate) {
+		m.now = func() time.Time { return now }
+		if err := m.Sync(context.TODO()); err != nil {
+			t.Fatal(err)
+		}
+		secret, err := client.CoreV1().Secrets("kse-rescheduler").Get(context.TODO(), "kse-rescheduler-tls", v1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		served, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(served.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the served certificate is trusted by the caBundle of the webhook for the service
+		config, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), "kse-rescheduler", v1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots, err := cert.NewPoolFromBytes(config.Webhooks[0].ClientConfig.CABundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "kse-rescheduler.kse-rescheduler.svc", CurrentTime: now}); err != nil {
+			t.Errorf("served certificate isn't trusted by the caBundle: %v", err)
+		}
+		if string(config.Webhooks[1].ClientConfig.CABundle) != "other" {
+			t.Errorf("caBundle of the other service is patched")
+		}
+		return secret, leaf
+	}
+
+	secret, leaf := sync(start)
+	if diff := cmp.Diff(m.dnsNames(), leaf.DNSNames); diff != "" {
+		t.Errorf("unexpected DNS names (-want,+got):\n%s", diff)
+	}
+
+	// nothing is rotated while the certificates are valid
+	unchanged, unchangedLeaf := sync(start.Add(time.Hour))
+	if unchanged.ResourceVersion != secret.ResourceVersion || !unchangedLeaf.Equal(leaf) {
+		t.Errorf("valid certificates are rotated")
+	}
+
+	// the expiring serving certificate is renewed by the same CA
+	renewed, renewedLeaf := sync(start.Add(pkg.CertValidity - pkg.CertRenewBefore + time.Hour))
+	if renewedLeaf.Equal(leaf) {
+		t.Errorf("expiring serving certificate isn't renewed")
+	}
+	if !bytes.Equal(renewed.Data[caCertKey], secret.Data[caCertKey]) {
+		t.Errorf("CA is rotated with the serving certificate")
+	}
+
+	// the expiring CA is rotated and the previous CA is kept in the bundle
+	rotated, _ := sync(start.Add(pkg.CAValidity - pkg.CertValidity + time.Hour))
+	cas, err := cert.ParseCertsPEM(rotated.Data[caCertKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := cert.ParseCertsPEM(secret.Data[caCertKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cas) != 2 || !cas[1].Equal(previous[0]) {
+		t.Errorf("CA bundle after rotation has %d CAs, want the new and the previous CA", len(cas))
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	now := time.Now()
+	ca, caKey, err := newCA(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(dnsName string) {
+		certPEM, keyPEM, err := newServingCert(ca, caKey, []string{dnsName, dnsName}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := newCertReloader(certFile, keyFile)
+	if _, err := r.GetCertificate(nil); err == nil {
+		t.Errorf("GetCertificate returned a certificate before it's loaded")
+	}
+	if err := r.reload(); err == nil {
+		t.Errorf("reload of the missing files returned no error")
+	}
+	servedName := func() string {
+		certificate, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.DNSNames[0]
+	}
+
+	write("first.svc")
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(); got != "first.svc" {
+		t.Errorf("served %s want first.svc", got)
+	}
+	write("second.svc")
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(); got != "second.svc" {
+		t.Errorf("served %s want second.svc after the files changed", got)
+	}
+	// a broken file keeps the current certificate
+	if err := os.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err == nil {
+		t.Errorf("reload of a broken certificate returned no error")
+	}
+	if got := servedName(); got != "second.svc" {
+		t.Errorf("served %s want second.svc after a broken reload", got)
+	}
+}
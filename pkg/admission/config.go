@@ -0,0 +1,168 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/klog/v2"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/apis/controllerconfig"
+	controllerconfigscheme "kse/kse-rescheduler/pkg/apis/controllerconfig/scheme"
+	"kse/kse-rescheduler/pkg/apis/controllerconfig/validation"
+	"kse/kse-rescheduler/pkg/listfunc"
+	"os"
+	"time"
+)
+
+// liveSettings are the settings changed by a reload of the configuration file. They are replaced as a whole, so the
+// requests and the listFunc in flight keep the settings they started with.
+type liveSettings struct {
+	handler        *RequestsHandler
+	listFunc       *listfunc.ListFunc
+	listFuncPeriod time.Duration
+	gcPeriod       time.Duration
+}
+
+// settings returns the live settings, they are the fields of the server until Start stores them
+func (s *Server) settings() *liveSettings {
+	if live := s.live.Load(); live != nil {
+		return live
+	}
+	return &liveSettings{handler: &s.Handler, listFunc: &s.ListFunc, listFuncPeriod: s.ListFuncPeriod, gcPeriod: s.GCPeriod}
+}
+
+// storeSettings publishes the fields of the server as the live settings
+func (s *Server) storeSettings() {
+	handler, listFunc := s.Handler, s.ListFunc
+	s.live.Store(&liveSettings{handler: &handler, listFunc: &listFunc, listFuncPeriod: s.ListFuncPeriod, gcPeriod: s.GCPeriod})
+}
+
+// loadConfig decodes and validates the configuration file
+func loadConfig(data []byte) (*controllerconfig.KseReschedulerConfiguration, error) {
+	cfg, err := controllerconfigscheme.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode configuration err: %s", err.Error())
+	}
+	if err := validation.ValidateKseReschedulerConfiguration(cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %s", err.Error())
+	}
+	return cfg, nil
+}
+
+// applyConfig overrides the flags by the configuration file before Start
+func (s *Server) applyConfig(cfg *controllerconfig.KseReschedulerConfiguration) {
+	s.ListFuncPeriod = cfg.ListFuncPeriod.Duration
+	s.GCPeriod = cfg.GCPeriod.Duration
+	s.ClientConnection = cfg.ClientConnection
+	s.LeaderElection = cfg.LeaderElection
+	applyLiveConfig(cfg, &s.Handler, &s.ListFunc)
+}
+
+// applyLiveConfig sets the settings of the webhooks and the listFunc which are applied without a restart
+func applyLiveConfig(cfg *controllerconfig.KseReschedulerConfiguration, h *RequestsHandler, lf *listfunc.ListFunc) {
+	lf.ExcludedNamespaces = cfg.ExcludedNamespaces
+	lf.ReschedulingWindow = cfg.ReschedulingWindow.Duration
+	lf.MaxReschedulesPerPeriod = int(cfg.MaxReschedulesPerPeriod)
+	lf.EvictPods = cfg.EvictPods
+	h.RequestTimeout = cfg.Webhook.RequestTimeout.Duration
+	h.FailOpen = cfg.Webhook.FailOpen
+	h.NodeAffinityMode = cfg.Webhook.NodeAffinityMode
+	h.SchedulerName = cfg.Webhook.SchedulerName
+	h.StateEditors = cfg.Webhook.StateEditors
+	h.AuthorizeStateEdits = cfg.Webhook.AuthorizeStateEdits
+}
+
+// readConfig loads ConfigFile and applies it to the flags before Start
+func (s *Server) readConfig() error {
+	data, err := os.ReadFile(s.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("read configuration file %s err: %s", s.ConfigFile, err.Error())
+	}
+	cfg, err := loadConfig(data)
+	if err != nil {
+		return fmt.Errorf("configuration file %s: %s", s.ConfigFile, err.Error())
+	}
+	s.applyConfig(cfg)
+	s.config, s.configData = cfg, data
+	klog.Infof("Using the configuration file %s\n", s.ConfigFile)
+	return nil
+}
+
+// reloadConfig applies the changes of ConfigFile, the changes of clientConnection and leaderElection are applied on
+// restart. A broken file keeps the current configuration, so does a new schedulerName whose profile isn't running, it's
+// checked again by the next reload.
+func (s *Server) reloadConfig() error {
+	data, err := os.ReadFile(s.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("read configuration file %s err: %s", s.ConfigFile, err.Error())
+	}
+	if bytes.Equal(data, s.configData) {
+		return nil
+	}
+	// a broken file is reported once
+	previousData := s.configData
+	s.configData = data
+	cfg, err := loadConfig(data)
+	if err != nil {
+		return fmt.Errorf("configuration file %s: %s", s.ConfigFile, err.Error())
+	}
+	restartDiff := cmp.Diff(s.config.ClientConnection, cfg.ClientConnection) + cmp.Diff(s.config.LeaderElection, cfg.LeaderElection)
+	if restartDiff != "" {
+		klog.Warningf("the changes of clientConnection and leaderElection are applied on restart (-current,+new):\n%s\n", restartDiff)
+		cfg.ClientConnection, cfg.LeaderElection = s.config.ClientConnection, s.config.LeaderElection
+	}
+	diff := cmp.Diff(s.config, cfg)
+	if diff == "" {
+		return nil
+	}
+	live := s.settings()
+	handler, listFunc := *live.handler, *live.listFunc
+	applyLiveConfig(cfg, &handler, &listFunc)
+	if handler.SchedulerName != "" && handler.SchedulerName != live.handler.SchedulerName {
+		ctx, cancel := context.WithTimeout(context.Background(), pkg.APIServerCheckTimeout)
+		defer cancel()
+		if err := handler.profileAvailable(ctx); err != nil {
+			s.configData = previousData
+			return fmt.Errorf("configuration file %s: %s", s.ConfigFile, err.Error())
+		}
+	}
+	s.live.Store(&liveSettings{handler: &handler, listFunc: &listFunc, listFuncPeriod: cfg.ListFuncPeriod.Duration, gcPeriod: cfg.GCPeriod.Duration})
+	s.config = cfg
+	klog.Infof("Applied the changes of the configuration file %s (-old,+new):\n%s\n", s.ConfigFile, diff)
+	return nil
+}
+
+func (s *Server) reloadConfigLogged() {
+	if err := s.reloadConfig(); err != nil {
+		klog.Errorf("keep the current configuration: %s\n", err.Error())
+	}
+}
+
+// untilWithPeriod runs f until ctx is done, the period is read again after every run so a reload changes it
+func untilWithPeriod(ctx context.Context, f func(), period func() time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		f()
+		timer := time.NewTimer(period())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"kse/kse-rescheduler/pkg"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(data string) {
+		if err := os.WriteFile(configFile, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+apiVersion: kserescheduler.config.kse.com/v1alpha1
+kind: KseReschedulerConfiguration
+listFuncPeriod: 1m
+excludedNamespaces: [kube-system]
+webhook:
+  failOpen: false
+`)
+	s := NewKseReschedulerServer()
+	s.ConfigFile = configFile
+	// the flags of the settings in the file are overridden
+	s.ListFuncPeriod = 10 * time.Second
+	s.Handler.FailOpen = true
+	if err := s.readConfig(); err != nil {
+		t.Fatal(err)
+	}
+	s.storeSettings()
+	started := s.settings()
+	if started.listFuncPeriod != time.Minute || started.handler.FailOpen || started.gcPeriod != 10*time.Minute {
+		t.Errorf("configuration isn't applied: listFuncPeriod %v, gcPeriod %v, failOpen %v", started.listFuncPeriod, started.gcPeriod, started.handler.FailOpen)
+	}
+	if diff := cmp.Diff([]string{"kube-system"}, started.listFunc.ExcludedNamespaces); diff != "" {
+		t.Errorf("unexpected excluded namespaces (-want,+got):\n%s", diff)
+	}
+
+	// the safe changes are applied, the leader election waits for a restart
+	write(`
+apiVersion: kserescheduler.config.kse.com/v1alpha1
+kind: KseReschedulerConfiguration
+listFuncPeriod: 2m
+maxReschedulesPerPeriod: 5
+leaderElection:
+  leaseDuration: 30s
+webhook:
+  failOpen: true
+  nodeAffinityMode: preferred
+`)
+	if err := s.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := s.settings()
+	if reloaded.listFuncPeriod != 2*time.Minute || !reloaded.handler.FailOpen || reloaded.handler.NodeAffinityMode != "preferred" || reloaded.listFunc.MaxReschedulesPerPeriod != 5 {
+		t.Errorf("changes aren't applied: listFuncPeriod %v, failOpen %v, nodeAffinityMode %q, maxReschedulesPerPeriod %d", reloaded.listFuncPeriod, reloaded.handler.FailOpen, reloaded.handler.NodeAffinityMode, reloaded.listFunc.MaxReschedulesPerPeriod)
+	}
+	if reloaded.listFunc.ExcludedNamespaces != nil {
+		t.Errorf("removed excluded namespaces are kept: %v", reloaded.listFunc.ExcludedNamespaces)
+	}
+	if s.config.LeaderElection.LeaseDuration.Duration != 15*time.Second || s.LeaderElection.LeaseDuration.Duration != 15*time.Second {
+		t.Errorf("leader election is changed without a restart")
+	}
+	// the requests in flight keep the settings they started with
+	if started.handler.FailOpen || started.listFuncPeriod != time.Minute {
+		t.Errorf("settings in use are modified by the reload")
+	}
+
+	// a broken file keeps the current configuration
+	write(`
+apiVersion: kserescheduler.config.kse.com/v1alpha1
+kind: KseReschedulerConfiguration
+listFuncPeriod: 0s
+`)
+	if err := s.reloadConfig(); err == nil {
+		t.Errorf("reload of an invalid configuration returned no error")
+	}
+	if s.settings() != reloaded {
+		t.Errorf("invalid configuration is applied")
+	}
+	if err := s.reloadConfig(); err != nil {
+		t.Errorf("unchanged invalid configuration is reported again: %v", err)
+	}
+}
+
+func TestReloadConfigSchedulerName(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte(`
+apiVersion: kserescheduler.config.kse.com/v1alpha1
+kind: KseReschedulerConfiguration
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset()
+	s := NewKseReschedulerServer()
+	s.ConfigFile = configFile
+	s.Handler.K8sClientSet = client
+	if err := s.readConfig(); err != nil {
+		t.Fatal(err)
+	}
+	s.storeSettings()
+	started := s.settings()
+
+	if err := os.WriteFile(configFile, []byte(`
+apiVersion: kserescheduler.config.kse.com/v1alpha1
+kind: KseReschedulerConfiguration
+webhook:
+  schedulerName: kse-scheduler
+  nodeAffinityMode: required
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the profile isn't running, the current settings are kept
+	if err := s.reloadConfig(); err == nil {
+		t.Errorf("reload of a scheduler profile which isn't running returned no error")
+	}
+	if s.settings() != started {
+		t.Errorf("scheduler name of a profile which isn't running is applied")
+	}
+
+	// the unchanged file is applied once the profile renews its lease
+	renewTime := v1.NewMicroTime(time.Now())
+	lease := &coordinationv1.Lease{
+		ObjectMeta: v1.ObjectMeta{Name: pkg.ProfileLeasePrefix + "kse-scheduler", Namespace: pkg.NAMESPACE},
+		Spec:       coordinationv1.LeaseSpec{RenewTime: &renewTime},
+	}
+	if _, err := client.CoordinationV1().Leases(pkg.NAMESPACE).Create(context.TODO(), lease, v1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded := s.settings(); reloaded.handler.SchedulerName != "kse-scheduler" || reloaded.handler.NodeAffinityMode != "required" {
+		t.Errorf("changes aren't applied: schedulerName %q, nodeAffinityMode %q", reloaded.handler.SchedulerName, reloaded.handler.NodeAffinityMode)
+	}
+}
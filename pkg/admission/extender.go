@@ -0,0 +1,81 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"k8s.io/klog/v2"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+	"kse/kse-rescheduler/pkg/podrescheduling"
+	"net/http"
+)
+
+const (
+	// ExtenderURLPrefix is the path the extender is served under, kube-scheduler calls <urlPrefix>/<verb>
+	ExtenderURLPrefix    = "/extender"
+	ExtenderFilterVerb     = "filter"
+	ExtenderPrioritizeVerb = "prioritize"
+)
+
+// ExtenderHandler serves the kube-scheduler extender protocol with the exclusions of Podrescheduling
+type ExtenderHandler struct {
+	Extender *podrescheduling.Extender
+}
+
+func (h *ExtenderHandler) filter(w http.ResponseWriter, r *http.Request) {
+	args, header, err := readExtenderArgs(r)
+	if err != nil {
+		klog.Infof("failed to parse extender args: %v\n", err)
+		http.Error(w, fmt.Sprintf("failed to parse extender args from request, error=%s", err.Error()), header)
+		return
+	}
+	writeExtenderResult(w, h.Extender.Filter(args))
+}
+
+func (h *ExtenderHandler) prioritize(w http.ResponseWriter, r *http.Request) {
+	args, header, err := readExtenderArgs(r)
+	if err != nil {
+		klog.Infof("failed to parse extender args: %v\n", err)
+		http.Error(w, fmt.Sprintf("failed to parse extender args from request, error=%s", err.Error()), header)
+		return
+	}
+	priorities, err := h.Extender.Prioritize(args)
+	if err != nil {
+		klog.Errorf("failed to prioritize the nodes: %v\n", err)
+		http.Error(w, fmt.Sprintf("failed to prioritize the nodes: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	writeExtenderResult(w, priorities)
+}
+
+func readExtenderArgs(r *http.Request) (*extenderv1.ExtenderArgs, int, error) {
+	if r.Method != http.MethodPost {
+		return nil, http.StatusMethodNotAllowed, fmt.Errorf("invalid method %s, only POST requests are allowed", r.Method)
+	}
+	args := &extenderv1.ExtenderArgs{}
+	if err := json.NewDecoder(r.Body).Decode(args); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("could not deserialize request to extender args: %v", err)
+	}
+	return args, http.StatusOK, nil
+}
+
+func writeExtenderResult(w http.ResponseWriter, result interface{}) {
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		klog.Errorf("failed to marshal extender result: %+v, error=%v\n", result, err)
+		http.Error(w, fmt.Sprintf("failed to marshal extender result: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if _, err := w.Write(bytes); err != nil {
+		klog.Errorf("failed to write response to output http stream: %v\n", err)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/podrescheduling"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestExtenderHandler(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "busybox", Namespace: "default", Annotations: map[string]string{
+		pkg.SchedulinedHostString: `["node1"]`,
+	}}}
+	nodeNames := []string{"node1", "node2"}
+	tests := []struct {
+		name     string
+		method   string
+		verb     string
+		wantCode int
+		// want is the response decoded into the type of the verb's result
+		want interface{}
+	}{
+		{
+			name:     "filter",
+			method:   http.MethodPost,
+			verb:     ExtenderFilterVerb,
+			wantCode: http.StatusOK,
+			want: &extenderv1.ExtenderFilterResult{
+				NodeNames:                  &[]string{"node2"},
+				FailedAndUnresolvableNodes: extenderv1.FailedNodesMap{"node1": "node node1 excluded by kse-rescheduler after the pod failed on it"},
+			},
+		},
+		{
+			name:     "prioritize",
+			method:   http.MethodPost,
+			verb:     ExtenderPrioritizeVerb,
+			wantCode: http.StatusOK,
+			want:     &extenderv1.HostPriorityList{{Host: "node1", Score: 5}, {Host: "node2", Score: 10}},
+		},
+		{
+			name:     "get request",
+			method:   http.MethodGet,
+			verb:     ExtenderFilterVerb,
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(
+				&corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "node1"}},
+				&corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "node2"}},
+			), 0)
+			extender, err := podrescheduling.NewExtender(nil, informerFactory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			informerFactory.Start(ctx.Done())
+			informerFactory.WaitForCacheSync(ctx.Done())
+			h := &ExtenderHandler{Extender: extender}
+
+			body, err := json.Marshal(&extenderv1.ExtenderArgs{Pod: pod, NodeNames: &nodeNames})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(test.method, ExtenderURLPrefix+"/"+test.verb, bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			if test.verb == ExtenderFilterVerb {
+				h.filter(w, r)
+			} else {
+				h.prioritize(w, r)
+			}
+			if w.Code != test.wantCode {
+				t.Fatalf("test returned code %d want %d: %s", w.Code, test.wantCode, w.Body.String())
+			}
+			if test.want == nil {
+				return
+			}
+			got := reflect.New(reflect.TypeOf(test.want).Elem()).Interface()
+			if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("test returned wrong result: got %+v want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+	"kse/kse-rescheduler/pkg"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// iteration records when the running iteration of a loop started, a stuck iteration fails the liveness check
+type iteration struct {
+	started atomic.Int64
+}
+
+func (i *iteration) run(f func()) {
+	i.started.Store(time.Now().UnixNano())
+	defer i.started.Store(0)
+	f()
+}
+
+// running returns how long the current iteration has been running, 0 if none is
+func (i *iteration) running() time.Duration {
+	started := i.started.Load()
+	if started == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, started))
+}
+
+// healthzChecks fail if the process should be restarted: the leader didn't renew its lease, or the listFunc or the gc
+// is stuck
+func (s *Server) healthzChecks() []healthz.HealthChecker {
+	return []healthz.HealthChecker{
+		healthz.PingHealthz,
+		s.leaderHealthz,
+		healthz.NamedCheck("reconcile", s.reconcileCheck),
+	}
+}
+
+// readyzChecks fail if the replica shouldn't serve the webhook and the extender
+func (s *Server) readyzChecks() []healthz.HealthChecker {
+	return []healthz.HealthChecker{
+		healthz.PingHealthz,
+		healthz.NamedCheck("shutdown", s.shutdownCheck),
+		healthz.NamedCheck("informer-sync", s.informerSyncCheck),
+		healthz.NamedCheck("certificate", s.certificateCheck),
+		healthz.NamedCheck("apiserver", s.apiServerCheck),
+	}
+}
+
+func (s *Server) reconcileCheck(_ *http.Request) error {
+	if running := s.listIteration.running(); running > pkg.ReconcileStuckTimeout {
+		return fmt.Errorf("listFunc has been running for %v", running.Round(time.Second))
+	}
+	if running := s.gcIteration.running(); running > pkg.ReconcileStuckTimeout {
+		return fmt.Errorf("gc has been running for %v", running.Round(time.Second))
+	}
+	return nil
+}
+
+func (s *Server) shutdownCheck(_ *http.Request) error {
+	if s.shuttingDown.Load() {
+		return fmt.Errorf("shutting down")
+	}
+	return nil
+}
+
+// informerSyncCheck fails until the informer caches are synced, so the admission requests aren't served by live reads
+// on a new replica
+func (s *Server) informerSyncCheck(_ *http.Request) error {
+	if !s.cachesSynced.Load() {
+		return fmt.Errorf("informer caches not synced")
+	}
+	return nil
+}
+
+func (s *Server) certificateCheck(_ *http.Request) error {
+	if s.certs == nil {
+		return fmt.Errorf("serving certificate not loaded")
+	}
+	_, err := s.certs.GetCertificate(nil)
+	return err
+}
+
+// apiServerCheck fails if the api server can't be reached, e.g. the credentials of the client are broken
+func (s *Server) apiServerCheck(r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), pkg.APIServerCheckTimeout)
+	defer cancel()
+	if _, err := s.Handler.K8sClientSet.CoreV1().Pods(podNamespace()).List(ctx, metav1.ListOptions{Limit: 1}); err != nil {
+		return fmt.Errorf("list pods err: %s", err.Error())
+	}
+	return nil
+}
+
+// capabilitiesHandler serves the APIs detected by discovery, the features are degraded according to them
+func (s *Server) capabilitiesHandler(w http.ResponseWriter, _ *http.Request) {
+	if s.apiCapabilities == nil {
+		http.Error(w, "api server capabilities not detected", http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(s.apiCapabilities)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if _, err := w.Write(data); err != nil {
+		klog.Errorf("failed to write the capabilities: %v\n", err)
+	}
+}
+
+// opsHandler serves /healthz, /readyz, /readyz/capabilities, /metrics and, if EnableProfiling is set, /debug/pprof over
+// plain HTTP
+func (s *Server) opsHandler() http.Handler {
+	mux := http.NewServeMux()
+	healthz.InstallHandler(mux, s.healthzChecks()...)
+	healthz.InstallReadyzHandler(mux, s.readyzChecks()...)
+	mux.HandleFunc("/readyz/capabilities", s.capabilitiesHandler)
+	mux.Handle("/metrics", legacyregistry.Handler())
+	if s.EnableProfiling {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
@@ -0,0 +1,169 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/capabilities"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpsHandler(t *testing.T) {
+	now := time.Now()
+	ca, caKey, err := newCA(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := newServingCert(ca, caKey, []string{"kse-rescheduler.kse-rescheduler.svc", "kse-rescheduler.kse-rescheduler.svc.cluster.local"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		path string
+		// modify breaks the healthy server
+		modify func(s *Server, client *fake.Clientset)
+		// profiling enables /debug/pprof
+		profiling bool
+		wantCode  int
+		// wantBody is contained in the response
+		wantBody string
+	}{
+		{
+			name:     "healthy",
+			path:     "/healthz",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "ready",
+			path:     "/readyz",
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "listFunc stuck",
+			path: "/healthz",
+			modify: func(s *Server, _ *fake.Clientset) {
+				s.listIteration.started.Store(time.Now().Add(-pkg.ReconcileStuckTimeout - time.Minute).UnixNano())
+			},
+			wantCode: http.StatusInternalServerError,
+			wantBody: "[-]reconcile failed",
+		},
+		{
+			name: "listFunc running",
+			path: "/healthz",
+			modify: func(s *Server, _ *fake.Clientset) {
+				s.listIteration.started.Store(time.Now().Add(-time.Minute).UnixNano())
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "informer caches not synced",
+			path: "/readyz",
+			modify: func(s *Server, _ *fake.Clientset) {
+				s.cachesSynced.Store(false)
+			},
+			wantCode: http.StatusInternalServerError,
+			wantBody: "[-]informer-sync failed",
+		},
+		{
+			name: "certificate not loaded",
+			path: "/readyz",
+			modify: func(s *Server, _ *fake.Clientset) {
+				s.certs = newCertReloader("", "")
+			},
+			wantCode: http.StatusInternalServerError,
+			wantBody: "[-]certificate failed",
+		},
+		{
+			name: "apiserver unreachable",
+			path: "/readyz",
+			modify: func(_ *Server, client *fake.Clientset) {
+				client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("connection refused")
+				})
+			},
+			wantCode: http.StatusInternalServerError,
+			wantBody: "[-]apiserver failed",
+		},
+		{
+			name: "apiserver unreachable excluded",
+			path: "/readyz?exclude=apiserver",
+			modify: func(_ *Server, client *fake.Clientset) {
+				client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("connection refused")
+				})
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			name: "capabilities",
+			path: "/readyz/capabilities",
+			modify: func(s *Server, _ *fake.Clientset) {
+				s.apiCapabilities = &capabilities.Capabilities{ServerVersion: "v1.21.14", CronJobGroupVersion: capabilities.CronJobV1}
+			},
+			wantCode: http.StatusOK,
+			wantBody: `"serverVersion":"v1.21.14","cronJobGroupVersion":"batch/v1"`,
+		},
+		{
+			name:     "capabilities not detected",
+			path:     "/readyz/capabilities",
+			wantCode: http.StatusInternalServerError,
+		},
+		{
+			name:     "metrics",
+			path:     "/metrics",
+			wantCode: http.StatusOK,
+			wantBody: "kse_rescheduler_webhook_fail_open_total",
+		},
+		{
+			name:     "profiling disabled",
+			path:     "/debug/pprof/",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:      "profiling enabled",
+			path:      "/debug/pprof/",
+			profiling: true,
+			wantCode:  http.StatusOK,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			s := NewKseReschedulerServer()
+			s.Handler.K8sClientSet = client
+			s.EnableProfiling = test.profiling
+			s.cachesSynced.Store(true)
+			s.certs = newCertReloader("", "")
+			if err := s.certs.set(certPEM, keyPEM); err != nil {
+				t.Fatal(err)
+			}
+			if test.modify != nil {
+				test.modify(s, client)
+			}
+			rr := httptest.NewRecorder()
+			s.opsHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if rr.Code != test.wantCode {
+				t.Errorf("%s returned %d want %d: %s", test.path, rr.Code, test.wantCode, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), test.wantBody) {
+				t.Errorf("%s returned %q want it to contain %q", test.path, rr.Body.String(), test.wantBody)
+			}
+		})
+	}
+}
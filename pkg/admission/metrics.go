@@ -0,0 +1,29 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const metricsSubsystem = "kse_rescheduler"
+
+// webhookFailOpenTotal counts the pods admitted unpatched because their rescheduling state couldn't be read
+var webhookFailOpenTotal = metrics.NewCounter(&metrics.CounterOpts{
+	Subsystem:      metricsSubsystem,
+	Name:           "webhook_fail_open_total",
+	Help:           "Number of pods admitted without the rescheduling state because the webhook failed to read it",
+	StabilityLevel: metrics.ALPHA,
+})
+
+func init() {
+	legacyregistry.MustRegister(webhookFailOpenTotal)
+}
@@ -0,0 +1,194 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	"k8s.io/client-go/tools/cache"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/capabilities"
+)
+
+// OwnerCache reads the pods' owners from the informer cache of the webhook, a cache miss, e.g. the ReplicaSet created
+// just before its pods, falls back to a live read. The objects returned may be shared with the cache, they are read only.
+type OwnerCache struct {
+	client       kubernetes.Interface
+	// listers are keyed by the namespace of their factory, metav1.NamespaceAll for a cluster-wide factory
+	listers      map[string]*ownerListers
+	synced       []cache.InformerSynced
+	// cronJobs reads the CronJobs in the version the api server serves, they are cached only in batch/v1
+	cronJobs     *capabilities.CronJobClient
+}
+
+type ownerListers struct {
+	deployLister appslisters.DeploymentLister
+	rsLister     appslisters.ReplicaSetLister
+	stsLister    appslisters.StatefulSetLister
+	jobLister    batchlisters.JobLister
+	cjLister     batchlisters.CronJobLister
+}
+
+// NewOwnerCache registers the informers of the owners in the factory, the factory is started by the caller. Without a
+// factory every read is a live read.
+func NewOwnerCache(client kubernetes.Interface, factory informers.SharedInformerFactory) *OwnerCache {
+	if factory == nil {
+		return &OwnerCache{client: client, cronJobs: capabilities.NewCronJobClient(client, capabilities.Default.CronJobGroupVersion)}
+	}
+	return NewNamespacedOwnerCache(client, map[string]informers.SharedInformerFactory{metav1.NamespaceAll: factory}, capabilities.Default)
+}
+
+// NewNamespacedOwnerCache registers the informers of the owners in the factories keyed by the namespace they are
+// scoped to, the owners of the other namespaces are read live. The CronJobs are read live if the api server doesn't
+// serve them in batch/v1.
+func NewNamespacedOwnerCache(client kubernetes.Interface, factories map[string]informers.SharedInformerFactory, caps *capabilities.Capabilities) *OwnerCache {
+	c := &OwnerCache{
+		client:   client,
+		listers:  make(map[string]*ownerListers, len(factories)),
+		cronJobs: capabilities.NewCronJobClient(client, caps.CronJobGroupVersion),
+	}
+	for namespace, factory := range factories {
+		deployInformer := factory.Apps().V1().Deployments()
+		rsInformer := factory.Apps().V1().ReplicaSets()
+		stsInformer := factory.Apps().V1().StatefulSets()
+		jobInformer := factory.Batch().V1().Jobs()
+		c.listers[namespace] = &ownerListers{
+			deployLister: deployInformer.Lister(),
+			rsLister:     rsInformer.Lister(),
+			stsLister:    stsInformer.Lister(),
+			jobLister:    jobInformer.Lister(),
+		}
+		c.synced = append(c.synced,
+			deployInformer.Informer().HasSynced,
+			rsInformer.Informer().HasSynced,
+			stsInformer.Informer().HasSynced,
+			jobInformer.Informer().HasSynced,
+		)
+		if caps.CronJobGroupVersion == capabilities.CronJobV1 {
+			cjInformer := factory.Batch().V1().CronJobs()
+			c.listers[namespace].cjLister = cjInformer.Lister()
+			c.synced = append(c.synced, cjInformer.Informer().HasSynced)
+		}
+	}
+	return c
+}
+
+// listersOf returns the listers caching the namespace, it's nil if the namespace isn't cached
+func (c *OwnerCache) listersOf(namespace string) *ownerListers {
+	if listers, ok := c.listers[namespace]; ok {
+		return listers
+	}
+	return c.listers[metav1.NamespaceAll]
+}
+
+// HasSynced is true once the owners are listed into the cache
+func (c *OwnerCache) HasSynced() bool {
+	for _, synced := range c.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+// podOwnerInfo returns the workload of the pod, the Deployment of a ReplicaSet and the CronJob of a Job
+func (c *OwnerCache) podOwnerInfo(ctx context.Context, pod *corev1.Pod) (*pkg.PodOwnerInfo, error) {
+	var podOwnerInfo pkg.PodOwnerInfo
+	ownerRef := pod.OwnerReferences[0]
+	switch ownerRef.Kind {
+	case "ReplicaSet":
+		rs, err := c.replicaSet(ctx, pod.Namespace, ownerRef.Name)
+		if err != nil {
+			return nil, fmt.Errorf("get pod %s owner ReplicaSets err: %s", pod.Name, err.Error())
+		}
+		if len(rs.OwnerReferences) > 0 && rs.OwnerReferences[0].Kind == "Deployment" {
+			podOwnerInfo.PodOwnerName = rs.OwnerReferences[0].Name
+			podOwnerInfo.PodOwnerType = "Deployment"
+		} else {
+			podOwnerInfo.PodOwnerName = ownerRef.Name
+			podOwnerInfo.PodOwnerType = "ReplicaSet"
+		}
+	case "StatefulSet", "DaemonSet":
+		podOwnerInfo.PodOwnerName = ownerRef.Name
+		podOwnerInfo.PodOwnerType = ownerRef.Kind
+	case "Job":
+		jb, err := c.job(ctx, pod.Namespace, ownerRef.Name)
+		if err != nil {
+			return nil, fmt.Errorf("get pod %s onwer Job err: %s", pod.Name, err.Error())
+		}
+		if len(jb.OwnerReferences) > 0 && jb.OwnerReferences[0].Kind == "CronJob" {
+			podOwnerInfo.PodOwnerName = jb.OwnerReferences[0].Name
+			podOwnerInfo.PodOwnerType = "CronJob"
+		} else {
+			podOwnerInfo.PodOwnerName = ownerRef.Name
+			podOwnerInfo.PodOwnerType = "Job"
+		}
+	}
+	return &podOwnerInfo, nil
+}
+
+func (c *OwnerCache) deployment(ctx context.Context, namespace, name string) (*appsv1.Deployment, error) {
+	if listers := c.listersOf(namespace); listers != nil {
+		deploy, err := listers.deployLister.Deployments(namespace).Get(name)
+		if !apierrors.IsNotFound(err) {
+			return deploy, err
+		}
+	}
+	return c.client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c *OwnerCache) replicaSet(ctx context.Context, namespace, name string) (*appsv1.ReplicaSet, error) {
+	if listers := c.listersOf(namespace); listers != nil {
+		rs, err := listers.rsLister.ReplicaSets(namespace).Get(name)
+		if !apierrors.IsNotFound(err) {
+			return rs, err
+		}
+	}
+	return c.client.AppsV1().ReplicaSets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c *OwnerCache) statefulSet(ctx context.Context, namespace, name string) (*appsv1.StatefulSet, error) {
+	if listers := c.listersOf(namespace); listers != nil {
+		sts, err := listers.stsLister.StatefulSets(namespace).Get(name)
+		if !apierrors.IsNotFound(err) {
+			return sts, err
+		}
+	}
+	return c.client.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c *OwnerCache) job(ctx context.Context, namespace, name string) (*batchv1.Job, error) {
+	if listers := c.listersOf(namespace); listers != nil {
+		jb, err := listers.jobLister.Jobs(namespace).Get(name)
+		if !apierrors.IsNotFound(err) {
+			return jb, err
+		}
+	}
+	return c.client.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c *OwnerCache) cronJob(ctx context.Context, namespace, name string) (*batchv1.CronJob, error) {
+	if listers := c.listersOf(namespace); listers != nil && listers.cjLister != nil {
+		cj, err := listers.cjLister.CronJobs(namespace).Get(name)
+		if !apierrors.IsNotFound(err) {
+			return cj, err
+		}
+	}
+	return c.cronJobs.Get(ctx, namespace, name, metav1.GetOptions{})
+}
@@ -0,0 +1,169 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/capabilities"
+	"testing"
+)
+
+func TestOwnerCache(t *testing.T) {
+	owned := func(kind, name string) []v1.OwnerReference {
+		return []v1.OwnerReference{{Kind: kind, Name: name}}
+	}
+	rs := &appsv1.ReplicaSet{ObjectMeta: v1.ObjectMeta{Name: "nginx-7d9c", Namespace: "default", OwnerReferences: owned("Deployment", "nginx")}}
+	deploy := &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "default"}}
+	jb := &batchv1.Job{ObjectMeta: v1.ObjectMeta{Name: "backup-2788", Namespace: "default", OwnerReferences: owned("CronJob", "backup")}}
+	bareRs := &appsv1.ReplicaSet{ObjectMeta: v1.ObjectMeta{Name: "bare", Namespace: "default"}}
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		// cached are the objects in the informer cache, live are the objects only the api server has
+		cached        []runtime.Object
+		live          []runtime.Object
+		wantOwnerInfo *pkg.PodOwnerInfo
+		wantErr       bool
+		// wantLiveReads is the number of reads missing the cache
+		wantLiveReads int
+	}{
+		{
+			name:          "deployment from the cache",
+			pod:           &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "nginx-7d9c-x", Namespace: "default", OwnerReferences: owned("ReplicaSet", rs.Name)}},
+			cached:        []runtime.Object{rs},
+			wantOwnerInfo: &pkg.PodOwnerInfo{PodOwnerName: "nginx", PodOwnerType: "Deployment"},
+		},
+		{
+			name:          "replicaset missing the cache",
+			pod:           &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "bare-x", Namespace: "default", OwnerReferences: owned("ReplicaSet", bareRs.Name)}},
+			live:          []runtime.Object{bareRs},
+			wantOwnerInfo: &pkg.PodOwnerInfo{PodOwnerName: "bare", PodOwnerType: "ReplicaSet"},
+			wantLiveReads: 1,
+		},
+		{
+			name:          "cronjob from the cache",
+			pod:           &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "backup-2788-x", Namespace: "default", OwnerReferences: owned("Job", jb.Name)}},
+			cached:        []runtime.Object{jb},
+			wantOwnerInfo: &pkg.PodOwnerInfo{PodOwnerName: "backup", PodOwnerType: "CronJob"},
+		},
+		{
+			name:          "statefulset without reads",
+			pod:           &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "web-0", Namespace: "default", OwnerReferences: owned("StatefulSet", "web")}},
+			wantOwnerInfo: &pkg.PodOwnerInfo{PodOwnerName: "web", PodOwnerType: "StatefulSet"},
+		},
+		{
+			name:          "job not found",
+			pod:           &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "gone-x", Namespace: "default", OwnerReferences: owned("Job", "gone")}},
+			wantErr:       true,
+			wantLiveReads: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(test.live...)
+			factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+			owners := NewOwnerCache(client, factory)
+			for _, obj := range test.cached {
+				var err error
+				switch obj := obj.(type) {
+				case *appsv1.ReplicaSet:
+					err = factory.Apps().V1().ReplicaSets().Informer().GetIndexer().Add(obj)
+				case *batchv1.Job:
+					err = factory.Batch().V1().Jobs().Informer().GetIndexer().Add(obj)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			gotOwnerInfo, err := owners.podOwnerInfo(context.TODO(), test.pod)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("podOwnerInfo returned err %v, want err %v", err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.wantOwnerInfo, gotOwnerInfo); diff != "" {
+				t.Errorf("unexpected owner info (-want,+got):\n%s", diff)
+			}
+			if gotLiveReads := len(client.Actions()); gotLiveReads != test.wantLiveReads {
+				t.Errorf("got %d live reads, want %d: %v", gotLiveReads, test.wantLiveReads, client.Actions())
+			}
+		})
+	}
+
+	// the deployment is read from the cache once its informer has it
+	client := fake.NewSimpleClientset(deploy)
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	owners := NewOwnerCache(client, factory)
+	if owners.HasSynced() {
+		t.Errorf("HasSynced is true before the informers are started")
+	}
+	if _, err := owners.deployment(context.TODO(), "default", "nginx"); err != nil || len(client.Actions()) != 1 {
+		t.Errorf("deployment missing the cache: err %v, %d live reads", err, len(client.Actions()))
+	}
+	if err := factory.Apps().V1().Deployments().Informer().GetIndexer().Add(deploy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := owners.deployment(context.TODO(), "default", "nginx"); err != nil || len(client.Actions()) != 1 {
+		t.Errorf("deployment in the cache: err %v, %d live reads", err, len(client.Actions()))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+	if !owners.HasSynced() {
+		t.Errorf("HasSynced is false after the informers are synced")
+	}
+}
+
+func TestNamespacedOwnerCache(t *testing.T) {
+	cached := &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "team-a"}}
+	unwatched := &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "team-b"}}
+	client := fake.NewSimpleClientset(cached, unwatched)
+	factory := informers.NewSharedInformerFactoryWithOptions(fake.NewSimpleClientset(), 0, informers.WithNamespace("team-a"))
+	owners := NewNamespacedOwnerCache(client, map[string]informers.SharedInformerFactory{"team-a": factory}, capabilities.Default)
+	if err := factory.Apps().V1().Deployments().Informer().GetIndexer().Add(cached); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := owners.deployment(context.TODO(), "team-a", "nginx"); err != nil || len(client.Actions()) != 0 {
+		t.Errorf("deployment of a watched namespace: err %v, %d live reads", err, len(client.Actions()))
+	}
+	// the namespaces without a factory are read live
+	if _, err := owners.deployment(context.TODO(), "team-b", "nginx"); err != nil || len(client.Actions()) != 1 {
+		t.Errorf("deployment of another namespace: err %v, %d live reads", err, len(client.Actions()))
+	}
+}
+
+func TestOwnerCacheCronJobV1beta1(t *testing.T) {
+	client := fake.NewSimpleClientset(&batchv1beta1.CronJob{
+		ObjectMeta: v1.ObjectMeta{Name: "backup", Namespace: "default", Annotations: map[string]string{pkg.SchedulingRetrieString: "3"}},
+		Spec:       batchv1beta1.CronJobSpec{Schedule: "0 * * * *"},
+	})
+	factory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0)
+	owners := NewNamespacedOwnerCache(client, map[string]informers.SharedInformerFactory{v1.NamespaceAll: factory}, &capabilities.Capabilities{CronJobGroupVersion: capabilities.CronJobV1beta1})
+	// the batch/v1 CronJobs aren't cached, their informer would never sync
+	if owners.listersOf("default").cjLister != nil || len(owners.synced) != 4 {
+		t.Errorf("batch/v1 CronJobs are cached on a batch/v1beta1 api server")
+	}
+	cj, err := owners.cronJob(context.TODO(), "default", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cj.Spec.Schedule != "0 * * * *" || cj.Annotations[pkg.SchedulingRetrieString] != "3" {
+		t.Errorf("unexpected cronjob converted from batch/v1beta1: %+v", cj)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"bytes"
+	"encoding/json"
+	jsonpatch "github.com/evanphx/json-patch"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"kse/kse-rescheduler/pkg"
+	"reflect"
+	"testing"
+)
+
+func TestAnnotationPatches(t *testing.T) {
+	scheduledHosts := map[string]string{pkg.SchedulinedHostString: `["node1","node2"]`}
+	owner := &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{
+		pkg.NodeFailuresString:  `{"node1":{"count":2,"lastFailureTime":"2023-06-01T00:00:00Z","reason":"OOMKilled"}}`,
+		pkg.AvoidanceModeString: pkg.AvoidanceModeHard,
+	}}}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		// patched are the annotations added by the webhook
+		patched    map[string]string
+		owner      *appsv1.Deployment
+		goldenFile string
+	}{
+		{
+			name:       "pod without annotations",
+			patched:    scheduledHosts,
+			goldenFile: "testdata/annotations/no-annotations-golden.json",
+		},
+		{
+			name:        "pod with an empty annotations map",
+			annotations: map[string]string{},
+			patched:     scheduledHosts,
+			goldenFile:  "testdata/annotations/empty-annotations-golden.json",
+		},
+		{
+			name: "pod with the annotations of the other webhooks",
+			annotations: map[string]string{
+				"sidecar.istio.io/status":           `{"initContainers":["istio-init"],"containers":["istio-proxy"]}`,
+				"prometheus.io/scrape":              "true",
+				"prometheus.io/port":                "9090",
+				"kubectl.kubernetes.io/restartedAt": "2023-06-01T00:00:00Z",
+			},
+			patched:    scheduledHosts,
+			goldenFile: "testdata/annotations/other-webhooks-golden.json",
+		},
+		{
+			name:        "pod with the same scheduled hosts",
+			annotations: map[string]string{pkg.SchedulinedHostString: `["node1","node2"]`, "app": "nginx"},
+			patched:     scheduledHosts,
+			goldenFile:  "testdata/annotations/same-value-golden.json",
+		},
+		{
+			name:        "pod with stale scheduled hosts",
+			annotations: map[string]string{pkg.SchedulinedHostString: `["node3"]`},
+			patched:     scheduledHosts,
+			goldenFile:  "testdata/annotations/stale-value-golden.json",
+		},
+		{
+			name:        "keys to be escaped",
+			annotations: map[string]string{"app": "nginx"},
+			patched:     map[string]string{"example.com/a~b": "1", "example.com/a/b": "2", "~": "3"},
+			goldenFile:  "testdata/annotations/escaped-keys-golden.json",
+		},
+		{
+			name:       "owner annotations into a pod without annotations",
+			patched:    scheduledHosts,
+			owner:      owner,
+			goldenFile: "testdata/annotations/owner-no-annotations-golden.json",
+		},
+		{
+			name:        "owner annotations into a pod with annotations",
+			annotations: map[string]string{"prometheus.io/scrape": "true"},
+			patched:     scheduledHosts,
+			owner:       owner,
+			goldenFile:  "testdata/annotations/owner-with-annotations-golden.json",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				TypeMeta:   v1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+				ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: test.annotations},
+			}
+			patches := annotationPatches(pod, test.patched)
+			wantAnnotations := make(map[string]string)
+			for key, value := range test.annotations {
+				wantAnnotations[key] = value
+			}
+			for key, value := range test.patched {
+				wantAnnotations[key] = value
+			}
+			if test.owner != nil {
+				patches = ownerAvoidancePatches(pod, test.owner, patches)
+				for key, value := range test.owner.Annotations {
+					wantAnnotations[key] = value
+				}
+			}
+			patchBytes, err := json.Marshal(patches)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := compareResponse(bytes.NewBuffer(patchBytes), test.goldenFile); err != nil {
+				t.Errorf("TestAnnotationPatches: %v", err)
+			}
+
+			// the patched pod keeps its annotations
+			podBytes, err := json.Marshal(pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(patches) > 0 {
+				patch, err := jsonpatch.DecodePatch(patchBytes)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if podBytes, err = patch.Apply(podBytes); err != nil {
+					t.Fatalf("failed to apply the patches %s: %v", patchBytes, err)
+				}
+			}
+			var patchedPod corev1.Pod
+			if err := json.Unmarshal(podBytes, &patchedPod); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(patchedPod.Annotations, wantAnnotations) {
+				t.Errorf("test returned wrong annotations: got %v want %v", patchedPod.Annotations, wantAnnotations)
+			}
+		})
+	}
+}
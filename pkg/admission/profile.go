@@ -0,0 +1,80 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+	"kse/kse-rescheduler/pkg"
+	"strings"
+	"time"
+)
+
+// schedulerNamePatches routes the pod to the kse profile if it has rescheduling history, the pods which never failed
+// keep the default scheduler. The pod keeps the default scheduler if the profile's lease isn't renewed, so the pods
+// aren't left pending for a scheduler which doesn't run.
+func (h *RequestsHandler) schedulerNamePatches(ctx context.Context, pod *corev1.Pod, patches pkg.Patches) pkg.Patches {
+	if h.SchedulerName == "" {
+		return patches
+	}
+	// a pod choosing another scheduler is kept on it
+	if pod.Spec.SchedulerName != "" && pod.Spec.SchedulerName != corev1.DefaultSchedulerName {
+		return patches
+	}
+	if !hasReschedulingHistory(patchedAnnotations(pod, patches)) {
+		return patches
+	}
+	if err := h.profileAvailable(ctx); err != nil {
+		klog.Errorf("keep pod %s on the default scheduler: %s\n", pod.Name, err.Error())
+		return patches
+	}
+	return append(patches, pkg.Patch{Op: "add", Path: "/spec/schedulerName", Value: h.SchedulerName})
+}
+
+// hasReschedulingHistory is true if the pod is given the exclusions of its workload
+func hasReschedulingHistory(annotations map[string]string) bool {
+	for _, key := range []string{pkg.SchedulinedHostString, pkg.NodeFailuresString, pkg.ExcludedDomainsString} {
+		if value := annotations[key]; value != "" && value != "null" && value != "[]" && value != "{}" {
+			return true
+		}
+	}
+	return false
+}
+
+// profileAvailable returns an error if no scheduler running the profile renewed its lease within ProfileLeaseDuration
+func (h *RequestsHandler) profileAvailable(ctx context.Context) error {
+	name := pkg.ProfileLeasePrefix + h.SchedulerName
+	lease, err := h.K8sClientSet.CoordinationV1().Leases(pkg.NAMESPACE).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get scheduler profile %s lease err: %s", h.SchedulerName, err.Error())
+	}
+	if lease.Spec.RenewTime == nil || time.Since(lease.Spec.RenewTime.Time) > pkg.ProfileLeaseDuration {
+		return fmt.Errorf("scheduler profile %s lease isn't renewed within %v", h.SchedulerName, pkg.ProfileLeaseDuration)
+	}
+	return nil
+}
+
+// validateSchedulerName checks the --scheduler-name, it must be a profile other than the default scheduler
+func validateSchedulerName(schedulerName string) error {
+	if schedulerName == "" {
+		return nil
+	}
+	if schedulerName == corev1.DefaultSchedulerName {
+		return fmt.Errorf("invalid scheduler name %q, it must be a profile other than the default scheduler", schedulerName)
+	}
+	if errs := validation.IsDNS1123Subdomain(schedulerName); len(errs) > 0 {
+		return fmt.Errorf("invalid scheduler name %q: %s", schedulerName, strings.Join(errs, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"kse/kse-rescheduler/pkg"
+	"testing"
+	"time"
+)
+
+func TestSchedulerNamePatches(t *testing.T) {
+	hostPatch := pkg.Patch{Op: "add", Path: "/metadata/annotations", Value: map[string]string{pkg.SchedulinedHostString: `["node1"]`}}
+	lease := func(renewed time.Duration) *coordinationv1.Lease {
+		renewTime := v1.NewMicroTime(time.Now().Add(-renewed))
+		return &coordinationv1.Lease{
+			ObjectMeta: v1.ObjectMeta{Name: pkg.ProfileLeasePrefix + "kse-scheduler", Namespace: pkg.NAMESPACE},
+			Spec:       coordinationv1.LeaseSpec{RenewTime: &renewTime},
+		}
+	}
+	tests := []struct {
+		name          string
+		schedulerName string
+		pod           *corev1.Pod
+		patches       pkg.Patches
+		lease         *coordinationv1.Lease
+		wantPatches   pkg.Patches
+	}{
+		{
+			name:          "pod with rescheduling history",
+			schedulerName: "kse-scheduler",
+			pod:           &corev1.Pod{Spec: corev1.PodSpec{SchedulerName: corev1.DefaultSchedulerName}},
+			patches:       pkg.Patches{hostPatch},
+			lease:         lease(time.Second),
+			wantPatches:   pkg.Patches{hostPatch, {Op: "add", Path: "/spec/schedulerName", Value: "kse-scheduler"}},
+		},
+		{
+			name:          "pod with node failures of its workload",
+			schedulerName: "kse-scheduler",
+			pod:           &corev1.Pod{ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{"app": "busybox"}}},
+			patches:       pkg.Patches{{Op: "add", Path: "/metadata/annotations/kse.com~1node-failures", Value: `{"node1":{"count":1}}`}},
+			lease:         lease(time.Second),
+			wantPatches: pkg.Patches{
+				{Op: "add", Path: "/metadata/annotations/kse.com~1node-failures", Value: `{"node1":{"count":1}}`},
+				{Op: "add", Path: "/spec/schedulerName", Value: "kse-scheduler"},
+			},
+		},
+		{
+			name:          "pod without rescheduling history",
+			schedulerName: "kse-scheduler",
+			pod:           &corev1.Pod{},
+			lease:         lease(time.Second),
+		},
+		{
+			name:          "pod choosing another scheduler",
+			schedulerName: "kse-scheduler",
+			pod:           &corev1.Pod{Spec: corev1.PodSpec{SchedulerName: "volcano"}},
+			patches:       pkg.Patches{hostPatch},
+			lease:         lease(time.Second),
+			wantPatches:   pkg.Patches{hostPatch},
+		},
+		{
+			name:          "profile lease expired",
+			schedulerName: "kse-scheduler",
+			pod:           &corev1.Pod{},
+			patches:       pkg.Patches{hostPatch},
+			lease:         lease(2 * pkg.ProfileLeaseDuration),
+			wantPatches:   pkg.Patches{hostPatch},
+		},
+		{
+			name:          "profile not found",
+			schedulerName: "kse-scheduler",
+			pod:           &corev1.Pod{},
+			patches:       pkg.Patches{hostPatch},
+			wantPatches:   pkg.Patches{hostPatch},
+		},
+		{
+			name:        "routing off",
+			pod:         &corev1.Pod{},
+			patches:     pkg.Patches{hostPatch},
+			lease:       lease(time.Second),
+			wantPatches: pkg.Patches{hostPatch},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			if test.lease != nil {
+				if err := client.Tracker().Add(test.lease); err != nil {
+					t.Fatal(err)
+				}
+			}
+			h := &RequestsHandler{K8sClientSet: client, SchedulerName: test.schedulerName}
+			gotPatches := h.schedulerNamePatches(context.TODO(), test.pod, test.patches)
+			if diff := cmp.Diff(test.wantPatches, gotPatches); diff != "" {
+				t.Errorf("unexpected patches (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidateSchedulerName(t *testing.T) {
+	tests := []struct {
+		schedulerName string
+		wantErr       bool
+	}{
+		{schedulerName: ""},
+		{schedulerName: "kse-scheduler"},
+		{schedulerName: corev1.DefaultSchedulerName, wantErr: true},
+		{schedulerName: "KSE_Scheduler", wantErr: true},
+	}
+	for _, test := range tests {
+		if err := validateSchedulerName(test.schedulerName); (err != nil) != test.wantErr {
+			t.Errorf("validateSchedulerName(%q) returned err %v, want err %v", test.schedulerName, err, test.wantErr)
+		}
+	}
+}
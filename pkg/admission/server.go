@@ -10,9 +10,16 @@
 package admission
 
 import (
+	"crypto/tls"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/server/healthz"
+	componentbaseconfig "k8s.io/component-base/config"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/validation"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/leaderelection"
@@ -20,7 +27,13 @@ import (
 	"k8s.io/klog/v2"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"kse/kse-rescheduler/pkg/apis/controllerconfig"
+	"kse/kse-rescheduler/pkg/capabilities"
 	"kse/kse-rescheduler/pkg/listfunc"
+	"kse/kse-rescheduler/pkg/podrescheduling"
 	"kse/kse-rescheduler/pkg/version"
 	"kse/kse-rescheduler/pkg"
 	"time"
@@ -32,10 +45,57 @@ type Server struct {
 	TLSCertFile string
 	TLSKeyFile  string
 	Address     string
+	// OpsAddress serves the health checks, the metrics and the profiling over plain HTTP
+	OpsAddress          string
+	EnableProfiling     bool
 	ListFuncPeriod      time.Duration
+	GCPeriod            time.Duration
 	Handler     RequestsHandler
 	ListFunc    listfunc.ListFunc
 	KubeConfig  *restclient.Config
+	// EnableExtender serves the kube-scheduler extender protocol under ExtenderURLPrefix
+	EnableExtender      bool
+	Extender            ExtenderHandler
+	// InformerFactories are keyed by the namespace they are scoped to, metav1.NamespaceAll if all the namespaces are
+	// watched
+	InformerFactories   map[string]informers.SharedInformerFactory
+	// WatchNamespaces scopes the informers, the webhooks and the listFunc to the namespaces so kse-rescheduler runs with
+	// namespaced Roles only, all the namespaces are watched if it's empty
+	WatchNamespaces     []string
+	// ManageCerts generates and rotates the certificates in CertSecretName instead of reading TLSCertFile and TLSKeyFile,
+	// and patches the caBundle of the webhook configurations named WebhookConfigName calling ServiceName
+	ManageCerts         bool
+	CertSecretName      string
+	ServiceName         string
+	WebhookConfigName   string
+	// ConfigFile is a KseReschedulerConfiguration overriding the flags of its settings, its changes are applied without
+	// a restart except the ones of ClientConnection and LeaderElection
+	ConfigFile          string
+	// ClientConnection configures the client of the api server, the defaults of client-go are used if it's not set
+	ClientConnection    componentbaseconfig.ClientConnectionConfiguration
+	// LeaderElection configures the election of the replica running the listFunc and the gc
+	LeaderElection      componentbaseconfig.LeaderElectionConfiguration
+	// ShutdownDelay keeps serving while the replica is unready on shutdown, ShutdownGracePeriod bounds the draining of
+	// the in-flight requests after it
+	ShutdownDelay       time.Duration
+	ShutdownGracePeriod time.Duration
+	// cachesSynced is set once the informers of the webhook and the extender are synced, the replica isn't ready before
+	cachesSynced        atomic.Bool
+	shuttingDown        atomic.Bool
+	// reconcileMu is held by the listFunc of a leader term, leading is set while it runs
+	reconcileMu         sync.Mutex
+	leading             atomic.Bool
+	leaderID            string
+	leaderHealthz       *leaderelection.HealthzAdaptor
+	certs               *certReloader
+	// apiCapabilities are the APIs detected by discovery at startup
+	apiCapabilities     *capabilities.Capabilities
+	listIteration       iteration
+	gcIteration         iteration
+	// config and configData are the configuration loaded from ConfigFile, live the settings applied from it
+	config              *controllerconfig.KseReschedulerConfiguration
+	configData          []byte
+	live                atomic.Pointer[liveSettings]
 }
 
 func NewKseReschedulerServer() *Server {
@@ -43,115 +103,377 @@ func NewKseReschedulerServer() *Server {
 		TLSCertFile:          "/run/secrets/tls/tls.crt",
 		TLSKeyFile:            "/run/secrets/tls/tls.key",
 		Address:               ":8443",
+		OpsAddress:            ":8080",
 		ListFuncPeriod:        30 * time.Second,
+		GCPeriod:              10 * time.Minute,
 		Handler:               NewRequestsHandler(),
+		CertSecretName:        "kse-rescheduler-tls",
+		ServiceName:           "kse-rescheduler",
+		WebhookConfigName:     "kse-rescheduler",
 		ListFunc:              listfunc.NewListFunc(),
+		LeaderElection:        componentbaseconfig.LeaderElectionConfiguration{
+			LeaderElect:       true,
+			LeaseDuration:     metav1.Duration{Duration: pkg.LeaseDuration},
+			RenewDeadline:     metav1.Duration{Duration: pkg.RenewDeadlineDuration},
+			RetryPeriod:       metav1.Duration{Duration: pkg.RetryPeriod},
+			ResourceLock:      resourcelock.LeasesResourceLock,
+			ResourceName:      "kse-rescheduler",
+		},
+		ShutdownDelay:         5 * time.Second,
+		ShutdownGracePeriod:   20 * time.Second,
+		leaderHealthz:         leaderelection.NewLeaderHealthzAdaptor(time.Second * 20),
 	}
 }
 
-func (s *Server) health(w http.ResponseWriter, _ *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// syncCaches starts the informers and marks the server ready once they are synced
+func (s *Server) syncCaches(ctx context.Context) {
+	for namespace, factory := range s.InformerFactories {
+		factory.Start(ctx.Done())
+		for informerType, synced := range factory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				klog.Errorf("failed to sync the informer cache of %v in %q\n", informerType, namespace)
+				return
+			}
+		}
+	}
+	klog.Info("informer caches synced")
+	s.cachesSynced.Store(true)
 }
 
 func (s *Server) InitializeK8sClientSet(kubeconfigPath string) error {
+	if kubeconfigPath == "" {
+		kubeconfigPath = s.ClientConnection.Kubeconfig
+	}
 	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
 	if err != nil {
 		return err
 	}
+	if s.ClientConnection.QPS > 0 {
+		config.QPS = s.ClientConnection.QPS
+	}
+	if s.ClientConnection.Burst > 0 {
+		config.Burst = int(s.ClientConnection.Burst)
+	}
+	if s.ClientConnection.ContentType != "" {
+		config.ContentType = s.ClientConnection.ContentType
+	}
+	if s.ClientConnection.AcceptContentTypes != "" {
+		config.AcceptContentTypes = s.ClientConnection.AcceptContentTypes
+	}
 	k8sClientSet, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return err
 	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	apiCapabilities, err := capabilities.Detect(k8sClientSet.Discovery())
+	if err != nil {
+		return err
+	}
+	klog.Infof("Detected the api server capabilities: %s\n", apiCapabilities)
+	if err := s.checkCapabilities(apiCapabilities); err != nil {
+		return err
+	}
+	s.apiCapabilities = apiCapabilities
 	s.KubeConfig = config
 	s.Handler.K8sClientSet = k8sClientSet
 	s.ListFunc.K8sClientSet = k8sClientSet
+	s.ListFunc.DynamicClient = dynamicClient
+	s.ListFunc.JournalNamespace = podNamespace()
+	s.ListFunc.Capabilities = apiCapabilities
+	s.InformerFactories = make(map[string]informers.SharedInformerFactory)
+	if len(s.WatchNamespaces) == 0 {
+		s.InformerFactories[metav1.NamespaceAll] = informers.NewSharedInformerFactory(k8sClientSet, 0)
+	}
+	for _, namespace := range s.WatchNamespaces {
+		s.InformerFactories[namespace] = informers.NewSharedInformerFactoryWithOptions(k8sClientSet, 0, informers.WithNamespace(namespace))
+	}
+	s.Handler.Owners = NewNamespacedOwnerCache(k8sClientSet, s.InformerFactories, apiCapabilities)
+	if s.EnableExtender {
+		extender, err := podrescheduling.NewExtender(nil, s.InformerFactories[metav1.NamespaceAll])
+		if err != nil {
+			return err
+		}
+		s.Extender.Extender = extender
+	}
 	return nil
 }
 
-func (s *Server) Start(kubeconfigPath string) error {
+func (s *Server) Start(ctx context.Context, kubeconfigPath string) error {
 	klog.Info(version.DisplayVersion())
-	if err := s.InitializeK8sClientSet(kubeconfigPath); err != nil {
-		return err
+	if s.ConfigFile != "" {
+		if err := s.readConfig(); err != nil {
+			return err
+		}
 	}
-	leaderElectionConfig, id, err := makeLeaderElectionConfig(s.KubeConfig)
-	if err != nil {
+	switch s.Handler.NodeAffinityMode {
+	case "", pkg.NodeAffinityModeRequired, pkg.NodeAffinityModePreferred:
+	default:
+		return fmt.Errorf("invalid node affinity mode %q, must be %q or %q", s.Handler.NodeAffinityMode, pkg.NodeAffinityModeRequired, pkg.NodeAffinityModePreferred)
+	}
+	if err := validateSchedulerName(s.Handler.SchedulerName); err != nil {
 		return err
 	}
-	leaderElectionConfig.Callbacks = leaderelection.LeaderCallbacks{
-		OnStartedLeading: func(ctx context.Context) {
-			s.RunListFunc()
-		},
-		OnStoppedLeading: func() {
-			klog.Info("no longer the leader, staying inactive")
-		},
-		OnNewLeader:      func(currentId string) {
-			if currentId == id {
-				klog.Info("still the leader!")
-				return
-			}
-			klog.Info("new leader is: ", currentId)
-		},
+	if err := s.validateWatchNamespaces(); err != nil {
+		return err
 	}
-	leaderElector, err := leaderelection.NewLeaderElector(*leaderElectionConfig)
-	if err != nil {
-		return fmt.Errorf("couldn't create leader elector: %v", err)
+	s.Handler.WatchNamespaces = s.WatchNamespaces
+	s.ListFunc.WatchNamespaces = s.WatchNamespaces
+	if err := s.InitializeK8sClientSet(kubeconfigPath); err != nil {
+		return err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
+	s.storeSettings()
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	go leaderElector.Run(ctx)
+	if s.ConfigFile != "" {
+		go wait.Until(s.reloadConfigLogged, pkg.ConfigReloadPeriod, ctx.Done())
+	}
+	// the profile may start later, the pods keep the default scheduler until then
+	if s.Handler.SchedulerName != "" {
+		if err := s.Handler.profileAvailable(ctx); err != nil {
+			klog.Errorf("the rescheduled pods stay on the default scheduler: %s\n", err.Error())
+		}
+	}
+	var lock resourcelock.Interface
+	if s.LeaderElection.LeaderElect {
+		var err error
+		if lock, err = s.newResourceLock(); err != nil {
+			return err
+		}
+		// the election settings are checked before serving
+		if _, err := s.newLeaderElector(lock); err != nil {
+			return err
+		}
+	}
+	// the certificates are reloaded without restarting the server
+	reloader := newCertReloader(s.TLSCertFile, s.TLSKeyFile)
+	s.certs = reloader
+	if s.ManageCerts {
+		certManager := NewCertManager(s.Handler.K8sClientSet, podNamespace(), s.CertSecretName, s.ServiceName, s.WebhookConfigName, reloader)
+		if err := certManager.Sync(ctx); err != nil {
+			return err
+		}
+		go wait.UntilWithContext(ctx, certManager.SyncLogged, pkg.CertCheckPeriod)
+	} else {
+		if err := reloader.reload(); err != nil {
+			return err
+		}
+		go wait.Until(reloader.reloadLogged, pkg.CertReloadPeriod, ctx.Done())
+	}
+	reconcileDone := make(chan struct{})
+	go func() {
+		defer close(reconcileDone)
+		if lock == nil {
+			s.RunListFunc(ctx)
+			return
+		}
+		s.runLeaderElection(ctx, lock)
+	}()
+	// every replica serves the webhook and the extender from its caches, the apiserver and kube-scheduler may call any
+	// of them
+	go s.syncCaches(ctx)
 
 	klog.Infof("Listening on %s\n", s.Address)
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", s.Handler.handleFunc)
-	mux.HandleFunc("/health", s.health)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		s.settings().handler.handleFunc(w, r)
+	})
+	mux.HandleFunc(ValidatePath, func(w http.ResponseWriter, r *http.Request) {
+		s.settings().handler.validateFunc(w, r)
+	})
+	// the probes of the previous releases on the webhook port, the ops listener serves them over plain HTTP
+	healthz.InstallPathHandler(mux, "/health", s.healthzChecks()...)
+	healthz.InstallReadyzHandler(mux, s.readyzChecks()...)
+	if s.EnableExtender {
+		klog.Infof("Serving the scheduler extender on %s\n", ExtenderURLPrefix)
+		mux.HandleFunc(ExtenderURLPrefix+"/"+ExtenderFilterVerb, s.Extender.filter)
+		mux.HandleFunc(ExtenderURLPrefix+"/"+ExtenderPrioritizeVerb, s.Extender.prioritize)
+	}
 
 	server := &http.Server{
-		Addr:    s.Address,
-		Handler: mux,
+		Addr:      s.Address,
+		Handler:   mux,
+		TLSConfig: &tls.Config{GetCertificate: reloader.GetCertificate},
 	}
+	klog.Infof("Serving the health checks and the metrics on %s\n", s.OpsAddress)
+	opsServer := &http.Server{
+		Addr:    s.OpsAddress,
+		Handler: s.opsHandler(),
+	}
+	serveErr := make(chan error, 2)
+	go func() {
+		serveErr <- server.ListenAndServeTLS("", "")
+	}()
+	go func() {
+		serveErr <- opsServer.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	// the probes are answered until the webhook is drained
+	err := s.shutdown(server, opsServer)
+	// the lease is released once the listFunc stopped
+	<-reconcileDone
+	klog.Info("kse-rescheduler stopped")
+	return err
+}
 
-	return server.ListenAndServeTLS(s.TLSCertFile, s.TLSKeyFile)
+// shutdown drains the in-flight requests of the servers in order. The replica is unready for ShutdownDelay first, so
+// the apiserver and kube-scheduler stop calling it before its listener is closed.
+func (s *Server) shutdown(servers ...*http.Server) error {
+	klog.Infof("Shutting down, draining the in-flight requests within %v\n", s.ShutdownDelay+s.ShutdownGracePeriod)
+	s.shuttingDown.Store(true)
+	time.Sleep(s.ShutdownDelay)
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownGracePeriod)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			return fmt.Errorf("shut down the server on %s err: %s", server.Addr, err.Error())
+		}
+	}
+	return nil
 }
 
-func (s *Server) RunListFunc() {
-	stopCh := make(chan struct{})
-	defer close(stopCh)
-	klog.Infof("Starting listFunc and it's list period is %v\n", s.ListFuncPeriod)
-	wait.Until(s.ListFunc.List, s.ListFuncPeriod, stopCh)
+// RunListFunc runs the listFunc and the gc until ctx is done, e.g. the leadership is lost
+func (s *Server) RunListFunc(ctx context.Context) {
+	s.reconcileMu.Lock()
+	defer s.reconcileMu.Unlock()
+	s.leading.Store(true)
+	defer s.leading.Store(false)
+	klog.Infof("Starting kse.com state gc and it's period is %v\n", s.settings().gcPeriod)
+	var gc sync.WaitGroup
+	gc.Add(1)
+	go func() {
+		defer gc.Done()
+		untilWithPeriod(ctx, func() { s.gcIteration.run(s.settings().listFunc.GC) }, func() time.Duration { return s.settings().gcPeriod })
+	}()
+	klog.Infof("Starting listFunc and it's list period is %v\n", s.settings().listFuncPeriod)
+	untilWithPeriod(ctx, func() { s.listIteration.run(s.settings().listFunc.List) }, func() time.Duration { return s.settings().listFuncPeriod })
+	// the gc of the lost term must stop before reconcileMu is released, or it runs along with the gc of the next term
+	gc.Wait()
+	klog.Info("listFunc stopped")
 }
 
-func makeLeaderElectionConfig(kubeConfig *restclient.Config) (*leaderelection.LeaderElectionConfig, string, error) {
-	var namespace, id string
-	if namespace = os.Getenv("POD_NAMESPACE"); namespace == "" {
-		namespace = pkg.NAMESPACE
+// runLeaderElection campaigns until ctx is done. The listFunc runs while the replica leads and stops once the lease is
+// lost, then the replica campaigns again.
+func (s *Server) runLeaderElection(ctx context.Context, lock resourcelock.Interface) {
+	for {
+		leaderElector, err := s.newLeaderElector(lock)
+		if err != nil {
+			klog.Errorf("stop campaigning: %s\n", err.Error())
+			return
+		}
+		leaderElector.Run(ctx)
+		// the listFunc of the lost term has stopped before the replica campaigns again, a term started after the loss
+		// sees its context done and returns at once
+		s.reconcileMu.Lock()
+		s.reconcileMu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		klog.Info("lost the leadership, campaigning again")
 	}
-	hostname, err := os.Hostname()
-	if err != nil {
-		return nil, id, fmt.Errorf("unable to get hostname: %v", err)
+}
+
+// newResourceLock returns the lock of LeaderElection, it's in the namespace of kse-rescheduler if the namespace isn't set
+func (s *Server) newResourceLock() (resourcelock.Interface, error) {
+	if s.leaderID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get hostname: %v", err)
+		}
+		if s.leaderID = os.Getenv("POD_NAME"); s.leaderID == "" {
+			// add a uniquifier so that two processes on the same host don't accidentally both become active
+			s.leaderID = hostname + "_" + string(uuid.NewUUID())
+		}
 	}
-	if id = os.Getenv("POD_NAME"); id == "" {
-		// add a uniquifier so that two processes on the same host don't accidentally both become active
-		id = hostname + "_" + string(uuid.NewUUID())
+	namespace := s.LeaderElection.ResourceNamespace
+	if namespace == "" {
+		namespace = podNamespace()
 	}
-
 	rl, err := resourcelock.NewFromKubeconfig(
-		"leases",
+		s.LeaderElection.ResourceLock,
 		namespace,
-		"kse-rescheduler",
+		s.LeaderElection.ResourceName,
 		resourcelock.ResourceLockConfig{
-			Identity: id,
+			Identity: s.leaderID,
 		},
-		kubeConfig, pkg.RenewDeadlineDuration)
+		s.KubeConfig, s.LeaderElection.RenewDeadline.Duration)
 	if err != nil {
-		return nil, id, fmt.Errorf("couldn't create resource lock: %v", err)
-	}
-	return &leaderelection.LeaderElectionConfig{
-		Lock:            rl,
-		LeaseDuration:   pkg.LeaseDuration,
-		RenewDeadline:   pkg.RenewDeadlineDuration,
-		RetryPeriod:     pkg.RetryPeriod,
-		WatchDog:        leaderelection.NewLeaderHealthzAdaptor(time.Second * 20),
-		Name:            "kse-rescheduler",
+		return nil, fmt.Errorf("couldn't create resource lock: %v", err)
+	}
+	return rl, nil
+}
+
+func (s *Server) newLeaderElector(lock resourcelock.Interface) (*leaderelection.LeaderElector, error) {
+	leaderElector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: s.LeaderElection.LeaseDuration.Duration,
+		RenewDeadline: s.LeaderElection.RenewDeadline.Duration,
+		RetryPeriod:   s.LeaderElection.RetryPeriod.Duration,
+		WatchDog:      s.leaderHealthz,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: s.RunListFunc,
+			OnStoppedLeading: func() {
+				klog.Info("no longer the leader, staying inactive")
+			},
+			OnNewLeader: func(currentId string) {
+				if currentId == lock.Identity() {
+					klog.Info("still the leader!")
+					return
+				}
+				klog.Info("new leader is: ", currentId)
+			},
+		},
+		Name:            s.LeaderElection.ResourceName,
 		ReleaseOnCancel: true,
-	}, id, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create leader elector: %v", err)
+	}
+	return leaderElector, nil
+}
+
+// validateWatchNamespaces checks the --watch-namespaces, the extender and the managed certificates read or patch cluster
+// scoped resources so they can't run with namespaced Roles
+func (s *Server) validateWatchNamespaces() error {
+	if len(s.WatchNamespaces) == 0 {
+		return nil
+	}
+	for _, namespace := range s.WatchNamespaces {
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return fmt.Errorf("invalid watch namespace %q: %s", namespace, strings.Join(errs, ", "))
+		}
+	}
+	if s.EnableExtender {
+		return fmt.Errorf("the scheduler extender reads the nodes, it can't be enabled with the watch namespaces")
+	}
+	if s.ManageCerts {
+		return fmt.Errorf("the managed certificates patch the webhook configurations, they can't be enabled with the watch namespaces")
+	}
+	return nil
+}
+
+// checkCapabilities returns an error if a feature enabled needs an API the api server doesn't serve, the features which
+// can be degraded are degraded by their callers
+func (s *Server) checkCapabilities(apiCapabilities *capabilities.Capabilities) error {
+	if s.EnableExtender && apiCapabilities.CronJobGroupVersion != capabilities.CronJobV1 {
+		return fmt.Errorf("the scheduler extender caches the batch/v1 CronJobs, the api server serves %q", apiCapabilities.CronJobGroupVersion)
+	}
+	if s.ManageCerts && !apiCapabilities.AdmissionRegistrationV1 {
+		return fmt.Errorf("the managed certificates patch the admissionregistration.k8s.io/v1 webhook configurations, the api server doesn't serve them")
+	}
+	return nil
+}
+
+// podNamespace returns the namespace kse-rescheduler runs in
+func podNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	return pkg.NAMESPACE
 }
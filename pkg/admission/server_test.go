@@ -0,0 +1,238 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"context"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunLeaderElection(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	var lists atomic.Int32
+	client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		lists.Add(1)
+		return false, nil, nil
+	})
+	s := NewKseReschedulerServer()
+	s.ListFunc.K8sClientSet = client
+	s.ListFuncPeriod = 50 * time.Millisecond
+	s.LeaderElection.LeaseDuration = v1.Duration{Duration: time.Second}
+	s.LeaderElection.RenewDeadline = v1.Duration{Duration: 500 * time.Millisecond}
+	s.LeaderElection.RetryPeriod = v1.Duration{Duration: 100 * time.Millisecond}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  v1.ObjectMeta{Name: "kse-rescheduler", Namespace: "kse-rescheduler"},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: "replica-1"},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runLeaderElection(ctx, lock)
+	}()
+	waitFor := func(condition func() bool, msg string) {
+		if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) { return condition(), nil }); err != nil {
+			t.Fatalf("timed out waiting for %s", msg)
+		}
+	}
+	waitFor(func() bool { return s.leading.Load() && lists.Load() > 0 }, "the listFunc of the leader")
+
+	// another replica takes over the lease
+	lease, err := client.CoordinationV1().Leases("kse-rescheduler").Get(ctx, "kse-rescheduler", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder, now := "replica-2", v1.NewMicroTime(time.Now())
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.RenewTime = &now
+	if _, err := client.CoordinationV1().Leases("kse-rescheduler").Update(ctx, lease, v1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(func() bool { return !s.leading.Load() }, "the listFunc to stop after the lease is lost")
+	stopped := lists.Load()
+	time.Sleep(3 * s.ListFuncPeriod)
+	if got := lists.Load(); got != stopped {
+		t.Errorf("listFunc ran %d times after the lease is lost", got-stopped)
+	}
+
+	// the lease of the other replica expires and the listFunc restarts
+	waitFor(func() bool { return s.leading.Load() && lists.Load() > stopped }, "the listFunc to restart after the lease is acquired again")
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runLeaderElection didn't return after the context is done")
+	}
+	if s.leading.Load() {
+		t.Errorf("listFunc is running after the context is done")
+	}
+	lease, err = client.CoordinationV1().Leases("kse-rescheduler").Get(context.TODO(), "kse-rescheduler", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != "" {
+		t.Errorf("lease is held by %s after the context is done, want it released", *lease.Spec.HolderIdentity)
+	}
+}
+
+func TestRunListFuncWaitsForGC(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	gcStarted, releaseGC := make(chan struct{}), make(chan struct{})
+	var gcStartedOnce sync.Once
+	// the gc lists the nodes first, it's blocked until released
+	client.PrependReactor("list", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gcStartedOnce.Do(func() { close(gcStarted) })
+		<-releaseGC
+		return false, nil, nil
+	})
+	s := NewKseReschedulerServer()
+	s.ListFunc.K8sClientSet = client
+	s.ListFuncPeriod = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.RunListFunc(ctx)
+	}()
+	select {
+	case <-gcStarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the gc")
+	}
+	cancel()
+	select {
+	case <-done:
+		t.Fatal("RunListFunc returned while the gc is running")
+	case <-time.After(3 * s.ListFuncPeriod):
+	}
+	close(releaseGC)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunListFunc didn't return after the gc stopped")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := NewKseReschedulerServer()
+	s.cachesSynced.Store(true)
+	s.ShutdownDelay = 100 * time.Millisecond
+	s.ShutdownGracePeriod = 5 * time.Second
+	started, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Start()
+	defer server.Close()
+
+	inFlight := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		inFlight <- err
+	}()
+	<-started
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.shutdown(server.Config)
+	}()
+
+	// the replica is unready while the in-flight request is drained
+	ops := s.opsHandler()
+	waitErr := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		rr := httptest.NewRecorder()
+		ops.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz/shutdown", nil))
+		return rr.Code == http.StatusInternalServerError, nil
+	})
+	if waitErr != nil {
+		t.Fatal("replica is ready while shutting down")
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned %v before the in-flight request finished", err)
+	case <-time.After(2 * s.ShutdownDelay):
+	}
+	close(release)
+	if err := <-inFlight; err != nil {
+		t.Errorf("in-flight request failed: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("shutdown returned %v", err)
+	}
+}
+
+func TestValidateWatchNamespaces(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(s *Server)
+		wantErr bool
+	}{
+		{
+			name: "all the namespaces",
+			edit: func(s *Server) {
+				s.EnableExtender, s.ManageCerts = true, true
+			},
+		},
+		{
+			name: "watch namespaces",
+			edit: func(s *Server) {
+				s.WatchNamespaces = []string{"team-a", "team-b"}
+			},
+		},
+		{
+			name: "invalid namespace",
+			edit: func(s *Server) {
+				s.WatchNamespaces = []string{"team_a"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "extender",
+			edit: func(s *Server) {
+				s.WatchNamespaces, s.EnableExtender = []string{"team-a"}, true
+			},
+			wantErr: true,
+		},
+		{
+			name: "managed certificates",
+			edit: func(s *Server) {
+				s.WatchNamespaces, s.ManageCerts = []string{"team-a"}, true
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewKseReschedulerServer()
+			test.edit(s)
+			if err := s.validateWatchNamespaces(); (err != nil) != test.wantErr {
+				t.Errorf("validateWatchNamespaces returned err %v, want err %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	admissionv1 "k8s.io/api/admission/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/klog/v2"
+	"kse/kse-rescheduler/pkg"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidatePath is the path of the validating webhook
+const ValidatePath = "/validate"
+
+// validatedResources are the resources whose kse-rescheduler annotations are validated
+var validatedResources = sets.NewString(
+	"/v1/pods",
+	"apps/v1/deployments",
+	"apps/v1/replicasets",
+	"apps/v1/statefulsets",
+	"apps/v1/daemonsets",
+	"batch/v1/jobs",
+	"batch/v1/cronjobs",
+)
+
+// policyAnnotations are set by the users, their values are validated
+var policyAnnotations = map[string]func(value string) error{
+	pkg.SchedulingRetrieString: func(value string) error {
+		var retries int
+		if err := json.Unmarshal([]byte(value), &retries); err != nil {
+			return fmt.Errorf("must be an integer, e.g. \"3\"")
+		}
+		if retries < 0 || retries > pkg.MaxSchedulingRetries {
+			return fmt.Errorf("must be between 0 and %d", pkg.MaxSchedulingRetries)
+		}
+		return nil
+	},
+	pkg.AvoidanceModeString: func(value string) error {
+		if value != pkg.AvoidanceModeHard && value != pkg.AvoidanceModeSoft {
+			return fmt.Errorf("must be %q or %q", pkg.AvoidanceModeHard, pkg.AvoidanceModeSoft)
+		}
+		return nil
+	},
+	pkg.ExclusionTopologyKeyString: func(value string) error {
+		if errs := validation.IsQualifiedName(value); len(errs) > 0 {
+			return fmt.Errorf("must be a node label key: %s", strings.Join(errs, ", "))
+		}
+		return nil
+	},
+	pkg.DomainEscalationFailuresString: func(value string) error {
+		if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+			return fmt.Errorf("must be a positive integer")
+		}
+		return nil
+	},
+}
+
+// stateAnnotations are written by kse-rescheduler, they are the JSON of the types
+var stateAnnotations = map[string]func() interface{}{
+	pkg.StsPodMapString:               func() interface{} { return &pkg.StsPodsMap{} },
+	pkg.PurePodInfoString:             func() interface{} { return &pkg.PurePodInfo{} },
+	pkg.DeployInfoString:              func() interface{} { return &pkg.DeployInfo{} },
+	pkg.RsInfoString:                  func() interface{} { return &pkg.RsInfo{} },
+	pkg.CjInfoString:                  func() interface{} { return &pkg.CjInfo{} },
+	pkg.JobInfoString:                 func() interface{} { return &pkg.JobInfo{} },
+	pkg.SchedulinedHostString:         func() interface{} { return &[]string{} },
+	pkg.RelaxedHostString:             func() interface{} { return &[]string{} },
+	pkg.CurrentReschedulingTimeString: func() interface{} { var times int; return &times },
+	pkg.NodeFailuresString:            func() interface{} { return &pkg.NodeFailures{} },
+	pkg.ExcludedDomainsString:         func() interface{} { return &pkg.ExcludedDomains{} },
+	pkg.PlacementsString:              func() interface{} { return &pkg.Placements{} },
+	pkg.NodeAffinityExclusionsString:  func() interface{} { return &pkg.NodeAffinityExclusions{} },
+}
+
+// DefaultStateEditors are the users editing the kse.com state annotations besides kse-rescheduler
+var DefaultStateEditors = pkg.DefaultStateEditors
+
+func (h *RequestsHandler) validateFunc(w http.ResponseWriter, r *http.Request) {
+	review, header, err := h.readAdmissionReview(r)
+	if err != nil {
+		klog.Infof("failed to parse review: %v\n", err)
+		http.Error(w, fmt.Sprintf("failed to parse admission review from request, error=%s", err.Error()), header)
+		return
+	}
+	reviewResponse := admissionv1.AdmissionReview{
+		TypeMeta: review.TypeMeta,
+		Response: &admissionv1.AdmissionResponse{
+			UID:     review.Request.UID,
+			Allowed: true,
+		},
+	}
+
+	ctx := r.Context()
+	if h.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.RequestTimeout)
+		defer cancel()
+	}
+	status, err := h.validateAdmissionReview(ctx, review)
+	if err != nil {
+		if h.FailOpen {
+			klog.Errorf("admitting request unvalidated: error=%v, review=%+v\n", err, review.Request.Resource.Resource)
+			reviewResponse.Response.Warnings = []string{fmt.Sprintf("kse-rescheduler didn't validate the request: %s", err.Error())}
+		} else {
+			status = &metav1.Status{Status: metav1.StatusFailure, Code: http.StatusInternalServerError, Message: err.Error()}
+		}
+	}
+	if status != nil {
+		klog.Infof("rejecting %s %s/%s: %s\n", review.Request.Kind.Kind, review.Request.Namespace, review.Request.Name, status.Message)
+		reviewResponse.Response.Allowed = false
+		reviewResponse.Response.Result = status
+	}
+
+	bytes, err := marshalAdmissionReview(&reviewResponse)
+	if err != nil {
+		klog.Errorf("failed to marshal response review: %+v, error=%v\n", reviewResponse, err)
+		http.Error(w, fmt.Sprintf("failed to marshal response review: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(bytes); err != nil {
+		klog.Errorf("failed to write response to output http stream: %v\n", err)
+	}
+}
+
+// validateAdmissionReview returns the status rejecting the request, it's nil if the request is allowed. The error is
+// returned if the request can't be validated, e.g. the SubjectAccessReview failed.
+func (h *RequestsHandler) validateAdmissionReview(ctx context.Context, review *admissionv1.AdmissionReview) (*metav1.Status, error) {
+	request := review.Request
+	if request.Operation != admissionv1.Create && request.Operation != admissionv1.Update || !h.watched(request.Namespace) {
+		return nil, nil
+	}
+	if request.SubResource != "" || !validatedResources.Has(request.Resource.Group+"/"+request.Resource.Version+"/"+request.Resource.Resource) {
+		return nil, nil
+	}
+	annotations, err := objectAnnotations(request.Object.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize %s object: %v", request.Kind.Kind, err)
+	}
+	oldAnnotations, err := objectAnnotations(request.OldObject.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize old %s object: %v", request.Kind.Kind, err)
+	}
+	gk := schema.GroupKind{Group: request.Kind.Group, Kind: request.Kind.Kind}
+	if errs := validateAnnotations(annotations, oldAnnotations); len(errs) > 0 {
+		return &apierrors.NewInvalid(gk, request.Name, errs).ErrStatus, nil
+	}
+
+	// the state of a new pod is injected by the mutating webhook
+	if request.Operation == admissionv1.Create && request.Resource == podResource {
+		return nil, nil
+	}
+	edited := editedStateAnnotations(annotations, oldAnnotations)
+	if len(edited) == 0 {
+		return nil, nil
+	}
+	allowed, err := h.stateEditAllowed(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		err := fmt.Errorf("the kse.com state annotations %s are managed by kse-rescheduler, user %q isn't allowed to edit them",
+			strings.Join(edited, ", "), request.UserInfo.Username)
+		return &apierrors.NewForbidden(schema.GroupResource{Group: request.Resource.Group, Resource: request.Resource.Resource}, request.Name, err).ErrStatus, nil
+	}
+	return nil, nil
+}
+
+// objectAnnotations returns the annotations of the raw object, they are nil if there isn't an object
+func objectAnnotations(raw []byte) (map[string]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var obj metav1.PartialObjectMetadata
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	return obj.Annotations, nil
+}
+
+// validateAnnotations validates the kse-rescheduler annotations changed from the old ones, so an object already
+// carrying an invalid value can still be updated, e.g. scaled or fixed
+func validateAnnotations(annotations, oldAnnotations map[string]string) field.ErrorList {
+	var errs field.ErrorList
+	fldPath := field.NewPath("metadata", "annotations")
+	for _, key := range sets.StringKeySet(annotations).List() {
+		value := annotations[key]
+		if oldValue, ok := oldAnnotations[key]; ok && oldValue == value {
+			continue
+		}
+		if validate, ok := policyAnnotations[key]; ok {
+			if err := validate(value); err != nil {
+				errs = append(errs, field.Invalid(fldPath.Key(key), value, err.Error()))
+			}
+			continue
+		}
+		if newState, ok := stateAnnotations[key]; ok {
+			if len(value) > pkg.MaxStateSize {
+				errs = append(errs, field.TooLong(fldPath.Key(key), "", pkg.MaxStateSize))
+				continue
+			}
+			if err := json.Unmarshal([]byte(value), newState()); err != nil {
+				errs = append(errs, field.Invalid(fldPath.Key(key), value, fmt.Sprintf("must be the JSON of the kse-rescheduler state: %s", err.Error())))
+			}
+		}
+	}
+	return errs
+}
+
+// editedStateAnnotations returns the state annotations added, changed or removed
+func editedStateAnnotations(annotations, oldAnnotations map[string]string) []string {
+	var edited []string
+	for key := range stateAnnotations {
+		value, ok := annotations[key]
+		oldValue, oldOk := oldAnnotations[key]
+		if ok != oldOk || value != oldValue {
+			edited = append(edited, key)
+		}
+	}
+	sort.Strings(edited)
+	return edited
+}
+
+// stateEditAllowed is true if the user or one of its groups is a state editor, or a SubjectAccessReview allows the
+// user to update states.kse.com in the namespace
+func (h *RequestsHandler) stateEditAllowed(ctx context.Context, request *admissionv1.AdmissionRequest) (bool, error) {
+	editors := sets.NewString(h.StateEditors...)
+	if editors.Has(request.UserInfo.Username) || editors.HasAny(request.UserInfo.Groups...) {
+		return true, nil
+	}
+	if !h.AuthorizeStateEdits {
+		return false, nil
+	}
+	extra := make(map[string]authorizationv1.ExtraValue, len(request.UserInfo.Extra))
+	for key, value := range request.UserInfo.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+	spec := authorizationv1.SubjectAccessReviewSpec{
+		ResourceAttributes: &authorizationv1.ResourceAttributes{
+			Namespace: request.Namespace,
+			Verb:      "update",
+			Group:     pkg.StateEditGroup,
+			Resource:  pkg.StateEditResource,
+			Name:      request.Name,
+		},
+		User:   request.UserInfo.Username,
+		Groups: request.UserInfo.Groups,
+		Extra:  extra,
+		UID:    request.UserInfo.UID,
+	}
+	// a LocalSubjectAccessReview is created in the namespace with the namespaced Roles of WatchNamespaces
+	if len(h.WatchNamespaces) > 0 {
+		lsar := &authorizationv1.LocalSubjectAccessReview{
+			ObjectMeta: metav1.ObjectMeta{Namespace: request.Namespace},
+			Spec:       spec,
+		}
+		result, err := h.K8sClientSet.AuthorizationV1().LocalSubjectAccessReviews(request.Namespace).Create(ctx, lsar, metav1.CreateOptions{})
+		if err != nil {
+			return false, fmt.Errorf("create local subject access review for user %s err: %s", request.UserInfo.Username, err.Error())
+		}
+		return result.Status.Allowed, nil
+	}
+	sar := &authorizationv1.SubjectAccessReview{Spec: spec}
+	result, err := h.K8sClientSet.AuthorizationV1().SubjectAccessReviews().Create(ctx, sar, metav1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("create subject access review for user %s err: %s", request.UserInfo.Username, err.Error())
+	}
+	return result.Status.Allowed, nil
+}
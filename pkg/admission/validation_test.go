@@ -0,0 +1,309 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package admission
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"kse/kse-rescheduler/pkg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateAdmissionReview(t *testing.T) {
+	deployResource := v1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	rsResource := v1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+	deployment := func(annotations map[string]string) runtime.Object {
+		return &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: annotations}}
+	}
+	user := authenticationv1.UserInfo{Username: "alice", Groups: []string{"system:authenticated"}}
+	tests := []struct {
+		name      string
+		operation admissionv1.Operation
+		resource  v1.GroupVersionResource
+		// subResource is the subresource of the request, e.g. status
+		subResource string
+		object      runtime.Object
+		oldObject   runtime.Object
+		userInfo    authenticationv1.UserInfo
+		// watchNamespaces are the namespaces of the handler, the request is in default
+		watchNamespaces []string
+		// sarAllowed is the result of the SubjectAccessReview, sarErr fails it
+		sarAllowed bool
+		sarErr     error
+		wantCode   int32
+		wantErr    bool
+		// wantLocalSAR is true if a LocalSubjectAccessReview is created instead of a SubjectAccessReview
+		wantLocalSAR bool
+	}{
+		{
+			name:      "valid scheduling-retries",
+			operation: admissionv1.Create,
+			resource:  deployResource,
+			object:    deployment(map[string]string{pkg.SchedulingRetrieString: "3", pkg.AvoidanceModeString: pkg.AvoidanceModeSoft}),
+			userInfo:  user,
+		},
+		{
+			name:      "scheduling-retries not an integer",
+			operation: admissionv1.Create,
+			resource:  deployResource,
+			object:    deployment(map[string]string{pkg.SchedulingRetrieString: "three"}),
+			userInfo:  user,
+			wantCode:  http.StatusUnprocessableEntity,
+		},
+		{
+			name:      "negative scheduling-retries",
+			operation: admissionv1.Update,
+			resource:  deployResource,
+			object:    deployment(map[string]string{pkg.SchedulingRetrieString: "-1"}),
+			oldObject: deployment(map[string]string{pkg.SchedulingRetrieString: "3"}),
+			userInfo:  user,
+			wantCode:  http.StatusUnprocessableEntity,
+		},
+		{
+			name:      "scheduling-retries out of range",
+			operation: admissionv1.Create,
+			resource:  deployResource,
+			object:    deployment(map[string]string{pkg.SchedulingRetrieString: "1000"}),
+			userInfo:  user,
+			wantCode:  http.StatusUnprocessableEntity,
+		},
+		{
+			name:      "invalid avoidance mode and topology key",
+			operation: admissionv1.Create,
+			resource:  deployResource,
+			object: deployment(map[string]string{
+				pkg.AvoidanceModeString:            "medium",
+				pkg.ExclusionTopologyKeyString:     "zone/a/b",
+				pkg.DomainEscalationFailuresString: "0",
+			}),
+			userInfo: user,
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:      "unchanged invalid value",
+			operation: admissionv1.Update,
+			resource:  deployResource,
+			object:    deployment(map[string]string{pkg.SchedulingRetrieString: "three", "app": "nginx"}),
+			oldObject: deployment(map[string]string{pkg.SchedulingRetrieString: "three"}),
+			userInfo:  user,
+		},
+		{
+			name:      "malformed state",
+			operation: admissionv1.Update,
+			resource:  deployResource,
+			object:    deployment(map[string]string{pkg.SchedulingRetrieString: "3", pkg.DeployInfoString: `{"deployScheduledHosts":"node1"`}),
+			oldObject: deployment(map[string]string{pkg.SchedulingRetrieString: "3"}),
+			userInfo:  authenticationv1.UserInfo{Username: "system:kube-scheduler"},
+			wantCode:  http.StatusUnprocessableEntity,
+		},
+		{
+			name:      "state edited by a user",
+			operation: admissionv1.Update,
+			resource:  deployResource,
+			object:    deployment(map[string]string{pkg.SchedulingRetrieString: "3", pkg.DeployInfoString: `{"currentReschedulingTimes":0,"deployScheduledHosts":[]}`}),
+			oldObject: deployment(map[string]string{pkg.SchedulingRetrieString: "3", pkg.DeployInfoString: `{"currentReschedulingTimes":2,"deployScheduledHosts":["node1"]}`}),
+			userInfo:  user,
+			wantCode:  http.StatusForbidden,
+		},
+		{
+			name:      "state removed by a user",
+			operation: admissionv1.Update,
+			resource:  deployResource,
+			object:    deployment(map[string]string{pkg.SchedulingRetrieString: "3"}),
+			oldObject: deployment(map[string]string{pkg.SchedulingRetrieString: "3", pkg.NodeFailuresString: `{"node1":{"count":1}}`}),
+			userInfo:  user,
+			wantCode:  http.StatusForbidden,
+		},
+		{
+			name:       "state edited by an authorized user",
+			operation:  admissionv1.Update,
+			resource:   deployResource,
+			object:     deployment(map[string]string{pkg.SchedulingRetrieString: "3"}),
+			oldObject:  deployment(map[string]string{pkg.SchedulingRetrieString: "3", pkg.DeployInfoString: `{"currentReschedulingTimes":2}`}),
+			userInfo:   authenticationv1.UserInfo{Username: "admin", Groups: []string{"system:masters"}},
+			sarAllowed: true,
+		},
+		{
+			name:            "state edited by an authorized user of a watched namespace",
+			operation:       admissionv1.Update,
+			resource:        deployResource,
+			object:          deployment(map[string]string{pkg.SchedulingRetrieString: "3"}),
+			oldObject:       deployment(map[string]string{pkg.SchedulingRetrieString: "3", pkg.DeployInfoString: `{"currentReschedulingTimes":2}`}),
+			userInfo:        authenticationv1.UserInfo{Username: "team-admin"},
+			watchNamespaces: []string{"default"},
+			sarAllowed:      true,
+			wantLocalSAR:    true,
+		},
+		{
+			name:            "namespace not watched",
+			operation:       admissionv1.Create,
+			resource:        deployResource,
+			object:          deployment(map[string]string{pkg.SchedulingRetrieString: "three"}),
+			userInfo:        user,
+			watchNamespaces: []string{"team-a"},
+		},
+		{
+			name:      "state copied by the deployment controller",
+			operation: admissionv1.Update,
+			resource:  rsResource,
+			object:    &appsv1.ReplicaSet{ObjectMeta: v1.ObjectMeta{Name: "nginx-7d9c", Annotations: map[string]string{pkg.DeployInfoString: `{"currentReschedulingTimes":1}`}}},
+			oldObject: &appsv1.ReplicaSet{ObjectMeta: v1.ObjectMeta{Name: "nginx-7d9c"}},
+			userInfo:  authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:deployment-controller"},
+		},
+		{
+			name:      "state copied by kube-controller-manager without its service account credentials",
+			operation: admissionv1.Update,
+			resource:  rsResource,
+			object:    &appsv1.ReplicaSet{ObjectMeta: v1.ObjectMeta{Name: "nginx-7d9c", Annotations: map[string]string{pkg.DeployInfoString: `{"currentReschedulingTimes":1}`}}},
+			oldObject: &appsv1.ReplicaSet{ObjectMeta: v1.ObjectMeta{Name: "nginx-7d9c"}},
+			userInfo:  authenticationv1.UserInfo{Username: "system:kube-controller-manager"},
+		},
+		{
+			name:      "state injected into a new pod",
+			operation: admissionv1.Create,
+			resource:  podResource,
+			object:    &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "nginx-7d9c-x", Annotations: map[string]string{pkg.SchedulinedHostString: `["node1"]`}}},
+			userInfo:  authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:replicaset-controller"},
+		},
+		{
+			name:        "pod status",
+			operation:   admissionv1.Update,
+			resource:    podResource,
+			subResource: "status",
+			object:      &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "nginx-7d9c-x", Annotations: map[string]string{pkg.SchedulinedHostString: `["node1"]`}}},
+			oldObject:   &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "nginx-7d9c-x"}},
+			userInfo:    user,
+		},
+		{
+			name:      "subject access review failed",
+			operation: admissionv1.Update,
+			resource:  deployResource,
+			object:    deployment(map[string]string{pkg.PlacementsString: `[]`}),
+			oldObject: deployment(nil),
+			userInfo:  user,
+			sarErr:    errors.New("apiserver unavailable"),
+			wantErr:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			var sar *authorizationv1.SubjectAccessReview
+			client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				sar = action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+				result := sar.DeepCopy()
+				result.Status.Allowed = test.sarAllowed
+				return true, result, test.sarErr
+			})
+			gotLocalSAR := false
+			client.PrependReactor("create", "localsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				lsar := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.LocalSubjectAccessReview)
+				gotLocalSAR = lsar.Namespace == "default" && action.GetNamespace() == "default"
+				sar = &authorizationv1.SubjectAccessReview{Spec: lsar.Spec}
+				result := lsar.DeepCopy()
+				result.Status.Allowed = test.sarAllowed
+				return true, result, test.sarErr
+			})
+			h := &RequestsHandler{K8sClientSet: client, StateEditors: DefaultStateEditors, AuthorizeStateEdits: true, WatchNamespaces: test.watchNamespaces}
+			review := &admissionv1.AdmissionReview{Request: &admissionv1.AdmissionRequest{
+				Name:        "nginx",
+				Namespace:   "default",
+				Operation:   test.operation,
+				Resource:    test.resource,
+				SubResource: test.subResource,
+				Object:      runtime.RawExtension{Object: test.object},
+				UserInfo:    test.userInfo,
+			}}
+			if test.oldObject != nil {
+				review.Request.OldObject = runtime.RawExtension{Object: test.oldObject}
+			}
+			byteReview, err := json.Marshal(review)
+			if err != nil {
+				t.Fatal(err)
+			}
+			review = &admissionv1.AdmissionReview{}
+			if err := json.Unmarshal(byteReview, review); err != nil {
+				t.Fatal(err)
+			}
+
+			status, err := h.validateAdmissionReview(context.TODO(), review)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("validateAdmissionReview returned err %v, want err %v", err, test.wantErr)
+			}
+			var gotCode int32
+			if status != nil {
+				gotCode = status.Code
+			}
+			if gotCode != test.wantCode {
+				t.Errorf("validateAdmissionReview returned code %d want %d, status %+v", gotCode, test.wantCode, status)
+			}
+			if sar != nil && (sar.Spec.User != test.userInfo.Username || sar.Spec.ResourceAttributes.Resource != pkg.StateEditResource) {
+				t.Errorf("unexpected subject access review %+v", sar.Spec)
+			}
+			if gotLocalSAR != test.wantLocalSAR {
+				t.Errorf("validateAdmissionReview created a local subject access review in the namespace: %v want %v", gotLocalSAR, test.wantLocalSAR)
+			}
+		})
+	}
+}
+
+func TestValidateFunc(t *testing.T) {
+	object, err := json.Marshal(&appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "nginx", Annotations: map[string]string{pkg.SchedulingRetrieString: "three"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byteReview, err := json.Marshal(&admissionv1.AdmissionReview{
+		TypeMeta: v1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "0c0829ff-c2f5-4634-a1c3-098147304d03",
+			Kind:      v1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Resource:  v1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+			Name:      "nginx",
+			Namespace: "default",
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: object},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &RequestsHandler{K8sClientSet: fake.NewSimpleClientset()}
+	req := httptest.NewRequest(http.MethodPost, ValidatePath, bytes.NewReader(byteReview))
+	req.Header.Add("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	h.validateFunc(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var gotReview admissionv1.AdmissionReview
+	if err := json.Unmarshal(rr.Body.Bytes(), &gotReview); err != nil {
+		t.Fatal(err)
+	}
+	if gotReview.Response.Allowed || gotReview.Response.Result == nil {
+		t.Fatalf("test allowed the invalid scheduling-retries: %+v", gotReview.Response)
+	}
+	wantMessage := `Deployment.apps "nginx" is invalid: metadata.annotations[scheduling-retries]: Invalid value: "three": must be an integer, e.g. "3"`
+	if gotReview.Response.Result.Message != wantMessage {
+		t.Errorf("test returned message %q want %q", gotReview.Response.Result.Message, wantMessage)
+	}
+}
@@ -0,0 +1,35 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package config
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func (in *PodreschedulingArgs) DeepCopyInto(out *PodreschedulingArgs) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+}
+
+func (in *PodreschedulingArgs) DeepCopy() *PodreschedulingArgs {
+	if in == nil {
+		return nil
+	}
+	out := new(PodreschedulingArgs)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *PodreschedulingArgs) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
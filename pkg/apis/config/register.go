@@ -0,0 +1,34 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package config
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	schedconfig "k8s.io/kubernetes/pkg/scheduler/apis/config"
+)
+
+// SchemeGroupVersion is the internal version of the kube-scheduler configuration
+var SchemeGroupVersion = schedconfig.SchemeGroupVersion
+
+var (
+	SchemeBuilder = runtime.NewSchemeBuilder(addKnownTypes)
+	// AddToScheme registers the internal plugin args to a scheme
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func init() {
+	// kube-scheduler converts the plugin args with its own scheme built from the in-tree scheme builder
+	schedconfig.SchemeBuilder.Register(addKnownTypes)
+}
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(SchemeGroupVersion, &PodreschedulingArgs{})
+	return nil
+}
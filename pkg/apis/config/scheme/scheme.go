@@ -0,0 +1,31 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package scheme
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	schedscheme "k8s.io/kubernetes/pkg/scheduler/apis/config/scheme"
+	"kse/kse-rescheduler/pkg/apis/config"
+	"kse/kse-rescheduler/pkg/apis/config/v1beta3"
+)
+
+// Scheme is the kube-scheduler scheme, the Podrescheduling args are decoded from sched-cc.yaml with it
+var Scheme = schedscheme.Scheme
+
+func init() {
+	AddToScheme(Scheme)
+}
+
+// AddToScheme registers the Podrescheduling args of all the versions to a scheme
+func AddToScheme(scheme *runtime.Scheme) {
+	utilruntime.Must(config.AddToScheme(scheme))
+	utilruntime.Must(v1beta3.AddToScheme(scheme))
+}
@@ -0,0 +1,90 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package scheme
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/apimachinery/pkg/runtime"
+	schedconfig "k8s.io/kubernetes/pkg/scheduler/apis/config"
+	schedscheme "k8s.io/kubernetes/pkg/scheduler/apis/config/scheme"
+	"kse/kse-rescheduler/pkg/apis/config"
+	"testing"
+)
+
+func TestDecodePodreschedulingArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantArgs runtime.Object
+	}{
+		{
+			name: "args with defaults",
+			data: `
+apiVersion: kubescheduler.config.k8s.io/v1beta3
+kind: KubeSchedulerConfiguration
+profiles:
+- schedulerName: default-scheduler
+  pluginConfig:
+  - name: Podrescheduling
+    args:
+      avoidanceMode: soft
+`,
+			wantArgs: &config.PodreschedulingArgs{
+				ScheduledHostsAnnotation: "kse.com/scheduled-hosts",
+				AvoidanceMode:            "soft",
+				Fallback:                 config.FallbackRelax,
+				MaxExcludedPercentage:    100,
+			},
+		},
+		{
+			name: "args of all the fields",
+			data: `
+apiVersion: kubescheduler.config.k8s.io/v1beta3
+kind: KubeSchedulerConfiguration
+profiles:
+- schedulerName: default-scheduler
+  pluginConfig:
+  - name: Podrescheduling
+    args:
+      scheduledHostsAnnotation: example.com/failed-nodes
+      avoidanceMode: hard
+      fallback: None
+      maxExcludedPercentage: 50
+`,
+			wantArgs: &config.PodreschedulingArgs{
+				ScheduledHostsAnnotation: "example.com/failed-nodes",
+				AvoidanceMode:            "hard",
+				Fallback:                 config.FallbackNone,
+				MaxExcludedPercentage:    50,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			obj, _, err := schedscheme.Codecs.UniversalDecoder().Decode([]byte(test.data), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, ok := obj.(*schedconfig.KubeSchedulerConfiguration)
+			if !ok {
+				t.Fatalf("test decoded %T, want KubeSchedulerConfiguration", obj)
+			}
+			var gotArgs runtime.Object
+			for _, pluginConfig := range cfg.Profiles[0].PluginConfig {
+				if pluginConfig.Name == "Podrescheduling" {
+					gotArgs = pluginConfig.Args
+				}
+			}
+			if diff := cmp.Diff(test.wantArgs, gotArgs); diff != "" {
+				t.Errorf("unexpected args (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
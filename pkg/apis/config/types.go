@@ -0,0 +1,40 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package config
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// FallbackRelax relaxes the exclusions one by one in PostFilter when no node fits the pod
+	FallbackRelax = "Relax"
+	// FallbackIgnore ignores all the exclusions when all the nodes are excluded, the nodes are still scored lower
+	FallbackIgnore = "Ignore"
+	// FallbackNone keeps the pod pending when no node fits the pod
+	FallbackNone = "None"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PodreschedulingArgs holds the arguments used to configure the Podrescheduling plugin
+type PodreschedulingArgs struct {
+	metav1.TypeMeta
+
+	// ScheduledHostsAnnotation is the pod annotation holding the nodes the pod failed on
+	ScheduledHostsAnnotation string
+	// AvoidanceMode is the avoidance mode of the pods without kse.com/avoidance-mode, hard or soft
+	AvoidanceMode string
+	// Fallback is what to do when no node fits the pod because of the exclusions, Relax, Ignore or None
+	Fallback string
+	// MaxExcludedPercentage is the max percentage of the nodes excluded for a pod, the least failed nodes are
+	// not excluded beyond it
+	MaxExcludedPercentage int32
+}
@@ -0,0 +1,40 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package v1beta3
+
+import (
+	"k8s.io/apimachinery/pkg/conversion"
+	"kse/kse-rescheduler/pkg/apis/config"
+)
+
+func Convert_v1beta3_PodreschedulingArgs_To_config_PodreschedulingArgs(in *PodreschedulingArgs, out *config.PodreschedulingArgs, s conversion.Scope) error {
+	if in.ScheduledHostsAnnotation != nil {
+		out.ScheduledHostsAnnotation = *in.ScheduledHostsAnnotation
+	}
+	if in.AvoidanceMode != nil {
+		out.AvoidanceMode = *in.AvoidanceMode
+	}
+	if in.Fallback != nil {
+		out.Fallback = *in.Fallback
+	}
+	if in.MaxExcludedPercentage != nil {
+		out.MaxExcludedPercentage = *in.MaxExcludedPercentage
+	}
+	return nil
+}
+
+func Convert_config_PodreschedulingArgs_To_v1beta3_PodreschedulingArgs(in *config.PodreschedulingArgs, out *PodreschedulingArgs, s conversion.Scope) error {
+	scheduledHostsAnnotation, avoidanceMode, fallback, maxExcludedPercentage := in.ScheduledHostsAnnotation, in.AvoidanceMode, in.Fallback, in.MaxExcludedPercentage
+	out.ScheduledHostsAnnotation = &scheduledHostsAnnotation
+	out.AvoidanceMode = &avoidanceMode
+	out.Fallback = &fallback
+	out.MaxExcludedPercentage = &maxExcludedPercentage
+	return nil
+}
@@ -0,0 +1,38 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package v1beta3
+
+import (
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/apis/config"
+)
+
+var (
+	defaultScheduledHostsAnnotation       = pkg.SchedulinedHostString
+	defaultAvoidanceMode                  = pkg.AvoidanceModeHard
+	defaultFallback                       = config.FallbackRelax
+	defaultMaxExcludedPercentage    int32 = 100
+)
+
+// SetDefaults_PodreschedulingArgs sets the default parameters for the Podrescheduling plugin
+func SetDefaults_PodreschedulingArgs(obj *PodreschedulingArgs) {
+	if obj.ScheduledHostsAnnotation == nil {
+		obj.ScheduledHostsAnnotation = &defaultScheduledHostsAnnotation
+	}
+	if obj.AvoidanceMode == nil {
+		obj.AvoidanceMode = &defaultAvoidanceMode
+	}
+	if obj.Fallback == nil {
+		obj.Fallback = &defaultFallback
+	}
+	if obj.MaxExcludedPercentage == nil {
+		obj.MaxExcludedPercentage = &defaultMaxExcludedPercentage
+	}
+}
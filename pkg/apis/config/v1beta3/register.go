@@ -0,0 +1,54 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package v1beta3
+
+import (
+	"k8s.io/apimachinery/pkg/conversion"
+	"k8s.io/apimachinery/pkg/runtime"
+	schedv1beta3 "k8s.io/kube-scheduler/config/v1beta3"
+	"kse/kse-rescheduler/pkg/apis/config"
+)
+
+// SchemeGroupVersion is the v1beta3 version of the kube-scheduler configuration
+var SchemeGroupVersion = schedv1beta3.SchemeGroupVersion
+
+var (
+	SchemeBuilder = runtime.NewSchemeBuilder(addKnownTypes, addDefaultingFuncs, addConversionFuncs)
+	// AddToScheme registers the v1beta3 plugin args with their defaulting and conversion to a scheme
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func init() {
+	// kube-scheduler converts the plugin args with its own scheme built from the in-tree scheme builder
+	schedv1beta3.SchemeBuilder.Register(addKnownTypes, addDefaultingFuncs, addConversionFuncs)
+}
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(SchemeGroupVersion, &PodreschedulingArgs{})
+	return nil
+}
+
+func addDefaultingFuncs(scheme *runtime.Scheme) error {
+	scheme.AddTypeDefaultingFunc(&PodreschedulingArgs{}, func(obj interface{}) {
+		SetDefaults_PodreschedulingArgs(obj.(*PodreschedulingArgs))
+	})
+	return nil
+}
+
+func addConversionFuncs(scheme *runtime.Scheme) error {
+	if err := scheme.AddConversionFunc((*PodreschedulingArgs)(nil), (*config.PodreschedulingArgs)(nil), func(a, b interface{}, scope conversion.Scope) error {
+		return Convert_v1beta3_PodreschedulingArgs_To_config_PodreschedulingArgs(a.(*PodreschedulingArgs), b.(*config.PodreschedulingArgs), scope)
+	}); err != nil {
+		return err
+	}
+	return scheme.AddConversionFunc((*config.PodreschedulingArgs)(nil), (*PodreschedulingArgs)(nil), func(a, b interface{}, scope conversion.Scope) error {
+		return Convert_config_PodreschedulingArgs_To_v1beta3_PodreschedulingArgs(a.(*config.PodreschedulingArgs), b.(*PodreschedulingArgs), scope)
+	})
+}
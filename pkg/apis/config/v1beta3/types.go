@@ -0,0 +1,30 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package v1beta3
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PodreschedulingArgs holds the arguments used to configure the Podrescheduling plugin
+type PodreschedulingArgs struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ScheduledHostsAnnotation is the pod annotation holding the nodes the pod failed on, default kse.com/scheduled-hosts
+	ScheduledHostsAnnotation *string `json:"scheduledHostsAnnotation,omitempty"`
+	// AvoidanceMode is the avoidance mode of the pods without kse.com/avoidance-mode, hard (default) or soft
+	AvoidanceMode *string `json:"avoidanceMode,omitempty"`
+	// Fallback is what to do when no node fits the pod because of the exclusions, Relax (default), Ignore or None
+	Fallback *string `json:"fallback,omitempty"`
+	// MaxExcludedPercentage is the max percentage of the nodes excluded for a pod, default 100
+	MaxExcludedPercentage *int32 `json:"maxExcludedPercentage,omitempty"`
+}
@@ -0,0 +1,47 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package validation
+
+import (
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/apis/config"
+)
+
+var (
+	validAvoidanceModes = []string{pkg.AvoidanceModeHard, pkg.AvoidanceModeSoft}
+	validFallbacks      = []string{config.FallbackRelax, config.FallbackIgnore, config.FallbackNone}
+)
+
+// ValidatePodreschedulingArgs validates the args of the Podrescheduling plugin
+func ValidatePodreschedulingArgs(path *field.Path, args *config.PodreschedulingArgs) error {
+	var allErrs field.ErrorList
+	allErrs = append(allErrs, metav1validation.ValidateLabelName(args.ScheduledHostsAnnotation, path.Child("scheduledHostsAnnotation"))...)
+	if !contains(validAvoidanceModes, args.AvoidanceMode) {
+		allErrs = append(allErrs, field.NotSupported(path.Child("avoidanceMode"), args.AvoidanceMode, validAvoidanceModes))
+	}
+	if !contains(validFallbacks, args.Fallback) {
+		allErrs = append(allErrs, field.NotSupported(path.Child("fallback"), args.Fallback, validFallbacks))
+	}
+	if args.MaxExcludedPercentage < 0 || args.MaxExcludedPercentage > 100 {
+		allErrs = append(allErrs, field.Invalid(path.Child("maxExcludedPercentage"), args.MaxExcludedPercentage, "must be in the range [0, 100]"))
+	}
+	return allErrs.ToAggregate()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package validation
+
+import (
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"kse/kse-rescheduler/pkg/apis/config"
+	"testing"
+)
+
+func TestValidatePodreschedulingArgs(t *testing.T) {
+	valid := config.PodreschedulingArgs{
+		ScheduledHostsAnnotation: "kse.com/scheduled-hosts",
+		AvoidanceMode:            "hard",
+		Fallback:                 config.FallbackRelax,
+		MaxExcludedPercentage:    100,
+	}
+	tests := []struct {
+		name    string
+		edit    func(args *config.PodreschedulingArgs)
+		wantErr string
+	}{
+		{
+			name: "valid args",
+			edit: func(args *config.PodreschedulingArgs) {},
+		},
+		{
+			name: "invalid annotation",
+			edit: func(args *config.PodreschedulingArgs) {
+				args.ScheduledHostsAnnotation = "kse.com/scheduled hosts"
+			},
+			wantErr: `args.scheduledHostsAnnotation: Invalid value: "kse.com/scheduled hosts": name part must consist of alphanumeric characters, '-', '_' or '.', and must start and end with an alphanumeric character (e.g. 'MyName',  or 'my.name',  or '123-abc', regex used for validation is '([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9]')`,
+		},
+		{
+			name: "unsupported avoidance mode",
+			edit: func(args *config.PodreschedulingArgs) {
+				args.AvoidanceMode = "strict"
+			},
+			wantErr: `args.avoidanceMode: Unsupported value: "strict": supported values: "hard", "soft"`,
+		},
+		{
+			name: "unsupported fallback",
+			edit: func(args *config.PodreschedulingArgs) {
+				args.Fallback = "Evict"
+			},
+			wantErr: `args.fallback: Unsupported value: "Evict": supported values: "Relax", "Ignore", "None"`,
+		},
+		{
+			name: "max excluded percentage out of range",
+			edit: func(args *config.PodreschedulingArgs) {
+				args.MaxExcludedPercentage = 120
+			},
+			wantErr: `args.maxExcludedPercentage: Invalid value: 120: must be in the range [0, 100]`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := valid
+			test.edit(&args)
+			err := ValidatePodreschedulingArgs(field.NewPath("args"), &args)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != test.wantErr {
+				t.Errorf("test returned wrong err: got %v want %v", gotErr, test.wantErr)
+			}
+		})
+	}
+}
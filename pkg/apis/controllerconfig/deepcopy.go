@@ -0,0 +1,61 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package controllerconfig
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func (in *KseReschedulerConfiguration) DeepCopyInto(out *KseReschedulerConfiguration) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	if in.ExcludedNamespaces != nil {
+		in, out := &in.ExcludedNamespaces, &out.ExcludedNamespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	out.ClientConnection = in.ClientConnection
+	out.LeaderElection = in.LeaderElection
+	in.Webhook.DeepCopyInto(&out.Webhook)
+}
+
+func (in *KseReschedulerConfiguration) DeepCopy() *KseReschedulerConfiguration {
+	if in == nil {
+		return nil
+	}
+	out := new(KseReschedulerConfiguration)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *KseReschedulerConfiguration) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+func (in *WebhookConfiguration) DeepCopyInto(out *WebhookConfiguration) {
+	*out = *in
+	if in.StateEditors != nil {
+		in, out := &in.StateEditors, &out.StateEditors
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+func (in *WebhookConfiguration) DeepCopy() *WebhookConfiguration {
+	if in == nil {
+		return nil
+	}
+	out := new(WebhookConfiguration)
+	in.DeepCopyInto(out)
+	return out
+}
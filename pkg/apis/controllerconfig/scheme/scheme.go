@@ -0,0 +1,50 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package scheme
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"kse/kse-rescheduler/pkg/apis/controllerconfig"
+	"kse/kse-rescheduler/pkg/apis/controllerconfig/v1alpha1"
+)
+
+var (
+	// Scheme is the scheme of the kse-rescheduler controller configuration
+	Scheme = runtime.NewScheme()
+	// Codecs decodes the configuration strictly, the unknown and duplicated fields are errors
+	Codecs = serializer.NewCodecFactory(Scheme, serializer.EnableStrict)
+)
+
+func init() {
+	AddToScheme(Scheme)
+}
+
+// AddToScheme registers the controller configuration of all the versions to a scheme
+func AddToScheme(scheme *runtime.Scheme) {
+	utilruntime.Must(controllerconfig.AddToScheme(scheme))
+	utilruntime.Must(v1alpha1.AddToScheme(scheme))
+	utilruntime.Must(scheme.SetVersionPriority(v1alpha1.SchemeGroupVersion))
+}
+
+// Decode decodes a configuration file of any version into the defaulted internal configuration
+func Decode(data []byte) (*controllerconfig.KseReschedulerConfiguration, error) {
+	obj, gvk, err := Codecs.UniversalDecoder().Decode(data, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	cfg, ok := obj.(*controllerconfig.KseReschedulerConfiguration)
+	if !ok {
+		return nil, fmt.Errorf("couldn't decode %v as KseReschedulerConfiguration", gvk)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,142 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package scheme
+
+import (
+	"github.com/google/go-cmp/cmp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	componentbaseconfig "k8s.io/component-base/config"
+	"kse/kse-rescheduler/pkg/apis/controllerconfig"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecode(t *testing.T) {
+	defaultLeaderElection := componentbaseconfig.LeaderElectionConfiguration{
+		LeaderElect:   true,
+		LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+		RenewDeadline: metav1.Duration{Duration: 10 * time.Second},
+		RetryPeriod:   metav1.Duration{Duration: 2 * time.Second},
+		ResourceLock:  "leases",
+		ResourceName:  "kse-rescheduler",
+	}
+	tests := []struct {
+		name    string
+		data    string
+		wantCfg *controllerconfig.KseReschedulerConfiguration
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			data: `
+apiVersion: kserescheduler.config.kse.com/v1alpha1
+kind: KseReschedulerConfiguration
+`,
+			wantCfg: &controllerconfig.KseReschedulerConfiguration{
+				ListFuncPeriod:     metav1.Duration{Duration: 30 * time.Second},
+				GCPeriod:           metav1.Duration{Duration: 10 * time.Minute},
+				ReschedulingWindow: metav1.Duration{Duration: 30 * time.Minute},
+				ClientConnection:   componentbaseconfig.ClientConnectionConfiguration{QPS: 50, Burst: 100},
+				LeaderElection:     defaultLeaderElection,
+				Webhook: controllerconfig.WebhookConfiguration{
+					RequestTimeout:      metav1.Duration{Duration: 5 * time.Second},
+					FailOpen:            true,
+					StateEditors:        []string{"system:kube-scheduler", "system:serviceaccount:kube-system:deployment-controller", "system:kube-controller-manager"},
+					AuthorizeStateEdits: true,
+				},
+			},
+		},
+		{
+			name: "all the fields",
+			data: `
+apiVersion: kserescheduler.config.kse.com/v1alpha1
+kind: KseReschedulerConfiguration
+listFuncPeriod: 1m
+gcPeriod: 1h
+excludedNamespaces: [kube-system]
+reschedulingWindow: 2h
+maxReschedulesPerPeriod: 10
+evictPods: true
+clientConnection:
+  qps: 20
+  burst: 40
+leaderElection:
+  leaderElect: false
+  resourceNamespace: kse-rescheduler
+webhook:
+  requestTimeout: 3s
+  failOpen: false
+  nodeAffinityMode: preferred
+  schedulerName: kse-scheduler
+  stateEditors: [system:kube-scheduler]
+  authorizeStateEdits: false
+`,
+			wantCfg: &controllerconfig.KseReschedulerConfiguration{
+				ListFuncPeriod:          metav1.Duration{Duration: time.Minute},
+				GCPeriod:                metav1.Duration{Duration: time.Hour},
+				ExcludedNamespaces:      []string{"kube-system"},
+				ReschedulingWindow:      metav1.Duration{Duration: 2 * time.Hour},
+				MaxReschedulesPerPeriod: 10,
+				EvictPods:               true,
+				ClientConnection:        componentbaseconfig.ClientConnectionConfiguration{QPS: 20, Burst: 40},
+				LeaderElection: componentbaseconfig.LeaderElectionConfiguration{
+					LeaderElect:       false,
+					LeaseDuration:     metav1.Duration{Duration: 15 * time.Second},
+					RenewDeadline:     metav1.Duration{Duration: 10 * time.Second},
+					RetryPeriod:       metav1.Duration{Duration: 2 * time.Second},
+					ResourceLock:      "leases",
+					ResourceName:      "kse-rescheduler",
+					ResourceNamespace: "kse-rescheduler",
+				},
+				Webhook: controllerconfig.WebhookConfiguration{
+					RequestTimeout:   metav1.Duration{Duration: 3 * time.Second},
+					NodeAffinityMode: "preferred",
+					SchedulerName:    "kse-scheduler",
+					StateEditors:     []string{"system:kube-scheduler"},
+				},
+			},
+		},
+		{
+			name: "unknown field",
+			data: `
+apiVersion: kserescheduler.config.kse.com/v1alpha1
+kind: KseReschedulerConfiguration
+listFuncPeriods: 1m
+`,
+			wantErr: `unknown field "listFuncPeriods"`,
+		},
+		{
+			name: "unknown version",
+			data: `
+apiVersion: kserescheduler.config.kse.com/v1
+kind: KseReschedulerConfiguration
+`,
+			wantErr: `no kind "KseReschedulerConfiguration" is registered for version "kserescheduler.config.kse.com/v1"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := Decode([]byte(test.data))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Decode returned err %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.wantCfg, cfg); diff != "" {
+				t.Errorf("unexpected configuration (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package controllerconfig
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	componentbaseconfig "k8s.io/component-base/config"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// KseReschedulerConfiguration configures the kse-rescheduler controller and its webhooks
+type KseReschedulerConfiguration struct {
+	metav1.TypeMeta
+
+	// ListFuncPeriod is the period of the listFunc rescheduling the terminated or crashloopbackoff pods
+	ListFuncPeriod metav1.Duration
+	// GCPeriod is the period of the gc pruning the stale kse.com state of workloads and pods
+	GCPeriod metav1.Duration
+	// ExcludedNamespaces are the namespaces whose pods are never rescheduled
+	ExcludedNamespaces []string
+	// ReschedulingWindow is how long after its creation a failed pod is rescheduled away from the nodes it failed on,
+	// the older pods are recreated without the exclusions
+	ReschedulingWindow metav1.Duration
+	// MaxReschedulesPerPeriod bounds the pods the listFunc deletes or recreates in a period, 0 is unlimited
+	MaxReschedulesPerPeriod int32
+	// EvictPods evicts the pods the listFunc reschedules instead of deleting them, so their PodDisruptionBudgets are
+	// respected, the pods a budget doesn't allow evicting are retried in the next periods
+	EvictPods bool
+	// ClientConnection configures the client of the api server, its changes are applied on restart
+	ClientConnection componentbaseconfig.ClientConnectionConfiguration
+	// LeaderElection configures the election of the replica running the listFunc and the gc, its changes are applied
+	// on restart
+	LeaderElection componentbaseconfig.LeaderElectionConfiguration
+	// Webhook configures the mutating and the validating webhook
+	Webhook WebhookConfiguration
+}
+
+// WebhookConfiguration configures the mutating and the validating webhook
+type WebhookConfiguration struct {
+	// RequestTimeout bounds the lookups of an admission request, it should be shorter than the webhook's timeoutSeconds
+	RequestTimeout metav1.Duration
+	// FailOpen admits the pods unpatched if their rescheduling state can't be read, instead of rejecting them
+	FailOpen bool
+	// NodeAffinityMode injects the exclusions into the pods' nodeAffinity, required or preferred, it's off if empty
+	NodeAffinityMode string
+	// SchedulerName routes the pods with rescheduling history to the scheduler profile running Podrescheduling
+	SchedulerName string
+	// StateEditors are the users and groups allowed to edit the kse.com state annotations
+	StateEditors []string
+	// AuthorizeStateEdits allows the other users to edit the state annotations if a SubjectAccessReview allows them to
+	// update states.kse.com
+	AuthorizeStateEdits bool
+}
@@ -0,0 +1,86 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/conversion"
+	componentbaseconfigv1alpha1 "k8s.io/component-base/config/v1alpha1"
+	"kse/kse-rescheduler/pkg/apis/controllerconfig"
+)
+
+func Convert_v1alpha1_KseReschedulerConfiguration_To_controllerconfig_KseReschedulerConfiguration(in *KseReschedulerConfiguration, out *controllerconfig.KseReschedulerConfiguration, s conversion.Scope) error {
+	if in.ListFuncPeriod != nil {
+		out.ListFuncPeriod = *in.ListFuncPeriod
+	}
+	if in.GCPeriod != nil {
+		out.GCPeriod = *in.GCPeriod
+	}
+	out.ExcludedNamespaces = append([]string(nil), in.ExcludedNamespaces...)
+	if in.ReschedulingWindow != nil {
+		out.ReschedulingWindow = *in.ReschedulingWindow
+	}
+	if in.MaxReschedulesPerPeriod != nil {
+		out.MaxReschedulesPerPeriod = *in.MaxReschedulesPerPeriod
+	}
+	if in.EvictPods != nil {
+		out.EvictPods = *in.EvictPods
+	}
+	if err := componentbaseconfigv1alpha1.Convert_v1alpha1_ClientConnectionConfiguration_To_config_ClientConnectionConfiguration(&in.ClientConnection, &out.ClientConnection, s); err != nil {
+		return err
+	}
+	if err := componentbaseconfigv1alpha1.Convert_v1alpha1_LeaderElectionConfiguration_To_config_LeaderElectionConfiguration(&in.LeaderElection, &out.LeaderElection, s); err != nil {
+		return err
+	}
+	return Convert_v1alpha1_WebhookConfiguration_To_controllerconfig_WebhookConfiguration(&in.Webhook, &out.Webhook, s)
+}
+
+func Convert_controllerconfig_KseReschedulerConfiguration_To_v1alpha1_KseReschedulerConfiguration(in *controllerconfig.KseReschedulerConfiguration, out *KseReschedulerConfiguration, s conversion.Scope) error {
+	listFuncPeriod, gcPeriod, reschedulingWindow, maxReschedulesPerPeriod, evictPods := in.ListFuncPeriod, in.GCPeriod, in.ReschedulingWindow, in.MaxReschedulesPerPeriod, in.EvictPods
+	out.ListFuncPeriod = &listFuncPeriod
+	out.GCPeriod = &gcPeriod
+	out.ExcludedNamespaces = append([]string(nil), in.ExcludedNamespaces...)
+	out.ReschedulingWindow = &reschedulingWindow
+	out.MaxReschedulesPerPeriod = &maxReschedulesPerPeriod
+	out.EvictPods = &evictPods
+	if err := componentbaseconfigv1alpha1.Convert_config_ClientConnectionConfiguration_To_v1alpha1_ClientConnectionConfiguration(&in.ClientConnection, &out.ClientConnection, s); err != nil {
+		return err
+	}
+	if err := componentbaseconfigv1alpha1.Convert_config_LeaderElectionConfiguration_To_v1alpha1_LeaderElectionConfiguration(&in.LeaderElection, &out.LeaderElection, s); err != nil {
+		return err
+	}
+	return Convert_controllerconfig_WebhookConfiguration_To_v1alpha1_WebhookConfiguration(&in.Webhook, &out.Webhook, s)
+}
+
+func Convert_v1alpha1_WebhookConfiguration_To_controllerconfig_WebhookConfiguration(in *WebhookConfiguration, out *controllerconfig.WebhookConfiguration, s conversion.Scope) error {
+	if in.RequestTimeout != nil {
+		out.RequestTimeout = *in.RequestTimeout
+	}
+	if in.FailOpen != nil {
+		out.FailOpen = *in.FailOpen
+	}
+	out.NodeAffinityMode = in.NodeAffinityMode
+	out.SchedulerName = in.SchedulerName
+	out.StateEditors = append([]string(nil), in.StateEditors...)
+	if in.AuthorizeStateEdits != nil {
+		out.AuthorizeStateEdits = *in.AuthorizeStateEdits
+	}
+	return nil
+}
+
+func Convert_controllerconfig_WebhookConfiguration_To_v1alpha1_WebhookConfiguration(in *controllerconfig.WebhookConfiguration, out *WebhookConfiguration, s conversion.Scope) error {
+	requestTimeout, failOpen, authorizeStateEdits := in.RequestTimeout, in.FailOpen, in.AuthorizeStateEdits
+	out.RequestTimeout = &requestTimeout
+	out.FailOpen = &failOpen
+	out.NodeAffinityMode = in.NodeAffinityMode
+	out.SchedulerName = in.SchedulerName
+	out.StateEditors = append([]string(nil), in.StateEditors...)
+	out.AuthorizeStateEdits = &authorizeStateEdits
+	return nil
+}
@@ -0,0 +1,102 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func (in *KseReschedulerConfiguration) DeepCopyInto(out *KseReschedulerConfiguration) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	if in.ListFuncPeriod != nil {
+		in, out := &in.ListFuncPeriod, &out.ListFuncPeriod
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.GCPeriod != nil {
+		in, out := &in.GCPeriod, &out.GCPeriod
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.ExcludedNamespaces != nil {
+		in, out := &in.ExcludedNamespaces, &out.ExcludedNamespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ReschedulingWindow != nil {
+		in, out := &in.ReschedulingWindow, &out.ReschedulingWindow
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.MaxReschedulesPerPeriod != nil {
+		in, out := &in.MaxReschedulesPerPeriod, &out.MaxReschedulesPerPeriod
+		*out = new(int32)
+		**out = **in
+	}
+	if in.EvictPods != nil {
+		in, out := &in.EvictPods, &out.EvictPods
+		*out = new(bool)
+		**out = **in
+	}
+	out.ClientConnection = in.ClientConnection
+	in.LeaderElection.DeepCopyInto(&out.LeaderElection)
+	in.Webhook.DeepCopyInto(&out.Webhook)
+}
+
+func (in *KseReschedulerConfiguration) DeepCopy() *KseReschedulerConfiguration {
+	if in == nil {
+		return nil
+	}
+	out := new(KseReschedulerConfiguration)
+	in.DeepCopyInto(out)
+	return out
+}
+
+func (in *KseReschedulerConfiguration) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+func (in *WebhookConfiguration) DeepCopyInto(out *WebhookConfiguration) {
+	*out = *in
+	if in.RequestTimeout != nil {
+		in, out := &in.RequestTimeout, &out.RequestTimeout
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.FailOpen != nil {
+		in, out := &in.FailOpen, &out.FailOpen
+		*out = new(bool)
+		**out = **in
+	}
+	if in.StateEditors != nil {
+		in, out := &in.StateEditors, &out.StateEditors
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AuthorizeStateEdits != nil {
+		in, out := &in.AuthorizeStateEdits, &out.AuthorizeStateEdits
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+func (in *WebhookConfiguration) DeepCopy() *WebhookConfiguration {
+	if in == nil {
+		return nil
+	}
+	out := new(WebhookConfiguration)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,90 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	componentbaseconfigv1alpha1 "k8s.io/component-base/config/v1alpha1"
+	"kse/kse-rescheduler/pkg"
+	"time"
+)
+
+var (
+	defaultListFuncPeriod                = metav1.Duration{Duration: 30 * time.Second}
+	defaultGCPeriod                      = metav1.Duration{Duration: 10 * time.Minute}
+	defaultMaxReschedulesPerPeriod int32 = 0
+	defaultEvictPods                     = false
+	defaultQPS                     float32 = 50
+	defaultBurst                   int32 = 100
+	defaultRequestTimeout                = metav1.Duration{Duration: 5 * time.Second}
+	defaultFailOpen                      = true
+	defaultAuthorizeStateEdits           = true
+)
+
+// SetDefaults_KseReschedulerConfiguration sets the default parameters of the kse-rescheduler controller
+func SetDefaults_KseReschedulerConfiguration(obj *KseReschedulerConfiguration) {
+	if obj.ListFuncPeriod == nil {
+		obj.ListFuncPeriod = &defaultListFuncPeriod
+	}
+	if obj.GCPeriod == nil {
+		obj.GCPeriod = &defaultGCPeriod
+	}
+	if obj.ReschedulingWindow == nil {
+		window, _ := time.ParseDuration(pkg.OutOfTimeToRescheduling)
+		obj.ReschedulingWindow = &metav1.Duration{Duration: window}
+	}
+	if obj.MaxReschedulesPerPeriod == nil {
+		obj.MaxReschedulesPerPeriod = &defaultMaxReschedulesPerPeriod
+	}
+	if obj.EvictPods == nil {
+		obj.EvictPods = &defaultEvictPods
+	}
+	if obj.ClientConnection.QPS == 0 {
+		obj.ClientConnection.QPS = defaultQPS
+	}
+	if obj.ClientConnection.Burst == 0 {
+		obj.ClientConnection.Burst = defaultBurst
+	}
+	if obj.LeaderElection.ResourceLock == "" {
+		obj.LeaderElection.ResourceLock = resourcelock.LeasesResourceLock
+	}
+	if obj.LeaderElection.ResourceName == "" {
+		obj.LeaderElection.ResourceName = "kse-rescheduler"
+	}
+	zero := metav1.Duration{}
+	if obj.LeaderElection.LeaseDuration == zero {
+		obj.LeaderElection.LeaseDuration = metav1.Duration{Duration: pkg.LeaseDuration}
+	}
+	if obj.LeaderElection.RenewDeadline == zero {
+		obj.LeaderElection.RenewDeadline = metav1.Duration{Duration: pkg.RenewDeadlineDuration}
+	}
+	if obj.LeaderElection.RetryPeriod == zero {
+		obj.LeaderElection.RetryPeriod = metav1.Duration{Duration: pkg.RetryPeriod}
+	}
+	componentbaseconfigv1alpha1.RecommendedDefaultLeaderElectionConfiguration(&obj.LeaderElection)
+	SetDefaults_WebhookConfiguration(&obj.Webhook)
+}
+
+// SetDefaults_WebhookConfiguration sets the default parameters of the webhooks
+func SetDefaults_WebhookConfiguration(obj *WebhookConfiguration) {
+	if obj.RequestTimeout == nil {
+		obj.RequestTimeout = &defaultRequestTimeout
+	}
+	if obj.FailOpen == nil {
+		obj.FailOpen = &defaultFailOpen
+	}
+	if obj.StateEditors == nil {
+		obj.StateEditors = append([]string{}, pkg.DefaultStateEditors...)
+	}
+	if obj.AuthorizeStateEdits == nil {
+		obj.AuthorizeStateEdits = &defaultAuthorizeStateEdits
+	}
+}
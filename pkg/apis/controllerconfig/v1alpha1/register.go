@@ -0,0 +1,49 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/conversion"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"kse/kse-rescheduler/pkg/apis/controllerconfig"
+)
+
+// SchemeGroupVersion is the v1alpha1 version of the kse-rescheduler controller configuration
+var SchemeGroupVersion = schema.GroupVersion{Group: controllerconfig.GroupName, Version: "v1alpha1"}
+
+var (
+	SchemeBuilder = runtime.NewSchemeBuilder(addKnownTypes, addDefaultingFuncs, addConversionFuncs)
+	// AddToScheme registers the v1alpha1 controller configuration with its defaulting and conversion to a scheme
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(SchemeGroupVersion, &KseReschedulerConfiguration{})
+	return nil
+}
+
+func addDefaultingFuncs(scheme *runtime.Scheme) error {
+	scheme.AddTypeDefaultingFunc(&KseReschedulerConfiguration{}, func(obj interface{}) {
+		SetDefaults_KseReschedulerConfiguration(obj.(*KseReschedulerConfiguration))
+	})
+	return nil
+}
+
+func addConversionFuncs(scheme *runtime.Scheme) error {
+	if err := scheme.AddConversionFunc((*KseReschedulerConfiguration)(nil), (*controllerconfig.KseReschedulerConfiguration)(nil), func(a, b interface{}, scope conversion.Scope) error {
+		return Convert_v1alpha1_KseReschedulerConfiguration_To_controllerconfig_KseReschedulerConfiguration(a.(*KseReschedulerConfiguration), b.(*controllerconfig.KseReschedulerConfiguration), scope)
+	}); err != nil {
+		return err
+	}
+	return scheme.AddConversionFunc((*controllerconfig.KseReschedulerConfiguration)(nil), (*KseReschedulerConfiguration)(nil), func(a, b interface{}, scope conversion.Scope) error {
+		return Convert_controllerconfig_KseReschedulerConfiguration_To_v1alpha1_KseReschedulerConfiguration(a.(*controllerconfig.KseReschedulerConfiguration), b.(*KseReschedulerConfiguration), scope)
+	})
+}
@@ -0,0 +1,64 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	componentbaseconfigv1alpha1 "k8s.io/component-base/config/v1alpha1"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// KseReschedulerConfiguration configures the kse-rescheduler controller and its webhooks
+type KseReschedulerConfiguration struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ListFuncPeriod is the period of the listFunc rescheduling the terminated or crashloopbackoff pods, default 30s
+	ListFuncPeriod *metav1.Duration `json:"listFuncPeriod,omitempty"`
+	// GCPeriod is the period of the gc pruning the stale kse.com state of workloads and pods, default 10m
+	GCPeriod *metav1.Duration `json:"gcPeriod,omitempty"`
+	// ExcludedNamespaces are the namespaces whose pods are never rescheduled
+	ExcludedNamespaces []string `json:"excludedNamespaces,omitempty"`
+	// ReschedulingWindow is how long after its creation a failed pod is rescheduled away from the nodes it failed on,
+	// the older pods are recreated without the exclusions, default 30m
+	ReschedulingWindow *metav1.Duration `json:"reschedulingWindow,omitempty"`
+	// MaxReschedulesPerPeriod bounds the pods the listFunc deletes or recreates in a period, default 0 (unlimited)
+	MaxReschedulesPerPeriod *int32 `json:"maxReschedulesPerPeriod,omitempty"`
+	// EvictPods evicts the pods the listFunc reschedules instead of deleting them, so their PodDisruptionBudgets are
+	// respected, the pods are deleted if the api server doesn't serve pods/eviction, default false
+	EvictPods *bool `json:"evictPods,omitempty"`
+	// ClientConnection configures the client of the api server, default qps 50 and burst 100, its changes are applied
+	// on restart
+	ClientConnection componentbaseconfigv1alpha1.ClientConnectionConfiguration `json:"clientConnection"`
+	// LeaderElection configures the election of the replica running the listFunc and the gc, default the leases lock
+	// kse-rescheduler in the namespace of kse-rescheduler, its changes are applied on restart
+	LeaderElection componentbaseconfigv1alpha1.LeaderElectionConfiguration `json:"leaderElection"`
+	// Webhook configures the mutating and the validating webhook
+	Webhook WebhookConfiguration `json:"webhook"`
+}
+
+// WebhookConfiguration configures the mutating and the validating webhook
+type WebhookConfiguration struct {
+	// RequestTimeout bounds the lookups of an admission request, it should be shorter than the webhook's
+	// timeoutSeconds, default 5s
+	RequestTimeout *metav1.Duration `json:"requestTimeout,omitempty"`
+	// FailOpen admits the pods unpatched if their rescheduling state can't be read, default true
+	FailOpen *bool `json:"failOpen,omitempty"`
+	// NodeAffinityMode injects the exclusions into the pods' nodeAffinity, required or preferred, default "" (off)
+	NodeAffinityMode string `json:"nodeAffinityMode,omitempty"`
+	// SchedulerName routes the pods with rescheduling history to the scheduler profile running Podrescheduling
+	SchedulerName string `json:"schedulerName,omitempty"`
+	// StateEditors are the users and groups allowed to edit the kse.com state annotations, default system:kube-scheduler
+	// and the deployment controller, with or without kube-controller-manager's --use-service-account-credentials
+	StateEditors []string `json:"stateEditors,omitempty"`
+	// AuthorizeStateEdits allows the other users to edit the state annotations if a SubjectAccessReview allows them to
+	// update states.kse.com, default true
+	AuthorizeStateEdits *bool `json:"authorizeStateEdits,omitempty"`
+}
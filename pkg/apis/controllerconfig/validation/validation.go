@@ -0,0 +1,88 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package validation
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	componentbaseconfigvalidation "k8s.io/component-base/config/validation"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/apis/controllerconfig"
+	"strings"
+	"time"
+)
+
+var validNodeAffinityModes = []string{"", pkg.NodeAffinityModeRequired, pkg.NodeAffinityModePreferred}
+
+// ValidateKseReschedulerConfiguration validates the configuration of the kse-rescheduler controller
+func ValidateKseReschedulerConfiguration(cfg *controllerconfig.KseReschedulerConfiguration) error {
+	var allErrs field.ErrorList
+	allErrs = append(allErrs, validatePositive(field.NewPath("listFuncPeriod"), cfg.ListFuncPeriod.Duration)...)
+	allErrs = append(allErrs, validatePositive(field.NewPath("gcPeriod"), cfg.GCPeriod.Duration)...)
+	for i, namespace := range cfg.ExcludedNamespaces {
+		for _, msg := range validation.IsDNS1123Label(namespace) {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("excludedNamespaces").Index(i), namespace, msg))
+		}
+	}
+	allErrs = append(allErrs, validatePositive(field.NewPath("reschedulingWindow"), cfg.ReschedulingWindow.Duration)...)
+	if cfg.MaxReschedulesPerPeriod < 0 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("maxReschedulesPerPeriod"), cfg.MaxReschedulesPerPeriod, "must be non-negative"))
+	}
+	if cfg.ClientConnection.QPS < 0 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("clientConnection", "qps"), cfg.ClientConnection.QPS, "must be non-negative"))
+	}
+	allErrs = append(allErrs, componentbaseconfigvalidation.ValidateClientConnectionConfiguration(&cfg.ClientConnection, field.NewPath("clientConnection"))...)
+	// the lock is in the namespace of kse-rescheduler if resourceNamespace isn't set
+	leaderElection := cfg.LeaderElection
+	if leaderElection.ResourceNamespace == "" {
+		leaderElection.ResourceNamespace = pkg.NAMESPACE
+	}
+	allErrs = append(allErrs, componentbaseconfigvalidation.ValidateLeaderElectionConfiguration(&leaderElection, field.NewPath("leaderElection"))...)
+	allErrs = append(allErrs, validateWebhookConfiguration(field.NewPath("webhook"), &cfg.Webhook)...)
+	return allErrs.ToAggregate()
+}
+
+func validateWebhookConfiguration(path *field.Path, webhook *controllerconfig.WebhookConfiguration) field.ErrorList {
+	var allErrs field.ErrorList
+	allErrs = append(allErrs, validatePositive(path.Child("requestTimeout"), webhook.RequestTimeout.Duration)...)
+	if !contains(validNodeAffinityModes, webhook.NodeAffinityMode) {
+		allErrs = append(allErrs, field.NotSupported(path.Child("nodeAffinityMode"), webhook.NodeAffinityMode, validNodeAffinityModes))
+	}
+	if webhook.SchedulerName == corev1.DefaultSchedulerName {
+		allErrs = append(allErrs, field.Invalid(path.Child("schedulerName"), webhook.SchedulerName, "must be a profile other than the default scheduler"))
+	} else if webhook.SchedulerName != "" {
+		if errs := validation.IsDNS1123Subdomain(webhook.SchedulerName); len(errs) > 0 {
+			allErrs = append(allErrs, field.Invalid(path.Child("schedulerName"), webhook.SchedulerName, strings.Join(errs, ", ")))
+		}
+	}
+	for i, editor := range webhook.StateEditors {
+		if editor == "" {
+			allErrs = append(allErrs, field.Required(path.Child("stateEditors").Index(i), "must be a user or a group"))
+		}
+	}
+	return allErrs
+}
+
+func validatePositive(path *field.Path, d time.Duration) field.ErrorList {
+	if d <= 0 {
+		return field.ErrorList{field.Invalid(path, d.String(), "must be greater than zero")}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
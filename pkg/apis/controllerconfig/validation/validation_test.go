@@ -0,0 +1,122 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package validation
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	componentbaseconfig "k8s.io/component-base/config"
+	"kse/kse-rescheduler/pkg/apis/controllerconfig"
+	"testing"
+	"time"
+)
+
+func TestValidateKseReschedulerConfiguration(t *testing.T) {
+	valid := func() *controllerconfig.KseReschedulerConfiguration {
+		return &controllerconfig.KseReschedulerConfiguration{
+			ListFuncPeriod:     metav1.Duration{Duration: 30 * time.Second},
+			GCPeriod:           metav1.Duration{Duration: 10 * time.Minute},
+			ExcludedNamespaces: []string{"kube-system"},
+			ReschedulingWindow: metav1.Duration{Duration: 30 * time.Minute},
+			ClientConnection:   componentbaseconfig.ClientConnectionConfiguration{QPS: 50, Burst: 100},
+			LeaderElection: componentbaseconfig.LeaderElectionConfiguration{
+				LeaderElect:   true,
+				LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+				RenewDeadline: metav1.Duration{Duration: 10 * time.Second},
+				RetryPeriod:   metav1.Duration{Duration: 2 * time.Second},
+				ResourceLock:  "leases",
+				ResourceName:  "kse-rescheduler",
+			},
+			Webhook: controllerconfig.WebhookConfiguration{
+				RequestTimeout: metav1.Duration{Duration: 5 * time.Second},
+				FailOpen:       true,
+				StateEditors:   []string{"system:kube-scheduler"},
+			},
+		}
+	}
+	tests := []struct {
+		name    string
+		edit    func(cfg *controllerconfig.KseReschedulerConfiguration)
+		wantErr string
+	}{
+		{
+			name: "valid configuration",
+			edit: func(cfg *controllerconfig.KseReschedulerConfiguration) {},
+		},
+		{
+			name: "zero list period",
+			edit: func(cfg *controllerconfig.KseReschedulerConfiguration) {
+				cfg.ListFuncPeriod.Duration = 0
+			},
+			wantErr: `listFuncPeriod: Invalid value: "0s": must be greater than zero`,
+		},
+		{
+			name: "invalid excluded namespace",
+			edit: func(cfg *controllerconfig.KseReschedulerConfiguration) {
+				cfg.ExcludedNamespaces = []string{"kube_system"}
+			},
+			wantErr: `excludedNamespaces[0]: Invalid value: "kube_system": a lowercase RFC 1123 label must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character (e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?')`,
+		},
+		{
+			name: "negative max reschedules",
+			edit: func(cfg *controllerconfig.KseReschedulerConfiguration) {
+				cfg.MaxReschedulesPerPeriod = -1
+			},
+			wantErr: `maxReschedulesPerPeriod: Invalid value: -1: must be non-negative`,
+		},
+		{
+			name: "lease shorter than the renew deadline",
+			edit: func(cfg *controllerconfig.KseReschedulerConfiguration) {
+				cfg.LeaderElection.LeaseDuration.Duration = 5 * time.Second
+			},
+			wantErr: `leaderElection.leaseDuration: Invalid value: v1.Duration{Duration:10000000000}: LeaseDuration must be greater than RenewDeadline`,
+		},
+		{
+			name: "leader election disabled",
+			edit: func(cfg *controllerconfig.KseReschedulerConfiguration) {
+				cfg.LeaderElection = componentbaseconfig.LeaderElectionConfiguration{}
+			},
+		},
+		{
+			name: "unsupported node affinity mode",
+			edit: func(cfg *controllerconfig.KseReschedulerConfiguration) {
+				cfg.Webhook.NodeAffinityMode = "strict"
+			},
+			wantErr: `webhook.nodeAffinityMode: Unsupported value: "strict": supported values: "", "required", "preferred"`,
+		},
+		{
+			name: "default scheduler",
+			edit: func(cfg *controllerconfig.KseReschedulerConfiguration) {
+				cfg.Webhook.SchedulerName = "default-scheduler"
+			},
+			wantErr: `webhook.schedulerName: Invalid value: "default-scheduler": must be a profile other than the default scheduler`,
+		},
+		{
+			name: "empty state editor",
+			edit: func(cfg *controllerconfig.KseReschedulerConfiguration) {
+				cfg.Webhook.StateEditors = []string{""}
+			},
+			wantErr: `webhook.stateEditors[0]: Required value: must be a user or a group`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := valid()
+			test.edit(cfg)
+			err := ValidateKseReschedulerConfiguration(cfg)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != test.wantErr {
+				t.Errorf("test returned wrong err: got %v want %v", gotErr, test.wantErr)
+			}
+		})
+	}
+}
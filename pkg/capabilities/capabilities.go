@@ -0,0 +1,144 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package capabilities
+
+import (
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilversion "k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/discovery"
+	"k8s.io/klog/v2"
+	"strings"
+)
+
+const (
+	CronJobV1              = "batch/v1"
+	CronJobV1beta1         = "batch/v1beta1"
+	EvictionV1             = "policy/v1"
+	EvictionV1beta1        = "policy/v1beta1"
+	AdmissionReviewV1      = "v1"
+	AdmissionReviewV1beta1 = "v1beta1"
+)
+
+// podFailurePolicyVersion is the first version the Jobs have the podFailurePolicy in
+var podFailurePolicyVersion = utilversion.MustParseGeneric("1.25")
+
+// Capabilities are the APIs the api server serves, they are detected by discovery at startup so kse-rescheduler runs
+// on the older servers too, the features whose APIs are missing are degraded
+type Capabilities struct {
+	// ServerVersion is the git version of the api server
+	ServerVersion string `json:"serverVersion"`
+	// CronJobGroupVersion is the version the CronJobs are read and written in, batch/v1 or batch/v1beta1, the CronJobs
+	// aren't rescheduled if it's empty
+	CronJobGroupVersion string `json:"cronJobGroupVersion"`
+	// EvictionGroupVersion is the version of the pods/eviction subresource, policy/v1 or policy/v1beta1, the pods are
+	// evicted in it with evictPods. It's empty if the pods can't be evicted, they are deleted then
+	EvictionGroupVersion string `json:"evictionGroupVersion"`
+	// AdmissionReviewVersions are the versions of the AdmissionReview the webhooks may be called with, the preferred one
+	// first, the chart renders the webhooks' admissionReviewVersions by the same check. AdmissionRegistrationV1 is true
+	// if the webhook configurations are served in admissionregistration.k8s.io/v1, the webhook certificates can't be
+	// managed without it
+	AdmissionReviewVersions []string `json:"admissionReviewVersions"`
+	AdmissionRegistrationV1 bool     `json:"admissionRegistrationV1"`
+	// PodFailurePolicy is true if the Jobs may have a podFailurePolicy, it isn't read on the older servers
+	PodFailurePolicy bool `json:"podFailurePolicy"`
+}
+
+// Default are the capabilities of the servers kse-rescheduler is built for, they are used until the server is detected
+var Default = &Capabilities{
+	CronJobGroupVersion:     CronJobV1,
+	EvictionGroupVersion:    EvictionV1,
+	AdmissionReviewVersions: []string{AdmissionReviewV1, AdmissionReviewV1beta1},
+	AdmissionRegistrationV1: true,
+	PodFailurePolicy:        true,
+}
+
+// Detect reads the capabilities of the api server by discovery
+func Detect(client discovery.DiscoveryInterface) (*Capabilities, error) {
+	c := &Capabilities{}
+	info, err := client.ServerVersion()
+	if err != nil {
+		return nil, fmt.Errorf("get api server version err: %s", err.Error())
+	}
+	c.ServerVersion = info.GitVersion
+	if serverVersion, err := utilversion.ParseGeneric(info.GitVersion); err != nil {
+		// an unknown version is taken as a recent one, the missing fields are read as empty
+		klog.Errorf("parse api server version %q err: %s, the podFailurePolicy is read\n", info.GitVersion, err.Error())
+		c.PodFailurePolicy = true
+	} else {
+		c.PodFailurePolicy = serverVersion.AtLeast(podFailurePolicyVersion)
+	}
+
+	for _, groupVersion := range []string{CronJobV1, CronJobV1beta1} {
+		served, err := servesResource(client, groupVersion, "cronjobs")
+		if err != nil {
+			return nil, err
+		}
+		if served {
+			c.CronJobGroupVersion = groupVersion
+			break
+		}
+	}
+
+	core, err := client.ServerResourcesForGroupVersion("v1")
+	if err != nil {
+		return nil, fmt.Errorf("discover the resources of v1 err: %s", err.Error())
+	}
+	for _, resource := range core.APIResources {
+		if resource.Name == "pods/eviction" {
+			// the subresource is served in the version of the policy group the server prefers
+			c.EvictionGroupVersion = EvictionV1beta1
+			if resource.Group != "" && resource.Version != "" {
+				c.EvictionGroupVersion = resource.Group + "/" + resource.Version
+			}
+			break
+		}
+	}
+
+	c.AdmissionRegistrationV1, err = servesResource(client, "admissionregistration.k8s.io/v1", "mutatingwebhookconfigurations")
+	if err != nil {
+		return nil, err
+	}
+	c.AdmissionReviewVersions = []string{AdmissionReviewV1beta1}
+	if c.AdmissionRegistrationV1 {
+		c.AdmissionReviewVersions = []string{AdmissionReviewV1, AdmissionReviewV1beta1}
+	}
+	return c, nil
+}
+
+// servesResource is true if the api server serves the resource in the group version
+func servesResource(client discovery.DiscoveryInterface, groupVersion, resource string) (bool, error) {
+	resources, err := client.ServerResourcesForGroupVersion(groupVersion)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("discover the resources of %s err: %s", groupVersion, err.Error())
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// String describes the capabilities in the logs
+func (c *Capabilities) String() string {
+	cronJob, eviction := c.CronJobGroupVersion, c.EvictionGroupVersion
+	if cronJob == "" {
+		cronJob = "not served, the CronJobs aren't rescheduled"
+	}
+	if eviction == "" {
+		eviction = "not served, the pods are deleted"
+	}
+	return fmt.Sprintf("server %s, CronJob %s, Eviction %s, AdmissionReview %s, Job podFailurePolicy %v",
+		c.ServerVersion, cronJob, eviction, strings.Join(c.AdmissionReviewVersions, ","), c.PodFailurePolicy)
+}
@@ -0,0 +1,120 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package capabilities
+
+import (
+	"github.com/google/go-cmp/cmp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	resources := func(groupVersion string, names ...string) *metav1.APIResourceList {
+		list := &metav1.APIResourceList{GroupVersion: groupVersion}
+		for _, name := range names {
+			list.APIResources = append(list.APIResources, metav1.APIResource{Name: name})
+		}
+		return list
+	}
+	eviction := func(version string) *metav1.APIResourceList {
+		list := resources("v1", "pods", "nodes")
+		list.APIResources = append(list.APIResources, metav1.APIResource{Name: "pods/eviction", Group: "policy", Version: version})
+		return list
+	}
+	tests := []struct {
+		name             string
+		serverVersion    string
+		resources        []*metav1.APIResourceList
+		wantCapabilities *Capabilities
+	}{
+		{
+			name:          "v1.21",
+			serverVersion: "v1.21.14",
+			resources: []*metav1.APIResourceList{
+				eviction("v1beta1"),
+				resources("batch/v1", "jobs", "cronjobs"),
+				resources("batch/v1beta1", "cronjobs"),
+				resources("admissionregistration.k8s.io/v1", "mutatingwebhookconfigurations", "validatingwebhookconfigurations"),
+			},
+			wantCapabilities: &Capabilities{
+				ServerVersion:           "v1.21.14",
+				CronJobGroupVersion:     CronJobV1,
+				EvictionGroupVersion:    EvictionV1beta1,
+				AdmissionReviewVersions: []string{AdmissionReviewV1, AdmissionReviewV1beta1},
+				AdmissionRegistrationV1: true,
+			},
+		},
+		{
+			name:          "v1.28",
+			serverVersion: "v1.28.2+k3s1",
+			resources: []*metav1.APIResourceList{
+				eviction("v1"),
+				resources("batch/v1", "jobs", "cronjobs"),
+				resources("admissionregistration.k8s.io/v1", "mutatingwebhookconfigurations", "validatingwebhookconfigurations"),
+			},
+			wantCapabilities: &Capabilities{
+				ServerVersion:           "v1.28.2+k3s1",
+				CronJobGroupVersion:     CronJobV1,
+				EvictionGroupVersion:    EvictionV1,
+				AdmissionReviewVersions: []string{AdmissionReviewV1, AdmissionReviewV1beta1},
+				AdmissionRegistrationV1: true,
+				PodFailurePolicy:        true,
+			},
+		},
+		{
+			name:          "cronjobs in batch/v1beta1 only",
+			serverVersion: "v1.18.20",
+			resources: []*metav1.APIResourceList{
+				resources("v1", "pods", "nodes", "pods/eviction"),
+				resources("batch/v1", "jobs"),
+				resources("batch/v1beta1", "cronjobs"),
+				resources("admissionregistration.k8s.io/v1", "mutatingwebhookconfigurations", "validatingwebhookconfigurations"),
+			},
+			wantCapabilities: &Capabilities{
+				ServerVersion:           "v1.18.20",
+				CronJobGroupVersion:     CronJobV1beta1,
+				EvictionGroupVersion:    EvictionV1beta1,
+				AdmissionReviewVersions: []string{AdmissionReviewV1, AdmissionReviewV1beta1},
+				AdmissionRegistrationV1: true,
+			},
+		},
+		{
+			name:          "missing apis",
+			serverVersion: "v1.15.12",
+			resources: []*metav1.APIResourceList{
+				resources("v1", "pods", "nodes"),
+				resources("batch/v1", "jobs"),
+				resources("admissionregistration.k8s.io/v1beta1", "mutatingwebhookconfigurations"),
+			},
+			wantCapabilities: &Capabilities{
+				ServerVersion:           "v1.15.12",
+				AdmissionReviewVersions: []string{AdmissionReviewV1beta1},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakediscovery.FakeDiscovery{
+				Fake:               &k8stesting.Fake{Resources: test.resources},
+				FakedServerVersion: &version.Info{GitVersion: test.serverVersion},
+			}
+			gotCapabilities, err := Detect(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.wantCapabilities, gotCapabilities); diff != "" {
+				t.Errorf("unexpected capabilities (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package capabilities
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// CronJobClient reads and writes the CronJobs in the version the api server serves. The batch/v1beta1 CronJobs are
+// converted from and to batch/v1, so the callers only handle batch/v1, the fields v1beta1 doesn't have are dropped.
+type CronJobClient struct {
+	client       kubernetes.Interface
+	groupVersion string
+}
+
+// NewCronJobClient returns the client of the CronJobs in groupVersion, CronJobV1 or CronJobV1beta1, every call fails if
+// it's empty
+func NewCronJobClient(client kubernetes.Interface, groupVersion string) *CronJobClient {
+	return &CronJobClient{client: client, groupVersion: groupVersion}
+}
+
+func (c *CronJobClient) notServed() error {
+	return fmt.Errorf("cronjobs aren't served by the api server")
+}
+
+func (c *CronJobClient) Get(ctx context.Context, namespace, name string, opts metav1.GetOptions) (*batchv1.CronJob, error) {
+	switch c.groupVersion {
+	case CronJobV1:
+		return c.client.BatchV1().CronJobs(namespace).Get(ctx, name, opts)
+	case CronJobV1beta1:
+		cj, err := c.client.BatchV1beta1().CronJobs(namespace).Get(ctx, name, opts)
+		if err != nil {
+			return nil, err
+		}
+		return toV1(cj)
+	}
+	return nil, c.notServed()
+}
+
+func (c *CronJobClient) List(ctx context.Context, namespace string, opts metav1.ListOptions) (*batchv1.CronJobList, error) {
+	switch c.groupVersion {
+	case CronJobV1:
+		return c.client.BatchV1().CronJobs(namespace).List(ctx, opts)
+	case CronJobV1beta1:
+		cjs, err := c.client.BatchV1beta1().CronJobs(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		list := &batchv1.CronJobList{}
+		if err := convert(cjs, list); err != nil {
+			return nil, err
+		}
+		return list, nil
+	}
+	return nil, c.notServed()
+}
+
+func (c *CronJobClient) Create(ctx context.Context, namespace string, cj *batchv1.CronJob, opts metav1.CreateOptions) (*batchv1.CronJob, error) {
+	switch c.groupVersion {
+	case CronJobV1:
+		return c.client.BatchV1().CronJobs(namespace).Create(ctx, cj, opts)
+	case CronJobV1beta1:
+		v1beta1Cj := &batchv1beta1.CronJob{}
+		if err := convert(cj, v1beta1Cj); err != nil {
+			return nil, err
+		}
+		created, err := c.client.BatchV1beta1().CronJobs(namespace).Create(ctx, v1beta1Cj, opts)
+		if err != nil {
+			return nil, err
+		}
+		return toV1(created)
+	}
+	return nil, c.notServed()
+}
+
+func (c *CronJobClient) Delete(ctx context.Context, namespace, name string, opts metav1.DeleteOptions) error {
+	switch c.groupVersion {
+	case CronJobV1:
+		return c.client.BatchV1().CronJobs(namespace).Delete(ctx, name, opts)
+	case CronJobV1beta1:
+		return c.client.BatchV1beta1().CronJobs(namespace).Delete(ctx, name, opts)
+	}
+	return c.notServed()
+}
+
+// Patch applies the patch in the served version, the merge patches of the metadata are the same in both versions
+func (c *CronJobClient) Patch(ctx context.Context, namespace, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions) (*batchv1.CronJob, error) {
+	switch c.groupVersion {
+	case CronJobV1:
+		return c.client.BatchV1().CronJobs(namespace).Patch(ctx, name, pt, data, opts)
+	case CronJobV1beta1:
+		patched, err := c.client.BatchV1beta1().CronJobs(namespace).Patch(ctx, name, pt, data, opts)
+		if err != nil {
+			return nil, err
+		}
+		return toV1(patched)
+	}
+	return nil, c.notServed()
+}
+
+func toV1(cj *batchv1beta1.CronJob) (*batchv1.CronJob, error) {
+	v1Cj := &batchv1.CronJob{}
+	if err := convert(cj, v1Cj); err != nil {
+		return nil, err
+	}
+	return v1Cj, nil
+}
+
+// convert converts between the v1 and v1beta1 CronJobs, their fields are the same except the ones added in v1
+func convert(in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("could not convert cronjob %T: %v", in, err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("could not convert cronjob %T to %T: %v", in, out, err)
+	}
+	return nil
+}
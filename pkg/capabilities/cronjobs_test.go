@@ -0,0 +1,77 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package capabilities
+
+import (
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestCronJobClient(t *testing.T) {
+	for _, groupVersion := range []string{CronJobV1, CronJobV1beta1} {
+		t.Run(groupVersion, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			cronJobs := NewCronJobClient(client, groupVersion)
+			ctx := context.TODO()
+			cj := &batchv1.CronJob{
+				ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "default"},
+				Spec:       batchv1.CronJobSpec{Schedule: "0 * * * *"},
+			}
+			if _, err := cronJobs.Create(ctx, "default", cj, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			// the CronJob is stored in the version served
+			_, v1Err := client.BatchV1().CronJobs("default").Get(ctx, "backup", metav1.GetOptions{})
+			_, v1beta1Err := client.BatchV1beta1().CronJobs("default").Get(ctx, "backup", metav1.GetOptions{})
+			if (v1Err == nil) != (groupVersion == CronJobV1) || (v1beta1Err == nil) != (groupVersion == CronJobV1beta1) {
+				t.Errorf("cronjob isn't created in %s: batch/v1 err %v, batch/v1beta1 err %v", groupVersion, v1Err, v1beta1Err)
+			}
+			patched, err := cronJobs.Patch(ctx, "default", "backup", types.MergePatchType, []byte(`{"metadata":{"annotations":{"scheduling-retries":"3"}}}`), metav1.PatchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if patched.Annotations["scheduling-retries"] != "3" {
+				t.Errorf("patch returned annotations %v", patched.Annotations)
+			}
+			got, err := cronJobs.Get(ctx, "default", "backup", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Spec.Schedule != "0 * * * *" || got.Annotations["scheduling-retries"] != "3" {
+				t.Errorf("get returned %+v", got)
+			}
+			list, err := cronJobs.List(ctx, "default", metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list.Items) != 1 || list.Items[0].Name != "backup" {
+				t.Errorf("list returned %+v", list.Items)
+			}
+			if err := cronJobs.Delete(ctx, "default", "backup", metav1.DeleteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cronJobs.Get(ctx, "default", "backup", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+				t.Errorf("get of a deleted cronjob returned err %v", err)
+			}
+		})
+	}
+
+	// the CronJobs of an api server which doesn't serve them can't be read
+	client := fake.NewSimpleClientset(&batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "default"}})
+	if _, err := NewCronJobClient(client, "").Get(context.TODO(), "default", "backup", metav1.GetOptions{}); err == nil {
+		t.Errorf("get returned no error without a served version")
+	}
+}
@@ -0,0 +1,44 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package capabilities
+
+import (
+	"context"
+	"fmt"
+	policyv1 "k8s.io/api/policy/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// EvictionClient evicts the pods in the version of the pods/eviction subresource the api server serves, an eviction
+// is refused with a TooManyRequests error while the PodDisruptionBudgets of the pod don't allow it
+type EvictionClient struct {
+	client       kubernetes.Interface
+	groupVersion string
+}
+
+// NewEvictionClient returns the client of the evictions in groupVersion, EvictionV1 or EvictionV1beta1, every call fails
+// if it's empty
+func NewEvictionClient(client kubernetes.Interface, groupVersion string) *EvictionClient {
+	return &EvictionClient{client: client, groupVersion: groupVersion}
+}
+
+// Evict evicts the pod, opts are the DeleteOptions the pod is deleted with once the eviction is allowed
+func (c *EvictionClient) Evict(ctx context.Context, namespace, name string, opts metav1.DeleteOptions) error {
+	objectMeta := metav1.ObjectMeta{Namespace: namespace, Name: name}
+	switch c.groupVersion {
+	case EvictionV1:
+		return c.client.CoreV1().Pods(namespace).EvictV1(ctx, &policyv1.Eviction{ObjectMeta: objectMeta, DeleteOptions: &opts})
+	case EvictionV1beta1:
+		return c.client.CoreV1().Pods(namespace).EvictV1beta1(ctx, &policyv1beta1.Eviction{ObjectMeta: objectMeta, DeleteOptions: &opts})
+	}
+	return fmt.Errorf("pods/eviction isn't served by the api server")
+}
@@ -0,0 +1,69 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package capabilities
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+)
+
+func TestEvictionClient(t *testing.T) {
+	tests := []struct {
+		groupVersion string
+		wantEviction runtime.Object
+	}{
+		{groupVersion: EvictionV1, wantEviction: &policyv1.Eviction{}},
+		{groupVersion: EvictionV1beta1, wantEviction: &policyv1beta1.Eviction{}},
+	}
+	for _, test := range tests {
+		t.Run(test.groupVersion, func(t *testing.T) {
+			client := fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default"}})
+			gracePeriod := int64(0)
+			if err := NewEvictionClient(client, test.groupVersion).Evict(context.TODO(), "default", "nginx", metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod}); err != nil {
+				t.Fatal(err)
+			}
+			// the pod is evicted in the version served
+			var evictions int
+			for _, action := range client.Actions() {
+				create, ok := action.(k8stesting.CreateAction)
+				if !ok || action.GetSubresource() != "eviction" {
+					continue
+				}
+				evictions++
+				switch eviction := create.GetObject().(type) {
+				case *policyv1.Eviction:
+					if _, ok := test.wantEviction.(*policyv1.Eviction); !ok || eviction.Name != "nginx" || *eviction.DeleteOptions.GracePeriodSeconds != 0 {
+						t.Errorf("unexpected eviction %+v", eviction)
+					}
+				case *policyv1beta1.Eviction:
+					if _, ok := test.wantEviction.(*policyv1beta1.Eviction); !ok || eviction.Name != "nginx" || *eviction.DeleteOptions.GracePeriodSeconds != 0 {
+						t.Errorf("unexpected eviction %+v", eviction)
+					}
+				}
+			}
+			if evictions != 1 {
+				t.Errorf("got %d evictions, want 1", evictions)
+			}
+		})
+	}
+
+	// the pods of an api server which doesn't serve pods/eviction can't be evicted
+	client := fake.NewSimpleClientset(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default"}})
+	if err := NewEvictionClient(client, "").Evict(context.TODO(), "default", "nginx", metav1.DeleteOptions{}); err == nil {
+		t.Errorf("evict returned no error without a served version")
+	}
+}
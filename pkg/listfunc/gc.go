@@ -0,0 +1,347 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package listfunc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+	"kse/kse-rescheduler/pkg"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// GC prunes the stale kse.com state periodically: all the state of the workloads and pure pods whose scheduling-retries
+// has been removed, the scheduled hosts and node failures of the nodes which don't exist any more, the statefulset pods
+// whose ordinal is out of the replicas and the indexes out of the indexed job completions. Only WatchNamespaces are
+// pruned if they're set, the scheduled hosts are kept then.
+func (lf *ListFunc) GC() {
+	// the scheduled hosts are kept if the nodes can't be read with namespaced Roles
+	var nodes sets.String
+	if !lf.namespaceScoped() {
+		nodeList, err := lf.K8sClientSet.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			klog.Errorf("list nodes err: %s\n", err.Error())
+			return
+		}
+		nodes = sets.NewString()
+		for _, node := range nodeList.Items {
+			nodes.Insert(node.Name)
+		}
+	}
+
+	var objs []metav1.Object
+	for _, namespace := range lf.namespaces() {
+		objs = append(objs, lf.stateObjects(namespace)...)
+	}
+
+	for _, obj := range objs {
+		if err := lf.gcState(obj, nodes); err != nil {
+			// the state changed by others is pruned at the next period
+			klog.Errorf("gc %s/%s kse.com state err: %s\n", obj.GetNamespace(), obj.GetName(), err.Error())
+		}
+	}
+}
+
+// stateObjects lists the workloads and the pure pods of the namespace which may carry kse.com state
+func (lf *ListFunc) stateObjects(namespace string) []metav1.Object {
+	var objs []metav1.Object
+	if deploys, err := lf.K8sClientSet.AppsV1().Deployments(namespace).List(context.TODO(), metav1.ListOptions{}); err != nil {
+		klog.Errorf("list deployments in %s err: %s\n", namespaceDescription(namespace), err.Error())
+	} else {
+		for i := range deploys.Items {
+			objs = append(objs, &deploys.Items[i])
+		}
+	}
+	if rss, err := lf.K8sClientSet.AppsV1().ReplicaSets(namespace).List(context.TODO(), metav1.ListOptions{}); err != nil {
+		klog.Errorf("list replicasets in %s err: %s\n", namespaceDescription(namespace), err.Error())
+	} else {
+		for i := range rss.Items {
+			objs = append(objs, &rss.Items[i])
+		}
+	}
+	if stss, err := lf.K8sClientSet.AppsV1().StatefulSets(namespace).List(context.TODO(), metav1.ListOptions{}); err != nil {
+		klog.Errorf("list statefulsets in %s err: %s\n", namespaceDescription(namespace), err.Error())
+	} else {
+		for i := range stss.Items {
+			objs = append(objs, &stss.Items[i])
+		}
+	}
+	if dss, err := lf.K8sClientSet.AppsV1().DaemonSets(namespace).List(context.TODO(), metav1.ListOptions{}); err != nil {
+		klog.Errorf("list daemonsets in %s err: %s\n", namespaceDescription(namespace), err.Error())
+	} else {
+		for i := range dss.Items {
+			objs = append(objs, &dss.Items[i])
+		}
+	}
+	if jbs, err := lf.K8sClientSet.BatchV1().Jobs(namespace).List(context.TODO(), metav1.ListOptions{}); err != nil {
+		klog.Errorf("list jobs in %s err: %s\n", namespaceDescription(namespace), err.Error())
+	} else {
+		for i := range jbs.Items {
+			objs = append(objs, &jbs.Items[i])
+		}
+	}
+	// the CronJobs aren't rescheduled if the api server doesn't serve them
+	if lf.capabilities().CronJobGroupVersion != "" {
+		if cjs, err := lf.cronJobs().List(context.TODO(), namespace, metav1.ListOptions{}); err != nil {
+			klog.Errorf("list cronjobs in %s err: %s\n", namespaceDescription(namespace), err.Error())
+		} else {
+			for i := range cjs.Items {
+				objs = append(objs, &cjs.Items[i])
+			}
+		}
+	}
+	if pods, err := lf.K8sClientSet.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{}); err != nil {
+		klog.Errorf("list pods in %s err: %s\n", namespaceDescription(namespace), err.Error())
+	} else {
+		for i := range pods.Items {
+			// the pods of the workloads are created again with their owner's state
+			if len(pods.Items[i].OwnerReferences) == 0 {
+				objs = append(objs, &pods.Items[i])
+			}
+		}
+	}
+	return objs
+}
+
+func (lf *ListFunc) gcState(obj metav1.Object, nodes sets.String) error {
+	kind, stateKeys := stateAnnotations(obj)
+	annotations := obj.GetAnnotations()
+	patch := make(map[string]*string)
+	if _, ok := annotations[pkg.SchedulingRetrieString]; !ok {
+		// the workload has opted out of rescheduling
+		for _, key := range stateKeys {
+			if _, found := annotations[key]; found {
+				patch[key] = nil
+			}
+		}
+	} else {
+		pruned, err := pruneState(obj, nodes)
+		if err != nil {
+			return err
+		}
+		if value, found := annotations[pkg.NodeFailuresString]; found {
+			var nodeFailures pkg.NodeFailures
+			if err := json.Unmarshal([]byte(value), &nodeFailures); err != nil {
+				return fmt.Errorf("unmarshal %s kse.com/node-failures err: %s\n", obj.GetName(), err.Error())
+			}
+			for node := range nodeFailures {
+				if nodes != nil && !nodes.Has(node) {
+					delete(nodeFailures, node)
+				}
+			}
+			byteNodeFailures, err := json.Marshal(nodeFailures)
+			if err != nil {
+				return fmt.Errorf("marshal %s kse.com/node-failures err: %s\n", obj.GetName(), err.Error())
+			}
+			pruned[pkg.NodeFailuresString] = string(byteNodeFailures)
+		}
+		for key, value := range pruned {
+			if !sameJSON(annotations[key], value) {
+				value := value
+				patch[key] = &value
+			}
+		}
+	}
+	if len(patch) == 0 {
+		return nil
+	}
+	klog.Infof("gc %s %s/%s kse.com state %v\n", kind, obj.GetNamespace(), obj.GetName(), sets.StringKeySet(patch).List())
+	return lf.patchStateAnnotations(kind, obj, stateKeys[0], patch)
+}
+
+// stateAnnotations returns the kind of obj and the kse.com annotations it may carry
+func stateAnnotations(obj metav1.Object) (string, []string) {
+	switch obj.(type) {
+	case *appsv1.Deployment:
+		return "Deployment", []string{pkg.DeployInfoString, pkg.NodeFailuresString, pkg.ExcludedDomainsString, pkg.PlacementsString}
+	case *appsv1.ReplicaSet:
+		return "ReplicaSet", []string{pkg.RsInfoString, pkg.NodeFailuresString, pkg.ExcludedDomainsString, pkg.PlacementsString}
+	case *appsv1.StatefulSet:
+		return "StatefulSet", []string{pkg.StsPodMapString, pkg.NodeFailuresString, pkg.ExcludedDomainsString, pkg.PlacementsString}
+	case *appsv1.DaemonSet:
+		return "DaemonSet", []string{pkg.CurrentReschedulingTimeString, pkg.NodeFailuresString, pkg.ExcludedDomainsString, pkg.PlacementsString}
+	case *batchv1.Job:
+		return "Job", []string{pkg.JobInfoString, pkg.NodeFailuresString, pkg.ExcludedDomainsString, pkg.PlacementsString}
+	case *batchv1.CronJob:
+		return "CronJob", []string{pkg.CjInfoString, pkg.NodeFailuresString, pkg.ExcludedDomainsString, pkg.PlacementsString}
+	default:
+		return "Pod", []string{pkg.PurePodInfoString, pkg.SchedulinedHostString, pkg.RelaxedHostString, pkg.NodeFailuresString, pkg.ExcludedDomainsString, pkg.PlacementsString}
+	}
+}
+
+// pruneState returns the kse.com annotations of obj without the stale scheduled hosts, ordinals and indexes, the
+// annotations obj doesn't carry are not returned
+func pruneState(obj metav1.Object, nodes sets.String) (map[string]string, error) {
+	annotations := obj.GetAnnotations()
+	pruned := make(map[string]string)
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		value, found := annotations[pkg.DeployInfoString]
+		if !found {
+			return pruned, nil
+		}
+		var deployInfo pkg.DeployInfo
+		if err := json.Unmarshal([]byte(value), &deployInfo); err != nil {
+			return nil, fmt.Errorf("unmarshal deploy %s kse.com/deploy err: %s\n", o.Name, err.Error())
+		}
+		deployInfo.DeployScheduledHosts = existingNodes(deployInfo.DeployScheduledHosts, nodes)
+		value, err := deployInfoAnnotation(o, &deployInfo)
+		if err != nil {
+			return nil, err
+		}
+		pruned[pkg.DeployInfoString] = value
+	case *appsv1.ReplicaSet:
+		value, found := annotations[pkg.RsInfoString]
+		if !found {
+			return pruned, nil
+		}
+		var rsInfo pkg.RsInfo
+		if err := json.Unmarshal([]byte(value), &rsInfo); err != nil {
+			return nil, fmt.Errorf("unmarshal replicaset %s kse.com/rs err: %s\n", o.Name, err.Error())
+		}
+		rsInfo.RsScheduledHosts = existingNodes(rsInfo.RsScheduledHosts, nodes)
+		value, err := rsInfoAnnotation(o, &rsInfo)
+		if err != nil {
+			return nil, err
+		}
+		pruned[pkg.RsInfoString] = value
+	case *appsv1.StatefulSet:
+		value, found := annotations[pkg.StsPodMapString]
+		if !found {
+			return pruned, nil
+		}
+		var stsPodsMap pkg.StsPodsMap
+		if err := json.Unmarshal([]byte(value), &stsPodsMap); err != nil {
+			return nil, fmt.Errorf("unmarshal statefulset %s kse.com/sts-pods-map err: %s\n", o.Name, err.Error())
+		}
+		replicas := 1
+		if o.Spec.Replicas != nil {
+			replicas = int(*o.Spec.Replicas)
+		}
+		for podName, podInfo := range stsPodsMap {
+			// the pod of a removed ordinal is created again as a new pod after scaling up
+			ordinal, err := strconv.Atoi(strings.TrimPrefix(podName, o.Name+"-"))
+			if !strings.HasPrefix(podName, o.Name+"-") || err != nil || ordinal >= replicas {
+				delete(stsPodsMap, podName)
+				continue
+			}
+			podInfo.PodScheduledHosts = existingNodes(podInfo.PodScheduledHosts, nodes)
+			stsPodsMap[podName] = podInfo
+		}
+		value, err := stsPodsMapAnnotation(o, &stsPodsMap)
+		if err != nil {
+			return nil, err
+		}
+		pruned[pkg.StsPodMapString] = value
+	case *batchv1.Job:
+		value, found := annotations[pkg.JobInfoString]
+		if !found {
+			return pruned, nil
+		}
+		var jobInfo pkg.JobInfo
+		if err := json.Unmarshal([]byte(value), &jobInfo); err != nil {
+			return nil, fmt.Errorf("unmarshal job %s kse.com/job err: %s\n", o.Name, err.Error())
+		}
+		jobInfo.JobScheduledHosts = existingNodes(jobInfo.JobScheduledHosts, nodes)
+		completions := 1
+		if o.Spec.Completions != nil {
+			completions = int(*o.Spec.Completions)
+		}
+		for index, podInfo := range jobInfo.IndexReschedulingMap {
+			if i, err := strconv.Atoi(index); err != nil || i >= completions {
+				delete(jobInfo.IndexReschedulingMap, index)
+				continue
+			}
+			podInfo.PodScheduledHosts = existingNodes(podInfo.PodScheduledHosts, nodes)
+			jobInfo.IndexReschedulingMap[index] = podInfo
+		}
+		value, err := jobInfoAnnotation(o, &jobInfo)
+		if err != nil {
+			return nil, err
+		}
+		pruned[pkg.JobInfoString] = value
+	case *batchv1.CronJob:
+		value, found := annotations[pkg.CjInfoString]
+		if !found {
+			return pruned, nil
+		}
+		var cjInfo pkg.CjInfo
+		if err := json.Unmarshal([]byte(value), &cjInfo); err != nil {
+			return nil, fmt.Errorf("unmarshal cronjob %s kse.com/cj err: %s\n", o.Name, err.Error())
+		}
+		cjInfo.CjScheduledHosts = existingNodes(cjInfo.CjScheduledHosts, nodes)
+		value, err := cjInfoAnnotation(o, &cjInfo)
+		if err != nil {
+			return nil, err
+		}
+		pruned[pkg.CjInfoString] = value
+	case *corev1.Pod:
+		if value, found := annotations[pkg.PurePodInfoString]; found {
+			var purePodInfo pkg.PurePodInfo
+			if err := json.Unmarshal([]byte(value), &purePodInfo); err != nil {
+				return nil, fmt.Errorf("unmarshal pod %s kse.com/pod err: %s\n", o.Name, err.Error())
+			}
+			purePodInfo.PodScheduledHosts = existingNodes(purePodInfo.PodScheduledHosts, nodes)
+			bytePurePodInfo, err := fitStateSize(func() ([]byte, error) { return json.Marshal(purePodInfo) }, &purePodInfo.PodScheduledHosts)
+			if err != nil {
+				return nil, fmt.Errorf("marshal pod %s kse.com/pod err: %s\n", o.Name, err.Error())
+			}
+			pruned[pkg.PurePodInfoString] = string(bytePurePodInfo)
+		}
+		if value, found := annotations[pkg.SchedulinedHostString]; found {
+			var scheduledHosts []string
+			if err := json.Unmarshal([]byte(value), &scheduledHosts); err != nil {
+				return nil, fmt.Errorf("unmarshal pod %s kse.com/scheduled-hosts err: %s\n", o.Name, err.Error())
+			}
+			scheduledHosts = existingNodes(scheduledHosts, nodes)
+			byteScheduledHosts, err := fitStateSize(func() ([]byte, error) { return json.Marshal(scheduledHosts) }, &scheduledHosts)
+			if err != nil {
+				return nil, fmt.Errorf("marshal pod %s kse.com/scheduled-hosts err: %s\n", o.Name, err.Error())
+			}
+			pruned[pkg.SchedulinedHostString] = string(byteScheduledHosts)
+		}
+	}
+	return pruned, nil
+}
+
+// existingNodes drops the hosts which are not nodes any more, a nil hosts is kept nil. The hosts are kept if the nodes
+// are unknown
+func existingNodes(hosts []string, nodes sets.String) []string {
+	if hosts == nil || nodes == nil {
+		return hosts
+	}
+	existing := []string{}
+	for _, host := range hosts {
+		if nodes.Has(host) {
+			existing = append(existing, host)
+		}
+	}
+	return existing
+}
+
+// sameJSON returns whether a and b are the same state, whatever the formatting is
+func sameJSON(a, b string) bool {
+	var objA, objB interface{}
+	if err := json.Unmarshal([]byte(a), &objA); err != nil {
+		return false
+	}
+	if err := json.Unmarshal([]byte(b), &objB); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(objA, objB)
+}
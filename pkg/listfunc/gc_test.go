@@ -0,0 +1,216 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package listfunc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"kse/kse-rescheduler/pkg"
+	"testing"
+)
+
+func TestGC(t *testing.T) {
+	replicas := int32(2)
+	tests := []struct {
+		name            string
+		obj             runtime.Object
+		wantAnnotations map[string]string
+		wantPatch       bool
+	}{
+		{
+			name: "deployment opted out",
+			obj: &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: map[string]string{
+				pkg.DeployInfoString: `{"currentReschedulingTimes":2,"deployScheduledHosts":["node1"]}`,
+			}}},
+			wantAnnotations: map[string]string{},
+			wantPatch:       true,
+		},
+		{
+			name: "deployment scheduled to a deleted node",
+			obj: &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: map[string]string{
+				pkg.SchedulingRetrieString: "3",
+				pkg.DeployInfoString:       `{"currentReschedulingTimes": 2, "deployScheduledHosts": ["node1", "node3"]}`,
+			}}},
+			wantAnnotations: map[string]string{
+				pkg.SchedulingRetrieString: "3",
+				pkg.DeployInfoString:       `{"currentReschedulingTimes":2,"deployScheduledHosts":["node1"]}`,
+			},
+			wantPatch: true,
+		},
+		{
+			name: "deployment state is up to date",
+			obj: &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: map[string]string{
+				pkg.SchedulingRetrieString: "3",
+				pkg.DeployInfoString:       `{"currentReschedulingTimes": 2, "deployScheduledHosts": ["node1", "node2"]}`,
+			}}},
+			wantAnnotations: map[string]string{
+				pkg.SchedulingRetrieString: "3",
+				pkg.DeployInfoString:       `{"currentReschedulingTimes": 2, "deployScheduledHosts": ["node1", "node2"]}`,
+			},
+			wantPatch: false,
+		},
+		{
+			name: "statefulset scaled down",
+			obj: &appsv1.StatefulSet{
+				ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "default", Annotations: map[string]string{
+					pkg.SchedulingRetrieString: "3",
+					pkg.StsPodMapString:        `{"web-0":{"currentReschedulingTimes":1,"podScheduledHosts":["node1"]},"web-2":{"currentReschedulingTimes":1,"podScheduledHosts":["node2"]}}`,
+				}},
+				Spec: appsv1.StatefulSetSpec{Replicas: &replicas},
+			},
+			wantAnnotations: map[string]string{
+				pkg.SchedulingRetrieString: "3",
+				pkg.StsPodMapString:        `{"web-0":{"currentReschedulingTimes":1,"podScheduledHosts":["node1"]}}`,
+			},
+			wantPatch: true,
+		},
+		{
+			name: "pure pod scheduled to a deleted node",
+			obj: &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: map[string]string{
+				pkg.SchedulingRetrieString: "3",
+				pkg.PurePodInfoString:      `{"currentReschedulingTimes":2,"podScheduledHosts":["node1","node3"]}`,
+				pkg.SchedulinedHostString:  `["node1","node3"]`,
+			}}},
+			wantAnnotations: map[string]string{
+				pkg.SchedulingRetrieString: "3",
+				pkg.PurePodInfoString:      `{"currentReschedulingTimes":2,"podScheduledHosts":["node1"]}`,
+				pkg.SchedulinedHostString:  `["node1"]`,
+			},
+			wantPatch: true,
+		},
+		{
+			name: "pure pod opted out",
+			obj: &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: map[string]string{
+				pkg.PurePodInfoString:     `{"currentReschedulingTimes":2,"podScheduledHosts":["node1"]}`,
+				pkg.SchedulinedHostString: `["node1"]`,
+				"kept":                    "true",
+			}}},
+			wantAnnotations: map[string]string{"kept": "true"},
+			wantPatch:       true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(test.obj,
+				&corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "node1"}},
+				&corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "node2"}})
+			lf := &ListFunc{K8sClientSet: client}
+			lf.GC()
+
+			gotPatch := false
+			for _, action := range client.Actions() {
+				if action.GetVerb() == "patch" {
+					gotPatch = true
+				}
+			}
+			if gotPatch != test.wantPatch {
+				t.Errorf("test returned patch: %v want %v", gotPatch, test.wantPatch)
+			}
+			meta := test.obj.(v1.Object)
+			var got v1.Object
+			var err error
+			switch test.obj.(type) {
+			case *appsv1.Deployment:
+				got, err = client.AppsV1().Deployments(meta.GetNamespace()).Get(context.TODO(), meta.GetName(), v1.GetOptions{})
+			case *appsv1.StatefulSet:
+				got, err = client.AppsV1().StatefulSets(meta.GetNamespace()).Get(context.TODO(), meta.GetName(), v1.GetOptions{})
+			case *corev1.Pod:
+				got, err = client.CoreV1().Pods(meta.GetNamespace()).Get(context.TODO(), meta.GetName(), v1.GetOptions{})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotAnnotations := got.GetAnnotations()
+			if len(gotAnnotations) != len(test.wantAnnotations) {
+				t.Fatalf("test returned wrong annotations: got %v want %v", gotAnnotations, test.wantAnnotations)
+			}
+			for key, want := range test.wantAnnotations {
+				if gotAnnotations[key] != want {
+					t.Errorf("test returned wrong annotation %s: got %v want %v", key, gotAnnotations[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestFitStateSize(t *testing.T) {
+	deployInfo := pkg.DeployInfo{CurrentReschedulingTimes: 3}
+	for i := 0; i < 5000; i++ {
+		deployInfo.DeployScheduledHosts = append(deployInfo.DeployScheduledHosts, fmt.Sprintf("worker-node-%05d", i))
+	}
+	value, err := deployInfoAnnotation(&appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "nginx"}}, &deployInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(value) > pkg.MaxStateSize {
+		t.Errorf("test returned too large state: got %v bytes want at most %v bytes", len(value), pkg.MaxStateSize)
+	}
+	var gotDeployInfo pkg.DeployInfo
+	if err := json.Unmarshal([]byte(value), &gotDeployInfo); err != nil {
+		t.Fatal(err)
+	}
+	if gotDeployInfo.CurrentReschedulingTimes != 3 {
+		t.Errorf("test returned wrong current rescheduling times: got %v want %v", gotDeployInfo.CurrentReschedulingTimes, 3)
+	}
+	if len(gotDeployInfo.DeployScheduledHosts) == 0 {
+		t.Errorf("test dropped all the scheduled hosts")
+	}
+}
+
+func TestGCWatchNamespaces(t *testing.T) {
+	optedOut := map[string]string{pkg.DeployInfoString: `{"currentReschedulingTimes":2,"deployScheduledHosts":["node1"]}`}
+	scheduled := map[string]string{
+		pkg.SchedulingRetrieString: "3",
+		pkg.DeployInfoString:       `{"currentReschedulingTimes":2,"deployScheduledHosts":["node1","node3"]}`,
+	}
+	client := fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "opted-out", Namespace: "team-a", Annotations: optedOut}},
+		&appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "scheduled", Namespace: "team-a", Annotations: scheduled}},
+		&appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "opted-out", Namespace: "team-b", Annotations: optedOut}},
+		&corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "node1"}})
+	lf := &ListFunc{K8sClientSet: client, WatchNamespaces: []string{"team-a"}}
+	lf.GC()
+
+	for _, action := range client.Actions() {
+		if action.GetNamespace() != "team-a" {
+			t.Errorf("test %s %s out of the watched namespaces: %q", action.GetVerb(), action.GetResource().Resource, action.GetNamespace())
+		}
+	}
+	tests := []struct {
+		namespace       string
+		name            string
+		wantAnnotations map[string]string
+	}{
+		{namespace: "team-a", name: "opted-out", wantAnnotations: map[string]string{}},
+		// the nodes aren't read, so the scheduled hosts are kept
+		{namespace: "team-a", name: "scheduled", wantAnnotations: scheduled},
+		{namespace: "team-b", name: "opted-out", wantAnnotations: optedOut},
+	}
+	for _, test := range tests {
+		deploy, err := client.AppsV1().Deployments(test.namespace).Get(context.TODO(), test.name, v1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deploy.Annotations) != len(test.wantAnnotations) {
+			t.Fatalf("test returned wrong %s/%s annotations: got %v want %v", test.namespace, test.name, deploy.Annotations, test.wantAnnotations)
+		}
+		for key, want := range test.wantAnnotations {
+			if deploy.Annotations[key] != want {
+				t.Errorf("test returned wrong %s/%s annotation %s: got %v want %v", test.namespace, test.name, key, deploy.Annotations[key], want)
+			}
+		}
+	}
+}
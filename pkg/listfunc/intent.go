@@ -0,0 +1,412 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package listfunc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"kse/kse-rescheduler/pkg"
+	"time"
+)
+
+// Every reschedule needs two writes which are not atomic, e.g. updating the owner's rescheduling state and deleting
+// the pod, or deleting a pure pod and creating it again. The reschedule is journaled as an intent in a ConfigMap before
+// acting, and the step is saved after every write, so the next listFunc period, maybe on a new leader, resumes or rolls
+// back the unfinished intents. The journal is bounded by pkg.MaxJournalSize, the intents are removed once finished, so
+// only the reschedules interrupted by errors are kept in it.
+
+// errJournalFull means the intent can't be journaled before the unfinished intents are resumed, the reschedule is
+// retried in the next period
+var errJournalFull = errors.New("the intent journal is full")
+
+func (lf *ListFunc) journalNamespace() string {
+	if lf.JournalNamespace == "" {
+		return pkg.NAMESPACE
+	}
+	return lf.JournalNamespace
+}
+
+func (lf *ListFunc) loadIntents() (map[string]pkg.ReschedulingIntent, error) {
+	intents := make(map[string]pkg.ReschedulingIntent)
+	cm, err := lf.K8sClientSet.CoreV1().ConfigMaps(lf.journalNamespace()).Get(context.TODO(), pkg.IntentJournalString, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return intents, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get intent journal err: %s\n", err.Error())
+	}
+	for podUID, data := range cm.Data {
+		var intent pkg.ReschedulingIntent
+		if err := json.Unmarshal([]byte(data), &intent); err != nil {
+			klog.Errorf("unmarshal intent of pod %s err: %s\n", podUID, err.Error())
+			continue
+		}
+		intents[podUID] = intent
+	}
+	return intents, nil
+}
+
+func (lf *ListFunc) saveIntent(intent *pkg.ReschedulingIntent) error {
+	byteIntent, err := json.Marshal(intent)
+	if err != nil {
+		return fmt.Errorf("marshal intent of pod %s err: %s\n", intent.PodName, err.Error())
+	}
+	return lf.updateJournal(func(data map[string]string) error {
+		size := len(intent.PodUID) + len(byteIntent)
+		for podUID, value := range data {
+			if podUID != intent.PodUID {
+				size += len(podUID) + len(value)
+			}
+		}
+		if size > pkg.MaxJournalSize {
+			return fmt.Errorf("journal intent of pod %s/%s err: %w", intent.Namespace, intent.PodName, errJournalFull)
+		}
+		data[intent.PodUID] = string(byteIntent)
+		return nil
+	})
+}
+
+func (lf *ListFunc) removeIntent(intent *pkg.ReschedulingIntent) error {
+	return lf.updateJournal(func(data map[string]string) error {
+		delete(data, intent.PodUID)
+		return nil
+	})
+}
+
+func (lf *ListFunc) updateJournal(mutate func(data map[string]string) error) error {
+	namespace := lf.journalNamespace()
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
+		cm, err := lf.K8sClientSet.CoreV1().ConfigMaps(namespace).Get(context.TODO(), pkg.IntentJournalString, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: pkg.IntentJournalString, Namespace: namespace}, Data: map[string]string{}}
+			if err := mutate(cm.Data); err != nil {
+				return err
+			}
+			_, err = lf.K8sClientSet.CoreV1().ConfigMaps(namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				return apierrors.NewConflict(corev1.Resource("configmaps"), pkg.IntentJournalString, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		if err := mutate(cm.Data); err != nil {
+			return err
+		}
+		_, err = lf.K8sClientSet.CoreV1().ConfigMaps(namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+		return err
+	})
+	if retryErr != nil {
+		return fmt.Errorf("update intent journal err: %s\n", retryErr.Error())
+	}
+	return nil
+}
+
+func newIntent(pod *corev1.Pod, ownerKind, ownerName string) *pkg.ReschedulingIntent {
+	return &pkg.ReschedulingIntent{
+		Step:         pkg.IntentStepPending,
+		Namespace:    pod.Namespace,
+		PodName:      pod.Name,
+		PodUID:       string(pod.UID),
+		OwnerKind:    ownerKind,
+		OwnerName:    ownerName,
+		CreationTime: time.Now(),
+	}
+}
+
+// rescheduleOwnedPod updates the rescheduling state of the pod's owner and then deletes the pod, the owner's controller
+// will create the pod again
+func (lf *ListFunc) rescheduleOwnedPod(pod *corev1.Pod, ownerKind string, owner metav1.Object, key, value string) error {
+	annotations := map[string]*string{key: &value}
+	// the failure is recorded with the state in the same write, it's computed before the intent is journaled so every
+	// error after the journaling is rolled back or resumed
+	failureAnnotations, err := lf.recordFailure(owner, pod, time.Now())
+	if err != nil {
+		return err
+	}
+	for failureKey := range failureAnnotations {
+		failureValue := failureAnnotations[failureKey]
+		annotations[failureKey] = &failureValue
+	}
+	return lf.patchStateAndDeletePod(pod, ownerKind, owner, key, annotations)
+}
+
+// patchStateAndDeletePod patches the annotations of the pod's owner, the key one is its rescheduling state, and then
+// deletes the pod
+func (lf *ListFunc) patchStateAndDeletePod(pod *corev1.Pod, ownerKind string, owner metav1.Object, key string, annotations map[string]*string) error {
+	intent := newIntent(pod, ownerKind, owner.GetName())
+	intent.AnnotationKey = key
+	// a nil value removes the annotation, which reads as empty when the intent is resumed
+	if value := annotations[key]; value != nil {
+		intent.AnnotationValue = *value
+	}
+	if err := lf.saveIntent(intent); err != nil {
+		return err
+	}
+	if err := lf.patchStateAnnotations(ownerKind, owner, key, annotations); err != nil {
+		// nothing has been changed, roll the intent back
+		if removeErr := lf.removeIntent(intent); removeErr != nil {
+			klog.Error(removeErr.Error())
+		}
+		return err
+	}
+	intent.Step = pkg.IntentStepStateUpdated
+	if err := lf.saveIntent(intent); err != nil {
+		return err
+	}
+	if err := lf.delPod(pod); err != nil {
+		return fmt.Errorf("%s, it will be resumed at the next period\n", err.Error())
+	}
+	return lf.removeIntent(intent)
+}
+
+func (lf *ListFunc) rescheduleDeployPod(deploy *appsv1.Deployment, pod *corev1.Pod, deployInfo *pkg.DeployInfo) error {
+	value, err := deployInfoAnnotation(deploy, deployInfo)
+	if err != nil {
+		return err
+	}
+	return lf.rescheduleOwnedPod(pod, "Deployment", deploy, pkg.DeployInfoString, value)
+}
+
+func (lf *ListFunc) rescheduleRsPod(rs *appsv1.ReplicaSet, pod *corev1.Pod, rsInfo *pkg.RsInfo) error {
+	value, err := rsInfoAnnotation(rs, rsInfo)
+	if err != nil {
+		return err
+	}
+	return lf.rescheduleOwnedPod(pod, "ReplicaSet", rs, pkg.RsInfoString, value)
+}
+
+func (lf *ListFunc) rescheduleJobPod(jb *batchv1.Job, pod *corev1.Pod, jobInfo *pkg.JobInfo) error {
+	value, err := jobInfoAnnotation(jb, jobInfo)
+	if err != nil {
+		return err
+	}
+	return lf.rescheduleOwnedPod(pod, "Job", jb, pkg.JobInfoString, value)
+}
+
+func (lf *ListFunc) rescheduleDsPod(ds *appsv1.DaemonSet, pod *corev1.Pod, annotationValue string) error {
+	return lf.rescheduleOwnedPod(pod, "DaemonSet", ds, pkg.CurrentReschedulingTimeString, annotationValue)
+}
+
+func (lf *ListFunc) rescheduleStsPod(sts *appsv1.StatefulSet, pod *corev1.Pod, stsPodsMap *pkg.StsPodsMap) error {
+	value, err := stsPodsMapAnnotation(sts, stsPodsMap)
+	if err != nil {
+		return err
+	}
+	return lf.rescheduleOwnedPod(pod, "StatefulSet", sts, pkg.StsPodMapString, value)
+}
+
+// recreatePod deletes the pure pod and creates it again with the new rescheduling state, the pod to be created is
+// journaled, so it's never lost if the creation fails
+func (lf *ListFunc) recreatePod(pod *corev1.Pod, purePodInfo *pkg.PurePodInfo) error {
+	newPod, err := lf.newReschedulingPod(pod, purePodInfo)
+	if err != nil {
+		return err
+	}
+	return lf.replacePod(pod, newPod)
+}
+
+// replacePod deletes the pure pod and creates newPod instead
+func (lf *ListFunc) replacePod(pod, newPod *corev1.Pod) error {
+	snapshot, err := json.Marshal(newPod)
+	if err != nil {
+		return fmt.Errorf("marshal pod %s snapshot err: %s\n", pod.Name, err.Error())
+	}
+	if len(snapshot) > pkg.MaxIntentSnapshotSize {
+		return fmt.Errorf("pod %s snapshot is %d bytes, larger than the %d bytes an intent journals, it isn't recreated\n", pod.Name, len(snapshot), pkg.MaxIntentSnapshotSize)
+	}
+	intent := newIntent(pod, "Pod", pod.Name)
+	intent.Snapshot = snapshot
+	if err := lf.saveIntent(intent); err != nil {
+		return err
+	}
+	if err := lf.delPod(pod); err != nil {
+		if removeErr := lf.removeIntent(intent); removeErr != nil {
+			klog.Error(removeErr.Error())
+		}
+		return err
+	}
+	intent.Step = pkg.IntentStepDeleted
+	if err := lf.saveIntent(intent); err != nil {
+		return err
+	}
+	if err := lf.createSnapshot(intent); err != nil {
+		return fmt.Errorf("%s, it will be resumed at the next period\n", err.Error())
+	}
+	return lf.removeIntent(intent)
+}
+
+// recreateCj deletes the cronjob and creates it again with the new rescheduling state, it's pods will be deleted with
+// the cronjob
+func (lf *ListFunc) recreateCj(cj *batchv1.CronJob, pod *corev1.Pod, cjInfo *pkg.CjInfo) error {
+	newCj, err := lf.newReschedulingCj(cj, pod, cjInfo)
+	if err != nil {
+		return err
+	}
+	snapshot, err := json.Marshal(newCj)
+	if err != nil {
+		return fmt.Errorf("marshal cronjob %s snapshot err: %s\n", cj.Name, err.Error())
+	}
+	if len(snapshot) > pkg.MaxIntentSnapshotSize {
+		return fmt.Errorf("cronjob %s snapshot is %d bytes, larger than the %d bytes an intent journals, it isn't recreated\n", cj.Name, len(snapshot), pkg.MaxIntentSnapshotSize)
+	}
+	intent := newIntent(pod, "CronJob", cj.Name)
+	intent.OwnerUID = string(cj.UID)
+	intent.Snapshot = snapshot
+	if err := lf.saveIntent(intent); err != nil {
+		return err
+	}
+	if err := lf.delCj(cj); err != nil {
+		if removeErr := lf.removeIntent(intent); removeErr != nil {
+			klog.Error(removeErr.Error())
+		}
+		return err
+	}
+	intent.Step = pkg.IntentStepDeleted
+	if err := lf.saveIntent(intent); err != nil {
+		return err
+	}
+	if err := lf.createSnapshot(intent); err != nil {
+		return fmt.Errorf("%s, it will be resumed at the next period\n", err.Error())
+	}
+	return lf.removeIntent(intent)
+}
+
+func (lf *ListFunc) createSnapshot(intent *pkg.ReschedulingIntent) error {
+	var createErr error
+	switch intent.OwnerKind {
+	case "Pod":
+		var pod corev1.Pod
+		if err := json.Unmarshal(intent.Snapshot, &pod); err != nil {
+			return fmt.Errorf("unmarshal pod %s snapshot err: %s\n", intent.PodName, err.Error())
+		}
+		_, createErr = lf.K8sClientSet.CoreV1().Pods(intent.Namespace).Create(context.TODO(), &pod, metav1.CreateOptions{})
+	case "CronJob":
+		var cj batchv1.CronJob
+		if err := json.Unmarshal(intent.Snapshot, &cj); err != nil {
+			return fmt.Errorf("unmarshal cronjob %s snapshot err: %s\n", intent.OwnerName, err.Error())
+		}
+		_, createErr = lf.cronJobs().Create(context.TODO(), intent.Namespace, &cj, metav1.CreateOptions{})
+	default:
+		return fmt.Errorf("unsupported snapshot kind %s of %s/%s", intent.OwnerKind, intent.Namespace, intent.OwnerName)
+	}
+	// the snapshot has been created by the interrupted reschedule
+	if apierrors.IsAlreadyExists(createErr) {
+		return nil
+	}
+	if createErr != nil {
+		return fmt.Errorf("create %s %s err: %s", intent.OwnerKind, intent.OwnerName, createErr.Error())
+	}
+	return nil
+}
+
+// resumeIntents resumes or rolls back the unfinished intents, it returns the UIDs of the pods whose intent is still
+// unfinished, these pods must not be rescheduled again in this period
+func (lf *ListFunc) resumeIntents() sets.String {
+	unfinished := sets.NewString()
+	intents, err := lf.loadIntents()
+	if err != nil {
+		klog.Error(err.Error())
+		return unfinished
+	}
+	for podUID := range intents {
+		intent := intents[podUID]
+		if err := lf.resumeIntent(&intent); err != nil {
+			klog.Errorf("resume intent of pod %s/%s err: %s\n", intent.Namespace, intent.PodName, err.Error())
+			unfinished.Insert(podUID)
+			continue
+		}
+		if err := lf.removeIntent(&intent); err != nil {
+			klog.Error(err.Error())
+			unfinished.Insert(podUID)
+		}
+	}
+	return unfinished
+}
+
+func (lf *ListFunc) resumeIntent(intent *pkg.ReschedulingIntent) error {
+	switch intent.OwnerKind {
+	case "Pod", "CronJob":
+		if intent.Step == pkg.IntentStepPending {
+			deleted, err := lf.snapshotSourceDeleted(intent)
+			if err != nil {
+				return err
+			}
+			if !deleted {
+				klog.Infof("roll back the intent of pod %s/%s, the %s has not been deleted\n", intent.Namespace, intent.PodName, intent.OwnerKind)
+				return nil
+			}
+		}
+		klog.Infof("resume the intent of pod %s/%s, create the %s %s\n", intent.Namespace, intent.PodName, intent.OwnerKind, intent.OwnerName)
+		return lf.createSnapshot(intent)
+	default:
+		if intent.Step == pkg.IntentStepPending {
+			value, found, err := lf.getOwnerAnnotation(intent.OwnerKind, intent.Namespace, intent.OwnerName, intent.AnnotationKey)
+			if err != nil {
+				return err
+			}
+			if !found || value != intent.AnnotationValue {
+				klog.Infof("roll back the intent of pod %s/%s, the %s %s state has not been updated\n", intent.Namespace, intent.PodName, intent.OwnerKind, intent.OwnerName)
+				return nil
+			}
+		}
+		// the retry has been counted in the owner's state, only the pod deletion is left
+		klog.Infof("resume the intent of pod %s/%s, delete the pod\n", intent.Namespace, intent.PodName)
+		gracePeriod := int64(0)
+		backgroundDeletion := metav1.DeletePropagationBackground
+		uid := types.UID(intent.PodUID)
+		err := lf.deletePod(intent.Namespace, intent.PodName, metav1.DeleteOptions{
+			GracePeriodSeconds: &gracePeriod,
+			PropagationPolicy:  &backgroundDeletion,
+			Preconditions:      &metav1.Preconditions{UID: &uid},
+		})
+		// the pod has gone, or it's a new pod with the same name
+		if err == nil || apierrors.IsNotFound(err) || apierrors.IsConflict(err) {
+			return nil
+		}
+		return fmt.Errorf("delete pod %s err: %s", intent.PodName, err.Error())
+	}
+}
+
+// snapshotSourceDeleted returns whether the pure pod or cronjob of the intent has been deleted
+func (lf *ListFunc) snapshotSourceDeleted(intent *pkg.ReschedulingIntent) (bool, error) {
+	var obj metav1.Object
+	var err error
+	uid := intent.PodUID
+	if intent.OwnerKind == "CronJob" {
+		uid = intent.OwnerUID
+		obj, err = lf.cronJobs().Get(context.TODO(), intent.Namespace, intent.OwnerName, metav1.GetOptions{})
+	} else {
+		obj, err = lf.K8sClientSet.CoreV1().Pods(intent.Namespace).Get(context.TODO(), intent.PodName, metav1.GetOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(obj.GetUID()) != uid, nil
+}
@@ -0,0 +1,278 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package listfunc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/capabilities"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failOnce makes the first verb request on resource fail
+func failOnce(client *fake.Clientset, verb, resource string) {
+	failed := false
+	client.PrependReactor(verb, resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failed {
+			return false, nil, nil
+		}
+		failed = true
+		return true, nil, errors.New("injected error")
+	})
+}
+
+func TestRecreatePodResume(t *testing.T) {
+	pod, err := unMarshalPods("testdata/pure-pod-with-annotations.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod.CreationTimestamp = v1.Time{Time: time.Now()}
+	client := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "default"}}, pod)
+	failOnce(client, "create", "pods")
+	lf := &ListFunc{K8sClientSet: client}
+
+	if _, err := lf.doPods(pod); err == nil {
+		t.Fatal("test expected the pod creation to fail")
+	}
+	intents, err := lf.loadIntents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if intents[string(pod.UID)].Step != pkg.IntentStepDeleted {
+		t.Fatalf("test returned wrong intent step: got %v want %v", intents[string(pod.UID)].Step, pkg.IntentStepDeleted)
+	}
+
+	// the next period creates the deleted pod from the journaled snapshot
+	if unfinished := lf.resumeIntents(); unfinished.Len() != 0 {
+		t.Fatalf("test returned unfinished intents: %v", unfinished.List())
+	}
+	gotPod, err := lf.K8sClientSet.CoreV1().Pods("default").Get(context.TODO(), pod.Name, v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("test lost the pure pod: %v", err)
+	}
+	var gotPurePodInfo pkg.PurePodInfo
+	if err := json.Unmarshal([]byte(gotPod.Annotations[pkg.PurePodInfoString]), &gotPurePodInfo); err != nil {
+		t.Fatal(err)
+	}
+	if gotPurePodInfo.CurrentReschedulingTimes != 3 {
+		t.Errorf("test returned wrong current rescheduling times: got %v want %v", gotPurePodInfo.CurrentReschedulingTimes, 3)
+	}
+	if intents, _ := lf.loadIntents(); len(intents) != 0 {
+		t.Errorf("test didn't remove the finished intent: %v", intents)
+	}
+}
+
+func TestRescheduleOwnedPodResume(t *testing.T) {
+	pod, err := unMarshalPods("testdata/deploy-pod.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod.CreationTimestamp = v1.Time{Time: time.Now()}
+	deploy, err := unMarshalDeploy("testdata/deploy-with-annotations.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := unMarshalRs("testdata/deploy-rs.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "default"}}, pod, deploy, rs)
+	failOnce(client, "delete", "pods")
+	lf := &ListFunc{K8sClientSet: client}
+
+	podOwnerInfo, err := lf.GetPodOwnerInfo(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lf.doDeploys(pod, *podOwnerInfo); err == nil {
+		t.Fatal("test expected the pod deletion to fail")
+	}
+	// the pod is kept by the unfinished intent, it mustn't be counted again
+	if unfinished := lf.resumeIntents(); unfinished.Len() != 0 {
+		t.Fatalf("test returned unfinished intents: %v", unfinished.List())
+	}
+	if _, err := lf.K8sClientSet.CoreV1().Pods("default").Get(context.TODO(), pod.Name, v1.GetOptions{}); err == nil {
+		t.Errorf("test didn't delete the pod %s", pod.Name)
+	}
+	gotDeploy, err := lf.K8sClientSet.AppsV1().Deployments("default").Get(context.TODO(), deploy.Name, v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotDeployInfo pkg.DeployInfo
+	if err := json.Unmarshal([]byte(gotDeploy.Annotations[pkg.DeployInfoString]), &gotDeployInfo); err != nil {
+		t.Fatal(err)
+	}
+	if gotDeployInfo.CurrentReschedulingTimes != 3 {
+		t.Errorf("test returned wrong current rescheduling times: got %v want %v", gotDeployInfo.CurrentReschedulingTimes, 3)
+	}
+}
+
+func TestRescheduleOwnedPodEviction(t *testing.T) {
+	pod, err := unMarshalPods("testdata/deploy-pod.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod.CreationTimestamp = v1.Time{Time: time.Now()}
+	deploy, err := unMarshalDeploy("testdata/deploy-with-annotations.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := unMarshalRs("testdata/deploy-rs.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "default"}}, pod, deploy, rs)
+	// the PodDisruptionBudget of the deployment refuses the first eviction
+	evictions := 0
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		// the eviction is created in the version the api server serves
+		if _, ok := action.(k8stesting.CreateAction).GetObject().(*policyv1beta1.Eviction); !ok {
+			t.Errorf("test evicted the pod in the wrong version: %T", action.(k8stesting.CreateAction).GetObject())
+		}
+		evictions++
+		if evictions == 1 {
+			return true, nil, apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 10)
+		}
+		return true, nil, nil
+	})
+	lf := &ListFunc{K8sClientSet: client, EvictPods: true, Capabilities: &capabilities.Capabilities{EvictionGroupVersion: capabilities.EvictionV1beta1}}
+
+	podOwnerInfo, err := lf.GetPodOwnerInfo(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lf.doDeploys(pod, *podOwnerInfo); err == nil {
+		t.Fatal("test expected the pod eviction to be refused")
+	}
+	// the next period evicts the pod of the unfinished intent again
+	if unfinished := lf.resumeIntents(); unfinished.Len() != 0 {
+		t.Fatalf("test returned unfinished intents: %v", unfinished.List())
+	}
+	if evictions != 2 {
+		t.Errorf("test returned wrong evictions: got %d want %d", evictions, 2)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "delete" && action.GetResource().Resource == "pods" {
+			t.Errorf("test deleted the pod %s instead of evicting it", pod.Name)
+		}
+	}
+}
+
+func TestRescheduleOwnedPodRollback(t *testing.T) {
+	pod, err := unMarshalPods("testdata/deploy-pod.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploy, err := unMarshalDeploy("testdata/deploy-with-annotations.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf := &ListFunc{K8sClientSet: fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "default"}}, pod, deploy)}
+
+	// the leader was lost after journaling the intent, before updating the deployment
+	intent := newIntent(pod, "Deployment", deploy.Name)
+	intent.AnnotationKey = pkg.DeployInfoString
+	intent.AnnotationValue = `{"currentReschedulingTimes":3,"deployScheduledHosts":["master1","node1","node2"]}`
+	if err := lf.saveIntent(intent); err != nil {
+		t.Fatal(err)
+	}
+	if unfinished := lf.resumeIntents(); unfinished.Len() != 0 {
+		t.Fatalf("test returned unfinished intents: %v", unfinished.List())
+	}
+	if _, err := lf.K8sClientSet.CoreV1().Pods("default").Get(context.TODO(), pod.Name, v1.GetOptions{}); err != nil {
+		t.Errorf("test deleted the pod %s of a rolled back intent", pod.Name)
+	}
+	gotDeploy, err := lf.K8sClientSet.AppsV1().Deployments("default").Get(context.TODO(), deploy.Name, v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotDeploy.Annotations[pkg.DeployInfoString] != deploy.Annotations[pkg.DeployInfoString] {
+		t.Errorf("test changed the deployment state: got %v want %v", gotDeploy.Annotations[pkg.DeployInfoString], deploy.Annotations[pkg.DeployInfoString])
+	}
+}
+
+func TestIntentJournalBounds(t *testing.T) {
+	// an unfinished intent of another pod fills the journal
+	byteFiller, err := json.Marshal(&pkg.ReschedulingIntent{
+		Step:      pkg.IntentStepDeleted,
+		Namespace: "default",
+		PodName:   "busybox",
+		PodUID:    "filler",
+		OwnerKind: "Pod",
+		Snapshot:  []byte(`"` + strings.Repeat("x", pkg.MaxJournalSize) + `"`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fullJournal := map[string]string{"filler": string(byteFiller)}
+	tests := []struct {
+		name    string
+		journal map[string]string
+		// largeAnnotation makes the snapshot of the pod larger than pkg.MaxIntentSnapshotSize
+		largeAnnotation bool
+		wantIntents     int
+	}{
+		{
+			name:        "journal full",
+			journal:     fullJournal,
+			wantIntents: 1,
+		},
+		{
+			name:            "snapshot too large",
+			largeAnnotation: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod, err := unMarshalPods("testdata/pure-pod-with-annotations.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pod.CreationTimestamp = v1.Time{Time: time.Now()}
+			if test.largeAnnotation {
+				pod.Annotations["example.com/large"] = strings.Repeat("x", pkg.MaxIntentSnapshotSize)
+			}
+			objects := []runtime.Object{&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "default"}}, pod}
+			if test.journal != nil {
+				objects = append(objects, &corev1.ConfigMap{ObjectMeta: v1.ObjectMeta{Name: pkg.IntentJournalString, Namespace: pkg.NAMESPACE}, Data: test.journal})
+			}
+			lf := &ListFunc{K8sClientSet: fake.NewSimpleClientset(objects...)}
+
+			if _, err := lf.doPods(pod); err == nil {
+				t.Fatal("test expected the reschedule to fail")
+			}
+			gotPod, err := lf.K8sClientSet.CoreV1().Pods("default").Get(context.TODO(), pod.Name, v1.GetOptions{})
+			if err != nil || gotPod.UID != pod.UID {
+				t.Errorf("test deleted the pod of an intent which isn't journaled: %v", err)
+			}
+			intents, err := lf.loadIntents()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, found := intents[string(pod.UID)]; found || len(intents) != test.wantIntents {
+				t.Errorf("test returned wrong intents: got %d want %d", len(intents), test.wantIntents)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package listfunc
+
+import (
+	"context"
+	"fmt"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"kse/kse-rescheduler/pkg"
+)
+
+var jobResource = schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+
+// jobPodCompletionIndex returns the completion index of the pod if it belongs to an Indexed Job
+func jobPodCompletionIndex(jb *batchv1.Job, pod *corev1.Pod) (string, bool) {
+	if jb.Spec.CompletionMode == nil || *jb.Spec.CompletionMode != batchv1.IndexedCompletion {
+		return "", false
+	}
+	index, ok := pod.Annotations[batchv1.JobCompletionIndexAnnotation]
+	if !ok || index == "" {
+		return "", false
+	}
+	return index, true
+}
+
+// jobBackoffLimitExceeded returns true if deleting the pod would make the Job reach it's backoffLimit. A pod which is
+// already Failed has been counted in status.failed, deleting it won't be counted again
+func jobBackoffLimitExceeded(jb *batchv1.Job, pod *corev1.Pod) bool {
+	if jb.Spec.BackoffLimit == nil {
+		return false
+	}
+	failed := jb.Status.Failed
+	if pod.Status.Phase != corev1.PodFailed {
+		failed = failed + 1
+	}
+	return failed > *jb.Spec.BackoffLimit
+}
+
+// jobPodFailureAction returns the action of the first podFailurePolicy rule the pod matches, it's empty if the Job has
+// no podFailurePolicy or none of the rules match
+func (lf *ListFunc) jobPodFailureAction(jb *batchv1.Job, pod *corev1.Pod) (string, error) {
+	policy, err := lf.getJobPodFailurePolicy(jb)
+	if err != nil {
+		return "", err
+	}
+	if policy == nil {
+		return "", nil
+	}
+	for _, rule := range policy.Rules {
+		if podMatchesFailurePolicyRule(pod, rule) {
+			return rule.Action, nil
+		}
+	}
+	return "", nil
+}
+
+func (lf *ListFunc) getJobPodFailurePolicy(jb *batchv1.Job) (*pkg.PodFailurePolicy, error) {
+	// the older servers don't have the podFailurePolicy
+	if lf.DynamicClient == nil || !lf.capabilities().PodFailurePolicy {
+		return nil, nil
+	}
+	obj, err := lf.DynamicClient.Resource(jobResource).Namespace(jb.Namespace).Get(context.TODO(), jb.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get job %s podFailurePolicy err: %s\n", jb.Name, err.Error())
+	}
+	field, found, err := unstructured.NestedMap(obj.Object, "spec", "podFailurePolicy")
+	if err != nil {
+		return nil, fmt.Errorf("get job %s podFailurePolicy err: %s\n", jb.Name, err.Error())
+	}
+	if !found {
+		return nil, nil
+	}
+	var policy pkg.PodFailurePolicy
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(field, &policy); err != nil {
+		return nil, fmt.Errorf("convert job %s podFailurePolicy err: %s\n", jb.Name, err.Error())
+	}
+	return &policy, nil
+}
+
+func podMatchesFailurePolicyRule(pod *corev1.Pod, rule pkg.PodFailurePolicyRule) bool {
+	if rule.OnExitCodes != nil {
+		return podMatchesOnExitCodes(pod, rule.OnExitCodes)
+	}
+	for _, pattern := range rule.OnPodConditions {
+		for _, condition := range pod.Status.Conditions {
+			if string(condition.Type) == pattern.Type && string(condition.Status) == pattern.Status {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func podMatchesOnExitCodes(pod *corev1.Pod, requirement *pkg.PodFailurePolicyOnExitCodesRequirement) bool {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if requirement.ContainerName != nil && *requirement.ContainerName != cs.Name {
+			continue
+		}
+		// crashloopbackoff containers are waiting, the exit code is in the last termination state
+		terminated := cs.State.Terminated
+		if terminated == nil {
+			terminated = cs.LastTerminationState.Terminated
+		}
+		if terminated == nil || terminated.ExitCode == 0 {
+			continue
+		}
+		found := false
+		for _, value := range requirement.Values {
+			if value == terminated.ExitCode {
+				found = true
+				break
+			}
+		}
+		if requirement.Operator == pkg.PodFailurePolicyOnExitCodesOpIn && found {
+			return true
+		}
+		if requirement.Operator == pkg.PodFailurePolicyOnExitCodesOpNotIn && !found {
+			return true
+		}
+	}
+	return false
+}
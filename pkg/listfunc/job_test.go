@@ -0,0 +1,147 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package listfunc
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/capabilities"
+	"testing"
+)
+
+func TestJobPodFailureAction(t *testing.T) {
+	tests := []struct{
+		name             string
+		podFailurePolicy map[string]interface{}
+		exitCode         int32
+		// capabilities are the api server's, the latest if nil
+		capabilities     *capabilities.Capabilities
+		wanted           string
+	}{
+		{
+			name:     "job without podFailurePolicy",
+			exitCode: 42,
+			wanted:   "",
+		},
+		{
+			name: "exit code in FailJob rule",
+			podFailurePolicy: map[string]interface{}{"rules": []interface{}{
+				map[string]interface{}{"action": "FailJob", "onExitCodes": map[string]interface{}{"operator": "In", "values": []interface{}{int64(42)}}},
+			}},
+			exitCode: 42,
+			wanted:   pkg.PodFailurePolicyActionFailJob,
+		},
+		{
+			name: "exit code not in FailJob rule but in Ignore rule",
+			podFailurePolicy: map[string]interface{}{"rules": []interface{}{
+				map[string]interface{}{"action": "FailJob", "onExitCodes": map[string]interface{}{"operator": "In", "values": []interface{}{int64(42)}}},
+				map[string]interface{}{"action": "Ignore", "onExitCodes": map[string]interface{}{"operator": "NotIn", "values": []interface{}{int64(42)}}},
+			}},
+			exitCode: 1,
+			wanted:   pkg.PodFailurePolicyActionIgnore,
+		},
+		{
+			name: "server without podFailurePolicy",
+			podFailurePolicy: map[string]interface{}{"rules": []interface{}{
+				map[string]interface{}{"action": "FailJob", "onExitCodes": map[string]interface{}{"operator": "In", "values": []interface{}{int64(42)}}},
+			}},
+			exitCode:     42,
+			capabilities: &capabilities.Capabilities{CronJobGroupVersion: capabilities.CronJobV1},
+			wanted:       "",
+		},
+		{
+			name: "pod condition in Ignore rule",
+			podFailurePolicy: map[string]interface{}{"rules": []interface{}{
+				map[string]interface{}{"action": "Ignore", "onPodConditions": []interface{}{map[string]interface{}{"type": "PodScheduled", "status": "True"}}},
+			}},
+			exitCode: 1,
+			wanted:   pkg.PodFailurePolicyActionIgnore,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jb, err := unMarshalJob("testdata/job-with-annotations.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pod, err := unMarshalPods("testdata/job-pod.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pod.Status.ContainerStatuses[0].State = corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: tt.exitCode}}
+
+			unstructuredJob, err := runtime.DefaultUnstructuredConverter.ToUnstructured(jb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.podFailurePolicy != nil {
+				if err := unstructured.SetNestedMap(unstructuredJob, tt.podFailurePolicy, "spec", "podFailurePolicy"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			lf := &ListFunc{
+				K8sClientSet:  fake.NewSimpleClientset(jb),
+				DynamicClient: dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), &unstructured.Unstructured{Object: unstructuredJob}),
+				Capabilities:  tt.capabilities,
+			}
+			got, err := lf.jobPodFailureAction(jb, pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.wanted {
+				t.Errorf("test returned wrong action: got %v want %v", got, tt.wanted)
+			}
+		})
+	}
+}
+
+func TestJobBackoffLimitExceeded(t *testing.T) {
+	tests := []struct{
+		name     string
+		jobFile  string
+		podPhase corev1.PodPhase
+		wanted   bool
+	}{
+		{
+			name:     "running pod within backoffLimit",
+			jobFile:  "testdata/job-with-annotations.json",
+			podPhase: corev1.PodRunning,
+			wanted:   false,
+		},
+		{
+			name:     "running pod reaches backoffLimit",
+			jobFile:  "testdata/job-backoff-limit-exceeded.json",
+			podPhase: corev1.PodRunning,
+			wanted:   true,
+		},
+		{
+			name:     "failed pod has been counted",
+			jobFile:  "testdata/job-backoff-limit-exceeded.json",
+			podPhase: corev1.PodFailed,
+			wanted:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jb, err := unMarshalJob(tt.jobFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pod := &corev1.Pod{Status: corev1.PodStatus{Phase: tt.podPhase}}
+			if got := jobBackoffLimitExceeded(jb, pod); got != tt.wanted {
+				t.Errorf("test returned wrong result: got %v want %v", got, tt.wanted)
+			}
+		})
+	}
+}
@@ -16,34 +16,122 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
 	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/capabilities"
+	"kse/kse-rescheduler/pkg/workloadstate"
 	"time"
 )
 
 type ListFunc struct {
 	K8sClientSet                kubernetes.Interface
+	// DynamicClient reads the fields our typed clients don't know yet, e.g. the Job's podFailurePolicy
+	DynamicClient               dynamic.Interface
+	// JournalNamespace is the namespace the rescheduling intents are journaled in
+	JournalNamespace            string
+	// WatchNamespaces scopes the listFunc and the gc to the namespaces, the nodes aren't read in this mode so only
+	// namespaced Roles are needed. All the namespaces are watched if it's empty
+	WatchNamespaces             []string
+	// ExcludedNamespaces are the namespaces whose pods are never rescheduled
+	ExcludedNamespaces          []string
+	// ReschedulingWindow is how long after its creation a failed pod is rescheduled away from the nodes it failed on,
+	// the older pods are recreated without the exclusions, it's OutOfTimeToRescheduling if not set
+	ReschedulingWindow          time.Duration
+	// Capabilities are the APIs the api server serves, capabilities.Default if it's nil
+	Capabilities                *capabilities.Capabilities
+	// MaxReschedulesPerPeriod bounds the abnormal pods rescheduled in a period, the rest are handled in the next periods,
+	// 0 is unlimited
+	MaxReschedulesPerPeriod     int
+	// EvictPods evicts the pods instead of deleting them, so their PodDisruptionBudgets are respected
+	EvictPods                   bool
 }
 
 func NewListFunc() ListFunc {
 	return ListFunc{}
 }
 
+func (lf *ListFunc) reschedulingWindow() time.Duration {
+	if lf.ReschedulingWindow > 0 {
+		return lf.ReschedulingWindow
+	}
+	timeDura, _ := time.ParseDuration(pkg.OutOfTimeToRescheduling)
+	return timeDura
+}
+
+func (lf *ListFunc) capabilities() *capabilities.Capabilities {
+	if lf.Capabilities != nil {
+		return lf.Capabilities
+	}
+	return capabilities.Default
+}
+
+// cronJobs returns the client of the CronJobs in the version the api server serves
+func (lf *ListFunc) cronJobs() *capabilities.CronJobClient {
+	return capabilities.NewCronJobClient(lf.K8sClientSet, lf.capabilities().CronJobGroupVersion)
+}
+
+// deletePod evicts the pod with EvictPods if the api server serves pods/eviction, otherwise it deletes the pod. The
+// eviction a PodDisruptionBudget doesn't allow yet fails with a TooManyRequests error
+func (lf *ListFunc) deletePod(namespace, name string, opts metav1.DeleteOptions) error {
+	if evictionGroupVersion := lf.capabilities().EvictionGroupVersion; lf.EvictPods && evictionGroupVersion != "" {
+		return capabilities.NewEvictionClient(lf.K8sClientSet, evictionGroupVersion).Evict(context.TODO(), namespace, name, opts)
+	}
+	return lf.K8sClientSet.CoreV1().Pods(namespace).Delete(context.TODO(), name, opts)
+}
+
+// namespaces returns the namespaces to list, metav1.NamespaceAll if all the namespaces are watched
+func (lf *ListFunc) namespaces() []string {
+	if len(lf.WatchNamespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	return lf.WatchNamespaces
+}
+
+// namespaceScoped is true if only WatchNamespaces are watched, the cluster scoped resources can't be read then
+func (lf *ListFunc) namespaceScoped() bool {
+	return len(lf.WatchNamespaces) > 0
+}
+
+// namespaceDescription names the namespace in the logs
+func namespaceDescription(namespace string) string {
+	if namespace == metav1.NamespaceAll {
+		return "all namespaces"
+	}
+	return "namespace " + namespace
+}
+
+func (lf *ListFunc) namespaceExcluded(namespace string) bool {
+	for _, excluded := range lf.ExcludedNamespaces {
+		if excluded == namespace {
+			return true
+		}
+	}
+	return false
+}
+
 func (lf *ListFunc) List() {
-	podList, err := lf.K8sClientSet.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		klog.Errorf("list pods in all namespaces err: %s\n", err.Error())
-		return
+	var allNameSpacePods []corev1.Pod
+	for _, namespace := range lf.namespaces() {
+		podList, err := lf.K8sClientSet.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			klog.Errorf("list pods in %s err: %s\n", namespaceDescription(namespace), err.Error())
+			return
+		}
+		allNameSpacePods = append(allNameSpacePods, podList.Items...)
 	}
-	allNameSpacePods := podList.Items
 
 	//get the abnormalPods in the k8s cluster
 	var abnormalPods []corev1.Pod
 	for _, pod := range allNameSpacePods {
+		if lf.namespaceExcluded(pod.Namespace) {
+			continue
+		}
 		for _, condition := range pod.Status.Conditions {
 			if condition.Status == "False" {
 				abnormalPods = append(abnormalPods, pod)
@@ -52,72 +140,92 @@ func (lf *ListFunc) List() {
 		}
 	}
 
-	// beginning to rescheduling the abnormalPods
+	// resume or roll back the reschedules interrupted in the previous periods first
+	unfinishedPods := lf.resumeIntents()
+
+	// beginning to rescheduling the abnormalPods, only the pods deleted or recreated count against
+	// MaxReschedulesPerPeriod so the pods which aren't rescheduled never hold back the others
+	rescheduledPods := 0
 	for _, pod := range abnormalPods {
-		// Avoid pod has been deleted at this list pods period
-		_, err := lf.K8sClientSet.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{})
-		if err != nil {
-			klog.Errorf("get pod: %s err: %s\n", pod.Name, err.Error())
+		if unfinishedPods.Has(string(pod.UID)) {
 			continue
 		}
-		if len(pod.OwnerReferences) >0 {
-			podOwnerInfo, err := lf.GetPodOwnerInfo(&pod)
+		if lf.MaxReschedulesPerPeriod > 0 && rescheduledPods >= lf.MaxReschedulesPerPeriod {
+			klog.Infof("rescheduled %d abnormal pods in this period, the rest are handled in the next periods\n", rescheduledPods)
+			break
+		}
+		rescheduled := false
+		// the state is recomputed from the objects read again if it has been changed by others
+		err := retry.OnError(retry.DefaultRetry, workloadstate.IsStateChanged, func() error {
+			// Avoid pod has been deleted at this list pods period
+			latestPod, err := lf.K8sClientSet.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{})
 			if err != nil {
-				klog.Error(err.Error())
-				continue
+				return fmt.Errorf("get pod: %s err: %s\n", pod.Name, err.Error())
 			}
-			switch podOwnerInfo.PodOwnerType {
-			case "Deployment":
-				if err := lf.doDeploys(&pod, *podOwnerInfo); err != nil {
-					klog.Error(err.Error())
-					continue
-				}
-			case "ReplicaSet":
-				if err := lf.doRs(&pod, *podOwnerInfo); err != nil {
-					klog.Error(err.Error())
-					continue
-				}
-			case "CronJob":
-				if !podCompleted(&pod) {
-					if err := lf.doCjs(&pod, *podOwnerInfo); err != nil {
-						klog.Error(err.Error())
-						continue
-					}
-				}
-			case "Job":
-				if !podCompleted(&pod) {
-					if err := lf.doJobs(&pod, *podOwnerInfo); err != nil {
-						klog.Error(err.Error())
-						continue
-					}
-				}
-			case "DaemonSet":
-				if err := lf.doDs(&pod, *podOwnerInfo); err != nil {
-					klog.Error(err.Error())
-					continue
-				}
-			case "StatefulSet":
-				if err := lf.doSts(&pod, *podOwnerInfo); err != nil {
-					klog.Error(err.Error())
-					continue
-				}
+			// a new pod with the same name
+			if latestPod.UID != pod.UID {
+				return nil
 			}
+			rescheduled, err = lf.reschedulePod(latestPod)
+			return err
+		})
+		if err != nil {
+			klog.Error(err.Error())
+		}
+		if rescheduled {
+			rescheduledPods++
+		}
+	}
+}
 
-		} else {
-			//pure pod
-			if err := lf.doPods(&pod); err != nil {
-				klog.Error(err.Error())
-				continue
+// reschedulePod returns true if the pod was deleted or recreated to be rescheduled. The pods pending because no node
+// fits them without their scheduled hosts are left to the scheduler, which relaxes the exclusions of the Podrescheduling
+// plugin in PostFilter. The webhook injects the required nodeAffinity exclusions only if a node the pod may be
+// scheduled to is left, but the pod may still not fit it, these pods are relaxed by relaxPendingPod.
+func (lf *ListFunc) reschedulePod(pod *corev1.Pod) (bool, error) {
+	if exclusions, ok := pendingOnExclusions(pod); ok {
+		return lf.relaxPendingPod(pod, exclusions)
+	}
+	if len(pod.OwnerReferences) >0 {
+		podOwnerInfo, err := lf.GetPodOwnerInfo(pod)
+		if err != nil {
+			return false, err
+		}
+		switch podOwnerInfo.PodOwnerType {
+		case "Deployment":
+			return lf.doDeploys(pod, *podOwnerInfo)
+		case "ReplicaSet":
+			return lf.doRs(pod, *podOwnerInfo)
+		case "CronJob":
+			// the CronJobs aren't rescheduled if the api server doesn't serve them
+			if !podCompleted(pod) && lf.capabilities().CronJobGroupVersion != "" {
+				return lf.doCjs(pod, *podOwnerInfo)
 			}
+		case "Job":
+			if !podCompleted(pod) {
+				return lf.doJobs(pod, *podOwnerInfo)
+			}
+		case "DaemonSet":
+			return lf.doDs(pod, *podOwnerInfo)
+		case "StatefulSet":
+			return lf.doSts(pod, *podOwnerInfo)
 		}
+		return false, nil
 	}
+	//pure pod
+	return lf.doPods(pod)
 }
 
 func (lf *ListFunc) GetPodOwnerInfo(pod *corev1.Pod) (*pkg.PodOwnerInfo, error) {
+	return lf.GetPodOwnerInfoWithContext(context.TODO(), pod)
+}
+
+// GetPodOwnerInfoWithContext is GetPodOwnerInfo bounded by the ctx, e.g. the timeout of an admission request
+func (lf *ListFunc) GetPodOwnerInfoWithContext(ctx context.Context, pod *corev1.Pod) (*pkg.PodOwnerInfo, error) {
 	var podOwnerInfo pkg.PodOwnerInfo
 	if pod.OwnerReferences[0].Kind == "ReplicaSet" {
 		rsName := pod.OwnerReferences[0].Name
-		rs, err := lf.K8sClientSet.AppsV1().ReplicaSets(pod.Namespace).Get(context.TODO(), rsName, metav1.GetOptions{})
+		rs, err := lf.K8sClientSet.AppsV1().ReplicaSets(pod.Namespace).Get(ctx, rsName, metav1.GetOptions{})
 		if err != nil {
 			return nil, fmt.Errorf("get pod %s owner ReplicaSets err: %s\n", pod.Name, err.Error())
 		}
@@ -141,7 +249,7 @@ func (lf *ListFunc) GetPodOwnerInfo(pod *corev1.Pod) (*pkg.PodOwnerInfo, error)
 	}
 	if pod.OwnerReferences[0].Kind == "Job" {
 		jbName := pod.OwnerReferences[0].Name
-		jb, err := lf.K8sClientSet.BatchV1().Jobs(pod.Namespace).Get(context.TODO(), jbName, metav1.GetOptions{})
+		jb, err := lf.K8sClientSet.BatchV1().Jobs(pod.Namespace).Get(ctx, jbName, metav1.GetOptions{})
 		if err != nil {
 			return nil, fmt.Errorf("get pod %s onwer Job err: %s\n", pod.Name, err.Error())
 		}
@@ -180,19 +288,6 @@ func podHasScheduled(pod *corev1.Pod) bool {
 	return podHasScheduled
 }
 
-func podUnschedulable(pod *corev1.Pod) bool {
-	var podUnschedulable bool
-	podUnschedulable = false
-	for _, condition := range pod.Status.Conditions {
-		if condition.Type == "PodScheduled" && condition.Status == "False" {
-			if _, ok := pod.Annotations[pkg.SchedulinedHostString]; ok {
-				podUnschedulable = true
-			}
-		}
-	}
-	return podUnschedulable
-}
-
 func podCompleted(pod *corev1.Pod) bool {
 	// avoid pod unschedulable and it's phase is Pending
 	if pod.Status.Phase == "Pending" {
@@ -215,7 +310,7 @@ func (lf *ListFunc) delPod(pod *corev1.Pod) error{
 		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
 		backgroundDeletion := metav1.DeletePropagationBackground
 		gracePeriod := int64(0)
-		if err := lf.K8sClientSet.CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod, PropagationPolicy: &backgroundDeletion}); err != nil {
+		if err := lf.deletePod(pod.Namespace, pod.Name, metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod, PropagationPolicy: &backgroundDeletion}); err != nil {
 			return fmt.Errorf("delete pod %s err: %s", pod.Name, err.Error())
 		}
 		return nil
@@ -226,57 +321,44 @@ func (lf *ListFunc) delPod(pod *corev1.Pod) error{
 	return nil
 }
 
+// delCj deletes the cronjob only if it's unchanged since it was read, the cronjob carries the kse.com/cj state which is
+// created again by recreateCj
 func (lf *ListFunc) delCj(cj *batchv1.CronJob) error {
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		gracePeriod := int64(0)
-		backgroundDeletion := metav1.DeletePropagationBackground
-		if err := lf.K8sClientSet.BatchV1().CronJobs(cj.Namespace).Delete(context.TODO(), cj.Name, metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod, PropagationPolicy: &backgroundDeletion}); err != nil {
-			return fmt.Errorf("delete cronjob %s err: %s", cj.Name, err.Error())
-		}
-		return nil
+	gracePeriod := int64(0)
+	backgroundDeletion := metav1.DeletePropagationBackground
+	err := lf.cronJobs().Delete(context.TODO(), cj.Namespace, cj.Name, metav1.DeleteOptions{
+		GracePeriodSeconds: &gracePeriod,
+		PropagationPolicy:  &backgroundDeletion,
+		Preconditions:      &metav1.Preconditions{UID: &cj.UID, ResourceVersion: &cj.ResourceVersion},
 	})
-	if retryErr != nil {
-		return retryErr
+	if apierrors.IsConflict(err) {
+		return fmt.Errorf("delete cronjob %s err: %w", cj.Name, workloadstate.ErrStateChanged)
 	}
-	return nil
-}
-
-func (lf *ListFunc) delJob(job *batchv1.Job) error {
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		gracePeriod := int64(0)
-		backgroundDeletion := metav1.DeletePropagationBackground
-		if err := lf.K8sClientSet.BatchV1().Jobs(job.Namespace).Delete(context.TODO(), job.Name, metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod, PropagationPolicy: &backgroundDeletion}); err != nil {
-			return fmt.Errorf("delete job %s err: %s", job.Name, err.Error())
-		}
-		return nil
-	})
-	if retryErr != nil {
-		return retryErr
+	if err != nil {
+		return fmt.Errorf("delete cronjob %s err: %s", cj.Name, err.Error())
 	}
 	return nil
 }
 
-func (lf *ListFunc) doDeploys(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error {
+func (lf *ListFunc) doDeploys(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) (bool, error) {
 	deploy, err := lf.K8sClientSet.AppsV1().Deployments(pod.Namespace).Get(context.TODO(), podOwnerInfo.PodOwnerName, metav1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("get pod %s owner Deployment err: %s\n", pod.Name, err.Error())
+		return false, fmt.Errorf("get pod %s owner Deployment err: %s\n", pod.Name, err.Error())
 	}
 	if _, ok := deploy.Annotations[pkg.SchedulingRetrieString]; ok {
 		var schedulingRetries int
 		var deployInfo pkg.DeployInfo
 		var deployScheduledHosts []string
 		if err := json.Unmarshal([]byte(deploy.Annotations[pkg.SchedulingRetrieString]), &schedulingRetries); err != nil {
-			return fmt.Errorf("unmarshal %s deployment %s scheduling-retries err: %s\n", pod.Name, deploy.Name, err.Error())
+			return false, fmt.Errorf("unmarshal %s deployment %s scheduling-retries err: %s\n", pod.Name, deploy.Name, err.Error())
 		}
 		totalSchedulingRetries := schedulingRetries * int(*deploy.Spec.Replicas)
 		nowTime := time.Now()
-		timeDura, _ := time.ParseDuration(pkg.OutOfTimeToRescheduling)
+		timeDura := lf.reschedulingWindow()
 		if nowTime.Before(pod.CreationTimestamp.Add(timeDura)) {
 			if _, ok := deploy.Annotations[pkg.DeployInfoString]; ok {
 				if err := json.Unmarshal([]byte(deploy.Annotations[pkg.DeployInfoString]), &deployInfo); err != nil {
-					return fmt.Errorf("unmarshal deployment %s kse.com/deploy err: %s\n", deploy.Name, err.Error())
+					return false, fmt.Errorf("unmarshal deployment %s kse.com/deploy err: %s\n", deploy.Name, err.Error())
 				}
 				// only for the successful scheduled pods
 				if podHasScheduled(pod) {
@@ -284,47 +366,30 @@ func (lf *ListFunc) doDeploys(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) er
 						deployInfo := pkg.DeployInfo{
 							CurrentReschedulingTimes: deployInfo.CurrentReschedulingTimes + 1,
 							DeployScheduledHosts: append(deployInfo.DeployScheduledHosts, pod.Spec.NodeName)}
-						if err := lf.updateDeploy(deploy, &deployInfo); err != nil {
-							return err
-						}
-						if err := lf.delPod(pod); err != nil {
-							return err
+						if err := lf.rescheduleDeployPod(deploy, pod, &deployInfo); err != nil {
+							return false, err
 						}
+						return true, nil
 					}
 					if deployInfo.CurrentReschedulingTimes > totalSchedulingRetries {
 						deployInfo := pkg.DeployInfo{
 							CurrentReschedulingTimes: deployInfo.CurrentReschedulingTimes,
 							DeployScheduledHosts: nil}
 						if err := lf.updateDeploy(deploy, &deployInfo); err != nil {
-							return err
+							return false, err
 						}
 					}
-					return nil
+					return false, nil
 				}
-				// our Podrescheduling preFilter plugin caused pod unschedulable, just delete pod and it's scheduled-hosts
-				if podUnschedulable(pod) {
-					deployInfo := pkg.DeployInfo{
-						CurrentReschedulingTimes: deployInfo.CurrentReschedulingTimes,
-						DeployScheduledHosts: nil}
-					if err := lf.updateDeploy(deploy, &deployInfo); err != nil {
-						return err
-					}
-					if err := lf.delPod(pod); err != nil {
-						return err
-					}
-				}
-
 			} else {
 				// first time rescheduling pods, so the deploy.Annotations[pkg.DeployInfoString] is empty, add it
 				if podHasScheduled(pod) {
 					deployScheduledHosts = append(deployScheduledHosts, pod.Spec.NodeName)
 					deployInfo := pkg.DeployInfo{CurrentReschedulingTimes: 1, DeployScheduledHosts: deployScheduledHosts}
-					if err := lf.updateDeploy(deploy, &deployInfo); err != nil {
-						return err
-					}
-					if err := lf.delPod(pod); err != nil {
-						return err
+					if err := lf.rescheduleDeployPod(deploy, pod, &deployInfo); err != nil {
+						return false, err
 					}
+					return true, nil
 				}
 			}
 			//if a pod's createTime max than OutOfTimeToRescheduling，just need to delete it, and don't have to
@@ -332,7 +397,7 @@ func (lf *ListFunc) doDeploys(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) er
 		} else {
 			if _, ok := deploy.Annotations[pkg.DeployInfoString]; ok {
 				if err := json.Unmarshal([]byte(deploy.Annotations[pkg.DeployInfoString]), &deployInfo); err != nil {
-					return fmt.Errorf("unmarshal deployment %s kse.com/deploy err: %s\n", deploy.Name, err.Error())
+					return false, fmt.Errorf("unmarshal deployment %s kse.com/deploy err: %s\n", deploy.Name, err.Error())
 				}
 				// only for the successful scheduled pods
 				if podHasScheduled(pod) {
@@ -340,72 +405,56 @@ func (lf *ListFunc) doDeploys(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) er
 						deployInfo := pkg.DeployInfo{
 							CurrentReschedulingTimes: deployInfo.CurrentReschedulingTimes + 1,
 							DeployScheduledHosts: nil}
-						if err := lf.updateDeploy(deploy, &deployInfo); err != nil {
-							return err
-						}
-						if err := lf.delPod(pod); err != nil {
-							return err
+						if err := lf.rescheduleDeployPod(deploy, pod, &deployInfo); err != nil {
+							return false, err
 						}
+						return true, nil
 					}
 					if deployInfo.CurrentReschedulingTimes > totalSchedulingRetries {
 						deployInfo := pkg.DeployInfo{
 							CurrentReschedulingTimes: deployInfo.CurrentReschedulingTimes,
 							DeployScheduledHosts: nil}
 						if err := lf.updateDeploy(deploy, &deployInfo); err != nil {
-							return err
+							return false, err
 						}
 					}
-					return nil
-				}
-				// our Podrescheduling preFilter plugin caused pod unschedulable, just delete pod and it's scheduled-hosts
-				if podUnschedulable(pod) {
-					deployInfo := pkg.DeployInfo{
-						CurrentReschedulingTimes: deployInfo.CurrentReschedulingTimes,
-						DeployScheduledHosts: nil}
-					if err := lf.updateDeploy(deploy, &deployInfo); err != nil {
-						return err
-					}
-					if err := lf.delPod(pod); err != nil {
-						return err
-					}
+					return false, nil
 				}
 			} else {
 				// first time rescheduling pods, so the deploy.Annotations[pkg.DeployInfoString] is empty, add it, and set
 				// DeployScheduledHosts nil
 				if podHasScheduled(pod) {
 					deployInfo := pkg.DeployInfo{CurrentReschedulingTimes: 1, DeployScheduledHosts: nil}
-					if err := lf.updateDeploy(deploy, &deployInfo); err != nil {
-						return err
-					}
-					if err := lf.delPod(pod); err != nil {
-						return err
+					if err := lf.rescheduleDeployPod(deploy, pod, &deployInfo); err != nil {
+						return false, err
 					}
+					return true, nil
 				}
 			}
 		}
 	}
-	return nil
+	return false, nil
 }
 
-func (lf *ListFunc) doRs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error {
+func (lf *ListFunc) doRs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) (bool, error) {
 	rs, err := lf.K8sClientSet.AppsV1().ReplicaSets(pod.Namespace).Get(context.TODO(), podOwnerInfo.PodOwnerName, metav1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("get pod %s owner ReplicaSets err: %s\n", pod.Name, err.Error())
+		return false, fmt.Errorf("get pod %s owner ReplicaSets err: %s\n", pod.Name, err.Error())
 	}
 	if _, ok := rs.Annotations[pkg.SchedulingRetrieString]; ok {
 		var schedulingRetries int
 		var rsInfo pkg.RsInfo
 		var rsScheduledHosts []string
 		if err := json.Unmarshal([]byte(rs.Annotations[pkg.SchedulingRetrieString]), &schedulingRetries); err != nil {
-			return fmt.Errorf("unmarshal %s ReplicaSets %s scheduling-retries err: %s\n", pod.Name, rs.Name, err.Error())
+			return false, fmt.Errorf("unmarshal %s ReplicaSets %s scheduling-retries err: %s\n", pod.Name, rs.Name, err.Error())
 		}
 		totalSchedulingRetries := schedulingRetries * int(*rs.Spec.Replicas)
 		nowTime := time.Now()
-		timeDura, _ := time.ParseDuration(pkg.OutOfTimeToRescheduling)
+		timeDura := lf.reschedulingWindow()
 		if nowTime.Before(pod.CreationTimestamp.Add(timeDura)) {
 			if _, ok := rs.Annotations[pkg.RsInfoString]; ok {
 				if err := json.Unmarshal([]byte(rs.Annotations[pkg.RsInfoString]), &rsInfo); err != nil {
-					return fmt.Errorf("unmarshal deployment %s kse.com/rs err: %s\n", rs.Name, err.Error())
+					return false, fmt.Errorf("unmarshal deployment %s kse.com/rs err: %s\n", rs.Name, err.Error())
 				}
 				// only for the successful scheduled pods
 				if podHasScheduled(pod) {
@@ -413,47 +462,30 @@ func (lf *ListFunc) doRs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error {
 						rsInfo := pkg.RsInfo{
 							CurrentReschedulingTimes: rsInfo.CurrentReschedulingTimes + 1,
 							RsScheduledHosts: append(rsInfo.RsScheduledHosts, pod.Spec.NodeName)}
-						if err := lf.updateRs(rs, &rsInfo); err != nil {
-							return err
-						}
-						if err := lf.delPod(pod); err != nil {
-							return err
+						if err := lf.rescheduleRsPod(rs, pod, &rsInfo); err != nil {
+							return false, err
 						}
+						return true, nil
 					}
 					if rsInfo.CurrentReschedulingTimes > totalSchedulingRetries {
 						rsInfo := pkg.RsInfo{
 							CurrentReschedulingTimes: rsInfo.CurrentReschedulingTimes,
 							RsScheduledHosts: nil}
 						if err := lf.updateRs(rs, &rsInfo); err != nil {
-							return err
+							return false, err
 						}
 					}
-					return nil
-				}
-				// our Podrescheduling preFilter plugin caused pod unschedulable, just delete pod and it's scheduled-hosts
-				if podUnschedulable(pod) {
-					rsInfo := pkg.RsInfo{
-						CurrentReschedulingTimes: rsInfo.CurrentReschedulingTimes,
-						RsScheduledHosts: nil}
-					if err := lf.updateRs(rs, &rsInfo); err != nil {
-						return err
-					}
-					if err := lf.delPod(pod); err != nil {
-						return err
-					}
+					return false, nil
 				}
-
 			} else {
 				// first time rescheduling pods, so the rs.Annotations[pkg.RsInfoString] is empty, add it
 				if podHasScheduled(pod) {
 					rsScheduledHosts = append(rsScheduledHosts, pod.Spec.NodeName)
 					rsInfo := pkg.RsInfo{CurrentReschedulingTimes: 1, RsScheduledHosts: rsScheduledHosts}
-					if err := lf.updateRs(rs, &rsInfo); err != nil {
-						return err
-					}
-					if err := lf.delPod(pod); err != nil {
-						return err
+					if err := lf.rescheduleRsPod(rs, pod, &rsInfo); err != nil {
+						return false, err
 					}
+					return true, nil
 				}
 			}
 			//if a pod's createTime max than OutOfTimeToRescheduling，just need to delete it, and don't have to
@@ -461,7 +493,7 @@ func (lf *ListFunc) doRs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error {
 		} else {
 			if _, ok := rs.Annotations[pkg.RsInfoString]; ok {
 				if err := json.Unmarshal([]byte(rs.Annotations[pkg.RsInfoString]), &rsInfo); err != nil {
-					return fmt.Errorf("unmarshal replicasets %s kse.com/rs err: %s\n", rs.Name, err.Error())
+					return false, fmt.Errorf("unmarshal replicasets %s kse.com/rs err: %s\n", rs.Name, err.Error())
 				}
 				// only for the successful scheduled pods
 				if podHasScheduled(pod) {
@@ -469,71 +501,55 @@ func (lf *ListFunc) doRs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error {
 						rsInfo := pkg.RsInfo{
 							CurrentReschedulingTimes: rsInfo.CurrentReschedulingTimes + 1,
 							RsScheduledHosts: nil}
-						if err := lf.updateRs(rs, &rsInfo); err != nil {
-							return err
-						}
-						if err := lf.delPod(pod); err != nil {
-							return err
+						if err := lf.rescheduleRsPod(rs, pod, &rsInfo); err != nil {
+							return false, err
 						}
+						return true, nil
 					}
 					if rsInfo.CurrentReschedulingTimes > totalSchedulingRetries {
 						rsInfo := pkg.RsInfo{
 							CurrentReschedulingTimes: rsInfo.CurrentReschedulingTimes,
 							RsScheduledHosts: nil}
 						if err := lf.updateRs(rs, &rsInfo); err != nil {
-							return err
+							return false, err
 						}
 					}
-					return nil
-				}
-				// our Podrescheduling preFilter plugin caused pod unschedulable, just delete pod and it's scheduled-hosts
-				if podUnschedulable(pod) {
-					rsInfo := pkg.RsInfo{
-						CurrentReschedulingTimes: rsInfo.CurrentReschedulingTimes,
-						RsScheduledHosts: nil}
-					if err := lf.updateRs(rs, &rsInfo); err != nil {
-						return err
-					}
-					if err := lf.delPod(pod); err != nil {
-						return err
-					}
+					return false, nil
 				}
 			} else {
 				// first time rescheduling pods, so the rs.Annotations[pkg.RsInfoString] is empty, add it, and set
 				// RsScheduledHosts nil
 				if podHasScheduled(pod) {
 					rsInfo := pkg.RsInfo{CurrentReschedulingTimes: 1, RsScheduledHosts: nil}
-					if err := lf.updateRs(rs, &rsInfo); err != nil {
-						return err
-					}
-					if err := lf.delPod(pod); err != nil {
-						return err
+					if err := lf.rescheduleRsPod(rs, pod, &rsInfo); err != nil {
+						return false, err
 					}
+					return true, nil
 				}
 			}
 		}
 	}
-	return nil
+	return false, nil
 }
 
-func (lf *ListFunc) doCjs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error {
-	cj, err := lf.K8sClientSet.BatchV1().CronJobs(pod.Namespace).Get(context.TODO(), podOwnerInfo.PodOwnerName, metav1.GetOptions{})
+func (lf *ListFunc) doCjs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) (bool, error) {
+	cj, err := lf.cronJobs().Get(context.TODO(), pod.Namespace, podOwnerInfo.PodOwnerName, metav1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("get pod %s owner CronJob err: %s\n", pod.Name, err.Error())
+		return false, fmt.Errorf("get pod %s owner CronJob err: %s\n", pod.Name, err.Error())
 	}
 	if _, ok := cj.Annotations[pkg.SchedulingRetrieString]; ok {
 		var schedulingRetries int
 		var cjInfo pkg.CjInfo
 		var cjScheduledHosts []string
 		if err := json.Unmarshal([]byte(cj.Annotations[pkg.SchedulingRetrieString]), &schedulingRetries); err != nil {
-			return fmt.Errorf("unmarshal %s cronjob %s scheduling-retries err: %s\n", pod.Name, cj.Name, err.Error())
+			return false, fmt.Errorf("unmarshal %s cronjob %s scheduling-retries err: %s\n", pod.Name, cj.Name, err.Error())
 		}
 		nowTime := time.Now()
-		timeDura, _ := time.ParseDuration(pkg.OutOfTimeToRescheduling)
+		timeDura := lf.reschedulingWindow()
 		if nowTime.Before(pod.CreationTimestamp.Add(timeDura)) {
 			if _, ok := cj.Annotations[pkg.CjInfoString]; ok {
 				if err := json.Unmarshal([]byte(cj.Annotations[pkg.CjInfoString]), &cjInfo); err != nil {
-					return fmt.Errorf("unmarshal cronjob %s kse.com/cj err: %s\n", cj.Name, err.Error())
+					return false, fmt.Errorf("unmarshal cronjob %s kse.com/cj err: %s\n", cj.Name, err.Error())
 				}
 				// only for the successful scheduled pods
 				if podHasScheduled(pod) {
@@ -542,49 +558,31 @@ func (lf *ListFunc) doCjs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error
 							CurrentReschedulingTimes: cjInfo.CurrentReschedulingTimes + 1,
 							CjScheduledHosts: append(cjInfo.CjScheduledHosts, pod.Spec.NodeName)}
 						// we just need to delete cronjob, and it's pods will be deleted
-						if err := lf.delCj(cj); err != nil {
-							return err
-						}
-						if err := lf.createCj(cj, &cjInfo); err != nil {
-							return err
+						if err := lf.recreateCj(cj, pod, &cjInfo); err != nil {
+							return false, err
 						}
+						return true, nil
 					}
 					if cjInfo.CurrentReschedulingTimes > schedulingRetries {
 						cjInfo := pkg.CjInfo{
 							CurrentReschedulingTimes: cjInfo.CurrentReschedulingTimes,
 							CjScheduledHosts: nil}
 						if err := lf.updateCj(cj, &cjInfo); err != nil {
-							return err
+							return false, err
 						}
 					}
-					return nil
-				}
-				// our Podrescheduling preFilter plugin caused pod unschedulable, just delete pod and it's scheduled-hosts
-				if podUnschedulable(pod) {
-					cjInfo := pkg.CjInfo{
-						CurrentReschedulingTimes: cjInfo.CurrentReschedulingTimes,
-						CjScheduledHosts: nil}
-					// we just need to delete cronjob, and it's pods will be deleted
-					if err := lf.delCj(cj); err != nil {
-						return err
-					}
-					if err := lf.createCj(cj, &cjInfo); err != nil {
-						return err
-					}
+					return false, nil
 				}
-
 			} else {
 				// first time rescheduling pods, so the cj.Annotations[pkg.CjInfoString] is empty, add it
 				if podHasScheduled(pod) {
 					cjScheduledHosts = append(cjScheduledHosts, pod.Spec.NodeName)
 					cjInfo := pkg.CjInfo{CurrentReschedulingTimes: 1, CjScheduledHosts: cjScheduledHosts}
 					// we just need to delete cronjob, and it's pods will be deleted
-					if err := lf.delCj(cj); err != nil {
-						return err
-					}
-					if err := lf.createCj(cj, &cjInfo); err != nil {
-						return err
+					if err := lf.recreateCj(cj, pod, &cjInfo); err != nil {
+						return false, err
 					}
+					return true, nil
 				}
 			}
 			//if a pod's createTime max than OutOfTimeToRescheduling，just need to delete it, and don't have to
@@ -592,7 +590,7 @@ func (lf *ListFunc) doCjs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error
 		} else {
 			if _, ok := cj.Annotations[pkg.CjInfoString]; ok {
 				if err := json.Unmarshal([]byte(cj.Annotations[pkg.CjInfoString]), &cjInfo); err != nil {
-					return fmt.Errorf("unmarshal cronjob %s kse.com/cj err: %s\n", cj.Name, err.Error())
+					return false, fmt.Errorf("unmarshal cronjob %s kse.com/cj err: %s\n", cj.Name, err.Error())
 				}
 				// only for the successful scheduled pods
 				if podHasScheduled(pod) {
@@ -601,35 +599,20 @@ func (lf *ListFunc) doCjs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error
 							CurrentReschedulingTimes: cjInfo.CurrentReschedulingTimes + 1,
 							CjScheduledHosts: nil}
 						// we just need to delete cronjob, and it's pods will be deleted
-						if err := lf.delCj(cj); err != nil {
-							return err
-						}
-						if err := lf.createCj(cj, &cjInfo); err != nil {
-							return err
+						if err := lf.recreateCj(cj, pod, &cjInfo); err != nil {
+							return false, err
 						}
+						return true, nil
 					}
 					if cjInfo.CurrentReschedulingTimes > schedulingRetries {
 						cjInfo := pkg.CjInfo{
 							CurrentReschedulingTimes: cjInfo.CurrentReschedulingTimes,
 							CjScheduledHosts: nil}
 						if err := lf.updateCj(cj, &cjInfo); err != nil {
-							return err
+							return false, err
 						}
 					}
-					return nil
-				}
-				// our Podrescheduling preFilter plugin caused pod unschedulable, just delete pod and it's scheduled-hosts
-				if podUnschedulable(pod) {
-					cjInfo := pkg.CjInfo{
-						CurrentReschedulingTimes: cjInfo.CurrentReschedulingTimes,
-						CjScheduledHosts: nil}
-					// we just need to delete cronjob, and it's pods will be deleted
-					if err := lf.delCj(cj); err != nil {
-						return err
-					}
-					if err := lf.createCj(cj, &cjInfo); err != nil {
-						return err
-					}
+					return false, nil
 				}
 			} else {
 				// first time rescheduling pods, so the cj.Annotations[pkg.CjInfoString] is empty, add it, and set
@@ -637,218 +620,184 @@ func (lf *ListFunc) doCjs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error
 				if podHasScheduled(pod) {
 					cjInfo := pkg.CjInfo{CurrentReschedulingTimes: 1, CjScheduledHosts: nil}
 					// we just need to delete cronjob, and it's pods will be deleted
-					if err := lf.delCj(cj); err != nil {
-						return err
-					}
-					if err := lf.createCj(cj, &cjInfo); err != nil {
-						return err
+					if err := lf.recreateCj(cj, pod, &cjInfo); err != nil {
+						return false, err
 					}
+					return true, nil
 				}
 			}
 		}
 	}
-	return nil
+	return false, nil
 }
 
-func (lf *ListFunc) doJobs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error {
+func (lf *ListFunc) doJobs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) (bool, error) {
 	jb, err := lf.K8sClientSet.BatchV1().Jobs(pod.Namespace).Get(context.TODO(), podOwnerInfo.PodOwnerName, metav1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("get pod %s owner Job err: %s\n", pod.Name, err.Error())
+		return false, fmt.Errorf("get pod %s owner Job err: %s\n", pod.Name, err.Error())
 	}
 	if _, ok := jb.Annotations[pkg.SchedulingRetrieString]; ok {
 		var schedulingRetries int
 		var jbInfo pkg.JobInfo
-		var jbScheduledHosts []string
 		if err := json.Unmarshal([]byte(jb.Annotations[pkg.SchedulingRetrieString]), &schedulingRetries); err != nil {
-			return fmt.Errorf("unmarshal %s job %s scheduling-retries err: %s\n", pod.Name, jb.Name, err.Error())
+			return false, fmt.Errorf("unmarshal %s job %s scheduling-retries err: %s\n", pod.Name, jb.Name, err.Error())
 		}
+		_, jbInfoFound := jb.Annotations[pkg.JobInfoString]
+		if jbInfoFound {
+			if err := json.Unmarshal([]byte(jb.Annotations[pkg.JobInfoString]), &jbInfo); err != nil {
+				return false, fmt.Errorf("unmarshal job %s kse.com/job err: %s\n", jb.Name, err.Error())
+			}
+		}
+		if !podHasScheduled(pod) {
+			return false, nil
+		}
+
+		// we never delete or recreate the Job, only the failed pod is deleted and the job controller creates
+		// a new one, so the Job's status.failed, succeeded indexes and completions are kept
+		action, err := lf.jobPodFailureAction(jb, pod)
+		if err != nil {
+			return false, err
+		}
+		if action == pkg.PodFailurePolicyActionFailJob {
+			klog.Infof("pod %s matches a FailJob rule of job %s podFailurePolicy, skip rescheduling\n", pod.Name, jb.Name)
+			return false, nil
+		}
+		if action != pkg.PodFailurePolicyActionIgnore && jobBackoffLimitExceeded(jb, pod) {
+			klog.Infof("rescheduling pod %s would exceed job %s backoffLimit, skip rescheduling\n", pod.Name, jb.Name)
+			return false, nil
+		}
+
 		nowTime := time.Now()
-		timeDura, _ := time.ParseDuration(pkg.OutOfTimeToRescheduling)
-		if nowTime.Before(pod.CreationTimestamp.Add(timeDura)) {
-			if _, ok := jb.Annotations[pkg.JobInfoString]; ok {
-				if err := json.Unmarshal([]byte(jb.Annotations[pkg.JobInfoString]), &jbInfo); err != nil {
-					return fmt.Errorf("unmarshal job %s kse.com/job err: %s\n", jb.Name, err.Error())
-				}
-				// only for the successful scheduled pods
-				if podHasScheduled(pod) {
-					if jbInfo.CurrentReschedulingTimes >= 1 && jbInfo.CurrentReschedulingTimes <= schedulingRetries {
-						jbInfo := pkg.JobInfo{
-							CurrentReschedulingTimes: jbInfo.CurrentReschedulingTimes + 1,
-							JobScheduledHosts: append(jbInfo.JobScheduledHosts, pod.Spec.NodeName)}
-						// we just need to delete job, and it's pods will be deleted
-						if err := lf.delJob(jb); err != nil {
-							return err
-						}
-						if err := lf.createJob(jb, &jbInfo); err != nil {
-							return err
-						}
-					}
-					if jbInfo.CurrentReschedulingTimes > schedulingRetries {
-						jbInfo := pkg.JobInfo{
-							CurrentReschedulingTimes: jbInfo.CurrentReschedulingTimes,
-							JobScheduledHosts: nil}
-						if err := lf.updateJob(jb, &jbInfo); err != nil {
-							return err
-						}
-					}
-					return nil
-				}
-				// our Podrescheduling preFilter plugin caused pod unschedulable, just delete pod and it's scheduled-hosts
-				if podUnschedulable(pod) {
-					jbInfo := pkg.JobInfo{
-						CurrentReschedulingTimes: jbInfo.CurrentReschedulingTimes,
-						JobScheduledHosts: nil}
-					// we just need to delete job, and it's pods will be deleted
-					if err := lf.delJob(jb); err != nil {
-						return err
-					}
-					if err := lf.createJob(jb, &jbInfo); err != nil {
-						return err
-					}
-				}
+		timeDura := lf.reschedulingWindow()
+		//if a pod's createTime max than OutOfTimeToRescheduling，don't have to keep scheduled-hosts, we don't need
+		// kube-scheduler to interfere the scheduling in the priFilter phase
+		keepScheduledHosts := nowTime.Before(pod.CreationTimestamp.Add(timeDura))
 
-			} else {
-				// first time rescheduling pods, so the jb.Annotations[pkg.JobInfoString] is empty, add it
-				if podHasScheduled(pod) {
-					jbScheduledHosts = append(jbScheduledHosts, pod.Spec.NodeName)
-					jbInfo := pkg.JobInfo{CurrentReschedulingTimes: 1, JobScheduledHosts: jbScheduledHosts}
-					// we just need to delete job, and it's pods will be deleted
-					if err := lf.delJob(jb); err != nil {
-						return err
-					}
-					if err := lf.createJob(jb, &jbInfo); err != nil {
-						return err
-					}
+		var needUpdate, needDelete bool
+		if index, ok := jobPodCompletionIndex(jb, pod); ok {
+			// Indexed Jobs count the retries and keep the scheduled hosts for every completion index
+			podInfo, found := jbInfo.IndexReschedulingMap[index]
+			podInfo, needUpdate, needDelete = nextReschedulingInfo(pod, podInfo, found, schedulingRetries, keepScheduledHosts)
+			if needUpdate {
+				if jbInfo.IndexReschedulingMap == nil {
+					jbInfo.IndexReschedulingMap = make(map[string]pkg.PurePodInfo)
 				}
+				jbInfo.IndexReschedulingMap[index] = podInfo
 			}
-			//if a pod's createTime max than OutOfTimeToRescheduling，just need to delete it, and don't have to
-			// keep scheduled-hosts, we don't need kube-scheduler to interfere the scheduling in the priFilter phase
 		} else {
-			if _, ok := jb.Annotations[pkg.JobInfoString]; ok {
-				if err := json.Unmarshal([]byte(jb.Annotations[pkg.JobInfoString]), &jbInfo); err != nil {
-					return fmt.Errorf("unmarshal job %s kse.com/jb err: %s\n", jb.Name, err.Error())
-				}
-				// only for the successful scheduled pods
-				if podHasScheduled(pod) {
-					if jbInfo.CurrentReschedulingTimes >= 1 && jbInfo.CurrentReschedulingTimes <= schedulingRetries {
-						jbInfo := pkg.JobInfo{
-							CurrentReschedulingTimes: jbInfo.CurrentReschedulingTimes + 1,
-							JobScheduledHosts: nil}
-						// we just need to delete job, and it's pods will be deleted
-						if err := lf.delJob(jb); err != nil {
-							return err
-						}
-						if err := lf.createJob(jb, &jbInfo); err != nil {
-							return err
-						}
-					}
-					if jbInfo.CurrentReschedulingTimes > schedulingRetries {
-						jbInfo := pkg.JobInfo{
-							CurrentReschedulingTimes: jbInfo.CurrentReschedulingTimes,
-							JobScheduledHosts: nil}
-						if err := lf.updateJob(jb, &jbInfo); err != nil {
-							return err
-						}
-					}
-					return nil
-				}
-				// our Podrescheduling preFilter plugin caused pod unschedulable, just delete pod and it's scheduled-hosts
-				if podUnschedulable(pod) {
-					jbInfo := pkg.JobInfo{
-						CurrentReschedulingTimes: jbInfo.CurrentReschedulingTimes,
-						JobScheduledHosts: nil}
-					// we just need to delete job, and it's pods will be deleted
-					if err := lf.delJob(jb); err != nil {
-						return err
-					}
-					if err := lf.createJob(jb, &jbInfo); err != nil {
-						return err
-					}
-				}
-			} else {
-				// first time rescheduling pods, so the jb.Annotations[pkg.JobInfoString] is empty, add it, and set
-				// JobScheduledHosts nil
-				if podHasScheduled(pod) {
-					jbInfo := pkg.JobInfo{CurrentReschedulingTimes: 1, JobScheduledHosts: nil}
-					// we just need to delete job, and it's pods will be deleted
-					if err := lf.delJob(jb); err != nil {
-						return err
-					}
-					if err := lf.createJob(jb, &jbInfo); err != nil {
-						return err
-					}
-				}
+			podInfo := pkg.PurePodInfo{CurrentReschedulingTimes: jbInfo.CurrentReschedulingTimes, PodScheduledHosts: jbInfo.JobScheduledHosts}
+			podInfo, needUpdate, needDelete = nextReschedulingInfo(pod, podInfo, jbInfoFound, schedulingRetries, keepScheduledHosts)
+			jbInfo.CurrentReschedulingTimes = podInfo.CurrentReschedulingTimes
+			jbInfo.JobScheduledHosts = podInfo.PodScheduledHosts
+		}
+		if needUpdate && needDelete {
+			if err := lf.rescheduleJobPod(jb, pod, &jbInfo); err != nil {
+				return false, err
+			}
+			return true, nil
+		} else if needUpdate {
+			if err := lf.updateJob(jb, &jbInfo); err != nil {
+				return false, err
 			}
 		}
 	}
-	return nil
+	return false, nil
 }
 
-func (lf *ListFunc) doDs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error {
+// nextReschedulingInfo returns the rescheduling info after rescheduling the pod once more, whether the info should be
+// written back to its owner, and whether the pod should be deleted
+func nextReschedulingInfo(pod *corev1.Pod, podInfo pkg.PurePodInfo, found bool, schedulingRetries int, keepScheduledHosts bool) (pkg.PurePodInfo, bool, bool) {
+	if !found {
+		// first time rescheduling this pod, only for the successful scheduled pods
+		if !podHasScheduled(pod) {
+			return podInfo, false, false
+		}
+		newPodInfo := pkg.PurePodInfo{CurrentReschedulingTimes: 1, PodScheduledHosts: nil}
+		if keepScheduledHosts {
+			newPodInfo.PodScheduledHosts = []string{pod.Spec.NodeName}
+		}
+		return newPodInfo, true, true
+	}
+	if podHasScheduled(pod) {
+		if podInfo.CurrentReschedulingTimes >= 1 && podInfo.CurrentReschedulingTimes <= schedulingRetries {
+			newPodInfo := pkg.PurePodInfo{CurrentReschedulingTimes: podInfo.CurrentReschedulingTimes + 1, PodScheduledHosts: nil}
+			if keepScheduledHosts {
+				newPodInfo.PodScheduledHosts = append(podInfo.PodScheduledHosts, pod.Spec.NodeName)
+			}
+			return newPodInfo, true, true
+		}
+		if podInfo.CurrentReschedulingTimes > schedulingRetries {
+			return pkg.PurePodInfo{CurrentReschedulingTimes: podInfo.CurrentReschedulingTimes, PodScheduledHosts: nil}, true, false
+		}
+		return podInfo, false, false
+	}
+	// the pending pods are left to the scheduler
+	return podInfo, false, false
+}
+
+func (lf *ListFunc) doDs(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) (bool, error) {
 	ds, err := lf.K8sClientSet.AppsV1().DaemonSets(pod.Namespace).Get(context.TODO(), podOwnerInfo.PodOwnerName, metav1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("get pod %s owner DaemonSet err: %s\n", pod.Name, err.Error())
+		return false, fmt.Errorf("get pod %s owner DaemonSet err: %s\n", pod.Name, err.Error())
 	}
 	if _, ok := ds.Annotations[pkg.SchedulingRetrieString]; ok {
 		var schedulingRetries int
 		if err := json.Unmarshal([]byte(ds.Annotations[pkg.SchedulingRetrieString]), &schedulingRetries); err != nil {
-			return fmt.Errorf("unmarshal %s daemonsets %s scheduling-retries err: %s\n", pod.Name, ds.Name, err.Error())
+			return false, fmt.Errorf("unmarshal %s daemonsets %s scheduling-retries err: %s\n", pod.Name, ds.Name, err.Error())
 		}
 
 		var dsCurrentReschedulingTimes int
 		if _, ok := ds.Annotations[pkg.CurrentReschedulingTimeString]; ok {
 			if err := json.Unmarshal([]byte(ds.Annotations[pkg.CurrentReschedulingTimeString]), &dsCurrentReschedulingTimes); err != nil {
-				return fmt.Errorf("unmarshal %s daemonsets %s kse.com/current-retries-times err: %s\n", pod.Name, ds.Name, err.Error())
+				return false, fmt.Errorf("unmarshal %s daemonsets %s kse.com/current-retries-times err: %s\n", pod.Name, ds.Name, err.Error())
 			}
 			if dsCurrentReschedulingTimes >= 1 && dsCurrentReschedulingTimes <= schedulingRetries {
 				dsCurrentReschedulingTimes = dsCurrentReschedulingTimes +1
 				byteDsCurrentReschedulingTimes, err := json.Marshal(dsCurrentReschedulingTimes)
 				if err != nil {
-					return fmt.Errorf("marshal %s daemonsets %s kse.com/current-retries-times err: %s\n", pod.Name, ds.Name, err.Error())
-				}
-				if err := lf.updateDs(ds, string(byteDsCurrentReschedulingTimes)); err != nil {
-					return err
+					return false, fmt.Errorf("marshal %s daemonsets %s kse.com/current-retries-times err: %s\n", pod.Name, ds.Name, err.Error())
 				}
-				if err := lf.delPod(pod); err != nil {
-					return err
+				if err := lf.rescheduleDsPod(ds, pod, string(byteDsCurrentReschedulingTimes)); err != nil {
+					return false, err
 				}
+				return true, nil
 			}
 		} else {
 			dsCurrentReschedulingTimes = 1
 			byteDsCurrentReschedulingTimes, err := json.Marshal(dsCurrentReschedulingTimes)
 			if err != nil {
-				return fmt.Errorf("marshal %s daemonsets %s kse.com/current-retries-times err: %s\n", pod.Name, ds.Name, err.Error())
-			}
-			if err := lf.updateDs(ds, string(byteDsCurrentReschedulingTimes)); err != nil {
-				return err
+				return false, fmt.Errorf("marshal %s daemonsets %s kse.com/current-retries-times err: %s\n", pod.Name, ds.Name, err.Error())
 			}
-			if err := lf.delPod(pod); err != nil {
-				return err
+			if err := lf.rescheduleDsPod(ds, pod, string(byteDsCurrentReschedulingTimes)); err != nil {
+				return false, err
 			}
+			return true, nil
 		}
 	}
-	return nil
+	return false, nil
 }
 
-func (lf *ListFunc) doSts(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error {
+func (lf *ListFunc) doSts(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) (bool, error) {
 	sts, err := lf.K8sClientSet.AppsV1().StatefulSets(pod.Namespace).Get(context.TODO(), podOwnerInfo.PodOwnerName, metav1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("get pod %s owner Statefulset err: %s\n", pod.Name, err.Error())
+		return false, fmt.Errorf("get pod %s owner Statefulset err: %s\n", pod.Name, err.Error())
 	}
+	// the pod's state may be written once more after it's rescheduled
+	rescheduled := false
 	if _, ok := sts.Annotations[pkg.SchedulingRetrieString]; ok {
 		var schedulingRetries int
 		var podScheduledHosts []string
 		var currentReschedulingTime int
 		var stsPodsMap pkg.StsPodsMap
 		if err := json.Unmarshal([]byte(sts.Annotations[pkg.SchedulingRetrieString]), &schedulingRetries); err != nil {
-			return fmt.Errorf("unmarshal %s statefulset %s scheduling-retries err: %s\n", pod.Name, sts.Name, err.Error())
+			return false, fmt.Errorf("unmarshal %s statefulset %s scheduling-retries err: %s\n", pod.Name, sts.Name, err.Error())
 		}
 		nowTime := time.Now()
-		timeDura, _ := time.ParseDuration(pkg.OutOfTimeToRescheduling)
+		timeDura := lf.reschedulingWindow()
 		if nowTime.Before(pod.CreationTimestamp.Add(timeDura)) {
 			if _, ok := sts.Annotations[pkg.StsPodMapString]; ok {
 				if err := json.Unmarshal([]byte(sts.Annotations[pkg.StsPodMapString]), &stsPodsMap); err != nil {
-					return fmt.Errorf("unmarshal %s statefulset %s kse.com/sts-pods-map err: %s\n", pod.Name, sts.Name, err.Error())
+					return false, fmt.Errorf("unmarshal %s statefulset %s kse.com/sts-pods-map err: %s\n", pod.Name, sts.Name, err.Error())
 				}
 				if podHasScheduled(pod) {
 					if _, ok := stsPodsMap[pod.Name]; ok {
@@ -858,12 +807,10 @@ func (lf *ListFunc) doSts(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error
 								CurrentReschedulingTimes: currentReschedulingTime,
 								PodScheduledHosts: append(stsPodsMap[pod.Name].PodScheduledHosts, pod.Spec.NodeName)}
 							stsPodsMap[pod.Name] = stsPodInfo
-							if err := lf.updateSts(sts, pod, &stsPodsMap); err != nil {
-								return err
-							}
-							if err := lf.delPod(pod); err != nil {
-								return err
+							if err := lf.rescheduleStsPod(sts, pod, &stsPodsMap); err != nil {
+								return rescheduled, err
 							}
+							rescheduled = true
 						}
 						if stsPodsMap[pod.Name].CurrentReschedulingTimes > schedulingRetries {
 							stsPodInfo := pkg.PurePodInfo{
@@ -871,7 +818,7 @@ func (lf *ListFunc) doSts(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error
 								PodScheduledHosts: nil}
 							stsPodsMap[pod.Name] = stsPodInfo
 							if err := lf.updateSts(sts, pod, &stsPodsMap); err != nil {
-								return err
+								return rescheduled, err
 							}
 						}
 					} else {
@@ -879,42 +826,22 @@ func (lf *ListFunc) doSts(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error
 						podScheduledHosts = append(podScheduledHosts, pod.Spec.NodeName)
 						podInfo := pkg.PurePodInfo{CurrentReschedulingTimes: 1, PodScheduledHosts: podScheduledHosts}
 						stsPodsMap[pod.Name] = podInfo
-						if err := lf.updateSts(sts, pod, &stsPodsMap); err != nil {
-							return err
-						}
-						if err := lf.delPod(pod); err != nil {
-							return err
+						if err := lf.rescheduleStsPod(sts, pod, &stsPodsMap); err != nil {
+							return rescheduled, err
 						}
+						rescheduled = true
 					}
-					return nil
-				}
-				// our Podrescheduling preFilter plugin caused pod unschedulable, just delete pod and it's scheduled-hosts
-				if podUnschedulable(pod) {
-					if _, ok := stsPodsMap[pod.Name]; !ok {
-						return fmt.Errorf("this pod %s dont't add in the statefulset's StsPodMap\n", pod.Name)
-					}
-					stsPodInfo := pkg.PurePodInfo{
-						CurrentReschedulingTimes: stsPodsMap[pod.Name].CurrentReschedulingTimes,
-						PodScheduledHosts: nil}
-					stsPodsMap[pod.Name] = stsPodInfo
-					if err := lf.updateSts(sts, pod, &stsPodsMap); err != nil {
-						return err
-					}
-					if err := lf.delPod(pod); err != nil {
-						return err
-					}
+					return rescheduled, nil
 				}
 			} else {
 				// first time rescheduling pods, so the sts.Annotations[pkg.StsPodMapString] is empty, add it
 				if podHasScheduled(pod) {
 					podScheduledHosts = append(podScheduledHosts, pod.Spec.NodeName)
-					stsPodsMap = map[string]pkg.PurePodInfo{pod.Name: {1, podScheduledHosts}}
-					if err := lf.updateSts(sts, pod, &stsPodsMap); err != nil {
-						return err
-					}
-					if err := lf.delPod(pod); err != nil {
-						return err
+					stsPodsMap = map[string]pkg.PurePodInfo{pod.Name: {CurrentReschedulingTimes: 1, PodScheduledHosts: podScheduledHosts}}
+					if err := lf.rescheduleStsPod(sts, pod, &stsPodsMap); err != nil {
+						return rescheduled, err
 					}
+					rescheduled = true
 				}
 			}
 		} else {
@@ -922,7 +849,7 @@ func (lf *ListFunc) doSts(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error
 			// keep podName -> PurePodInfo, we don't need kube-scheduler to interfere the scheduling in the priFilter phase
 			if _, ok := sts.Annotations[pkg.StsPodMapString]; ok {
 				if err := json.Unmarshal([]byte(sts.Annotations[pkg.StsPodMapString]), &stsPodsMap); err != nil {
-					return fmt.Errorf("unmarshal %s statefulset %s kse.com/sts-pods-map err: %s\n", pod.Name, sts.Name, err.Error())
+					return false, fmt.Errorf("unmarshal %s statefulset %s kse.com/sts-pods-map err: %s\n", pod.Name, sts.Name, err.Error())
 				}
 				if podHasScheduled(pod) {
 					if _, ok := stsPodsMap[pod.Name]; ok {
@@ -932,12 +859,10 @@ func (lf *ListFunc) doSts(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error
 								CurrentReschedulingTimes: currentReschedulingTime,
 								PodScheduledHosts: nil}
 							stsPodsMap[pod.Name] = stsPodInfo
-							if err := lf.updateSts(sts, pod, &stsPodsMap); err != nil {
-								return err
-							}
-							if err := lf.delPod(pod); err != nil {
-								return err
+							if err := lf.rescheduleStsPod(sts, pod, &stsPodsMap); err != nil {
+								return rescheduled, err
 							}
+							rescheduled = true
 						}
 						if stsPodsMap[pod.Name].CurrentReschedulingTimes > schedulingRetries {
 							stsPodInfo := pkg.PurePodInfo{
@@ -945,7 +870,7 @@ func (lf *ListFunc) doSts(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error
 								PodScheduledHosts: nil}
 							stsPodsMap[pod.Name] = stsPodInfo
 							if err := lf.updateSts(sts, pod, &stsPodsMap); err != nil {
-								return err
+								return rescheduled, err
 							}
 						}
 					} else {
@@ -953,112 +878,75 @@ func (lf *ListFunc) doSts(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) error
 						// and set PodScheduledHosts nil
 						podInfo := pkg.PurePodInfo{CurrentReschedulingTimes: 1, PodScheduledHosts: nil}
 						stsPodsMap[pod.Name] = podInfo
-						if err := lf.updateSts(sts, pod, &stsPodsMap); err != nil {
-							return err
-						}
-						if err := lf.delPod(pod); err != nil {
-							return err
+						if err := lf.rescheduleStsPod(sts, pod, &stsPodsMap); err != nil {
+							return rescheduled, err
 						}
+						rescheduled = true
 					}
-					return nil
-				}
-				// our Podrescheduling preFilter plugin caused pod unschedulable, just delete pod and it's scheduled-hosts
-				if podUnschedulable(pod) {
-					if _, ok := stsPodsMap[pod.Name]; !ok {
-						return fmt.Errorf("this pod %s dont't add in the statefulset's StsPodMap\n", pod.Name)
-					}
-					stsPodInfo := pkg.PurePodInfo{
-						CurrentReschedulingTimes: stsPodsMap[pod.Name].CurrentReschedulingTimes,
-						PodScheduledHosts: nil}
-					stsPodsMap[pod.Name] = stsPodInfo
-					if err := lf.updateSts(sts, pod, &stsPodsMap); err != nil {
-						return err
-					}
-					if err := lf.delPod(pod); err != nil {
-						return err
-					}
+					return rescheduled, nil
 				}
 			} else {
 				// first time rescheduling pods, so the sts.Annotations[pkg.StsPodMapString] is empty, add it, and set
 				// podScheduledHosts nil
 				if podHasScheduled(pod) {
-					stsPodsMap = map[string]pkg.PurePodInfo{pod.Name: {1, nil}}
-					if err := lf.updateSts(sts, pod, &stsPodsMap); err != nil {
-						return err
-					}
-					if err := lf.delPod(pod); err != nil {
-						return err
+					stsPodsMap = map[string]pkg.PurePodInfo{pod.Name: {CurrentReschedulingTimes: 1, PodScheduledHosts: nil}}
+					if err := lf.rescheduleStsPod(sts, pod, &stsPodsMap); err != nil {
+						return rescheduled, err
 					}
+					rescheduled = true
 				}
 			}
 		}
 	}
-	return nil
+	return rescheduled, nil
 }
 
-func (lf *ListFunc) doPods(pod *corev1.Pod) error {
+func (lf *ListFunc) doPods(pod *corev1.Pod) (bool, error) {
 	if _, ok := pod.Annotations[pkg.SchedulingRetrieString]; ok {
 		var schedulingRetries int
 		var purePodInfo pkg.PurePodInfo
 		var podScheduledHosts []string
 		if err := json.Unmarshal([]byte(pod.Annotations[pkg.SchedulingRetrieString]), &schedulingRetries); err != nil {
-			return fmt.Errorf("unmarshal pod %s scheduling-retries err: %s\n", pod.Name, err.Error())
+			return false, fmt.Errorf("unmarshal pod %s scheduling-retries err: %s\n", pod.Name, err.Error())
 		}
 
 		nowTime := time.Now()
-		timeDura, _ := time.ParseDuration(pkg.OutOfTimeToRescheduling)
+		timeDura := lf.reschedulingWindow()
 		if nowTime.Before(pod.CreationTimestamp.Add(timeDura)) {
 			if _, ok := pod.Annotations[pkg.PurePodInfoString]; ok {
 				if err := json.Unmarshal([]byte(pod.Annotations[pkg.PurePodInfoString]), &purePodInfo); err != nil {
-					return fmt.Errorf("unmarshal pod %s kse.com/pure-pods err: %s\n", pod.Name, err.Error())
+					return false, fmt.Errorf("unmarshal pod %s kse.com/pure-pods err: %s\n", pod.Name, err.Error())
 				}
 				// only for the successful scheduled pods
 				if podHasScheduled(pod) {
 					if purePodInfo.CurrentReschedulingTimes >= 1 && purePodInfo.CurrentReschedulingTimes <= schedulingRetries {
-						if err := lf.delPod(pod); err != nil {
-							return err
-						}
 						purePodInfo := pkg.PurePodInfo{
 							CurrentReschedulingTimes: purePodInfo.CurrentReschedulingTimes + 1,
 							PodScheduledHosts: append(purePodInfo.PodScheduledHosts, pod.Spec.NodeName)}
-						if err := lf.createPod(pod, &purePodInfo); err != nil {
-							return err
+						if err := lf.recreatePod(pod, &purePodInfo); err != nil {
+							return false, err
 						}
+						return true, nil
 					}
 					if purePodInfo.CurrentReschedulingTimes > schedulingRetries {
 						purePodInfo := pkg.PurePodInfo{
 							CurrentReschedulingTimes: purePodInfo.CurrentReschedulingTimes,
 							PodScheduledHosts: nil}
 						if err := lf.updatePod(pod, &purePodInfo); err != nil {
-							return err
+							return false, err
 						}
 					}
-					return nil
-				}
-				// our Podrescheduling preFilter plugin caused pod unschedulable, just delete pod and it's scheduled-hosts
-				if podUnschedulable(pod) {
-					if err := lf.delPod(pod); err != nil {
-						return err
-					}
-					purePodInfo := pkg.PurePodInfo{
-						CurrentReschedulingTimes: purePodInfo.CurrentReschedulingTimes,
-						PodScheduledHosts: nil}
-					if err := lf.createPod(pod, &purePodInfo); err != nil {
-						return err
-					}
+					return false, nil
 				}
-
 			} else {
 				// first time rescheduling pods, so the pod.Annotations[pkg.PurePodInfoString] is empty, add it
 				if podHasScheduled(pod) {
-					if err := lf.delPod(pod); err != nil {
-						return err
-					}
 					podScheduledHosts = append(podScheduledHosts, pod.Spec.NodeName)
 					purePodInfo := pkg.PurePodInfo{CurrentReschedulingTimes: 1, PodScheduledHosts: podScheduledHosts}
-					if err := lf.createPod(pod, &purePodInfo); err != nil {
-						return err
+					if err := lf.recreatePod(pod, &purePodInfo); err != nil {
+						return false, err
 					}
+					return true, nil
 				}
 			}
 			//if a pod's createTime max than OutOfTimeToRescheduling，just need to delete it, and don't have to
@@ -1066,285 +954,247 @@ func (lf *ListFunc) doPods(pod *corev1.Pod) error {
 		} else {
 			if _, ok := pod.Annotations[pkg.PurePodInfoString]; ok {
 				if err := json.Unmarshal([]byte(pod.Annotations[pkg.PurePodInfoString]), &purePodInfo); err != nil {
-					return fmt.Errorf("unmarshal pod %s kse.com/pure-pods err: %s\n", pod.Name, err.Error())
+					return false, fmt.Errorf("unmarshal pod %s kse.com/pure-pods err: %s\n", pod.Name, err.Error())
 				}
 				// only for the successful scheduled pods
 				if podHasScheduled(pod) {
 					if purePodInfo.CurrentReschedulingTimes >= 1 && purePodInfo.CurrentReschedulingTimes <= schedulingRetries {
-						if err := lf.delPod(pod); err != nil {
-							return err
-						}
 						purePodInfo := pkg.PurePodInfo{
 							CurrentReschedulingTimes: purePodInfo.CurrentReschedulingTimes + 1,
 							PodScheduledHosts: nil}
-						if err := lf.createPod(pod, &purePodInfo); err != nil {
-							return err
+						if err := lf.recreatePod(pod, &purePodInfo); err != nil {
+							return false, err
 						}
+						return true, nil
 					}
 					if purePodInfo.CurrentReschedulingTimes > schedulingRetries {
 						purePodInfo := pkg.PurePodInfo{
 							CurrentReschedulingTimes: purePodInfo.CurrentReschedulingTimes,
 							PodScheduledHosts: nil}
 						if err := lf.updatePod(pod, &purePodInfo); err != nil {
-							return err
+							return false, err
 						}
 					}
-					return nil
-				}
-				// our Podrescheduling preFilter plugin  caused pod unschedulable, just delete pod and it's scheduled-hosts
-				if podUnschedulable(pod) {
-					if err := lf.delPod(pod); err != nil {
-						return err
-					}
-					purePodInfo := pkg.PurePodInfo{
-						CurrentReschedulingTimes: purePodInfo.CurrentReschedulingTimes,
-						PodScheduledHosts: nil}
-					if err := lf.createPod(pod, &purePodInfo); err != nil {
-						return err
-					}
+					return false, nil
 				}
 			} else {
 				// first time rescheduling pods, so the pod.Annotations[pkg.PurePodInfoString] is empty, add it, and
 				// the PodScheduledHosts set nil
 				if podHasScheduled(pod) {
-					if err := lf.delPod(pod); err != nil {
-						return err
-					}
 					purePodInfo := pkg.PurePodInfo{CurrentReschedulingTimes: 1, PodScheduledHosts: nil}
-					if err := lf.createPod(pod, &purePodInfo); err != nil {
-						return err
+					if err := lf.recreatePod(pod, &purePodInfo); err != nil {
+						return false, err
 					}
+					return true, nil
 				}
 			}
 		}
 
 	}
-	return nil
+	return false, nil
 }
 
 func (lf *ListFunc) updateDeploy(deploy *appsv1.Deployment, deployInfo *pkg.DeployInfo) error {
+	value, err := deployInfoAnnotation(deploy, deployInfo)
+	if err != nil {
+		return err
+	}
+	return lf.updateOwnerAnnotation("Deployment", deploy, pkg.DeployInfoString, value)
+}
+
+func deployInfoAnnotation(deploy *appsv1.Deployment, deployInfo *pkg.DeployInfo) (string, error) {
 	//exclude the same elements in slice
 	if deployInfo.DeployScheduledHosts != nil {
 		newStr := sets.NewString(deployInfo.DeployScheduledHosts...)
 		deployInfo.DeployScheduledHosts = newStr.List()
 	}
-	byteDeployInfo, err := json.Marshal(deployInfo)
+	byteDeployInfo, err := fitStateSize(func() ([]byte, error) { return json.Marshal(deployInfo) }, &deployInfo.DeployScheduledHosts)
 	if err != nil {
-		return  fmt.Errorf("marshal deploy %s kse.com/deploy err: %s\n", deploy.Name, err.Error())
-	}
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		deploy.Annotations[pkg.DeployInfoString] = string(byteDeployInfo)
-		_, updateErr := lf.K8sClientSet.AppsV1().Deployments(deploy.Namespace).Update(context.TODO(), deploy, metav1.UpdateOptions{})
-		return updateErr
-	})
-	if retryErr != nil {
-		return retryErr
+		return "", fmt.Errorf("marshal deploy %s kse.com/deploy err: %s\n", deploy.Name, err.Error())
 	}
-	return nil
+	return string(byteDeployInfo), nil
 }
 
 func (lf *ListFunc) updateRs(rs *appsv1.ReplicaSet, rsInfo *pkg.RsInfo) error {
+	value, err := rsInfoAnnotation(rs, rsInfo)
+	if err != nil {
+		return err
+	}
+	return lf.updateOwnerAnnotation("ReplicaSet", rs, pkg.RsInfoString, value)
+}
+
+func rsInfoAnnotation(rs *appsv1.ReplicaSet, rsInfo *pkg.RsInfo) (string, error) {
 	//exclude the same elements in slice
 	if rsInfo.RsScheduledHosts != nil {
 		newStr := sets.NewString(rsInfo.RsScheduledHosts...)
 		rsInfo.RsScheduledHosts = newStr.List()
 	}
-	byteRsInfo, err := json.Marshal(rsInfo)
+	byteRsInfo, err := fitStateSize(func() ([]byte, error) { return json.Marshal(rsInfo) }, &rsInfo.RsScheduledHosts)
 	if err != nil {
-		return  fmt.Errorf("marshal replicasets %s kse.com/rs err: %s\n", rs.Name, err.Error())
-	}
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		rs.Annotations[pkg.RsInfoString] = string(byteRsInfo)
-		_, updateErr := lf.K8sClientSet.AppsV1().ReplicaSets(rs.Namespace).Update(context.TODO(), rs, metav1.UpdateOptions{})
-		return updateErr
-	})
-	if retryErr != nil {
-		return retryErr
+		return "", fmt.Errorf("marshal replicasets %s kse.com/rs err: %s\n", rs.Name, err.Error())
 	}
-	return nil
+	return string(byteRsInfo), nil
 }
 
-func (lf *ListFunc) createCj(cj *batchv1.CronJob, cjInfo *pkg.CjInfo) error {
-	//exclude the same elements in slice
-	if cjInfo.CjScheduledHosts != nil {
-		newStr := sets.NewString(cjInfo.CjScheduledHosts...)
-		cjInfo.CjScheduledHosts = newStr.List()
+// newReschedulingCj returns the cronjob to be created instead of cj, with the new kse.com/cj annotation
+func (lf *ListFunc) newReschedulingCj(cj *batchv1.CronJob, pod *corev1.Pod, cjInfo *pkg.CjInfo) (*batchv1.CronJob, error) {
+	value, err := cjInfoAnnotation(cj, cjInfo)
+	if err != nil {
+		return nil, err
 	}
-	byteCjInfo, err := json.Marshal(cjInfo)
+	failureAnnotations, err := lf.recordFailure(cj, pod, time.Now())
 	if err != nil {
-		return  fmt.Errorf("marshal cronjob %s kse.com/cj err: %s\n", cj.Name, err.Error())
+		return nil, err
 	}
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		newCj := cj.DeepCopy()
-		newCj.UID = ""
-		newCj.ResourceVersion = ""
-		newCj.Status = batchv1.CronJobStatus{}
-		newCj.Annotations[pkg.CjInfoString] = string(byteCjInfo)
-		_, createErr := lf.K8sClientSet.BatchV1().CronJobs(cj.Namespace).Create(context.TODO(), newCj, metav1.CreateOptions{})
-		return createErr
-	})
-	if retryErr != nil {
-		return retryErr
+	newCj := cj.DeepCopy()
+	newCj.UID = ""
+	newCj.ResourceVersion = ""
+	newCj.ManagedFields = nil
+	newCj.Status = batchv1.CronJobStatus{}
+	newCj.Annotations[pkg.CjInfoString] = value
+	for key, failureValue := range failureAnnotations {
+		newCj.Annotations[key] = failureValue
 	}
-	return nil
+	return newCj, nil
 }
 
 func (lf *ListFunc) updateCj(cj *batchv1.CronJob, cjInfo *pkg.CjInfo) error {
+	value, err := cjInfoAnnotation(cj, cjInfo)
+	if err != nil {
+		return err
+	}
+	return lf.updateOwnerAnnotation("CronJob", cj, pkg.CjInfoString, value)
+}
+
+func cjInfoAnnotation(cj *batchv1.CronJob, cjInfo *pkg.CjInfo) (string, error) {
 	//exclude the same elements in slice
 	if cjInfo.CjScheduledHosts != nil {
 		newStr := sets.NewString(cjInfo.CjScheduledHosts...)
 		cjInfo.CjScheduledHosts = newStr.List()
 	}
-	byteCjInfo, err := json.Marshal(cjInfo)
+	byteCjInfo, err := fitStateSize(func() ([]byte, error) { return json.Marshal(cjInfo) }, &cjInfo.CjScheduledHosts)
 	if err != nil {
-		return  fmt.Errorf("marshal cronjob %s kse.com/cj err: %s\n", cj.Name, err.Error())
-	}
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		cj.Annotations[pkg.CjInfoString] = string(byteCjInfo)
-		_, updateErr := lf.K8sClientSet.BatchV1().CronJobs(cj.Namespace).Update(context.TODO(), cj, metav1.UpdateOptions{})
-		return updateErr
-	})
-	if retryErr != nil {
-		return retryErr
+		return "", fmt.Errorf("marshal cronjob %s kse.com/cj err: %s\n", cj.Name, err.Error())
 	}
-	return nil
+	return string(byteCjInfo), nil
 }
 
-func (lf *ListFunc) createJob(job *batchv1.Job, jobInfo *pkg.JobInfo) error {
-	//exclude the same elements in slice
-	if jobInfo.JobScheduledHosts != nil {
-		newStr := sets.NewString(jobInfo.JobScheduledHosts...)
-		jobInfo.JobScheduledHosts = newStr.List()
-	}
-	byteJobInfo, err := json.Marshal(jobInfo)
+func (lf *ListFunc) updateJob(job *batchv1.Job, jobInfo *pkg.JobInfo) error {
+	value, err := jobInfoAnnotation(job, jobInfo)
 	if err != nil {
-		return  fmt.Errorf("marshal job %s kse.com/job err: %s\n", job.Name, err.Error())
-	}
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		newJob := job.DeepCopy()
-		newJob.Labels = nil
-		newJob.UID = ""
-		newJob.Spec.Selector = nil
-		newJob.Spec.Template.Labels = nil
-		newJob.ResourceVersion = ""
-		newJob.Status = batchv1.JobStatus{}
-		newJob.Annotations[pkg.JobInfoString] = string(byteJobInfo)
-		_, createErr := lf.K8sClientSet.BatchV1().Jobs(job.Namespace).Create(context.TODO(), newJob, metav1.CreateOptions{})
-		return createErr
-	})
-	if retryErr != nil {
-		return retryErr
+		return err
 	}
-	return nil
+	return lf.updateOwnerAnnotation("Job", job, pkg.JobInfoString, value)
 }
 
-func (lf *ListFunc) updateJob(job *batchv1.Job, jobInfo *pkg.JobInfo) error {
+func jobInfoAnnotation(job *batchv1.Job, jobInfo *pkg.JobInfo) (string, error) {
 	//exclude the same elements in slice
 	if jobInfo.JobScheduledHosts != nil {
 		newStr := sets.NewString(jobInfo.JobScheduledHosts...)
 		jobInfo.JobScheduledHosts = newStr.List()
 	}
-	byteJobInfo, err := json.Marshal(jobInfo)
-	if err != nil {
-		return  fmt.Errorf("marshal job %s kse.com/job err: %s\n", job.Name, err.Error())
+	hosts := []*[]string{&jobInfo.JobScheduledHosts}
+	indexReschedulingMap := make(map[string]*pkg.PurePodInfo)
+	for index, podInfo := range jobInfo.IndexReschedulingMap {
+		podInfo := podInfo
+		if podInfo.PodScheduledHosts != nil {
+			newStr := sets.NewString(podInfo.PodScheduledHosts...)
+			podInfo.PodScheduledHosts = newStr.List()
+		}
+		indexReschedulingMap[index] = &podInfo
+		hosts = append(hosts, &podInfo.PodScheduledHosts)
 	}
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		job.Annotations[pkg.JobInfoString] = string(byteJobInfo)
-		_, updateErr := lf.K8sClientSet.BatchV1().Jobs(job.Namespace).Update(context.TODO(), job, metav1.UpdateOptions{})
-		return updateErr
-	})
-	if retryErr != nil {
-		return retryErr
+	byteJobInfo, err := fitStateSize(func() ([]byte, error) {
+		for index, podInfo := range indexReschedulingMap {
+			jobInfo.IndexReschedulingMap[index] = *podInfo
+		}
+		return json.Marshal(jobInfo)
+	}, hosts...)
+	if err != nil {
+		return "", fmt.Errorf("marshal job %s kse.com/job err: %s\n", job.Name, err.Error())
 	}
-	return nil
+	return string(byteJobInfo), nil
 }
 
 func (lf *ListFunc) updateDs(ds *appsv1.DaemonSet, annotationValue string) error {
+	return lf.updateOwnerAnnotation("DaemonSet", ds, pkg.CurrentReschedulingTimeString, annotationValue)
+}
 
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		ds.Annotations[pkg.CurrentReschedulingTimeString] = annotationValue
-		_, updateErr := lf.K8sClientSet.AppsV1().DaemonSets(ds.Namespace).Update(context.TODO(), ds, metav1.UpdateOptions{})
-		return updateErr
-	})
-	if retryErr != nil {
-		return retryErr
+func (lf *ListFunc) updateSts(sts *appsv1.StatefulSet, pod *corev1.Pod, stsPodsMap *pkg.StsPodsMap) error {
+	value, err := stsPodsMapAnnotation(sts, stsPodsMap)
+	if err != nil {
+		return err
 	}
-	return nil
+	return lf.updateOwnerAnnotation("StatefulSet", sts, pkg.StsPodMapString, value)
 }
 
-func (lf *ListFunc) updateSts(sts *appsv1.StatefulSet, pod *corev1.Pod, stsPodsMap *pkg.StsPodsMap) error {
+func stsPodsMapAnnotation(sts *appsv1.StatefulSet, stsPodsMap *pkg.StsPodsMap) (string, error) {
 	//exclude the same elements in slice
-	newStsPodsMap := make(pkg.StsPodsMap)
+	var hosts []*[]string
+	newStsPodsMap := make(map[string]*pkg.PurePodInfo)
 	for podName, podInfo := range *stsPodsMap {
+		podInfo := podInfo
 		if podInfo.PodScheduledHosts != nil {
 			newStr := sets.NewString(podInfo.PodScheduledHosts...)
 			podInfo.PodScheduledHosts = newStr.List()
 		}
-		newStsPodsMap[podName] = podInfo
+		newStsPodsMap[podName] = &podInfo
+		hosts = append(hosts, &podInfo.PodScheduledHosts)
 	}
-	byteStsPodsMap, err := json.Marshal(newStsPodsMap)
+	byteStsPodsMap, err := fitStateSize(func() ([]byte, error) { return json.Marshal(newStsPodsMap) }, hosts...)
 	if err != nil {
-		return fmt.Errorf("marshal %s statefulset %s kse.com/sts-pods-map err: %s\n", pod.Name, sts.Name, err.Error())
-	}
-	annotations := map[string]string{pkg.StsPodMapString: string(byteStsPodsMap)}
-	for k, v := range annotations {
-		retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-			// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-			sts.Annotations[k] = v
-			_, updateErr := lf.K8sClientSet.AppsV1().StatefulSets(sts.Namespace).Update(context.TODO(), sts, metav1.UpdateOptions{})
-			return updateErr
-		})
-		if retryErr != nil {
-			return retryErr
-		}
+		return "", fmt.Errorf("marshal statefulset %s kse.com/sts-pods-map err: %s\n", sts.Name, err.Error())
 	}
-	return nil
+	return string(byteStsPodsMap), nil
+}
+
+// newReschedulingPod returns the pure pod to be created instead of pod, with the new kse.com/pod and scheduled hosts
+// annotations
+func (lf *ListFunc) newReschedulingPod(pod *corev1.Pod, purePodInfo *pkg.PurePodInfo) (*corev1.Pod, error) {
+	failureAnnotations, err := lf.recordFailure(pod, pod, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return newPurePod(pod, purePodInfo, failureAnnotations)
 }
 
-func (lf *ListFunc) createPod(pod *corev1.Pod, purePodInfo *pkg.PurePodInfo) error {
+// newPurePod returns a copy of the pure pod to be created again with the kse.com/pod and scheduled hosts of
+// purePodInfo, and the annotations
+func newPurePod(pod *corev1.Pod, purePodInfo *pkg.PurePodInfo, annotations map[string]string) (*corev1.Pod, error) {
 	//exclude the same elements in slice
 	if purePodInfo.PodScheduledHosts != nil {
 		newStr := sets.NewString(purePodInfo.PodScheduledHosts...)
 		purePodInfo.PodScheduledHosts = newStr.List()
 	}
-	bytePurePodInfo, err := json.Marshal(purePodInfo)
+	bytePurePodInfo, err := fitStateSize(func() ([]byte, error) { return json.Marshal(purePodInfo) }, &purePodInfo.PodScheduledHosts)
 	if err != nil {
-		return fmt.Errorf("marshal pod %s kse.com/pod err: %s\n", pod.Name, err.Error())
+		return nil, fmt.Errorf("marshal pod %s kse.com/pod err: %s\n", pod.Name, err.Error())
 	}
 	byteScheduledHosts, err := json.Marshal(purePodInfo.PodScheduledHosts)
 	if err != nil {
-		return fmt.Errorf("marshal pod %s kse.com/pod err: %s\n", pod.Name, err.Error())
+		return nil, fmt.Errorf("marshal pod %s kse.com/pod err: %s\n", pod.Name, err.Error())
 	}
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		newPod := pod.DeepCopy()
-		if purePodInfo.PodScheduledHosts != nil {
-			newPod.Annotations[pkg.SchedulinedHostString] = string(byteScheduledHosts)
-		} else {
-			if _, ok := newPod.Annotations[pkg.SchedulinedHostString]; ok {
-				delete(newPod.Annotations, pkg.SchedulinedHostString)
-			}
+	newPod := pod.DeepCopy()
+	for key, value := range annotations {
+		newPod.Annotations[key] = value
+	}
+	if purePodInfo.PodScheduledHosts != nil {
+		newPod.Annotations[pkg.SchedulinedHostString] = string(byteScheduledHosts)
+	} else {
+		if _, ok := newPod.Annotations[pkg.SchedulinedHostString]; ok {
+			delete(newPod.Annotations, pkg.SchedulinedHostString)
 		}
-		newPod.ResourceVersion = ""
-		newPod.UID = ""
-		newPod.Spec.NodeName = ""
-		newPod.Status = corev1.PodStatus{}
-		newPod.Annotations[pkg.PurePodInfoString] = string(bytePurePodInfo)
-		_, createErr := lf.K8sClientSet.CoreV1().Pods(pod.Namespace).Create(context.TODO(), newPod, metav1.CreateOptions{})
-		return createErr
-	})
-	if retryErr != nil {
-		return retryErr
 	}
-
-	return nil
+	// the recreated pod excludes all the scheduled hosts again
+	delete(newPod.Annotations, pkg.RelaxedHostString)
+	newPod.ResourceVersion = ""
+	newPod.UID = ""
+	// the managed fields only bloat the journaled snapshot, the new pod gets its own
+	newPod.ManagedFields = nil
+	newPod.Spec.NodeName = ""
+	newPod.Status = corev1.PodStatus{}
+	newPod.Annotations[pkg.PurePodInfoString] = string(bytePurePodInfo)
+	return newPod, nil
 }
 
 func (lf *ListFunc) updatePod(pod *corev1.Pod, purePodInfo *pkg.PurePodInfo) error {
@@ -1353,7 +1203,7 @@ func (lf *ListFunc) updatePod(pod *corev1.Pod, purePodInfo *pkg.PurePodInfo) err
 		newStr := sets.NewString(purePodInfo.PodScheduledHosts...)
 		purePodInfo.PodScheduledHosts = newStr.List()
 	}
-	bytePurePodInfo, err := json.Marshal(purePodInfo)
+	bytePurePodInfo, err := fitStateSize(func() ([]byte, error) { return json.Marshal(purePodInfo) }, &purePodInfo.PodScheduledHosts)
 	if err != nil {
 		return fmt.Errorf("marshal pod %s kse.com/pod err: %s\n", pod.Name, err.Error())
 	}
@@ -1361,22 +1211,14 @@ func (lf *ListFunc) updatePod(pod *corev1.Pod, purePodInfo *pkg.PurePodInfo) err
 	if err != nil {
 		return fmt.Errorf("marshal pod %s kse.com/pod err: %s\n", pod.Name, err.Error())
 	}
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		if purePodInfo.PodScheduledHosts != nil {
-			pod.Annotations[pkg.SchedulinedHostString] = string(byteScheduledHosts)
-		} else {
-			if _, ok := pod.Annotations[pkg.SchedulinedHostString]; ok {
-				delete(pod.Annotations, pkg.SchedulinedHostString)
-			}
-		}
-		pod.Annotations[pkg.PurePodInfoString] = string(bytePurePodInfo)
-		_, updateErr := lf.K8sClientSet.CoreV1().Pods(pod.Namespace).Update(context.TODO(), pod, metav1.UpdateOptions{})
-		return updateErr
-	})
-	if retryErr != nil {
-		return retryErr
+	purePodInfoValue := string(bytePurePodInfo)
+	scheduledHostsValue := string(byteScheduledHosts)
+	annotations := map[string]*string{pkg.PurePodInfoString: &purePodInfoValue}
+	if purePodInfo.PodScheduledHosts != nil {
+		annotations[pkg.SchedulinedHostString] = &scheduledHostsValue
+	} else {
+		// a null value removes the annotation
+		annotations[pkg.SchedulinedHostString] = nil
 	}
-
-	return nil
+	return lf.patchStateAnnotations("Pod", pod, pkg.PurePodInfoString, annotations)
 }
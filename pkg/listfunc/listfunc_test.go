@@ -19,6 +19,7 @@ import (
 	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/fake"
 	"reflect"
 	"kse/kse-rescheduler/pkg"
@@ -80,13 +81,13 @@ func TestDoDeploy(t *testing.T) {
 			},
 		},
 		{
-			name: "deploy with annotations but pod unschedulable before time",
+			name: "deploy with annotations but pod unschedulable before time keeps the scheduled hosts",
 			fields: fields{
 				PodFile:            "testdata/deploy-pod-unschedulable.json",
 				ControllerFile:     "testdata/deploy-with-annotations.json",
 				SubControllerFile:  "testdata/deploy-rs.json",
 				BeforeOutOfTimeToRescheduling: true,
-				Wanted: map[string]string{pkg.DeployInfoString: string([]byte(`{"currentReschedulingTimes":2,"deployScheduledHosts":null}`))},
+				Wanted: map[string]string{pkg.DeployInfoString: string([]byte(`{"currentReschedulingTimes":2,"deployScheduledHosts":["node1","node2"]}`))},
 			},
 		},
 		{
@@ -120,13 +121,13 @@ func TestDoDeploy(t *testing.T) {
 			},
 		},
 		{
-			name: "deploy with annotations but pod unschedulable after time",
+			name: "deploy with annotations but pod unschedulable after time keeps the scheduled hosts",
 			fields: fields{
 				PodFile:            "testdata/deploy-pod-unschedulable.json",
 				ControllerFile:     "testdata/deploy-with-annotations.json",
 				SubControllerFile:  "testdata/deploy-rs.json",
 				BeforeOutOfTimeToRescheduling: false,
-				Wanted: map[string]string{pkg.DeployInfoString: string([]byte(`{"currentReschedulingTimes":2,"deployScheduledHosts":null}`))},
+				Wanted: map[string]string{pkg.DeployInfoString: string([]byte(`{"currentReschedulingTimes":2,"deployScheduledHosts":["node1","node2"]}`))},
 			},
 		},
 	}
@@ -210,12 +211,12 @@ func TestDoRs(t *testing.T) {
 			},
 		},
 		{
-			name: "rs with annotations but pod unschedulable before time",
+			name: "rs with annotations but pod unschedulable before time keeps the scheduled hosts",
 			fields: fields{
 				PodFile:            "testdata/rs-pod-unschedulable.json",
 				ControllerFile:     "testdata/rs-with-annotations.json",
 				BeforeOutOfTimeToRescheduling: true,
-				Wanted: map[string]string{pkg.RsInfoString: string([]byte(`{"currentReschedulingTimes":2,"rsScheduledHosts":null}`))},
+				Wanted: map[string]string{pkg.RsInfoString: string([]byte(`{"currentReschedulingTimes":2,"rsScheduledHosts":["node7","node8"]}`))},
 			},
 		},
 		{
@@ -246,12 +247,12 @@ func TestDoRs(t *testing.T) {
 			},
 		},
 		{
-			name: "rs with annotations but pod unschedulable after time",
+			name: "rs with annotations but pod unschedulable after time keeps the scheduled hosts",
 			fields: fields{
 				PodFile:            "testdata/rs-pod-unschedulable.json",
 				ControllerFile:     "testdata/rs-with-annotations.json",
 				BeforeOutOfTimeToRescheduling: false,
-				Wanted: map[string]string{pkg.RsInfoString: string([]byte(`{"currentReschedulingTimes":2,"rsScheduledHosts":null}`))},
+				Wanted: map[string]string{pkg.RsInfoString: string([]byte(`{"currentReschedulingTimes":2,"rsScheduledHosts":["node7","node8"]}`))},
 			},
 		},
 	}
@@ -317,11 +318,11 @@ func TestDoPod(t *testing.T) {
 			},
 		},
 		{
-			name: "pure pod with annotations but pod unschedulable before time",
+			name: "pure pod with annotations but pod unschedulable before time keeps the scheduled hosts",
 			fields: fields{
 				PodFile:            "testdata/pure-pod-unschedulable.json",
 				BeforeOutOfTimeToRescheduling: true,
-				Wanted: map[string]string{pkg.PurePodInfoString: string([]byte(`{"currentReschedulingTimes":2,"podScheduledHosts":null}`))},
+				Wanted: map[string]string{pkg.PurePodInfoString: string([]byte(`{"currentReschedulingTimes":2,"podScheduledHosts":["node1","node2"]}`))},
 			},
 		},
 		{
@@ -348,11 +349,11 @@ func TestDoPod(t *testing.T) {
 			},
 		},
 		{
-			name: "pure pod with annotations but pod unschedulable after time",
+			name: "pure pod with annotations but pod unschedulable after time keeps the scheduled hosts",
 			fields: fields{
 				PodFile:            "testdata/pure-pod-unschedulable.json",
 				BeforeOutOfTimeToRescheduling: false,
-				Wanted: map[string]string{pkg.PurePodInfoString: string([]byte(`{"currentReschedulingTimes":2,"podScheduledHosts":null}`))},
+				Wanted: map[string]string{pkg.PurePodInfoString: string([]byte(`{"currentReschedulingTimes":2,"podScheduledHosts":["node1","node2"]}`))},
 			},
 		},
 	}
@@ -426,12 +427,12 @@ func TestDoSts(t *testing.T) {
 			},
 		},
 		{
-			name: "sts with annotations but one pod unschedulable before time",
+			name: "sts with annotations but one pod unschedulable before time keeps the scheduled hosts",
 			fields: fields{
 				PodFile:            "testdata/sts-pod-0-unschedulable.json",
 				ControllerFile:     "testdata/sts-with-annotations.json",
 				BeforeOutOfTimeToRescheduling: true,
-				Wanted: map[string]string{pkg.StsPodMapString: string([]byte(`{"my-web-0":{"currentReschedulingTimes":2,"podScheduledHosts":null},"my-web-1":{"currentReschedulingTimes":1,"podScheduledHosts":["node2"]}}`))},
+				Wanted: map[string]string{pkg.StsPodMapString: string([]byte(`{"my-web-0":{"currentReschedulingTimes":2,"podScheduledHosts":["node1","node2"]},"my-web-1":{"currentReschedulingTimes":1,"podScheduledHosts":["node2"]}}`))},
 			},
 		},
 		{
@@ -471,12 +472,12 @@ func TestDoSts(t *testing.T) {
 			},
 		},
 		{
-			name: "sts with annotations but one pod unschedulable after time",
+			name: "sts with annotations but one pod unschedulable after time keeps the scheduled hosts",
 			fields: fields{
 				PodFile:            "testdata/sts-pod-0-unschedulable.json",
 				ControllerFile:     "testdata/sts-with-annotations.json",
 				BeforeOutOfTimeToRescheduling: false,
-				Wanted: map[string]string{pkg.StsPodMapString: string([]byte(`{"my-web-0":{"currentReschedulingTimes":2,"podScheduledHosts":null},"my-web-1":{"currentReschedulingTimes":1,"podScheduledHosts":["node2"]}}`))},
+				Wanted: map[string]string{pkg.StsPodMapString: string([]byte(`{"my-web-0":{"currentReschedulingTimes":2,"podScheduledHosts":["node1","node2"]},"my-web-1":{"currentReschedulingTimes":1,"podScheduledHosts":["node2"]}}`))},
 			},
 		},
 	}
@@ -602,12 +603,21 @@ func TestDoJob(t *testing.T) {
 			},
 		},
 		{
-			name: "job with annotations but pod unschedulable before time",
+			name: "job with annotations but pod unschedulable before time keeps the scheduled hosts",
 			fields: fields{
 				PodFile:            "testdata/job-pod-unschedulable.json",
 				ControllerFile:     "testdata/job-with-annotations.json",
 				BeforeOutOfTimeToRescheduling: true,
-				Wanted: map[string]string{pkg.JobInfoString: string([]byte(`{"currentReschedulingTimes":1,"jobScheduledHosts":null}`))},
+				Wanted: map[string]string{pkg.JobInfoString: string([]byte(`{"currentReschedulingTimes":1,"jobScheduledHosts":["node7","node8"]}`))},
+			},
+		},
+		{
+			name: "job with annotations but backoffLimit would be exceeded before time",
+			fields: fields{
+				PodFile:            "testdata/job-pod.json",
+				ControllerFile:     "testdata/job-backoff-limit-exceeded.json",
+				BeforeOutOfTimeToRescheduling: true,
+				Wanted: map[string]string{pkg.JobInfoString: string([]byte(`{"currentReschedulingTimes":1,"jobScheduledHosts":["node7","node8"]}`))},
 			},
 		},
 		{
@@ -638,12 +648,12 @@ func TestDoJob(t *testing.T) {
 			},
 		},
 		{
-			name: "job with annotations but pod unschedulable after time",
+			name: "job with annotations but pod unschedulable after time keeps the scheduled hosts",
 			fields: fields{
 				PodFile:            "testdata/job-pod-unschedulable.json",
 				ControllerFile:     "testdata/job-with-annotations.json",
 				BeforeOutOfTimeToRescheduling: false,
-				Wanted: map[string]string{pkg.JobInfoString: string([]byte(`{"currentReschedulingTimes":1,"jobScheduledHosts":null}`))},
+				Wanted: map[string]string{pkg.JobInfoString: string([]byte(`{"currentReschedulingTimes":1,"jobScheduledHosts":["node7","node8"]}`))},
 			},
 		},
 	}
@@ -672,6 +682,88 @@ func TestDoJob(t *testing.T) {
 	}
 }
 
+func TestDoIndexedJob(t *testing.T) {
+	tests := []struct{
+		name string
+		fields fields
+		wanted map[string]pkg.PurePodInfo
+	}{
+		{
+			name: "indexed job with annotations before time",
+			fields: fields{
+				PodFile:            "testdata/job-indexed-pod.json",
+				ControllerFile:     "testdata/job-indexed-with-annotations.json",
+				BeforeOutOfTimeToRescheduling: true,
+			},
+			wanted: map[string]pkg.PurePodInfo{
+				"0": {CurrentReschedulingTimes: 1, PodScheduledHosts: []string{"node5"}},
+				"1": {CurrentReschedulingTimes: 2, PodScheduledHosts: []string{"node7", "master2"}},
+			},
+		},
+		{
+			name: "indexed job with annotations after time",
+			fields: fields{
+				PodFile:            "testdata/job-indexed-pod.json",
+				ControllerFile:     "testdata/job-indexed-with-annotations.json",
+				BeforeOutOfTimeToRescheduling: false,
+			},
+			wanted: map[string]pkg.PurePodInfo{
+				"0": {CurrentReschedulingTimes: 1, PodScheduledHosts: []string{"node5"}},
+				"1": {CurrentReschedulingTimes: 2, PodScheduledHosts: nil},
+			},
+		},
+	}
+	for _, tt := range tests{
+		t.Run(tt.name, func(t *testing.T) {
+			pod, err := unMarshalPods(tt.fields.PodFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jb, err := unMarshalJob(tt.fields.ControllerFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nowTime := time.Now()
+			timeDura, _ := time.ParseDuration("-1h")
+			if tt.fields.BeforeOutOfTimeToRescheduling {
+				pod.CreationTimestamp = v1.Time{Time: nowTime}
+			} else {
+				pod.CreationTimestamp = v1.Time{Time: nowTime.Add(timeDura)}
+			}
+			fakeObjects := []runtime.Object{&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "default"}}, pod, jb}
+			lf := &ListFunc{K8sClientSet: fake.NewSimpleClientset(fakeObjects...)}
+			podOwnerInfo, err := lf.GetPodOwnerInfo(pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := lf.doJobs(pod, *podOwnerInfo); err != nil {
+				t.Fatal(err)
+			}
+			// the Job is kept with it's status, only the failed pod is deleted
+			gotJb, err := lf.K8sClientSet.BatchV1().Jobs("default").Get(context.TODO(), jb.Name, v1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotJb.UID != jb.UID || gotJb.Status.CompletedIndexes != jb.Status.CompletedIndexes {
+				t.Errorf("test returned a recreated job: got uid %v completedIndexes %v", gotJb.UID, gotJb.Status.CompletedIndexes)
+				return
+			}
+			if _, err := lf.K8sClientSet.CoreV1().Pods("default").Get(context.TODO(), pod.Name, v1.GetOptions{}); err == nil {
+				t.Errorf("test didn't delete the failed pod %s", pod.Name)
+				return
+			}
+			var gotJbInfo pkg.JobInfo
+			if err := json.Unmarshal([]byte(gotJb.Annotations[pkg.JobInfoString]), &gotJbInfo); err != nil {
+				t.Fatal(err)
+			}
+			if !isSameStsMap(tt.wanted, gotJbInfo.IndexReschedulingMap) {
+				t.Errorf("test returned wrong index rescheduling map: got %v want %v", gotJbInfo.IndexReschedulingMap, tt.wanted)
+				return
+			}
+		})
+	}
+}
+
 func TestDoCj(t *testing.T) {
 	tests := []struct{
 		name string
@@ -717,13 +809,13 @@ func TestDoCj(t *testing.T) {
 			},
 		},
 		{
-			name: "cj with annotations but pod unschedulable before time",
+			name: "cj with annotations but pod unschedulable before time keeps the scheduled hosts",
 			fields: fields{
 				PodFile:            "testdata/cj-pod-unschedulable.json",
 				ControllerFile:     "testdata/cj-with-annotations.json",
 				SubControllerFile:  "testdata/cj-job.json",
 				BeforeOutOfTimeToRescheduling: true,
-				Wanted: map[string]string{pkg.CjInfoString: string([]byte(`{"currentReschedulingTimes":1,"cjScheduledHosts":null}`))},
+				Wanted: map[string]string{pkg.CjInfoString: string([]byte(`{"currentReschedulingTimes":1,"cjScheduledHosts":["node7","node8"]}`))},
 			},
 		},
 		{
@@ -757,13 +849,13 @@ func TestDoCj(t *testing.T) {
 			},
 		},
 		{
-			name: "cj with annotations but pod unschedulable after time",
+			name: "cj with annotations but pod unschedulable after time keeps the scheduled hosts",
 			fields: fields{
 				PodFile:            "testdata/cj-pod-unschedulable.json",
 				ControllerFile:     "testdata/cj-with-annotations.json",
 				SubControllerFile:  "testdata/cj-job.json",
 				BeforeOutOfTimeToRescheduling: false,
-				Wanted: map[string]string{pkg.CjInfoString: string([]byte(`{"currentReschedulingTimes":1,"cjScheduledHosts":null}`))},
+				Wanted: map[string]string{pkg.CjInfoString: string([]byte(`{"currentReschedulingTimes":1,"cjScheduledHosts":["node7","node8"]}`))},
 			},
 		},
 	}
@@ -880,13 +972,136 @@ func TestList(t *testing.T) {
 	}
 }
 
+func TestListMaxReschedulesPerPeriod(t *testing.T) {
+	fakeObjects := []runtime.Object{&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "default"}}}
+	// the pods without scheduling-retries are abnormal but never rescheduled, they don't use up the budget
+	for i := 0; i < 3; i++ {
+		pod, err := unMarshalPods("testdata/pure-pod-empty-annotations.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pod.Name = fmt.Sprintf("a-not-rescheduled-%d", i)
+		pod.UID = types.UID(pod.Name)
+		setPodNotReady(pod)
+		fakeObjects = append(fakeObjects, pod)
+	}
+	pod, err := unMarshalPods("testdata/pure-pod-empty-scheduled-hosts-annotations.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod.Name = "z-rescheduled"
+	pod.CreationTimestamp = v1.Time{Time: time.Now()}
+	setPodNotReady(pod)
+	fakeObjects = append(fakeObjects, pod)
+
+	lf := &ListFunc{K8sClientSet: fake.NewSimpleClientset(fakeObjects...), MaxReschedulesPerPeriod: 1}
+	lf.List()
+	gotPod, err := lf.K8sClientSet.CoreV1().Pods("default").Get(context.TODO(), pod.Name, v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gotPod.Annotations[pkg.PurePodInfoString]; !ok {
+		t.Errorf("pod %s isn't rescheduled in the period", pod.Name)
+	}
+}
+
+func TestUnschedulablePodLeftToScheduler(t *testing.T) {
+	tests := []struct {
+		name        string
+		podFile     string
+		ownerFiles  map[string]string
+		ownerKind   string
+		stateKey    string
+	}{
+		{
+			name:       "deployment",
+			podFile:    "testdata/deploy-pod-unschedulable.json",
+			ownerFiles: map[string]string{"Deployment": "testdata/deploy-with-annotations.json", "ReplicaSet": "testdata/deploy-rs.json"},
+			ownerKind:  "Deployment",
+			stateKey:   pkg.DeployInfoString,
+		},
+		{
+			name:       "statefulset",
+			podFile:    "testdata/sts-pod-0-unschedulable.json",
+			ownerFiles: map[string]string{"StatefulSet": "testdata/sts-with-annotations.json"},
+			ownerKind:  "StatefulSet",
+			stateKey:   pkg.StsPodMapString,
+		},
+		{
+			name:       "pure pod",
+			podFile:    "testdata/pure-pod-unschedulable.json",
+			ownerKind:  "Pod",
+			stateKey:   pkg.PurePodInfoString,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod, err := unMarshalPods(tt.podFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pod.CreationTimestamp = v1.Time{Time: time.Now()}
+			fakeObjects := []runtime.Object{&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "default"}}, pod}
+			var owner v1.Object = pod
+			for kind, file := range tt.ownerFiles {
+				var obj runtime.Object
+				switch kind {
+				case "Deployment":
+					obj, err = unMarshalDeploy(file)
+				case "ReplicaSet":
+					obj, err = unMarshalRs(file)
+				case "StatefulSet":
+					obj, err = unMarshalSts(file)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if kind == tt.ownerKind {
+					owner = obj.(v1.Object)
+				}
+				fakeObjects = append(fakeObjects, obj)
+			}
+			lf := &ListFunc{K8sClientSet: fake.NewSimpleClientset(fakeObjects...)}
+			rescheduled, err := lf.reschedulePod(pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rescheduled {
+				t.Errorf("pending pod %s is rescheduled", pod.Name)
+			}
+			gotPod, err := lf.K8sClientSet.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, v1.GetOptions{})
+			if err != nil {
+				t.Fatalf("pending pod %s is deleted: %v", pod.Name, err)
+			}
+			if gotPod.UID != pod.UID {
+				t.Errorf("pending pod %s is recreated", pod.Name)
+			}
+			gotOwner, err := lf.getObject(tt.ownerKind, owner.GetNamespace(), owner.GetName())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := gotOwner.GetAnnotations()[tt.stateKey], owner.GetAnnotations()[tt.stateKey]; got != want {
+				t.Errorf("state of pending pod %s is changed: got %s want %s", pod.Name, got, want)
+			}
+		})
+	}
+}
+
+func setPodNotReady(pod *corev1.Pod) {
+	for i := range pod.Status.Conditions {
+		if pod.Status.Conditions[i].Type == corev1.PodReady {
+			pod.Status.Conditions[i].Status = corev1.ConditionFalse
+		}
+	}
+}
+
 func doDsTest(fakeObjects []runtime.Object, pod *corev1.Pod, wanted map[string]string, t *testing.T){
 	lf := &ListFunc{K8sClientSet: fake.NewSimpleClientset(fakeObjects...)}
 	podOwnerInfo, err := lf.GetPodOwnerInfo(pod)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := lf.doDs(pod, *podOwnerInfo); err != nil {
+	if _, err := lf.doDs(pod, *podOwnerInfo); err != nil {
 		t.Fatal(err)
 	}
 	ds, err := lf.K8sClientSet.AppsV1().DaemonSets("default").Get(context.TODO(), podOwnerInfo.PodOwnerName, v1.GetOptions{})
@@ -906,7 +1121,7 @@ func doStsTest(fakeObjects []runtime.Object, pod *corev1.Pod, wanted map[string]
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := lf.doSts(pod, *podOwnerInfo); err != nil {
+	if _, err := lf.doSts(pod, *podOwnerInfo); err != nil {
 		t.Fatal(err)
 	}
 	// get the  sts annotations after doSts
@@ -940,7 +1155,7 @@ func doStsTest(fakeObjects []runtime.Object, pod *corev1.Pod, wanted map[string]
 
 func doPodTest(fakeObjects []runtime.Object, pod *corev1.Pod, wanted map[string]string, t *testing.T){
 	lf := &ListFunc{K8sClientSet: fake.NewSimpleClientset(fakeObjects...)}
-	if err := lf.doPods(pod); err != nil {
+	if _, err := lf.doPods(pod); err != nil {
 		t.Fatal(err)
 	}
 	// get the  pod annotations after doPods
@@ -981,7 +1196,7 @@ func doRsTest(fakeObjects []runtime.Object, pod *corev1.Pod, wanted map[string]s
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := lf.doRs(pod, *podOwnerInfo); err != nil {
+	if _, err := lf.doRs(pod, *podOwnerInfo); err != nil {
 		t.Fatal(err)
 	}
 	// get the  rs annotations after doRs
@@ -1021,7 +1236,7 @@ func doDeployTest(fakeObjects []runtime.Object, pod *corev1.Pod, wanted map[stri
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := lf.doDeploys(pod, *podOwnerInfo); err != nil {
+	if _, err := lf.doDeploys(pod, *podOwnerInfo); err != nil {
 		t.Fatal(err)
 	}
 	// get the deploy annotations after doDeploy
@@ -1061,7 +1276,7 @@ func doJobTest(fakeObjects []runtime.Object, pod *corev1.Pod, wanted map[string]
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := lf.doJobs(pod, *podOwnerInfo); err != nil {
+	if _, err := lf.doJobs(pod, *podOwnerInfo); err != nil {
 		t.Fatal(err)
 	}
 	gotJb, err := lf.K8sClientSet.BatchV1().Jobs("default").Get(context.TODO(), podOwnerInfo.PodOwnerName, v1.GetOptions{})
@@ -1100,7 +1315,7 @@ func doCjTest(fakeObjects []runtime.Object, pod *corev1.Pod, wanted map[string]s
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := lf.doCjs(pod, *podOwnerInfo); err != nil {
+	if _, err := lf.doCjs(pod, *podOwnerInfo); err != nil {
 		t.Fatal(err)
 	}
 	gotCj, err := lf.K8sClientSet.BatchV1().CronJobs("default").Get(context.TODO(), podOwnerInfo.PodOwnerName, v1.GetOptions{})
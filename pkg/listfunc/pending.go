@@ -0,0 +1,347 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package listfunc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+	"kse/kse-rescheduler/pkg"
+	"time"
+)
+
+// The webhook injects the exclusions into the pod's nodeAffinity as required if a node the pod may be scheduled to is
+// left, but the pod may still not fit it, e.g. for lack of resources. The Podrescheduling plugin's PostFilter only
+// relaxes the exclusions of its own Filter, so the pods pending on the required exclusions are relaxed here: the
+// oldest excluded host is dropped from the history, or the oldest excluded domain once no host is left, and the pod is
+// created again by its owner, or recreated if it's a pure pod, with the exclusions left injected by the webhook.
+
+// pendingOnExclusions returns the kse.com/node-affinity-exclusions of the pod if it can't be scheduled with the required
+// exclusions the webhook injected
+func pendingOnExclusions(pod *corev1.Pod) (pkg.NodeAffinityExclusions, bool) {
+	var exclusions pkg.NodeAffinityExclusions
+	value, ok := pod.Annotations[pkg.NodeAffinityExclusionsString]
+	if !ok || pod.Spec.NodeName != "" || pod.Status.Phase != corev1.PodPending {
+		return exclusions, false
+	}
+	if err := json.Unmarshal([]byte(value), &exclusions); err != nil {
+		klog.Errorf("unmarshal pod %s kse.com/node-affinity-exclusions err: %s\n", pod.Name, err.Error())
+		return exclusions, false
+	}
+	if exclusions.Mode != pkg.NodeAffinityModeRequired || (len(exclusions.Hostnames) == 0 && len(exclusions.Domains) == 0) {
+		return exclusions, false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse && condition.Reason == corev1.PodReasonUnschedulable {
+			return exclusions, true
+		}
+	}
+	return exclusions, false
+}
+
+// relaxPendingPod relaxes the exclusions of the pod pending on them, it returns true if the pod was deleted or
+// recreated. The failures are not recorded, the pod never ran.
+func (lf *ListFunc) relaxPendingPod(pod *corev1.Pod, exclusions pkg.NodeAffinityExclusions) (bool, error) {
+	if len(pod.OwnerReferences) == 0 {
+		return lf.relaxPurePod(pod, exclusions)
+	}
+	podOwnerInfo, err := lf.GetPodOwnerInfo(pod)
+	if err != nil {
+		return false, err
+	}
+	owner, stateKey, state, err := lf.relaxedOwnerState(pod, *podOwnerInfo)
+	if err != nil || owner == nil {
+		return false, err
+	}
+	annotations := make(map[string]*string)
+	if state != nil {
+		annotations[stateKey] = state
+	} else {
+		domains, ok, err := relaxedDomains(owner)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			stateKey = pkg.ExcludedDomainsString
+			annotations[stateKey] = domains
+		}
+	}
+	klog.Infof("pod %s can't be scheduled with the exclusions of %s %s, relax the oldest one\n", pod.Name, podOwnerInfo.PodOwnerType, podOwnerInfo.PodOwnerName)
+	if len(annotations) == 0 {
+		// the exclusions have been dropped from the history since the pod was created, e.g. by the gc
+		if err := lf.delPod(pod); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err := lf.patchStateAndDeletePod(pod, podOwnerInfo.PodOwnerType, owner, stateKey, annotations); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// relaxedOwnerState returns the pod's owner, the key of its rescheduling state, and the state without the oldest host
+// the pod excludes, the state is nil if the pod excludes no host. The owner is nil if its pods are never relaxed, e.g.
+// the DaemonSet pods are bound to their nodes.
+func (lf *ListFunc) relaxedOwnerState(pod *corev1.Pod, podOwnerInfo pkg.PodOwnerInfo) (metav1.Object, string, *string, error) {
+	name := podOwnerInfo.PodOwnerName
+	var relaxed bool
+	switch podOwnerInfo.PodOwnerType {
+	case "Deployment":
+		deploy, err := lf.K8sClientSet.AppsV1().Deployments(pod.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("get pod %s owner Deployment err: %s\n", pod.Name, err.Error())
+		}
+		var deployInfo pkg.DeployInfo
+		if err := unmarshalState(deploy, pkg.DeployInfoString, &deployInfo); err != nil {
+			return nil, "", nil, err
+		}
+		if deployInfo.DeployScheduledHosts, relaxed = dropOldestHost(deploy, deployInfo.DeployScheduledHosts); !relaxed {
+			return deploy, pkg.DeployInfoString, nil, nil
+		}
+		value, err := deployInfoAnnotation(deploy, &deployInfo)
+		return deploy, pkg.DeployInfoString, &value, err
+	case "ReplicaSet":
+		rs, err := lf.K8sClientSet.AppsV1().ReplicaSets(pod.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("get pod %s owner ReplicaSets err: %s\n", pod.Name, err.Error())
+		}
+		var rsInfo pkg.RsInfo
+		if err := unmarshalState(rs, pkg.RsInfoString, &rsInfo); err != nil {
+			return nil, "", nil, err
+		}
+		if rsInfo.RsScheduledHosts, relaxed = dropOldestHost(rs, rsInfo.RsScheduledHosts); !relaxed {
+			return rs, pkg.RsInfoString, nil, nil
+		}
+		value, err := rsInfoAnnotation(rs, &rsInfo)
+		return rs, pkg.RsInfoString, &value, err
+	case "StatefulSet":
+		sts, err := lf.K8sClientSet.AppsV1().StatefulSets(pod.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("get pod %s owner Statefulset err: %s\n", pod.Name, err.Error())
+		}
+		var stsPodsMap pkg.StsPodsMap
+		if err := unmarshalState(sts, pkg.StsPodMapString, &stsPodsMap); err != nil {
+			return nil, "", nil, err
+		}
+		podInfo := stsPodsMap[pod.Name]
+		if podInfo.PodScheduledHosts, relaxed = dropOldestHost(sts, podInfo.PodScheduledHosts); !relaxed {
+			return sts, pkg.StsPodMapString, nil, nil
+		}
+		stsPodsMap[pod.Name] = podInfo
+		value, err := stsPodsMapAnnotation(sts, &stsPodsMap)
+		return sts, pkg.StsPodMapString, &value, err
+	case "Job":
+		jb, err := lf.K8sClientSet.BatchV1().Jobs(pod.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("get pod %s owner Job err: %s\n", pod.Name, err.Error())
+		}
+		var jbInfo pkg.JobInfo
+		if err := unmarshalState(jb, pkg.JobInfoString, &jbInfo); err != nil {
+			return nil, "", nil, err
+		}
+		if index, ok := jobPodCompletionIndex(jb, pod); ok {
+			podInfo := jbInfo.IndexReschedulingMap[index]
+			if podInfo.PodScheduledHosts, relaxed = dropOldestHost(jb, podInfo.PodScheduledHosts); relaxed {
+				jbInfo.IndexReschedulingMap[index] = podInfo
+			}
+		} else {
+			jbInfo.JobScheduledHosts, relaxed = dropOldestHost(jb, jbInfo.JobScheduledHosts)
+		}
+		if !relaxed {
+			return jb, pkg.JobInfoString, nil, nil
+		}
+		value, err := jobInfoAnnotation(jb, &jbInfo)
+		return jb, pkg.JobInfoString, &value, err
+	case "CronJob":
+		// the cronjob keeps its pods' history, only the pod is created again by its job
+		cj, err := lf.cronJobs().Get(context.TODO(), pod.Namespace, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("get pod %s owner CronJob err: %s\n", pod.Name, err.Error())
+		}
+		var cjInfo pkg.CjInfo
+		if err := unmarshalState(cj, pkg.CjInfoString, &cjInfo); err != nil {
+			return nil, "", nil, err
+		}
+		if cjInfo.CjScheduledHosts, relaxed = dropOldestHost(cj, cjInfo.CjScheduledHosts); !relaxed {
+			return cj, pkg.CjInfoString, nil, nil
+		}
+		value, err := cjInfoAnnotation(cj, &cjInfo)
+		return cj, pkg.CjInfoString, &value, err
+	}
+	return nil, "", nil, nil
+}
+
+// relaxPurePod recreates the pure pod without the oldest exclusion, the nodeAffinity requirements the webhook injected
+// are removed so the webhook injects the exclusions left
+func (lf *ListFunc) relaxPurePod(pod *corev1.Pod, exclusions pkg.NodeAffinityExclusions) (bool, error) {
+	var purePodInfo pkg.PurePodInfo
+	if err := unmarshalState(pod, pkg.PurePodInfoString, &purePodInfo); err != nil {
+		return false, err
+	}
+	var relaxed, domainRelaxed bool
+	var domains *string
+	if purePodInfo.PodScheduledHosts, relaxed = dropOldestHost(pod, purePodInfo.PodScheduledHosts); !relaxed {
+		var err error
+		if domains, domainRelaxed, err = relaxedDomains(pod); err != nil {
+			return false, err
+		}
+	}
+	newPod, err := newPurePod(pod, &purePodInfo, nil)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := pod.Annotations[pkg.PurePodInfoString]; !ok {
+		// the pod has never been rescheduled, it's rescheduled from its first failure
+		delete(newPod.Annotations, pkg.PurePodInfoString)
+	}
+	if domains != nil {
+		newPod.Annotations[pkg.ExcludedDomainsString] = *domains
+	} else if domainRelaxed {
+		delete(newPod.Annotations, pkg.ExcludedDomainsString)
+	}
+	delete(newPod.Annotations, pkg.NodeAffinityExclusionsString)
+	newPod.Spec.Affinity = withoutExclusions(newPod.Spec.Affinity, exclusions)
+	klog.Infof("pod %s can't be scheduled with its exclusions, relax the oldest one\n", pod.Name)
+	if err := lf.replacePod(pod, newPod); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// unmarshalState unmarshals the kse.com annotation of obj into state, state is left as it is if obj doesn't have it
+func unmarshalState(obj metav1.Object, key string, state interface{}) error {
+	value, ok := obj.GetAnnotations()[key]
+	if !ok {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(value), state); err != nil {
+		return fmt.Errorf("unmarshal %s %s err: %s\n", obj.GetName(), key, err.Error())
+	}
+	return nil
+}
+
+// lastFailureTimes returns the last failure time of the nodes in obj's kse.com/node-failures
+func lastFailureTimes(obj metav1.Object) map[string]time.Time {
+	times := make(map[string]time.Time)
+	var nodeFailures pkg.NodeFailures
+	if err := unmarshalState(obj, pkg.NodeFailuresString, &nodeFailures); err != nil {
+		klog.Errorf("%s, the exclusions are relaxed by their order\n", err.Error())
+		return times
+	}
+	for node, failure := range nodeFailures {
+		times[node] = failure.LastFailureTime
+	}
+	return times
+}
+
+// dropOldestHost returns the hosts without the one which failed the longest ago, the hosts whose failures aren't
+// recorded, e.g. dropped for the state size, are the oldest. relaxed is false if there is no host.
+func dropOldestHost(obj metav1.Object, hosts []string) ([]string, bool) {
+	if len(hosts) == 0 {
+		return hosts, false
+	}
+	return dropOldest(hosts, lastFailureTimes(obj)), true
+}
+
+// dropOldest returns the values without the one whose time is the oldest, the first of them if the times are equal
+func dropOldest(values []string, times map[string]time.Time) []string {
+	oldest := 0
+	for i, value := range values {
+		if times[value].Before(times[values[oldest]]) {
+			oldest = i
+		}
+	}
+	var left []string
+	left = append(left, values[:oldest]...)
+	return append(left, values[oldest+1:]...)
+}
+
+// relaxedDomains returns the kse.com/excluded-domains of obj without the domain whose last failure is the oldest, nil
+// if no domain is left. ok is false if obj excludes no domain.
+func relaxedDomains(obj metav1.Object) (*string, bool, error) {
+	var excludedDomains pkg.ExcludedDomains
+	if err := unmarshalState(obj, pkg.ExcludedDomainsString, &excludedDomains); err != nil {
+		return nil, false, err
+	}
+	if len(excludedDomains.Domains) == 0 {
+		return nil, false, nil
+	}
+	var nodeFailures pkg.NodeFailures
+	if err := unmarshalState(obj, pkg.NodeFailuresString, &nodeFailures); err != nil {
+		klog.Errorf("%s, the exclusions are relaxed by their order\n", err.Error())
+	}
+	times := make(map[string]time.Time)
+	for _, failure := range nodeFailures {
+		if failure.Domain != "" && failure.LastFailureTime.After(times[failure.Domain]) {
+			times[failure.Domain] = failure.LastFailureTime
+		}
+	}
+	if excludedDomains.Domains = dropOldest(excludedDomains.Domains, times); len(excludedDomains.Domains) == 0 {
+		return nil, true, nil
+	}
+	byteExcludedDomains, err := json.Marshal(excludedDomains)
+	if err != nil {
+		return nil, false, fmt.Errorf("marshal %s kse.com/excluded-domains err: %s\n", obj.GetName(), err.Error())
+	}
+	value := string(byteExcludedDomains)
+	return &value, true, nil
+}
+
+// withoutExclusions returns a copy of the affinity without the required NotIn requirements of the exclusions, the terms
+// left empty are removed
+func withoutExclusions(affinity *corev1.Affinity, exclusions pkg.NodeAffinityExclusions) *corev1.Affinity {
+	if affinity == nil || affinity.NodeAffinity == nil || affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return affinity
+	}
+	affinity = affinity.DeepCopy()
+	nodeAffinity := affinity.NodeAffinity
+	var terms []corev1.NodeSelectorTerm
+	for _, term := range nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		var requirements []corev1.NodeSelectorRequirement
+		for _, requirement := range term.MatchExpressions {
+			if !isExclusion(requirement, exclusions) {
+				requirements = append(requirements, requirement)
+			}
+		}
+		term.MatchExpressions = requirements
+		if len(term.MatchExpressions) > 0 || len(term.MatchFields) > 0 {
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) > 0 {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = terms
+	} else {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = nil
+	}
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil && len(nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution) == 0 {
+		affinity.NodeAffinity = nil
+	}
+	if affinity.NodeAffinity == nil && affinity.PodAffinity == nil && affinity.PodAntiAffinity == nil {
+		return nil
+	}
+	return affinity
+}
+
+// isExclusion is true if the requirement is one of the NotIn requirements of the exclusions
+func isExclusion(requirement corev1.NodeSelectorRequirement, exclusions pkg.NodeAffinityExclusions) bool {
+	if requirement.Operator != corev1.NodeSelectorOpNotIn {
+		return false
+	}
+	values := sets.NewString(requirement.Values...)
+	if requirement.Key == corev1.LabelHostname && len(exclusions.Hostnames) > 0 && values.Equal(sets.NewString(exclusions.Hostnames...)) {
+		return true
+	}
+	return requirement.Key == exclusions.TopologyKey && len(exclusions.Domains) > 0 && values.Equal(sets.NewString(exclusions.Domains...))
+}
@@ -0,0 +1,316 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package listfunc
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"kse/kse-rescheduler/pkg"
+	"testing"
+	"time"
+)
+
+// pendOnExclusions makes the pod pending unschedulable with the exclusions injected by the webhook
+func pendOnExclusions(pod *corev1.Pod, exclusions string) {
+	pod.CreationTimestamp = v1.Time{Time: time.Now()}
+	pod.Spec.NodeName = ""
+	pod.Annotations[pkg.NodeAffinityExclusionsString] = exclusions
+	pod.Status = corev1.PodStatus{
+		Phase:      corev1.PodPending,
+		Conditions: []corev1.PodCondition{{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: corev1.PodReasonUnschedulable}},
+	}
+}
+
+func TestPendingOnExclusions(t *testing.T) {
+	tests := []struct {
+		name       string
+		exclusions string
+		phase      corev1.PodPhase
+		reason     string
+		want       bool
+	}{
+		{
+			name:       "pending on the required exclusions",
+			exclusions: `{"mode":"required","hostnames":["node1"]}`,
+			phase:      corev1.PodPending,
+			reason:     corev1.PodReasonUnschedulable,
+			want:       true,
+		},
+		{
+			name:       "pending on the required domains",
+			exclusions: `{"mode":"required","topologyKey":"topology.kubernetes.io/zone","domains":["zone-a"]}`,
+			phase:      corev1.PodPending,
+			reason:     corev1.PodReasonUnschedulable,
+			want:       true,
+		},
+		{
+			name:       "preferred exclusions never hold the pod",
+			exclusions: `{"mode":"preferred","hostnames":["node1"]}`,
+			phase:      corev1.PodPending,
+			reason:     corev1.PodReasonUnschedulable,
+		},
+		{
+			name:       "scheduling gated",
+			exclusions: `{"mode":"required","hostnames":["node1"]}`,
+			phase:      corev1.PodPending,
+			reason:     "SchedulingGated",
+		},
+		{
+			name:       "running",
+			exclusions: `{"mode":"required","hostnames":["node1"]}`,
+			phase:      corev1.PodRunning,
+			reason:     corev1.PodReasonUnschedulable,
+		},
+		{
+			name:       "invalid exclusions",
+			exclusions: `{"mode":`,
+			phase:      corev1.PodPending,
+			reason:     corev1.PodReasonUnschedulable,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "pod", Annotations: map[string]string{}}}
+			pendOnExclusions(pod, test.exclusions)
+			pod.Status.Phase = test.phase
+			pod.Status.Conditions[0].Reason = test.reason
+			if _, got := pendingOnExclusions(pod); got != test.want {
+				t.Errorf("test returned wrong pending: got %v want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRelaxPendingDeployPod(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name            string
+		exclusions      string
+		deployInfo      string
+		nodeFailures    string
+		excludedDomains string
+		wantDeployInfo  string
+		// wantExcludedDomains is empty if the annotation is removed
+		wantExcludedDomains string
+	}{
+		{
+			name:           "the oldest failed host is relaxed",
+			exclusions:     `{"mode":"required","hostnames":["node1","node2","node3"]}`,
+			deployInfo:     `{"currentReschedulingTimes":3,"deployScheduledHosts":["node1","node2","node3"]}`,
+			nodeFailures:   `{"node1":{"count":1,"lastFailureTime":"` + now.Format(time.RFC3339) + `"},"node2":{"count":2,"lastFailureTime":"` + now.Add(-time.Hour).Format(time.RFC3339) + `"},"node3":{"count":1,"lastFailureTime":"` + now.Add(-time.Minute).Format(time.RFC3339) + `"}}`,
+			wantDeployInfo: `{"currentReschedulingTimes":3,"deployScheduledHosts":["node1","node3"]}`,
+		},
+		{
+			name:           "the host without a recorded failure is relaxed first",
+			exclusions:     `{"mode":"required","hostnames":["node1","node2"]}`,
+			deployInfo:     `{"currentReschedulingTimes":2,"deployScheduledHosts":["node1","node2"]}`,
+			nodeFailures:   `{"node1":{"count":1,"lastFailureTime":"` + now.Format(time.RFC3339) + `"}}`,
+			wantDeployInfo: `{"currentReschedulingTimes":2,"deployScheduledHosts":["node1"]}`,
+		},
+		{
+			name:                "the hosts are relaxed before the domains",
+			exclusions:          `{"mode":"required","hostnames":["node1"],"topologyKey":"zone","domains":["zone-a"]}`,
+			deployInfo:          `{"currentReschedulingTimes":2,"deployScheduledHosts":["node1"]}`,
+			excludedDomains:     `{"topologyKey":"zone","domains":["zone-a"]}`,
+			wantDeployInfo:      `{"currentReschedulingTimes":2,"deployScheduledHosts":null}`,
+			wantExcludedDomains: `{"topologyKey":"zone","domains":["zone-a"]}`,
+		},
+		{
+			name:                "the oldest failed domain is relaxed once no host is left",
+			exclusions:          `{"mode":"required","topologyKey":"zone","domains":["zone-a","zone-b"]}`,
+			deployInfo:          `{"currentReschedulingTimes":2,"deployScheduledHosts":null}`,
+			nodeFailures:        `{"node1":{"count":1,"lastFailureTime":"` + now.Add(-time.Hour).Format(time.RFC3339) + `","domain":"zone-a"},"node2":{"count":1,"lastFailureTime":"` + now.Format(time.RFC3339) + `","domain":"zone-b"}}`,
+			excludedDomains:     `{"topologyKey":"zone","domains":["zone-a","zone-b"]}`,
+			wantDeployInfo:      `{"currentReschedulingTimes":2,"deployScheduledHosts":null}`,
+			wantExcludedDomains: `{"topologyKey":"zone","domains":["zone-b"]}`,
+		},
+		{
+			name:            "the last domain is removed",
+			exclusions:      `{"mode":"required","topologyKey":"zone","domains":["zone-a"]}`,
+			deployInfo:      `{"currentReschedulingTimes":2,"deployScheduledHosts":null}`,
+			excludedDomains: `{"topologyKey":"zone","domains":["zone-a"]}`,
+			wantDeployInfo:  `{"currentReschedulingTimes":2,"deployScheduledHosts":null}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod, err := unMarshalPods("testdata/deploy-pod.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pendOnExclusions(pod, test.exclusions)
+			deploy, err := unMarshalDeploy("testdata/deploy-with-annotations.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			deploy.Annotations[pkg.DeployInfoString] = test.deployInfo
+			if test.nodeFailures != "" {
+				deploy.Annotations[pkg.NodeFailuresString] = test.nodeFailures
+			}
+			if test.excludedDomains != "" {
+				deploy.Annotations[pkg.ExcludedDomainsString] = test.excludedDomains
+			}
+			rs, err := unMarshalRs("testdata/deploy-rs.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			lf := &ListFunc{K8sClientSet: fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "default"}}, pod, deploy, rs)}
+
+			rescheduled, err := lf.reschedulePod(pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !rescheduled {
+				t.Fatal("test didn't relax the pending pod")
+			}
+			if _, err := lf.K8sClientSet.CoreV1().Pods("default").Get(context.TODO(), pod.Name, v1.GetOptions{}); err == nil {
+				t.Errorf("test didn't delete the pending pod %s", pod.Name)
+			}
+			gotDeploy, err := lf.K8sClientSet.AppsV1().Deployments("default").Get(context.TODO(), deploy.Name, v1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := gotDeploy.Annotations[pkg.DeployInfoString]; got != test.wantDeployInfo {
+				t.Errorf("test returned wrong kse.com/deploy: got %v want %v", got, test.wantDeployInfo)
+			}
+			if got := gotDeploy.Annotations[pkg.ExcludedDomainsString]; got != test.wantExcludedDomains {
+				t.Errorf("test returned wrong kse.com/excluded-domains: got %v want %v", got, test.wantExcludedDomains)
+			}
+			// the pod never ran, no failure is recorded
+			if got := gotDeploy.Annotations[pkg.NodeFailuresString]; got != test.nodeFailures {
+				t.Errorf("test returned wrong kse.com/node-failures: got %v want %v", got, test.nodeFailures)
+			}
+			if intents, _ := lf.loadIntents(); len(intents) != 0 {
+				t.Errorf("test didn't remove the finished intent: %v", intents)
+			}
+		})
+	}
+}
+
+func TestRelaxPendingPurePod(t *testing.T) {
+	pod, err := unMarshalPods("testdata/pure-pod-with-annotations.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pendOnExclusions(pod, `{"mode":"required","hostnames":["node1","node2"]}`)
+	pod.Annotations[pkg.SchedulinedHostString] = `["node1","node2"]`
+	zoneRequirement := corev1.NodeSelectorRequirement{Key: "topology.kubernetes.io/zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"zone-a"}}
+	pod.Spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+			{MatchExpressions: []corev1.NodeSelectorRequirement{
+				zoneRequirement,
+				{Key: corev1.LabelHostname, Operator: corev1.NodeSelectorOpNotIn, Values: []string{"node1", "node2"}},
+			}},
+		}},
+	}}
+	lf := &ListFunc{K8sClientSet: fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: "default"}}, pod)}
+
+	rescheduled, err := lf.reschedulePod(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rescheduled {
+		t.Fatal("test didn't relax the pending pod")
+	}
+	gotPod, err := lf.K8sClientSet.CoreV1().Pods("default").Get(context.TODO(), pod.Name, v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("test lost the pure pod: %v", err)
+	}
+	wantAnnotations := map[string]string{
+		pkg.SchedulingRetrieString: "3",
+		pkg.PurePodInfoString:      `{"currentReschedulingTimes":2,"podScheduledHosts":["node2"]}`,
+		pkg.SchedulinedHostString:  `["node2"]`,
+	}
+	if diff := cmp.Diff(wantAnnotations, gotPod.Annotations); diff != "" {
+		t.Errorf("unexpected annotations (-want,+got):\n%s", diff)
+	}
+	// the webhook injects the exclusions left into the pod's own nodeAffinity
+	wantAffinity := &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+			{MatchExpressions: []corev1.NodeSelectorRequirement{zoneRequirement}},
+		}},
+	}}
+	if diff := cmp.Diff(wantAffinity, gotPod.Spec.Affinity); diff != "" {
+		t.Errorf("unexpected affinity (-want,+got):\n%s", diff)
+	}
+}
+
+func TestWithoutExclusions(t *testing.T) {
+	exclusions := pkg.NodeAffinityExclusions{Mode: pkg.NodeAffinityModeRequired, Hostnames: []string{"node1"}, TopologyKey: "zone", Domains: []string{"zone-a"}}
+	hostRequirement := corev1.NodeSelectorRequirement{Key: corev1.LabelHostname, Operator: corev1.NodeSelectorOpNotIn, Values: []string{"node1"}}
+	domainRequirement := corev1.NodeSelectorRequirement{Key: "zone", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"zone-a"}}
+	tests := []struct {
+		name     string
+		affinity *corev1.Affinity
+		want     *corev1.Affinity
+	}{
+		{
+			name:     "no affinity",
+			affinity: nil,
+			want:     nil,
+		},
+		{
+			name: "the injected term is removed",
+			affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{MatchExpressions: []corev1.NodeSelectorRequirement{hostRequirement, domainRequirement}},
+				}},
+			}},
+			want: nil,
+		},
+		{
+			name: "the pod's own terms are kept",
+			affinity: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{MatchExpressions: []corev1.NodeSelectorRequirement{hostRequirement, domainRequirement}, MatchFields: []corev1.NodeSelectorRequirement{{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node2"}}}},
+					{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: corev1.LabelHostname, Operator: corev1.NodeSelectorOpNotIn, Values: []string{"node3"}}, hostRequirement}},
+				}},
+			}},
+			want: &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+					{MatchFields: []corev1.NodeSelectorRequirement{{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node2"}}}},
+					{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: corev1.LabelHostname, Operator: corev1.NodeSelectorOpNotIn, Values: []string{"node3"}}}},
+				}},
+			}},
+		},
+		{
+			name: "the preferred terms and the pod affinity are kept",
+			affinity: &corev1.Affinity{
+				NodeAffinity: &corev1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{
+						{MatchExpressions: []corev1.NodeSelectorRequirement{hostRequirement}},
+					}},
+					PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+						{Weight: 10, Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{hostRequirement}}},
+					},
+				},
+				PodAffinity: &corev1.PodAffinity{},
+			},
+			want: &corev1.Affinity{
+				NodeAffinity: &corev1.NodeAffinity{
+					PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{
+						{Weight: 10, Preference: corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{hostRequirement}}},
+					},
+				},
+				PodAffinity: &corev1.PodAffinity{},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := cmp.Diff(test.want, withoutExclusions(test.affinity, exclusions)); diff != "" {
+				t.Errorf("unexpected affinity (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package listfunc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/workloadstate"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// objects reads and patches the pods and their owners, the kse.com state written through it is resourceVersion guarded
+func (lf *ListFunc) objects() *workloadstate.Objects {
+	return &workloadstate.Objects{Client: lf.K8sClientSet, CronJobs: lf.cronJobs()}
+}
+
+// updateOwnerAnnotation sets the kse.com annotation of the pod's owner
+func (lf *ListFunc) updateOwnerAnnotation(ownerKind string, owner metav1.Object, key, value string) error {
+	return lf.objects().UpdateAnnotation(ownerKind, owner, key, value)
+}
+
+// patchStateAnnotations patches the annotations of obj, a nil value removes the annotation, see
+// workloadstate.Objects.PatchStateAnnotations
+func (lf *ListFunc) patchStateAnnotations(kind string, obj metav1.Object, stateKey string, annotations map[string]*string) error {
+	return lf.objects().PatchStateAnnotations(kind, obj, stateKey, annotations)
+}
+
+func (lf *ListFunc) getObject(kind, namespace, name string) (metav1.Object, error) {
+	return lf.objects().Get(kind, namespace, name)
+}
+
+// getOwnerAnnotation returns the kse.com annotation of the pod's owner, found is false if the owner has gone
+func (lf *ListFunc) getOwnerAnnotation(ownerKind, namespace, name, key string) (string, bool, error) {
+	obj, err := lf.getObject(ownerKind, namespace, name)
+	if apierrors.IsNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return obj.GetAnnotations()[key], true, nil
+}
+
+// fitStateSize marshals the state, and drops the scheduled hosts of the longest host lists until the state fits in
+// pkg.MaxStateSize, so the kse.com annotations never approach the annotations size limit. The dropped hosts may be
+// scheduled to again, the rescheduling times are always kept.
+func fitStateSize(marshal func() ([]byte, error), hosts ...*[]string) ([]byte, error) {
+	for {
+		byteState, err := marshal()
+		if err != nil || len(byteState) <= pkg.MaxStateSize {
+			return byteState, err
+		}
+		var longest *[]string
+		for _, h := range hosts {
+			if longest == nil || len(*h) > len(*longest) {
+				longest = h
+			}
+		}
+		if longest == nil || len(*longest) == 0 {
+			return byteState, nil
+		}
+		// every host takes its length, the quotes and the comma
+		excess, dropped := len(byteState)-pkg.MaxStateSize, 0
+		for dropped < len(*longest) && excess > 0 {
+			excess -= len((*longest)[dropped]) + 3
+			dropped++
+		}
+		*longest = (*longest)[dropped:]
+	}
+}
+
+// recordNodeFailure returns the kse.com/node-failures of obj with the failure of the pod on its node recorded, ok is
+// false if the pod didn't run on any node. The oldest failures are dropped if the state exceeds pkg.MaxStateSize.
+func recordNodeFailure(obj metav1.Object, pod *corev1.Pod, domain string, now time.Time) (string, bool, error) {
+	if pod.Spec.NodeName == "" {
+		return "", false, nil
+	}
+	nodeFailures := make(pkg.NodeFailures)
+	if value, found := obj.GetAnnotations()[pkg.NodeFailuresString]; found {
+		if err := json.Unmarshal([]byte(value), &nodeFailures); err != nil {
+			klog.Errorf("unmarshal %s kse.com/node-failures err: %s, the failures are recorded again\n", obj.GetName(), err.Error())
+			nodeFailures = make(pkg.NodeFailures)
+		}
+	}
+	failure := nodeFailures[pod.Spec.NodeName]
+	failure.Count++
+	failure.LastFailureTime = now
+	failure.Reason = podFailureReason(pod)
+	if domain != "" {
+		failure.Domain = domain
+	}
+	nodeFailures[pod.Spec.NodeName] = failure
+
+	nodes := make([]string, 0, len(nodeFailures))
+	for node := range nodeFailures {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodeFailures[nodes[i]].LastFailureTime.Before(nodeFailures[nodes[j]].LastFailureTime)
+	})
+	for {
+		byteNodeFailures, err := json.Marshal(nodeFailures)
+		if err != nil {
+			return "", false, fmt.Errorf("marshal %s kse.com/node-failures err: %s\n", obj.GetName(), err.Error())
+		}
+		if len(byteNodeFailures) <= pkg.MaxStateSize || len(nodes) <= 1 {
+			return string(byteNodeFailures), true, nil
+		}
+		delete(nodeFailures, nodes[0])
+		nodes = nodes[1:]
+	}
+}
+
+// recordFailure returns the kse.com annotations of obj recording the failure of the pod, the kse.com/node-failures and
+// the kse.com/excluded-domains if the failures in the pod's failure domain reach the kse.com/domain-escalation-failures
+func (lf *ListFunc) recordFailure(obj metav1.Object, pod *corev1.Pod, now time.Time) (map[string]string, error) {
+	annotations := make(map[string]string)
+	if pod.Spec.NodeName == "" {
+		// the pod has been unbound from its node, e.g. the node is deleted, the node it ran on is recorded by the
+		// scheduler
+		if nodeName := workloadstate.LastPlacement(obj, pod.Name); nodeName != "" {
+			placedPod := *pod
+			placedPod.Spec.NodeName = nodeName
+			pod = &placedPod
+		}
+	}
+	domain := lf.failureDomain(obj, pod.Spec.NodeName)
+	nodeFailures, ok, err := recordNodeFailure(obj, pod, domain, now)
+	if err != nil || !ok {
+		return annotations, err
+	}
+	annotations[pkg.NodeFailuresString] = nodeFailures
+	excludedDomains, ok, err := escalateDomains(obj, nodeFailures)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		annotations[pkg.ExcludedDomainsString] = excludedDomains
+	}
+	return annotations, nil
+}
+
+// failureDomain returns the value of obj's kse.com/exclusion-topology-key on the node, the failure isn't grouped if
+// obj doesn't set the key or the node can't be read, e.g. in the namespace scoped mode
+func (lf *ListFunc) failureDomain(obj metav1.Object, nodeName string) string {
+	topologyKey := obj.GetAnnotations()[pkg.ExclusionTopologyKeyString]
+	// the nodes can't be read with namespaced Roles
+	if topologyKey == "" || nodeName == "" || lf.namespaceScoped() {
+		return ""
+	}
+	node, err := lf.K8sClientSet.CoreV1().Nodes().Get(context.TODO(), nodeName, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("get node %s of %s err: %s, the failure is recorded without its domain\n", nodeName, obj.GetName(), err.Error())
+		return ""
+	}
+	return node.Labels[topologyKey]
+}
+
+// escalateDomains returns the kse.com/excluded-domains of obj with the domains whose failures reach the
+// kse.com/domain-escalation-failures, ok is false if obj doesn't set the topology key or no domain is excluded
+func escalateDomains(obj metav1.Object, nodeFailuresValue string) (string, bool, error) {
+	annotations := obj.GetAnnotations()
+	topologyKey := annotations[pkg.ExclusionTopologyKeyString]
+	if topologyKey == "" {
+		return "", false, nil
+	}
+	threshold := pkg.DefaultDomainEscalationFailures
+	if value, found := annotations[pkg.DomainEscalationFailuresString]; found {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			klog.Errorf("%s kse.com/domain-escalation-failures %q is invalid, %d is used\n", obj.GetName(), value, threshold)
+		} else {
+			threshold = n
+		}
+	}
+	var nodeFailures pkg.NodeFailures
+	if err := json.Unmarshal([]byte(nodeFailuresValue), &nodeFailures); err != nil {
+		return "", false, fmt.Errorf("unmarshal %s kse.com/node-failures err: %s\n", obj.GetName(), err.Error())
+	}
+	domainFailures := make(map[string]int)
+	for _, failure := range nodeFailures {
+		if failure.Domain != "" {
+			domainFailures[failure.Domain] += failure.Count
+		}
+	}
+	domains := sets.NewString()
+	// the domains excluded before are kept while the topology key is unchanged
+	if value, found := annotations[pkg.ExcludedDomainsString]; found {
+		var excludedDomains pkg.ExcludedDomains
+		if err := json.Unmarshal([]byte(value), &excludedDomains); err == nil && excludedDomains.TopologyKey == topologyKey {
+			domains.Insert(excludedDomains.Domains...)
+		}
+	}
+	for domain, count := range domainFailures {
+		if count >= threshold {
+			domains.Insert(domain)
+		}
+	}
+	if domains.Len() == 0 {
+		return "", false, nil
+	}
+	byteExcludedDomains, err := json.Marshal(pkg.ExcludedDomains{TopologyKey: topologyKey, Domains: domains.List()})
+	if err != nil {
+		return "", false, fmt.Errorf("marshal %s kse.com/excluded-domains err: %s\n", obj.GetName(), err.Error())
+	}
+	return string(byteExcludedDomains), true, nil
+}
+
+// podFailureReason returns why the pod failed, the reasons of the terminated containers are preferred to the waiting
+// ones, since a CrashLoopBackOff container keeps the real reason in its last termination state
+func podFailureReason(pod *corev1.Pod) string {
+	if pod.Status.Reason != "" {
+		return pod.Status.Reason
+	}
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		if status.State.Terminated != nil && status.State.Terminated.Reason != "" && status.State.Terminated.ExitCode != 0 {
+			return status.State.Terminated.Reason
+		}
+		if status.LastTerminationState.Terminated != nil && status.LastTerminationState.Terminated.Reason != "" {
+			return status.LastTerminationState.Terminated.Reason
+		}
+	}
+	for _, status := range statuses {
+		if status.State.Waiting != nil && status.State.Waiting.Reason != "" {
+			return status.State.Waiting.Reason
+		}
+	}
+	return ""
+}
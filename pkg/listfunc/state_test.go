@@ -0,0 +1,341 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package listfunc
+
+import (
+	"context"
+	"encoding/json"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/workloadstate"
+	"testing"
+	"time"
+)
+
+func TestPatchStateAnnotations(t *testing.T) {
+	newState := `{"currentReschedulingTimes":3,"deployScheduledHosts":["master1","node1","node2"]}`
+	otherState := `{"currentReschedulingTimes":3,"deployScheduledHosts":["node1","node2","node3"]}`
+	newFailures := `{"node2":{"count":1,"lastFailureTime":"2023-06-01T00:00:00Z","reason":"Error"}}`
+	otherFailures := `{"node3":{"count":1,"lastFailureTime":"2023-06-01T00:00:00Z","reason":"OOMKilled"}}`
+	tests := []struct {
+		name string
+		// concurrentEdit edits the deployment before the first patch is rejected by a conflict
+		concurrentEdit  func(deploy *appsv1.Deployment)
+		wantErr         bool
+		wantStateChange bool
+		// wantState is empty if the state isn't changed by the test
+		wantState    string
+		wantFailures string
+		wantLabel    string
+	}{
+		{
+			name:         "no conflict",
+			wantState:    newState,
+			wantFailures: newFailures,
+		},
+		{
+			name: "other fields changed",
+			concurrentEdit: func(deploy *appsv1.Deployment) {
+				deploy.Labels = map[string]string{"edited-by": "user"}
+			},
+			wantState:    newState,
+			wantFailures: newFailures,
+			wantLabel:    "user",
+		},
+		{
+			name: "state changed",
+			concurrentEdit: func(deploy *appsv1.Deployment) {
+				deploy.Annotations[pkg.DeployInfoString] = otherState
+			},
+			wantErr:         true,
+			wantStateChange: true,
+			wantState:       otherState,
+		},
+		{
+			name: "another patched annotation changed",
+			concurrentEdit: func(deploy *appsv1.Deployment) {
+				deploy.Annotations[pkg.NodeFailuresString] = otherFailures
+			},
+			wantErr:         true,
+			wantStateChange: true,
+			wantFailures:    otherFailures,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deploy, err := unMarshalDeploy("testdata/deploy-with-annotations.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := fake.NewSimpleClientset(deploy)
+			if test.concurrentEdit != nil {
+				conflicted := false
+				client.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					if conflicted {
+						return false, nil, nil
+					}
+					conflicted = true
+					edited := deploy.DeepCopy()
+					test.concurrentEdit(edited)
+					if err := client.Tracker().Update(appsv1.SchemeGroupVersion.WithResource("deployments"), edited, edited.Namespace); err != nil {
+						t.Fatal(err)
+					}
+					return true, nil, apierrors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"}, deploy.Name, nil)
+				})
+			}
+			lf := &ListFunc{K8sClientSet: client}
+
+			err = lf.patchStateAnnotations("Deployment", deploy, pkg.DeployInfoString, map[string]*string{
+				pkg.DeployInfoString:   &newState,
+				pkg.NodeFailuresString: &newFailures,
+			})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("test returned err: %v, want err: %v", err, test.wantErr)
+			}
+			if workloadstate.IsStateChanged(err) != test.wantStateChange {
+				t.Errorf("test returned state changed: %v want %v", workloadstate.IsStateChanged(err), test.wantStateChange)
+			}
+			gotDeploy, err := client.AppsV1().Deployments(deploy.Namespace).Get(context.TODO(), deploy.Name, v1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantState := test.wantState
+			if wantState == "" {
+				wantState = deploy.Annotations[pkg.DeployInfoString]
+			}
+			if gotDeploy.Annotations[pkg.DeployInfoString] != wantState {
+				t.Errorf("test returned wrong state: got %v want %v", gotDeploy.Annotations[pkg.DeployInfoString], wantState)
+			}
+			if gotDeploy.Annotations[pkg.NodeFailuresString] != test.wantFailures {
+				t.Errorf("test returned wrong node failures: got %v want %v", gotDeploy.Annotations[pkg.NodeFailuresString], test.wantFailures)
+			}
+			if gotDeploy.Annotations[pkg.SchedulingRetrieString] != deploy.Annotations[pkg.SchedulingRetrieString] {
+				t.Errorf("test overwrote the other annotations: got %v", gotDeploy.Annotations)
+			}
+			if gotDeploy.Labels["edited-by"] != test.wantLabel {
+				t.Errorf("test overwrote the user edits: got %v want %v", gotDeploy.Labels["edited-by"], test.wantLabel)
+			}
+		})
+	}
+}
+
+func TestUpdatePod(t *testing.T) {
+	pod, err := unMarshalPods("testdata/pure-pod-with-annotations.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod.Annotations[pkg.SchedulinedHostString] = `["node1"]`
+	lf := &ListFunc{K8sClientSet: fake.NewSimpleClientset(pod)}
+
+	purePodInfo := pkg.PurePodInfo{CurrentReschedulingTimes: 4}
+	if err := lf.updatePod(pod, &purePodInfo); err != nil {
+		t.Fatal(err)
+	}
+	gotPod, err := lf.K8sClientSet.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gotPod.Annotations[pkg.SchedulinedHostString]; ok {
+		t.Errorf("test didn't remove the scheduled hosts: %v", gotPod.Annotations[pkg.SchedulinedHostString])
+	}
+	if want := `{"currentReschedulingTimes":4,"podScheduledHosts":null}`; gotPod.Annotations[pkg.PurePodInfoString] != want {
+		t.Errorf("test returned wrong state: got %v want %v", gotPod.Annotations[pkg.PurePodInfoString], want)
+	}
+}
+
+func TestRecordNodeFailure(t *testing.T) {
+	now := time.Now()
+	deploy := &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "nginx", Annotations: map[string]string{
+		pkg.NodeFailuresString: `{"node1":{"count":1,"lastFailureTime":"2023-06-01T00:00:00Z"}}`,
+	}}}
+	tests := []struct {
+		name             string
+		pod              *corev1.Pod
+		wantOk           bool
+		wantNodeFailures pkg.NodeFailures
+	}{
+		{
+			name: "pod not scheduled",
+			pod:  &corev1.Pod{},
+		},
+		{
+			name:   "pod failed on a node again",
+			pod:    &corev1.Pod{Spec: corev1.PodSpec{NodeName: "node1"}},
+			wantOk: true,
+			wantNodeFailures: pkg.NodeFailures{
+				"node1": {Count: 2, LastFailureTime: now},
+			},
+		},
+		{
+			name:   "pod failed on a new node",
+			pod:    &corev1.Pod{Spec: corev1.PodSpec{NodeName: "node2"}},
+			wantOk: true,
+			wantNodeFailures: pkg.NodeFailures{
+				"node1": {Count: 1, LastFailureTime: time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)},
+				"node2": {Count: 1, LastFailureTime: now},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, ok, err := recordNodeFailure(deploy, test.pod, "", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != test.wantOk {
+				t.Fatalf("test returned ok: %v want %v", ok, test.wantOk)
+			}
+			if !ok {
+				return
+			}
+			var gotNodeFailures pkg.NodeFailures
+			if err := json.Unmarshal([]byte(value), &gotNodeFailures); err != nil {
+				t.Fatal(err)
+			}
+			if len(gotNodeFailures) != len(test.wantNodeFailures) {
+				t.Fatalf("test returned wrong node failures: got %v want %v", gotNodeFailures, test.wantNodeFailures)
+			}
+			for node, want := range test.wantNodeFailures {
+				got := gotNodeFailures[node]
+				if got.Count != want.Count || !got.LastFailureTime.Equal(want.LastFailureTime) {
+					t.Errorf("test returned wrong failure of %s: got %v want %v", node, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	now := time.Date(2023, 6, 2, 0, 0, 0, 0, time.UTC)
+	client := fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "node1", Labels: map[string]string{"example.com/rack": "rack1"}}},
+		&corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "node2", Labels: map[string]string{"example.com/rack": "rack1"}}},
+		&corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "node3", Labels: map[string]string{"example.com/rack": "rack2"}}})
+	lf := &ListFunc{K8sClientSet: client}
+	tests := []struct {
+		name            string
+		annotations     map[string]string
+		nodeName        string
+		wantAnnotations map[string]string
+	}{
+		{
+			name:     "workload without topology key",
+			nodeName: "node1",
+			wantAnnotations: map[string]string{
+				pkg.NodeFailuresString: `{"node1":{"count":1,"lastFailureTime":"2023-06-02T00:00:00Z"}}`,
+			},
+		},
+		{
+			name: "failures in a domain below the threshold",
+			annotations: map[string]string{
+				pkg.ExclusionTopologyKeyString: "example.com/rack",
+			},
+			nodeName: "node1",
+			wantAnnotations: map[string]string{
+				pkg.NodeFailuresString: `{"node1":{"count":1,"lastFailureTime":"2023-06-02T00:00:00Z","domain":"rack1"}}`,
+			},
+		},
+		{
+			name: "failures in a domain reaching the threshold",
+			annotations: map[string]string{
+				pkg.ExclusionTopologyKeyString:     "example.com/rack",
+				pkg.DomainEscalationFailuresString: "2",
+				pkg.NodeFailuresString:             `{"node1":{"count":1,"lastFailureTime":"2023-06-01T00:00:00Z","domain":"rack1"}}`,
+			},
+			nodeName: "node2",
+			wantAnnotations: map[string]string{
+				pkg.NodeFailuresString:    `{"node1":{"count":1,"lastFailureTime":"2023-06-01T00:00:00Z","domain":"rack1"},"node2":{"count":1,"lastFailureTime":"2023-06-02T00:00:00Z","domain":"rack1"}}`,
+				pkg.ExcludedDomainsString: `{"topologyKey":"example.com/rack","domains":["rack1"]}`,
+			},
+		},
+		{
+			name: "pod unbound from the node it was placed on",
+			annotations: map[string]string{
+				pkg.PlacementsString: `[{"pod":"nginx-x2k9q","node":"node3","time":"2023-06-01T00:00:00Z","attempt":0}]`,
+			},
+			wantAnnotations: map[string]string{
+				pkg.NodeFailuresString: `{"node3":{"count":1,"lastFailureTime":"2023-06-02T00:00:00Z"}}`,
+			},
+		},
+		{
+			name: "domains excluded before are kept",
+			annotations: map[string]string{
+				pkg.ExclusionTopologyKeyString: "example.com/rack",
+				pkg.ExcludedDomainsString:      `{"topologyKey":"example.com/rack","domains":["rack1"]}`,
+			},
+			nodeName: "node3",
+			wantAnnotations: map[string]string{
+				pkg.NodeFailuresString:    `{"node3":{"count":1,"lastFailureTime":"2023-06-02T00:00:00Z","domain":"rack2"}}`,
+				pkg.ExcludedDomainsString: `{"topologyKey":"example.com/rack","domains":["rack1"]}`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deploy := &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "nginx", Annotations: test.annotations}}
+			pod := &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: "nginx-x2k9q"}, Spec: corev1.PodSpec{NodeName: test.nodeName}}
+			gotAnnotations, err := lf.recordFailure(deploy, pod, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(gotAnnotations) != len(test.wantAnnotations) {
+				t.Fatalf("test returned wrong annotations: got %v want %v", gotAnnotations, test.wantAnnotations)
+			}
+			for key, want := range test.wantAnnotations {
+				if gotAnnotations[key] != want {
+					t.Errorf("test returned wrong annotation %s: got %v want %v", key, gotAnnotations[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestPodFailureReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		status corev1.PodStatus
+		want   string
+	}{
+		{
+			name:   "evicted pod",
+			status: corev1.PodStatus{Reason: "Evicted"},
+			want:   "Evicted",
+		},
+		{
+			name: "crashloopbackoff container killed by oom",
+			status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				State:                corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+				LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "OOMKilled", ExitCode: 137}},
+			}}},
+			want: "OOMKilled",
+		},
+		{
+			name: "container can't pull the image",
+			status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+			}}},
+			want: "ImagePullBackOff",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := podFailureReason(&corev1.Pod{Status: test.status}); got != test.want {
+				t.Errorf("test returned wrong reason: got %v want %v", got, test.want)
+			}
+		})
+	}
+}
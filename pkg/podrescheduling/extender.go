@@ -0,0 +1,134 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package podrescheduling
+
+import (
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+	"kse/kse-rescheduler/pkg/apis/config"
+	"kse/kse-rescheduler/pkg/apis/config/validation"
+	"math"
+	"time"
+)
+
+// Extender serves the exclusions of Podrescheduling through the kube-scheduler extender protocol, for the clusters
+// where kube-scheduler can't be replaced by the one with the plugin
+type Extender struct {
+	pr         *Podrescheduling
+	nodeLister corelisters.NodeLister
+}
+
+// NewExtender returns the extender reading the workloads and the nodes from the informers of the factory, the args are
+// defaulted if they are nil. The factory must be started by the caller.
+func NewExtender(args *config.PodreschedulingArgs, factory informers.SharedInformerFactory) (*Extender, error) {
+	if args == nil {
+		defaultArgs, err := getArgs(nil)
+		if err != nil {
+			return nil, err
+		}
+		args = defaultArgs
+	}
+	if err := validation.ValidatePodreschedulingArgs(field.NewPath("args"), args); err != nil {
+		return nil, err
+	}
+	return &Extender{
+		pr: &Podrescheduling{
+			args:            *args,
+			workloadListers: newWorkloadListers(factory),
+		},
+		nodeLister: factory.Core().V1().Nodes().Lister(),
+	}, nil
+}
+
+// Filter rejects the excluded nodes among the nodes which passed the filters of kube-scheduler. There is no PostFilter
+// in the extender protocol, so the Relax fallback keeps the least failed excluded node when all the nodes are excluded.
+func (e *Extender) Filter(args *extenderv1.ExtenderArgs) *extenderv1.ExtenderFilterResult {
+	if args.Pod == nil {
+		return &extenderv1.ExtenderFilterResult{Error: "the pod of the extender args is missing"}
+	}
+	nodes, err := e.nodes(args)
+	if err != nil {
+		return &extenderv1.ExtenderFilterResult{Error: err.Error()}
+	}
+	podWithState, _ := e.pr.withWorkloadState(args.Pod)
+	s := e.pr.exclusions(podWithState, nodes)
+	if s.excludedHosts.Len() == len(nodes) && len(nodes) > 0 && e.pr.args.Fallback == config.FallbackRelax {
+		relaxed := relaxationOrder(s)[0]
+		klog.V(2).InfoS("Relaxed the exclusion of kse-rescheduler", "pod", klog.KObj(args.Pod), "node", relaxed)
+		s.excludedHosts = s.excludedHosts.Difference(sets.NewString(relaxed))
+	}
+
+	result := &extenderv1.ExtenderFilterResult{FailedAndUnresolvableNodes: extenderv1.FailedNodesMap{}}
+	var fitNodes []v1.Node
+	var fitNodeNames []string
+	for _, node := range nodes {
+		if s.excludedHosts.Has(node.Name) {
+			result.FailedAndUnresolvableNodes[node.Name] = exclusionReason(node.Name, s.nodeFailures[node.Name], s.excludedDomains[node.Name])
+			continue
+		}
+		fitNodes = append(fitNodes, *node)
+		fitNodeNames = append(fitNodeNames, node.Name)
+	}
+	// the result carries the nodes the same way as the args, by names if kube-scheduler caches the nodes
+	if args.NodeNames != nil {
+		result.NodeNames = &fitNodeNames
+	} else {
+		result.Nodes = &v1.NodeList{Items: fitNodes}
+	}
+	return result
+}
+
+// Prioritize scores the nodes from 0 to MaxExtenderPriority the same way as Score and NormalizeScore do
+func (e *Extender) Prioritize(args *extenderv1.ExtenderArgs) (*extenderv1.HostPriorityList, error) {
+	if args.Pod == nil {
+		return nil, fmt.Errorf("the pod of the extender args is missing")
+	}
+	nodes, err := e.nodes(args)
+	if err != nil {
+		return nil, err
+	}
+	podWithState, _ := e.pr.withWorkloadState(args.Pod)
+	s := e.pr.penalties(podWithState, nodes, time.Now())
+	priorities := make(extenderv1.HostPriorityList, 0, len(nodes))
+	for _, node := range nodes {
+		score := math.Round(float64(extenderv1.MaxExtenderPriority) / (1 + s.nodePenalty(node.Name)))
+		priorities = append(priorities, extenderv1.HostPriority{Host: node.Name, Score: int64(score)})
+	}
+	return &priorities, nil
+}
+
+// nodes returns the nodes of the args, they are read from the informer cache if kube-scheduler only sends the names
+func (e *Extender) nodes(args *extenderv1.ExtenderArgs) ([]*v1.Node, error) {
+	if args.Nodes != nil {
+		nodes := make([]*v1.Node, 0, len(args.Nodes.Items))
+		for i := range args.Nodes.Items {
+			nodes = append(nodes, &args.Nodes.Items[i])
+		}
+		return nodes, nil
+	}
+	if args.NodeNames == nil {
+		return nil, fmt.Errorf("the nodes of the extender args are missing")
+	}
+	nodes := make([]*v1.Node, 0, len(*args.NodeNames))
+	for _, nodeName := range *args.NodeNames {
+		node, err := e.nodeLister.Get(nodeName)
+		if err != nil {
+			return nil, fmt.Errorf("get node %s err: %s", nodeName, err.Error())
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
@@ -0,0 +1,136 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package podrescheduling
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	extenderv1 "k8s.io/kube-scheduler/extender/v1"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/apis/config"
+	"testing"
+	"time"
+)
+
+func TestExtender(t *testing.T) {
+	recent := time.Now().Format(time.RFC3339)
+	nodes := []corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"topology.kubernetes.io/zone": "zone-a"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node2", Labels: map[string]string{"topology.kubernetes.io/zone": "zone-a"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node3", Labels: map[string]string{"topology.kubernetes.io/zone": "zone-b"}}},
+	}
+	objects := []k8sruntime.Object{
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: map[string]string{
+			pkg.SchedulingRetrieString: "3",
+			pkg.DeployInfoString:       `{"currentReschedulingTimes":1,"deployScheduledHosts":["node1"]}`,
+			pkg.NodeFailuresString:     `{"node1":{"count":1,"lastFailureTime":"` + recent + `","reason":"OOMKilled"}}`,
+		}}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "nginx-5d4f8", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+			{Kind: "Deployment", Name: "nginx"},
+		}}},
+	}
+	for i := range nodes {
+		objects = append(objects, &nodes[i])
+	}
+	deployPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nginx-5d4f8-x2k9q", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+		{Kind: "ReplicaSet", Name: "nginx-5d4f8"},
+	}}}
+	domainPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "busybox", Namespace: "default", Annotations: map[string]string{
+		pkg.SchedulinedHostString:  `["node1"]`,
+		pkg.ExcludedDomainsString: `{"topologyKey":"topology.kubernetes.io/zone","domains":["zone-a"]}`,
+	}}}
+	nodeNames := func(names ...string) *[]string {
+		return &names
+	}
+	tests := []struct {
+		name           string
+		args           *config.PodreschedulingArgs
+		extenderArgs   *extenderv1.ExtenderArgs
+		wantResult     *extenderv1.ExtenderFilterResult
+		wantPriorities *extenderv1.HostPriorityList
+	}{
+		{
+			name:         "workload failures with the node names",
+			extenderArgs: &extenderv1.ExtenderArgs{Pod: deployPod, NodeNames: nodeNames("node1", "node2", "node3")},
+			wantResult: &extenderv1.ExtenderFilterResult{
+				NodeNames: nodeNames("node2", "node3"),
+				FailedAndUnresolvableNodes: extenderv1.FailedNodesMap{
+					"node1": "node node1 excluded by kse-rescheduler after 1 failure (OOMKilled)",
+				},
+			},
+			wantPriorities: &extenderv1.HostPriorityList{{Host: "node1", Score: 5}, {Host: "node2", Score: 10}, {Host: "node3", Score: 10}},
+		},
+		{
+			name:         "excluded domain with the nodes",
+			extenderArgs: &extenderv1.ExtenderArgs{Pod: domainPod, Nodes: &corev1.NodeList{Items: nodes}},
+			wantResult: &extenderv1.ExtenderFilterResult{
+				Nodes: &corev1.NodeList{Items: nodes[2:]},
+				FailedAndUnresolvableNodes: extenderv1.FailedNodesMap{
+					"node1": "node node1 excluded by kse-rescheduler with its failure domain topology.kubernetes.io/zone=zone-a",
+					"node2": "node node2 excluded by kse-rescheduler with its failure domain topology.kubernetes.io/zone=zone-a",
+				},
+			},
+			wantPriorities: &extenderv1.HostPriorityList{{Host: "node1", Score: 5}, {Host: "node2", Score: 5}, {Host: "node3", Score: 10}},
+		},
+		{
+			name:         "all the nodes excluded are relaxed",
+			args:         &config.PodreschedulingArgs{ScheduledHostsAnnotation: pkg.SchedulinedHostString, AvoidanceMode: pkg.AvoidanceModeHard, Fallback: config.FallbackRelax, MaxExcludedPercentage: 100},
+			extenderArgs: &extenderv1.ExtenderArgs{Pod: domainPod, NodeNames: nodeNames("node1", "node2")},
+			wantResult: &extenderv1.ExtenderFilterResult{
+				NodeNames: nodeNames("node1"),
+				FailedAndUnresolvableNodes: extenderv1.FailedNodesMap{
+					"node2": "node node2 excluded by kse-rescheduler with its failure domain topology.kubernetes.io/zone=zone-a",
+				},
+			},
+			wantPriorities: &extenderv1.HostPriorityList{{Host: "node1", Score: 5}, {Host: "node2", Score: 5}},
+		},
+		{
+			name:         "unknown node",
+			extenderArgs: &extenderv1.ExtenderArgs{Pod: deployPod, NodeNames: nodeNames("node4")},
+			wantResult:   &extenderv1.ExtenderFilterResult{Error: `get node node4 err: node "node4" not found`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(objects...), 0)
+			e, err := NewExtender(test.args, informerFactory)
+			if err != nil {
+				t.Fatalf("Creating extender: %v", err)
+			}
+			informerFactory.Start(ctx.Done())
+			informerFactory.WaitForCacheSync(ctx.Done())
+
+			if diff := cmp.Diff(test.wantResult, e.Filter(test.extenderArgs)); diff != "" {
+				t.Errorf("unexpected filter result (-want,+got):\n%s", diff)
+			}
+			gotPriorities, err := e.Prioritize(test.extenderArgs)
+			if test.wantPriorities == nil {
+				if err == nil {
+					t.Errorf("test returned no error for the priorities %v", gotPriorities)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.wantPriorities, gotPriorities); diff != "" {
+				t.Errorf("unexpected priorities (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
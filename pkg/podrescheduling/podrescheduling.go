@@ -12,70 +12,272 @@ package podrescheduling
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/scheduler/framework"
 	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/apis/config"
+	"kse/kse-rescheduler/pkg/apis/config/scheme"
+	"kse/kse-rescheduler/pkg/apis/config/v1beta3"
+	"kse/kse-rescheduler/pkg/apis/config/validation"
+	"kse/kse-rescheduler/pkg/capabilities"
+	"kse/kse-rescheduler/pkg/workloadstate"
 )
 
 const (
 	// Name is the name of the plugin used in Registry and configurations.
 	Name                          = "Podrescheduling"
+	preFilterStateKey             = "PreFilter" + Name
 )
 
 type ScheduledHosts []string
 
 var _ framework.PreFilterPlugin = &Podrescheduling{}
+var _ framework.FilterPlugin = &Podrescheduling{}
+var _ framework.EnqueueExtensions = &Podrescheduling{}
 
 type Podrescheduling struct {
 	frameworkHandler framework.Handle
+	args             config.PodreschedulingArgs
+	workloadListers  *workloadListers
+	// placements records the placements of the bound pods into their workloads
+	placements       *workloadstate.PlacementRecorder
 }
 
 
+type preFilterState struct {
+	excludedHosts sets.String
+	nodeFailures  pkg.NodeFailures
+	// excludedDomains are the excluded domains of the nodes, e.g. topology.kubernetes.io/zone=zone-a
+	excludedDomains map[string]string
+}
+
+func (s *preFilterState) Clone() framework.StateData {
+	return s
+}
+
 func (pr *Podrescheduling) Name() string {
 	return Name
 }
 
 func New(obj runtime.Object, handle framework.Handle) (framework.Plugin, error) {
-	plugin := &Podrescheduling{frameworkHandler: handle}
+	args, err := getArgs(obj)
+	if err != nil {
+		return nil, err
+	}
+	if err := validation.ValidatePodreschedulingArgs(field.NewPath("args"), args); err != nil {
+		return nil, err
+	}
+	plugin := &Podrescheduling{
+		frameworkHandler: handle,
+		args:             *args,
+		workloadListers:  newWorkloadListers(handle.SharedInformerFactory()),
+	}
+	if handle.ClientSet() != nil {
+		// the scheduler reads the CronJobs in batch/v1 as well
+		plugin.placements = workloadstate.NewPlacementRecorder(workloadstate.NewObjects(handle.ClientSet(), capabilities.CronJobV1))
+		go wait.Forever(plugin.placements.Flush, pkg.PlacementFlushPeriod)
+	}
+	// the webhook's --scheduler-name routes the rescheduled pods to the profile while its lease is renewed
+	if f, ok := handle.(interface{ ProfileName() string }); ok && f.ProfileName() != "" && handle.ClientSet() != nil {
+		go wait.Forever(newProfileLease(handle.ClientSet(), f.ProfileName()).renew, pkg.ProfileLeaseRenewPeriod)
+	}
 	return plugin, nil
 }
 
+// getArgs returns the args from the pluginConfig of the profile, or the default args if the profile doesn't config them
+func getArgs(obj runtime.Object) (*config.PodreschedulingArgs, error) {
+	if obj == nil {
+		versionedArgs := &v1beta3.PodreschedulingArgs{}
+		scheme.Scheme.Default(versionedArgs)
+		args := &config.PodreschedulingArgs{}
+		if err := scheme.Scheme.Convert(versionedArgs, args, nil); err != nil {
+			return nil, fmt.Errorf("default %s args err: %s", Name, err.Error())
+		}
+		return args, nil
+	}
+	args, ok := obj.(*config.PodreschedulingArgs)
+	if !ok {
+		return nil, fmt.Errorf("want args to be of type PodreschedulingArgs, got %T", obj)
+	}
+	return args, nil
+}
+
+// EventsToRegister returns the events which may make the pods rejected by the exclusions schedulable, a new or changed
+// node may fit them, and a changed workload state may relax them. The pods' own updates, e.g. the kse.com/relaxed-hosts
+// written by PostFilter, always requeue them.
+func (pr *Podrescheduling) EventsToRegister() []framework.ClusterEvent {
+	return []framework.ClusterEvent{
+		{Resource: framework.Node, ActionType: framework.Add | framework.UpdateNodeLabel | framework.UpdateNodeTaint | framework.UpdateNodeCondition},
+		{Resource: "deployments.v1.apps", ActionType: framework.Update},
+		{Resource: "replicasets.v1.apps", ActionType: framework.Update},
+		{Resource: "statefulsets.v1.apps", ActionType: framework.Update},
+		{Resource: "daemonsets.v1.apps", ActionType: framework.Update},
+		{Resource: "jobs.v1.batch", ActionType: framework.Update},
+		{Resource: "cronjobs.v1.batch", ActionType: framework.Update},
+	}
+}
+
 func (pr *Podrescheduling) PreFilterExtensions() framework.PreFilterExtensions {
 	return nil
 }
 
+// PreFilter reads the nodes the pod must not be scheduled to again into the CycleState, they are rejected by Filter
+// with the reasons shown in the FailedScheduling events
 func (pr *Podrescheduling) PreFilter(ctx context.Context, state *framework.CycleState, pod *v1.Pod) (*framework.PreFilterResult, *framework.Status) {
-	if _, ok := pod.Annotations[pkg.SchedulinedHostString]; ok {
-		var scheduledHosts ScheduledHosts
-		if err := json.Unmarshal([]byte(pod.Annotations[pkg.SchedulinedHostString]), &scheduledHosts); err != nil {
+	podWithState, rescheduled := pr.withWorkloadState(pod)
+	if !rescheduled {
+		// no node is excluded for the pods not rescheduled by kse-rescheduler, Filter passes them without the state
+		return nil, nil
+	}
+	nodeInfos, err := pr.frameworkHandler.SnapshotSharedLister().NodeInfos().List()
+	if err != nil {
+		state.Write(preFilterStateKey, &preFilterState{excludedHosts: sets.NewString()})
+		return nil, framework.AsStatus(err)
+	}
+	nodes := make([]*v1.Node, 0, len(nodeInfos))
+	for _, nodeInfo := range nodeInfos {
+		nodes = append(nodes, nodeInfo.Node())
+	}
+	state.Write(preFilterStateKey, pr.exclusions(podWithState, nodes))
+	return nil, nil
+}
+
+// exclusions returns the nodes the pod must not be scheduled to again among the nodes, it's shared by PreFilter and
+// the extender's filter. The pod carries the rescheduling state of its workload.
+func (pr *Podrescheduling) exclusions(pod *v1.Pod, nodes []*v1.Node) *preFilterState {
+	s := &preFilterState{excludedHosts: sets.NewString()}
+	// the soft avoidance only scores the scheduled hosts lower
+	if pr.avoidanceMode(pod) == pkg.AvoidanceModeSoft {
+		return s
+	}
+	var scheduledHosts ScheduledHosts
+	if value, ok := pod.Annotations[pr.args.ScheduledHostsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &scheduledHosts); err != nil {
 			klog.ErrorS(err, "PreFilter failed", "pod", klog.KObj(pod))
-			return nil, nil
+			scheduledHosts = nil
+		}
+	}
+	excludedDomains := podExcludedDomains(pod)
+	if len(scheduledHosts) == 0 && len(excludedDomains.Domains) == 0 {
+		return s
+	}
+	// the relaxed hosts are allowed by PostFilter when no other node fits the pod
+	var relaxedHosts ScheduledHosts
+	if value, ok := pod.Annotations[pkg.RelaxedHostString]; ok {
+		if err := json.Unmarshal([]byte(value), &relaxedHosts); err != nil {
+			klog.ErrorS(err, "PreFilter failed to read the relaxed hosts", "pod", klog.KObj(pod))
+		}
+	}
+	relaxed := sets.NewString(relaxedHosts...)
+	scheduled := sets.NewString(scheduledHosts...)
+	domains := sets.NewString(excludedDomains.Domains...)
+	excludedHosts := sets.NewString()
+	s.excludedDomains = make(map[string]string)
+	for _, node := range nodes {
+		nodeName := node.Name
+		if relaxed.Has(nodeName) {
+			continue
 		}
-		nodeInfos, err := pr.frameworkHandler.SnapshotSharedLister().NodeInfos().List()
-		if err != nil {
-			return nil, framework.AsStatus(err)
+		if scheduled.Has(nodeName) {
+			excludedHosts.Insert(nodeName)
 		}
-		var resultNodes []string
-		for _, nodeInfo := range nodeInfos {
-			found := false
-			for _, scheduledHost := range scheduledHosts {
-				if nodeInfo.Node().Name == scheduledHost {
-					found = true
-					break
-				}
-			}
-			if !found {
-				resultNodes = append(resultNodes, nodeInfo.Node().Name)
-			}
+		// all the nodes in an excluded domain are excluded with the failed ones
+		if domain, ok := node.Labels[excludedDomains.TopologyKey]; ok && domains.Has(domain) {
+			excludedHosts.Insert(nodeName)
+			s.excludedDomains[nodeName] = excludedDomains.TopologyKey + "=" + domain
 		}
-		if len(resultNodes) == 0 {
-			return nil, nil
+	}
+	if excludedHosts.Len() == len(nodes) && pr.args.Fallback == config.FallbackIgnore {
+		// the scheduled hosts are still avoided by Score
+		klog.V(4).InfoS("all the nodes have been scheduled to, fall back to the soft avoidance", "pod", klog.KObj(pod))
+		s.excludedDomains = nil
+		return s
+	}
+	s.excludedHosts = excludedHosts
+	if value, ok := pod.Annotations[pkg.NodeFailuresString]; ok {
+		if err := json.Unmarshal([]byte(value), &s.nodeFailures); err != nil {
+			klog.ErrorS(err, "PreFilter failed to read the node failures", "pod", klog.KObj(pod))
 		}
-		nodeNames := sets.NewString(resultNodes...)
-		return &framework.PreFilterResult{NodeNames: nodeNames}, nil
 	}
-	return nil, nil
-}
\ No newline at end of file
+	// the least failed nodes beyond the max excluded percentage are not excluded
+	maxExcluded := len(nodes) * int(pr.args.MaxExcludedPercentage) / 100
+	if excludedHosts.Len() > maxExcluded {
+		s.excludedHosts = sets.NewString(relaxationOrder(s)[excludedHosts.Len()-maxExcluded:]...)
+	}
+	return s
+}
+
+// podExcludedDomains returns the kse.com/excluded-domains of the pod, it's empty if the pod doesn't have it
+func podExcludedDomains(pod *v1.Pod) pkg.ExcludedDomains {
+	var excludedDomains pkg.ExcludedDomains
+	if value, ok := pod.Annotations[pkg.ExcludedDomainsString]; ok {
+		if err := json.Unmarshal([]byte(value), &excludedDomains); err != nil {
+			klog.ErrorS(err, "failed to read the excluded domains", "pod", klog.KObj(pod))
+			return pkg.ExcludedDomains{}
+		}
+	}
+	return excludedDomains
+}
+
+// avoidanceMode is the kse.com/avoidance-mode of the pod, or the avoidanceMode of the args if the pod doesn't set it
+func (pr *Podrescheduling) avoidanceMode(pod *v1.Pod) string {
+	if mode, ok := pod.Annotations[pkg.AvoidanceModeString]; ok {
+		return mode
+	}
+	return pr.args.AvoidanceMode
+}
+
+func getPreFilterState(state *framework.CycleState) (*preFilterState, error) {
+	c, err := state.Read(preFilterStateKey)
+	if errors.Is(err, framework.ErrNotFound) {
+		// PreFilter skips the pods not rescheduled by kse-rescheduler
+		return &preFilterState{excludedHosts: sets.NewString()}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %q from cycleState: %w", preFilterStateKey, err)
+	}
+	s, ok := c.(*preFilterState)
+	if !ok {
+		return nil, fmt.Errorf("%+v  convert to podrescheduling.preFilterState error", c)
+	}
+	return s, nil
+}
+
+// Filter rejects the nodes the pod has been scheduled to, the status tells why the node is excluded
+func (pr *Podrescheduling) Filter(ctx context.Context, state *framework.CycleState, pod *v1.Pod, nodeInfo *framework.NodeInfo) *framework.Status {
+	s, err := getPreFilterState(state)
+	if err != nil {
+		return framework.AsStatus(err)
+	}
+	nodeName := nodeInfo.Node().Name
+	if !s.excludedHosts.Has(nodeName) {
+		return nil
+	}
+	return framework.NewStatus(framework.UnschedulableAndUnresolvable, exclusionReason(nodeName, s.nodeFailures[nodeName], s.excludedDomains[nodeName]))
+}
+
+// exclusionReason e.g. node node1 excluded by kse-rescheduler after 2 failures (OOMKilled), or node node2 excluded by
+// kse-rescheduler with its failure domain topology.kubernetes.io/zone=zone-a
+func exclusionReason(nodeName string, failure pkg.NodeFailure, domain string) string {
+	if failure.Count == 0 && domain != "" {
+		return fmt.Sprintf("node %s excluded by kse-rescheduler with its failure domain %s", nodeName, domain)
+	}
+	if failure.Count == 0 {
+		return fmt.Sprintf("node %s excluded by kse-rescheduler after the pod failed on it", nodeName)
+	}
+	failures := "failures"
+	if failure.Count == 1 {
+		failures = "failure"
+	}
+	if failure.Reason == "" {
+		return fmt.Sprintf("node %s excluded by kse-rescheduler after %d %s", nodeName, failure.Count, failures)
+	}
+	return fmt.Sprintf("node %s excluded by kse-rescheduler after %d %s (%s)", nodeName, failure.Count, failures, failure.Reason)
+}
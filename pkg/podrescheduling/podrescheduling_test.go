@@ -14,26 +14,76 @@ import (
 	"github.com/google/go-cmp/cmp"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/sets"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/kubernetes/pkg/scheduler/framework"
 	"k8s.io/kubernetes/pkg/scheduler/framework/runtime"
 	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/apis/config"
 	testutil "kse/kse-rescheduler/test/util"
 	"testing"
 )
 func TestPodRescheduling(t *testing.T) {
 	tests := []struct {
 		name                string
+		args                *config.PodreschedulingArgs
 		pod                 *corev1.Pod
 		nodes               []*corev1.Node
 		wantStatus          *framework.Status
 		wantPreFilterResult *framework.PreFilterResult
+		// wantFilterStatuses are the statuses of the rejected nodes
+		wantFilterStatuses  map[string]*framework.Status
 	}{
 		{
 			name: "pod with scheduled hosts",
 			pod: &corev1.Pod{
 				ObjectMeta: metav1.ObjectMeta{
-					Annotations: map[string]string{pkg.SchedulinedHostString: string([]byte(`["node1","node2","master1"]`))},
+					Annotations: map[string]string{pkg.SchedulingRetrieString: "3", pkg.SchedulinedHostString: string([]byte(`["node1","node2","master1"]`))},
+				},
+			},
+			nodes: []*corev1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "master1"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "master2"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "master3"}},
+			},
+			wantFilterStatuses: map[string]*framework.Status{
+				"node1":   framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node1 excluded by kse-rescheduler after the pod failed on it"),
+				"node2":   framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node2 excluded by kse-rescheduler after the pod failed on it"),
+				"master1": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node master1 excluded by kse-rescheduler after the pod failed on it"),
+			},
+		},
+		{
+			name: "pod with scheduled hosts and node failures",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						pkg.SchedulingRetrieString: "3",
+						pkg.SchedulinedHostString:  `["node1","node2"]`,
+						pkg.NodeFailuresString:     `{"node1":{"count":2,"lastFailureTime":"2023-06-01T00:00:00Z","reason":"OOMKilled"},"node2":{"count":1,"lastFailureTime":"2023-06-01T00:00:00Z"}}`,
+					},
+				},
+			},
+			nodes: []*corev1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "master1"}},
+			},
+			wantFilterStatuses: map[string]*framework.Status{
+				"node1": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node1 excluded by kse-rescheduler after 2 failures (OOMKilled)"),
+				"node2": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node2 excluded by kse-rescheduler after 1 failure"),
+			},
+		},
+		{
+			name: "pod with scheduled hosts in soft avoidance mode",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						pkg.SchedulingRetrieString: "3",
+						pkg.SchedulinedHostString:  string([]byte(`["node1","node2","master1"]`)),
+						pkg.AvoidanceModeString:    pkg.AvoidanceModeSoft,
+					},
 				},
 			},
 			nodes: []*corev1.Node{
@@ -43,7 +93,6 @@ func TestPodRescheduling(t *testing.T) {
 				{ObjectMeta: metav1.ObjectMeta{Name: "master2"}},
 				{ObjectMeta: metav1.ObjectMeta{Name: "master3"}},
 			},
-			wantPreFilterResult: &framework.PreFilterResult{NodeNames: sets.NewString("master2", "master3")},
 		},
 		{
 			name: "pod without scheduled hosts",
@@ -60,7 +109,7 @@ func TestPodRescheduling(t *testing.T) {
 			name: "pod with all the k8s cluster nodes",
 			pod: &corev1.Pod{
 				ObjectMeta: metav1.ObjectMeta{
-					Annotations: map[string]string{pkg.SchedulinedHostString: string([]byte(`["master2","master3","node1","node2","master1"]`))},
+					Annotations: map[string]string{pkg.SchedulingRetrieString: "3", pkg.SchedulinedHostString: string([]byte(`["master2","master3","node1","node2","master1"]`))},
 				},
 			},
 			nodes: []*corev1.Node{
@@ -70,13 +119,140 @@ func TestPodRescheduling(t *testing.T) {
 				{ObjectMeta: metav1.ObjectMeta{Name: "master2"}},
 				{ObjectMeta: metav1.ObjectMeta{Name: "master3"}},
 			},
+			// the exclusions are relaxed by PostFilter
+			wantFilterStatuses: map[string]*framework.Status{
+				"node1":   framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node1 excluded by kse-rescheduler after the pod failed on it"),
+				"node2":   framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node2 excluded by kse-rescheduler after the pod failed on it"),
+				"master1": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node master1 excluded by kse-rescheduler after the pod failed on it"),
+				"master2": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node master2 excluded by kse-rescheduler after the pod failed on it"),
+				"master3": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node master3 excluded by kse-rescheduler after the pod failed on it"),
+			},
+		},
+		{
+			name: "pod with all the k8s cluster nodes falling back to ignore the exclusions",
+			args: &config.PodreschedulingArgs{
+				ScheduledHostsAnnotation: pkg.SchedulinedHostString,
+				AvoidanceMode:            pkg.AvoidanceModeHard,
+				Fallback:                 config.FallbackIgnore,
+				MaxExcludedPercentage:    100,
+			},
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{pkg.SchedulingRetrieString: "3", pkg.SchedulinedHostString: `["node1","node2"]`},
+				},
+			},
+			nodes: []*corev1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+			},
+		},
+		{
+			name: "pod with more scheduled hosts than the max excluded percentage",
+			args: &config.PodreschedulingArgs{
+				ScheduledHostsAnnotation: pkg.SchedulinedHostString,
+				AvoidanceMode:            pkg.AvoidanceModeHard,
+				Fallback:                 config.FallbackRelax,
+				MaxExcludedPercentage:    50,
+			},
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						pkg.SchedulingRetrieString: "3",
+						pkg.SchedulinedHostString:  `["node1","node2","node3"]`,
+						pkg.NodeFailuresString:     `{"node1":{"count":1,"lastFailureTime":"2023-06-01T00:00:00Z"},"node2":{"count":3,"lastFailureTime":"2023-06-01T00:00:00Z"},"node3":{"count":2,"lastFailureTime":"2023-06-01T00:00:00Z"}}`,
+					},
+				},
+			},
+			nodes: []*corev1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "node3"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "node4"}},
+			},
+			wantFilterStatuses: map[string]*framework.Status{
+				"node2": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node2 excluded by kse-rescheduler after 3 failures"),
+				"node3": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node3 excluded by kse-rescheduler after 2 failures"),
+			},
+		},
+		{
+			name: "pod with scheduled hosts in a custom annotation and soft avoidance mode by default",
+			args: &config.PodreschedulingArgs{
+				ScheduledHostsAnnotation: "example.com/failed-nodes",
+				AvoidanceMode:            pkg.AvoidanceModeSoft,
+				Fallback:                 config.FallbackRelax,
+				MaxExcludedPercentage:    100,
+			},
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						pkg.SchedulingRetrieString: "3",
+						"example.com/failed-nodes": `["node1"]`,
+						pkg.AvoidanceModeString:    pkg.AvoidanceModeHard,
+					},
+				},
+			},
+			nodes: []*corev1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+			},
+			wantFilterStatuses: map[string]*framework.Status{
+				"node1": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node1 excluded by kse-rescheduler after the pod failed on it"),
+			},
+		},
+		{
+			name: "pod with an excluded domain",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						pkg.SchedulingRetrieString: "3",
+						pkg.SchedulinedHostString:  `["node1","node2"]`,
+						pkg.NodeFailuresString:     `{"node1":{"count":2,"lastFailureTime":"2023-06-01T00:00:00Z","domain":"rack1"},"node2":{"count":1,"lastFailureTime":"2023-06-01T00:00:00Z","domain":"rack1"}}`,
+						pkg.ExcludedDomainsString:  `{"topologyKey":"example.com/rack","domains":["rack1"]}`,
+					},
+				},
+			},
+			nodes: []*corev1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"example.com/rack": "rack1"}}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "node2", Labels: map[string]string{"example.com/rack": "rack1"}}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "node3", Labels: map[string]string{"example.com/rack": "rack1"}}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "node4", Labels: map[string]string{"example.com/rack": "rack2"}}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "node5"}},
+			},
+			wantFilterStatuses: map[string]*framework.Status{
+				"node1": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node1 excluded by kse-rescheduler after 2 failures"),
+				"node2": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node2 excluded by kse-rescheduler after 1 failure"),
+				"node3": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node3 excluded by kse-rescheduler with its failure domain example.com/rack=rack1"),
+			},
+		},
+		{
+			name: "pod with relaxed hosts",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						pkg.SchedulingRetrieString: "3",
+						pkg.SchedulinedHostString:  `["node1","node2"]`,
+						pkg.RelaxedHostString:      `["node2"]`,
+					},
+				},
+			},
+			nodes: []*corev1.Node{
+				{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+			},
+			wantFilterStatuses: map[string]*framework.Status{
+				"node1": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node1 excluded by kse-rescheduler after the pod failed on it"),
+			},
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			state := framework.NewCycleState()
 			fh, _ := runtime.NewFramework(nil, nil, runtime.WithSnapshotSharedLister(testutil.NewFakeSharedLister(nil, test.nodes)))
-			p, err := New(nil, fh)
+			var args k8sruntime.Object
+			if test.args != nil {
+				args = test.args
+			}
+			p, err := New(args, fh)
 			if err != nil {
 				t.Fatalf("Creating plugin: %v", err)
 			}
@@ -89,6 +265,38 @@ func TestPodRescheduling(t *testing.T) {
 				t.Errorf("unexpected PreFilterResult (-want,+got):\n%s", diff)
 				return
 			}
+			for _, node := range test.nodes {
+				nodeInfo := framework.NewNodeInfo()
+				nodeInfo.SetNode(node)
+				gotFilterStatus := p.(framework.FilterPlugin).Filter(context.Background(), state, test.pod, nodeInfo)
+				if diff := cmp.Diff(test.wantFilterStatuses[node.Name], gotFilterStatus); diff != "" {
+					t.Errorf("unexpected Filter Status of node %s (-want,+got):\n%s", node.Name, diff)
+				}
+			}
 		})
 	}
 }
+
+func TestEventsToRegister(t *testing.T) {
+	fh, _ := runtime.NewFramework(nil, nil)
+	p, err := New(nil, fh)
+	if err != nil {
+		t.Fatalf("Creating plugin: %v", err)
+	}
+	gotNodeActions := framework.ActionType(0)
+	for _, event := range p.(framework.EnqueueExtensions).EventsToRegister() {
+		switch event.Resource {
+		case framework.Node:
+			gotNodeActions |= event.ActionType
+		default:
+			// kube-scheduler drops the events of the other resources which aren't <kind in plural>.<version>.<group>
+			if gvr, _ := schema.ParseResourceArg(string(event.Resource)); gvr == nil {
+				t.Errorf("event of %s can't be watched by kube-scheduler", event.Resource)
+			}
+		}
+	}
+	wantNodeActions := framework.Add | framework.UpdateNodeLabel | framework.UpdateNodeTaint | framework.UpdateNodeCondition
+	if gotNodeActions != wantNodeActions {
+		t.Errorf("unexpected node events: got %b want %b", gotNodeActions, wantNodeActions)
+	}
+}
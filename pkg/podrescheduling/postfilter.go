@@ -0,0 +1,114 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package podrescheduling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/apis/config"
+	"sort"
+)
+
+var _ framework.PostFilterPlugin = &Podrescheduling{}
+
+// PostFilter relaxes the exclusions one by one when no node fits the pod, the least failed and then the oldest failed
+// node first. The first node which fits the pod without its exclusion is recorded in the pod's kse.com/relaxed-hosts
+// and nominated, so the pod is scheduled to it in the next cycle, and the scheduled hosts are kept.
+func (pr *Podrescheduling) PostFilter(ctx context.Context, state *framework.CycleState, pod *v1.Pod, filteredNodeStatusMap framework.NodeToStatusMap) (*framework.PostFilterResult, *framework.Status) {
+	s, err := getPreFilterState(state)
+	if err != nil {
+		return nil, framework.AsStatus(err)
+	}
+	if s.excludedHosts.Len() == 0 {
+		return nil, framework.NewStatus(framework.Unschedulable, "no node is excluded by kse-rescheduler")
+	}
+	if pr.args.Fallback != config.FallbackRelax {
+		return nil, framework.NewStatus(framework.Unschedulable, "the exclusions of kse-rescheduler are not relaxed")
+	}
+
+	for _, nodeName := range relaxationOrder(s) {
+		nodeInfo, err := pr.frameworkHandler.SnapshotSharedLister().NodeInfos().Get(nodeName)
+		if err != nil {
+			continue
+		}
+		relaxedState := state.Clone()
+		relaxedState.Write(preFilterStateKey, &preFilterState{
+			excludedHosts:   s.excludedHosts.Difference(sets.NewString(nodeName)),
+			nodeFailures:    s.nodeFailures,
+			excludedDomains: s.excludedDomains,
+		})
+		statuses := pr.frameworkHandler.RunFilterPlugins(ctx, relaxedState, pod, nodeInfo)
+		if !statuses.Merge().IsSuccess() {
+			continue
+		}
+		if err := pr.recordRelaxedHost(ctx, pod, nodeName); err != nil {
+			return nil, framework.AsStatus(err)
+		}
+		klog.V(2).InfoS("Relaxed the exclusion of kse-rescheduler", "pod", klog.KObj(pod), "node", nodeName)
+		return framework.NewPostFilterResultWithNominatedNode(nodeName), framework.NewStatus(framework.Success)
+	}
+	return nil, framework.NewStatus(framework.Unschedulable, "no node fits the pod even without the exclusions of kse-rescheduler")
+}
+
+// relaxationOrder sorts the excluded hosts by the failure count and then the last failure time, a host without a
+// failure record is the oldest one failed once
+func relaxationOrder(s *preFilterState) []string {
+	nodeNames := s.excludedHosts.List()
+	failure := func(nodeName string) pkg.NodeFailure {
+		f, ok := s.nodeFailures[nodeName]
+		if !ok || f.Count == 0 {
+			f.Count = 1
+		}
+		return f
+	}
+	sort.SliceStable(nodeNames, func(i, j int) bool {
+		fi, fj := failure(nodeNames[i]), failure(nodeNames[j])
+		if fi.Count != fj.Count {
+			return fi.Count < fj.Count
+		}
+		return fi.LastFailureTime.Before(fj.LastFailureTime)
+	})
+	return nodeNames
+}
+
+// recordRelaxedHost adds the node to the pod's kse.com/relaxed-hosts, the pod update moves it back to the active queue
+func (pr *Podrescheduling) recordRelaxedHost(ctx context.Context, pod *v1.Pod, nodeName string) error {
+	var relaxedHosts ScheduledHosts
+	if value, ok := pod.Annotations[pkg.RelaxedHostString]; ok {
+		if err := json.Unmarshal([]byte(value), &relaxedHosts); err != nil {
+			klog.ErrorS(err, "PostFilter failed to read the relaxed hosts", "pod", klog.KObj(pod))
+		}
+	}
+	byteRelaxedHosts, err := json.Marshal(append(relaxedHosts, nodeName))
+	if err != nil {
+		return fmt.Errorf("marshal pod %s kse.com/relaxed-hosts err: %s", pod.Name, err.Error())
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{pkg.RelaxedHostString: string(byteRelaxedHosts)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("marshal pod %s kse.com/relaxed-hosts patch err: %s", pod.Name, err.Error())
+	}
+	_, err = pr.frameworkHandler.ClientSet().CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: pkg.FieldManagerString})
+	if err != nil {
+		return fmt.Errorf("record pod %s relaxed host %s err: %s", pod.Name, nodeName, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package podrescheduling
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/kubernetes/pkg/scheduler/apis/config"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+	"k8s.io/kubernetes/pkg/scheduler/framework/plugins/defaultbinder"
+	"k8s.io/kubernetes/pkg/scheduler/framework/plugins/queuesort"
+	"k8s.io/kubernetes/pkg/scheduler/framework/runtime"
+	"kse/kse-rescheduler/pkg"
+	testutil "kse/kse-rescheduler/test/util"
+	"testing"
+)
+
+const fakeFilterName = "FakeFilter"
+
+// fakeFilter rejects the nodes which don't fit the pod for other reasons
+type fakeFilter struct {
+	rejectedNodes sets.String
+}
+
+func (f *fakeFilter) Name() string {
+	return fakeFilterName
+}
+
+func (f *fakeFilter) Filter(ctx context.Context, state *framework.CycleState, pod *corev1.Pod, nodeInfo *framework.NodeInfo) *framework.Status {
+	if f.rejectedNodes.Has(nodeInfo.Node().Name) {
+		return framework.NewStatus(framework.Unschedulable, "rejected by the fake filter")
+	}
+	return nil
+}
+
+func TestPostFilter(t *testing.T) {
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node3"}},
+	}
+	tests := []struct {
+		name             string
+		annotations      map[string]string
+		rejectedNodes    []string
+		wantCode         framework.Code
+		wantNominated    string
+		wantRelaxedHosts string
+	}{
+		{
+			name: "the least failed node is relaxed",
+			annotations: map[string]string{
+				pkg.SchedulingRetrieString: "3",
+				pkg.SchedulinedHostString:  `["node1","node2","node3"]`,
+				pkg.NodeFailuresString:     `{"node1":{"count":3,"lastFailureTime":"2023-06-01T00:00:00Z"},"node2":{"count":1,"lastFailureTime":"2023-06-02T00:00:00Z"},"node3":{"count":2,"lastFailureTime":"2023-06-01T00:00:00Z"}}`,
+			},
+			wantCode:         framework.Success,
+			wantNominated:    "node2",
+			wantRelaxedHosts: `["node2"]`,
+		},
+		{
+			name: "the oldest failed node is relaxed",
+			annotations: map[string]string{
+				pkg.SchedulingRetrieString: "3",
+				pkg.SchedulinedHostString:  `["node1","node2","node3"]`,
+				pkg.NodeFailuresString:     `{"node1":{"count":1,"lastFailureTime":"2023-06-03T00:00:00Z"},"node2":{"count":1,"lastFailureTime":"2023-06-02T00:00:00Z"},"node3":{"count":1,"lastFailureTime":"2023-06-01T00:00:00Z"}}`,
+			},
+			wantCode:         framework.Success,
+			wantNominated:    "node3",
+			wantRelaxedHosts: `["node3"]`,
+		},
+		{
+			name: "the node not fitting the pod is skipped",
+			annotations: map[string]string{
+				pkg.SchedulingRetrieString: "3",
+				pkg.SchedulinedHostString:  `["node1","node2","node3"]`,
+				pkg.RelaxedHostString:      `["node3"]`,
+				pkg.NodeFailuresString:     `{"node1":{"count":2,"lastFailureTime":"2023-06-01T00:00:00Z"},"node2":{"count":1,"lastFailureTime":"2023-06-01T00:00:00Z"}}`,
+			},
+			rejectedNodes:    []string{"node2", "node3"},
+			wantCode:         framework.Success,
+			wantNominated:    "node1",
+			wantRelaxedHosts: `["node3","node1"]`,
+		},
+		{
+			name: "no node fits the pod",
+			annotations: map[string]string{
+				pkg.SchedulingRetrieString: "3",
+				pkg.SchedulinedHostString:  `["node1","node2"]`,
+			},
+			rejectedNodes: []string{"node1", "node2", "node3"},
+			wantCode:      framework.Unschedulable,
+		},
+		{
+			name:          "no node is excluded",
+			annotations:   map[string]string{},
+			rejectedNodes: []string{"node1", "node2", "node3"},
+			wantCode:      framework.Unschedulable,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: test.annotations}}
+			client := fake.NewSimpleClientset(pod)
+			registry := runtime.Registry{
+				queuesort.Name:     queuesort.New,
+				defaultbinder.Name: defaultbinder.New,
+				Name:               New,
+				fakeFilterName: func(_ k8sruntime.Object, _ framework.Handle) (framework.Plugin, error) {
+					return &fakeFilter{rejectedNodes: sets.NewString(test.rejectedNodes...)}, nil
+				},
+			}
+			profile := &config.KubeSchedulerProfile{Plugins: &config.Plugins{
+				QueueSort:  config.PluginSet{Enabled: []config.Plugin{{Name: queuesort.Name}}},
+				Bind:       config.PluginSet{Enabled: []config.Plugin{{Name: defaultbinder.Name}}},
+				PreFilter:  config.PluginSet{Enabled: []config.Plugin{{Name: Name}}},
+				Filter:     config.PluginSet{Enabled: []config.Plugin{{Name: Name}, {Name: fakeFilterName}}},
+				PostFilter: config.PluginSet{Enabled: []config.Plugin{{Name: Name}}},
+			}}
+			fh, err := runtime.NewFramework(registry, profile,
+				runtime.WithClientSet(client),
+				runtime.WithSnapshotSharedLister(testutil.NewFakeSharedLister(nil, nodes)))
+			if err != nil {
+				t.Fatalf("Creating framework: %v", err)
+			}
+
+			state := framework.NewCycleState()
+			if _, status := fh.RunPreFilterPlugins(context.Background(), state, pod); !status.IsSuccess() {
+				t.Fatalf("unexpected PreFilter Status: %v", status)
+			}
+			gotResult, gotStatus := fh.RunPostFilterPlugins(context.Background(), state, pod, framework.NodeToStatusMap{})
+			if gotStatus.Code() != test.wantCode {
+				t.Fatalf("unexpected PostFilter Status: got %v want %v", gotStatus, test.wantCode)
+			}
+			gotNominated := ""
+			if gotResult != nil && gotResult.NominatingInfo != nil {
+				gotNominated = gotResult.NominatedNodeName
+			}
+			if diff := cmp.Diff(test.wantNominated, gotNominated); diff != "" {
+				t.Errorf("unexpected nominated node (-want,+got):\n%s", diff)
+			}
+			gotPod, err := client.CoreV1().Pods(pod.Namespace).Get(context.TODO(), pod.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantRelaxedHosts := test.wantRelaxedHosts
+			if wantRelaxedHosts == "" {
+				wantRelaxedHosts = test.annotations[pkg.RelaxedHostString]
+			}
+			if diff := cmp.Diff(wantRelaxedHosts, gotPod.Annotations[pkg.RelaxedHostString]); diff != "" {
+				t.Errorf("unexpected relaxed hosts (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package podrescheduling
+
+import (
+	"context"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"kse/kse-rescheduler/pkg"
+	"os"
+	"time"
+)
+
+// profileLease renews the lease of the scheduler profile running Podrescheduling, the webhook routes the rescheduled
+// pods to the profile by its schedulerName only while the lease is renewed
+type profileLease struct {
+	client      kubernetes.Interface
+	profileName string
+	identity    string
+}
+
+func newProfileLease(client kubernetes.Interface, profileName string) *profileLease {
+	identity, err := os.Hostname()
+	if err != nil {
+		identity = profileName
+	}
+	return &profileLease{client: client, profileName: profileName, identity: identity}
+}
+
+// renew creates or renews the lease, a failed renewal is retried in the next period
+func (l *profileLease) renew() {
+	now := metav1.NewMicroTime(time.Now())
+	leaseDurationSeconds := int32(pkg.ProfileLeaseDuration.Seconds())
+	leases := l.client.CoordinationV1().Leases(pkg.NAMESPACE)
+	name := pkg.ProfileLeasePrefix + l.profileName
+	lease, err := leases.Get(context.TODO(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(context.TODO(), &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: pkg.NAMESPACE},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.identity,
+				LeaseDurationSeconds: &leaseDurationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{FieldManager: pkg.FieldManagerString})
+	} else if err == nil {
+		lease.Spec.HolderIdentity = &l.identity
+		lease.Spec.LeaseDurationSeconds = &leaseDurationSeconds
+		lease.Spec.RenewTime = &now
+		_, err = leases.Update(context.TODO(), lease, metav1.UpdateOptions{FieldManager: pkg.FieldManagerString})
+	}
+	if err != nil {
+		klog.ErrorS(err, "failed to renew the lease of the scheduler profile", "profile", l.profileName)
+	}
+}
@@ -0,0 +1,40 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package podrescheduling
+
+import (
+	"context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"kse/kse-rescheduler/pkg"
+	"testing"
+	"time"
+)
+
+func TestProfileLeaseRenew(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	l := newProfileLease(client, "kse-scheduler")
+	var lastRenewTime time.Time
+	// the first renewal creates the lease, the second one updates it
+	for i := 0; i < 2; i++ {
+		l.renew()
+		lease, err := client.CoordinationV1().Leases(pkg.NAMESPACE).Get(context.TODO(), pkg.ProfileLeasePrefix+"kse-scheduler", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lease.Spec.RenewTime == nil || lease.Spec.RenewTime.Time.Before(lastRenewTime) {
+			t.Fatalf("test renewed the lease at %v, the last renewal was at %v", lease.Spec.RenewTime, lastRenewTime)
+		}
+		if lease.Spec.LeaseDurationSeconds == nil || *lease.Spec.LeaseDurationSeconds != int32(pkg.ProfileLeaseDuration.Seconds()) {
+			t.Errorf("test returned wrong lease duration: %v", lease.Spec.LeaseDurationSeconds)
+		}
+		lastRenewTime = lease.Spec.RenewTime.Time
+	}
+}
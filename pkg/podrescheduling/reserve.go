@@ -0,0 +1,112 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package podrescheduling
+
+import (
+	"context"
+	"encoding/json"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+	"kse/kse-rescheduler/pkg"
+	"time"
+)
+
+const reserveStateKey = "Reserve" + Name
+
+var _ framework.ReservePlugin = &Podrescheduling{}
+var _ framework.PostBindPlugin = &Podrescheduling{}
+
+// reserveState is the placement of the pod to be recorded into the workload once the pod is bound
+type reserveState struct {
+	kind      string
+	namespace string
+	name      string
+	placement pkg.Placement
+}
+
+func (s *reserveState) Clone() framework.StateData {
+	return s
+}
+
+// Reserve keeps the placement of a pod rescheduled by kse-rescheduler in the CycleState, it's recorded by PostBind
+func (pr *Podrescheduling) Reserve(ctx context.Context, state *framework.CycleState, pod *v1.Pod, nodeName string) *framework.Status {
+	s := pr.placementState(pod)
+	if s == nil {
+		return nil
+	}
+	s.placement.Node = nodeName
+	state.Write(reserveStateKey, s)
+	return nil
+}
+
+// Unreserve drops the placement, the pod isn't bound to the node
+func (pr *Podrescheduling) Unreserve(ctx context.Context, state *framework.CycleState, pod *v1.Pod, nodeName string) {
+	state.Delete(reserveStateKey)
+}
+
+// PostBind queues the placement to be recorded into the workload's kse.com/placements, so the controller knows where the
+// pod ran even if the pod disappears from the node. The placements are written asynchronously by pr.placements, the
+// bind path never waits for an api write.
+func (pr *Podrescheduling) PostBind(ctx context.Context, state *framework.CycleState, pod *v1.Pod, nodeName string) {
+	c, err := state.Read(reserveStateKey)
+	if err != nil {
+		return
+	}
+	s, ok := c.(*reserveState)
+	if !ok {
+		return
+	}
+	if pr.placements == nil {
+		return
+	}
+	placement := s.placement
+	placement.Time = time.Now()
+	pr.placements.Record(s.kind, s.namespace, s.name, placement)
+}
+
+// placementState returns the workload the pod's placement is recorded into, it's nil if the pod isn't rescheduled by
+// kse-rescheduler. A pure pod records its placements itself.
+func (pr *Podrescheduling) placementState(pod *v1.Pod) *reserveState {
+	if len(pod.OwnerReferences) == 0 {
+		if _, ok := pod.Annotations[pkg.SchedulingRetrieString]; !ok {
+			return nil
+		}
+		var purePodInfo pkg.PurePodInfo
+		if value, ok := pod.Annotations[pkg.PurePodInfoString]; ok {
+			if err := json.Unmarshal([]byte(value), &purePodInfo); err != nil {
+				klog.ErrorS(err, "failed to read the rescheduling state", "pod", klog.KObj(pod))
+			}
+		}
+		return &reserveState{
+			kind:      "Pod",
+			namespace: pod.Namespace,
+			name:      pod.Name,
+			placement: pkg.Placement{Pod: pod.Name, Attempt: purePodInfo.CurrentReschedulingTimes},
+		}
+	}
+	if pr.workloadListers == nil {
+		return nil
+	}
+	workload, err := pr.workloadListers.workloadState(pod)
+	if err != nil {
+		klog.V(5).InfoS("failed to read the workload of the pod", "pod", klog.KObj(pod), "err", err)
+		return nil
+	}
+	if workload == nil {
+		return nil
+	}
+	return &reserveState{
+		kind:      workload.kind,
+		namespace: workload.owner.GetNamespace(),
+		name:      workload.owner.GetName(),
+		placement: pkg.Placement{Pod: pod.Name, Attempt: workload.attempt},
+	}
+}
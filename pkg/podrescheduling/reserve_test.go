@@ -0,0 +1,141 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package podrescheduling
+
+import (
+	"context"
+	"encoding/json"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+	"k8s.io/kubernetes/pkg/scheduler/framework/runtime"
+	"kse/kse-rescheduler/pkg"
+	"testing"
+)
+
+func TestReservePostBind(t *testing.T) {
+	deploy := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: map[string]string{
+		pkg.SchedulingRetrieString: "3",
+		pkg.DeployInfoString:       `{"currentReschedulingTimes":2,"deployScheduledHosts":["node1"]}`,
+	}}}
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "nginx-5d4f8", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+		{Kind: "Deployment", Name: "nginx"},
+	}}}
+	ds := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "fluentd", Namespace: "default", Annotations: map[string]string{
+		pkg.SchedulingRetrieString:        "3",
+		pkg.CurrentReschedulingTimeString: "2",
+	}}}
+	purePod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "busybox", Namespace: "default", Annotations: map[string]string{
+		pkg.SchedulingRetrieString: "3",
+		pkg.PurePodInfoString:      `{"currentReschedulingTimes":1,"podScheduledHosts":["node1"]}`,
+	}}}
+	tests := []struct {
+		name          string
+		pod           *corev1.Pod
+		unreserve     bool
+		wantPlacement *pkg.Placement
+		// get reads the object the placement is recorded into
+		get func(client *fake.Clientset) (metav1.Object, error)
+	}{
+		{
+			name: "deployment pod placement",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nginx-5d4f8-x2k9q", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: "nginx-5d4f8"},
+			}}},
+			wantPlacement: &pkg.Placement{Pod: "nginx-5d4f8-x2k9q", Node: "node2", Attempt: 2},
+			get: func(client *fake.Clientset) (metav1.Object, error) {
+				return client.AppsV1().Deployments("default").Get(context.TODO(), "nginx", metav1.GetOptions{})
+			},
+		},
+		{
+			name: "unreserved deployment pod",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nginx-5d4f8-x2k9q", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: "nginx-5d4f8"},
+			}}},
+			unreserve: true,
+			get: func(client *fake.Clientset) (metav1.Object, error) {
+				return client.AppsV1().Deployments("default").Get(context.TODO(), "nginx", metav1.GetOptions{})
+			},
+		},
+		{
+			name: "daemonset pod placement",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "fluentd-q8x2v", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+				{Kind: "DaemonSet", Name: "fluentd"},
+			}}},
+			wantPlacement: &pkg.Placement{Pod: "fluentd-q8x2v", Node: "node2", Attempt: 2},
+			get: func(client *fake.Clientset) (metav1.Object, error) {
+				return client.AppsV1().DaemonSets("default").Get(context.TODO(), "fluentd", metav1.GetOptions{})
+			},
+		},
+		{
+			name:          "pure pod placement",
+			pod:           purePod,
+			wantPlacement: &pkg.Placement{Pod: "busybox", Node: "node2", Attempt: 1},
+			get: func(client *fake.Clientset) (metav1.Object, error) {
+				return client.CoreV1().Pods("default").Get(context.TODO(), "busybox", metav1.GetOptions{})
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			client := fake.NewSimpleClientset(deploy, rs, ds, purePod)
+			informerFactory := informers.NewSharedInformerFactory(client, 0)
+			fh, err := runtime.NewFramework(nil, nil, runtime.WithClientSet(client), runtime.WithInformerFactory(informerFactory))
+			if err != nil {
+				t.Fatalf("Creating framework: %v", err)
+			}
+			p, err := New(nil, fh)
+			if err != nil {
+				t.Fatalf("Creating plugin: %v", err)
+			}
+			informerFactory.Start(ctx.Done())
+			informerFactory.WaitForCacheSync(ctx.Done())
+
+			state := framework.NewCycleState()
+			if status := p.(framework.ReservePlugin).Reserve(ctx, state, test.pod, "node2"); !status.IsSuccess() {
+				t.Fatalf("unexpected Reserve Status: %v", status)
+			}
+			if test.unreserve {
+				p.(framework.ReservePlugin).Unreserve(ctx, state, test.pod, "node2")
+			}
+			p.(framework.PostBindPlugin).PostBind(ctx, state, test.pod, "node2")
+			// PostBind only queues the placement
+			p.(*Podrescheduling).placements.Flush()
+
+			obj, err := test.get(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, found := obj.GetAnnotations()[pkg.PlacementsString]
+			if test.wantPlacement == nil {
+				if found {
+					t.Errorf("test recorded an unreserved placement: %v", value)
+				}
+				return
+			}
+			var gotPlacements pkg.Placements
+			if err := json.Unmarshal([]byte(value), &gotPlacements); err != nil {
+				t.Fatal(err)
+			}
+			if len(gotPlacements) != 1 {
+				t.Fatalf("test returned wrong placements: %v", gotPlacements)
+			}
+			got := gotPlacements[0]
+			if got.Pod != test.wantPlacement.Pod || got.Node != test.wantPlacement.Node || got.Attempt != test.wantPlacement.Attempt || got.Time.IsZero() {
+				t.Errorf("test returned wrong placement: got %v want %v", got, *test.wantPlacement)
+			}
+		})
+	}
+}
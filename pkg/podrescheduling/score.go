@@ -0,0 +1,160 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package podrescheduling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+	"kse/kse-rescheduler/pkg"
+	"math"
+	"time"
+)
+
+const (
+	preScoreStateKey = "PreScore" + Name
+	// failureHalfLife is how long it takes the penalty of a node failure to decay to half
+	failureHalfLife = time.Hour
+	// penaltyScale keeps the decimals of the penalties in the int64 scores before they are normalized
+	penaltyScale = 1000
+)
+
+var _ framework.PreScorePlugin = &Podrescheduling{}
+var _ framework.ScorePlugin = &Podrescheduling{}
+
+type preScoreState struct {
+	nodeFailures pkg.NodeFailures
+	now          time.Time
+	// domainPenalties are the penalties of the nodes in the excluded domains, the sum of the failures in the domain
+	domainPenalties map[string]float64
+}
+
+func (s *preScoreState) Clone() framework.StateData {
+	return s
+}
+
+// PreScore reads the nodes where the pod's workload failed. The scheduled hosts without a failure record, e.g. recorded
+// by an older kse-rescheduler or kept when all the nodes have been scheduled to, count as one failure which never decays.
+func (pr *Podrescheduling) PreScore(ctx context.Context, state *framework.CycleState, pod *v1.Pod, nodes []*v1.Node) *framework.Status {
+	podWithState, _ := pr.withWorkloadState(pod)
+	state.Write(preScoreStateKey, pr.penalties(podWithState, nodes, time.Now()))
+	return nil
+}
+
+// penalties returns the failures of the pod's workload on the nodes, it's shared by PreScore and the extender's
+// prioritize. The pod carries the rescheduling state of its workload.
+func (pr *Podrescheduling) penalties(pod *v1.Pod, nodes []*v1.Node, now time.Time) *preScoreState {
+	nodeFailures := make(pkg.NodeFailures)
+	if value, ok := pod.Annotations[pkg.NodeFailuresString]; ok {
+		if err := json.Unmarshal([]byte(value), &nodeFailures); err != nil {
+			klog.ErrorS(err, "PreScore failed to read the node failures", "pod", klog.KObj(pod))
+		}
+	}
+	if value, ok := pod.Annotations[pr.args.ScheduledHostsAnnotation]; ok {
+		var scheduledHosts ScheduledHosts
+		if err := json.Unmarshal([]byte(value), &scheduledHosts); err != nil {
+			klog.ErrorS(err, "PreScore failed to read the scheduled hosts", "pod", klog.KObj(pod))
+		}
+		for _, scheduledHost := range scheduledHosts {
+			if _, ok := nodeFailures[scheduledHost]; !ok {
+				nodeFailures[scheduledHost] = pkg.NodeFailure{Count: 1, LastFailureTime: now}
+			}
+		}
+	}
+	return &preScoreState{
+		nodeFailures:    nodeFailures,
+		now:             now,
+		domainPenalties: domainPenalties(podExcludedDomains(pod), nodeFailures, nodes, now),
+	}
+}
+
+// domainPenalties returns the penalties of the nodes in the excluded domains, a node in an excluded domain is avoided
+// as if it failed as often as the whole domain
+func domainPenalties(excludedDomains pkg.ExcludedDomains, nodeFailures pkg.NodeFailures, nodes []*v1.Node, now time.Time) map[string]float64 {
+	penalties := make(map[string]float64)
+	if len(excludedDomains.Domains) == 0 {
+		return penalties
+	}
+	domainPenalty := make(map[string]float64)
+	for _, domain := range excludedDomains.Domains {
+		domainPenalty[domain] = 0
+	}
+	for _, failure := range nodeFailures {
+		if _, ok := domainPenalty[failure.Domain]; ok {
+			domainPenalty[failure.Domain] += failurePenalty(failure, now)
+		}
+	}
+	for _, node := range nodes {
+		domain, ok := node.Labels[excludedDomains.TopologyKey]
+		if !ok {
+			continue
+		}
+		if penalty, ok := domainPenalty[domain]; ok {
+			// a domain excluded without a failure record counts as one failure which never decays
+			penalties[node.Name] = math.Max(penalty, 1)
+		}
+	}
+	return penalties
+}
+
+func getPreScoreState(state *framework.CycleState) (*preScoreState, error) {
+	c, err := state.Read(preScoreStateKey)
+	if err != nil {
+		return nil, fmt.Errorf("reading %q from cycleState: %w", preScoreStateKey, err)
+	}
+	s, ok := c.(*preScoreState)
+	if !ok {
+		return nil, fmt.Errorf("%+v  convert to podrescheduling.preScoreState error", c)
+	}
+	return s, nil
+}
+
+// Score returns the penalty of the node, it's turned into the score by NormalizeScore
+func (pr *Podrescheduling) Score(ctx context.Context, state *framework.CycleState, pod *v1.Pod, nodeName string) (int64, *framework.Status) {
+	s, err := getPreScoreState(state)
+	if err != nil {
+		return 0, framework.AsStatus(err)
+	}
+	return int64(s.nodePenalty(nodeName) * penaltyScale), nil
+}
+
+// nodePenalty is the decayed failures of the node, or of its excluded domain if that's higher
+func (s *preScoreState) nodePenalty(nodeName string) float64 {
+	return math.Max(failurePenalty(s.nodeFailures[nodeName], s.now), s.domainPenalties[nodeName])
+}
+
+// failurePenalty is the count of the failures decayed by the age of the last failure
+func failurePenalty(failure pkg.NodeFailure, now time.Time) float64 {
+	if failure.Count <= 0 {
+		return 0
+	}
+	age := now.Sub(failure.LastFailureTime)
+	if age < 0 {
+		age = 0
+	}
+	return float64(failure.Count) * math.Exp2(-age.Seconds()/failureHalfLife.Seconds())
+}
+
+func (pr *Podrescheduling) ScoreExtensions() framework.ScoreExtensions {
+	return pr
+}
+
+// NormalizeScore turns the penalties into scores, a node without failures gets MaxNodeScore, one recent failure halves
+// it, and the score goes back to MaxNodeScore as the failures decay
+func (pr *Podrescheduling) NormalizeScore(ctx context.Context, state *framework.CycleState, pod *v1.Pod, scores framework.NodeScoreList) *framework.Status {
+	for i := range scores {
+		penalty := float64(scores[i].Score) / penaltyScale
+		scores[i].Score = int64(math.Round(float64(framework.MaxNodeScore) / (1 + penalty)))
+	}
+	return nil
+}
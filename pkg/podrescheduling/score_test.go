@@ -0,0 +1,139 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package podrescheduling
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+	"k8s.io/kubernetes/pkg/scheduler/framework/runtime"
+	"kse/kse-rescheduler/pkg"
+	testutil "kse/kse-rescheduler/test/util"
+	"testing"
+	"time"
+)
+
+func TestScore(t *testing.T) {
+	nodeFailures, err := json.Marshal(pkg.NodeFailures{
+		"node1": {Count: 3, LastFailureTime: time.Now()},
+		"node2": {Count: 1, LastFailureTime: time.Now().Add(-3 * failureHalfLife)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	domainFailures, err := json.Marshal(pkg.NodeFailures{
+		"node1": {Count: 3, LastFailureTime: time.Now(), Domain: "zone-a"},
+		"node2": {Count: 1, LastFailureTime: time.Now().Add(-3 * failureHalfLife), Domain: "zone-b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"topology.kubernetes.io/zone": "zone-a"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node2", Labels: map[string]string{"topology.kubernetes.io/zone": "zone-b"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "master1", Labels: map[string]string{"topology.kubernetes.io/zone": "zone-a"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "master2", Labels: map[string]string{"topology.kubernetes.io/zone": "zone-b"}}},
+	}
+	tests := []struct {
+		name       string
+		pod        *corev1.Pod
+		wantScores framework.NodeScoreList
+	}{
+		{
+			name: "pod without node failures",
+			pod:  &corev1.Pod{},
+			wantScores: framework.NodeScoreList{
+				{Name: "node1", Score: 100},
+				{Name: "node2", Score: 100},
+				{Name: "master1", Score: 100},
+				{Name: "master2", Score: 100},
+			},
+		},
+		{
+			name: "pod with recent and decayed node failures",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{pkg.NodeFailuresString: string(nodeFailures)},
+				},
+			},
+			wantScores: framework.NodeScoreList{
+				{Name: "node1", Score: 25},
+				{Name: "node2", Score: 89},
+				{Name: "master1", Score: 100},
+				{Name: "master2", Score: 100},
+			},
+		},
+		{
+			name: "pod with scheduled hosts without node failures",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						pkg.NodeFailuresString:    string(nodeFailures),
+						pkg.SchedulinedHostString: `["node1","master1"]`,
+					},
+				},
+			},
+			wantScores: framework.NodeScoreList{
+				{Name: "node1", Score: 25},
+				{Name: "node2", Score: 89},
+				{Name: "master1", Score: 50},
+				{Name: "master2", Score: 100},
+			},
+		},
+		{
+			name: "pod with an excluded domain",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						pkg.NodeFailuresString:    string(domainFailures),
+						pkg.ExcludedDomainsString: `{"topologyKey":"topology.kubernetes.io/zone","domains":["zone-a"]}`,
+					},
+				},
+			},
+			wantScores: framework.NodeScoreList{
+				{Name: "node1", Score: 25},
+				{Name: "node2", Score: 89},
+				{Name: "master1", Score: 25},
+				{Name: "master2", Score: 100},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := framework.NewCycleState()
+			fh, _ := runtime.NewFramework(nil, nil, runtime.WithSnapshotSharedLister(testutil.NewFakeSharedLister(nil, nodes)))
+			p, err := New(nil, fh)
+			if err != nil {
+				t.Fatalf("Creating plugin: %v", err)
+			}
+			if status := p.(framework.PreScorePlugin).PreScore(context.Background(), state, test.pod, nodes); !status.IsSuccess() {
+				t.Fatalf("unexpected PreScore Status: %v", status)
+			}
+			var gotScores framework.NodeScoreList
+			for _, node := range nodes {
+				score, status := p.(framework.ScorePlugin).Score(context.Background(), state, test.pod, node.Name)
+				if !status.IsSuccess() {
+					t.Fatalf("unexpected Score Status: %v", status)
+				}
+				gotScores = append(gotScores, framework.NodeScore{Name: node.Name, Score: score})
+			}
+			status := p.(framework.ScorePlugin).ScoreExtensions().NormalizeScore(context.Background(), state, test.pod, gotScores)
+			if !status.IsSuccess() {
+				t.Fatalf("unexpected NormalizeScore Status: %v", status)
+			}
+			if diff := cmp.Diff(test.wantScores, gotScores); diff != "" {
+				t.Errorf("unexpected scores (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
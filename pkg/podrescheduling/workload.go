@@ -0,0 +1,195 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package podrescheduling
+
+import (
+	"encoding/json"
+	"fmt"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	batchlisters "k8s.io/client-go/listers/batch/v1"
+	"k8s.io/klog/v2"
+	"kse/kse-rescheduler/pkg"
+)
+
+// workloadListers read the pods' workloads from the scheduler's informer cache
+type workloadListers struct {
+	deployLister appslisters.DeploymentLister
+	rsLister     appslisters.ReplicaSetLister
+	stsLister    appslisters.StatefulSetLister
+	dsLister     appslisters.DaemonSetLister
+	jobLister    batchlisters.JobLister
+	cjLister     batchlisters.CronJobLister
+}
+
+func newWorkloadListers(factory informers.SharedInformerFactory) *workloadListers {
+	if factory == nil {
+		return nil
+	}
+	return &workloadListers{
+		deployLister: factory.Apps().V1().Deployments().Lister(),
+		rsLister:     factory.Apps().V1().ReplicaSets().Lister(),
+		stsLister:    factory.Apps().V1().StatefulSets().Lister(),
+		dsLister:     factory.Apps().V1().DaemonSets().Lister(),
+		jobLister:    factory.Batch().V1().Jobs().Lister(),
+		cjLister:     factory.Batch().V1().CronJobs().Lister(),
+	}
+}
+
+// withWorkloadState returns the pod with the rescheduling state of its workload, so the exclusions are applied even if
+// the pod was admitted without the webhook, or before the state was written. The pod's own annotations are kept if the
+// workload can't be read. It's false if neither the pod nor its workload has kse.com/scheduling-retries.
+func (pr *Podrescheduling) withWorkloadState(pod *v1.Pod) (*v1.Pod, bool) {
+	if len(pod.OwnerReferences) == 0 {
+		_, ok := pod.Annotations[pkg.SchedulingRetrieString]
+		return pod, ok
+	}
+	if pr.workloadListers == nil {
+		return pod, true
+	}
+	workload, err := pr.workloadListers.workloadState(pod)
+	if err != nil {
+		klog.V(5).InfoS("failed to read the workload of the pod", "pod", klog.KObj(pod), "err", err)
+		return pod, true
+	}
+	if workload == nil {
+		return pod, false
+	}
+	owner, scheduledHosts := workload.owner, workload.scheduledHosts
+	annotations := make(map[string]string, len(pod.Annotations))
+	for key, value := range pod.Annotations {
+		annotations[key] = value
+	}
+	if len(scheduledHosts) > 0 {
+		byteScheduledHosts, err := json.Marshal(scheduledHosts)
+		if err != nil {
+			klog.ErrorS(err, "failed to marshal the scheduled hosts of the workload", "pod", klog.KObj(pod))
+			return pod, true
+		}
+		annotations[pr.args.ScheduledHostsAnnotation] = string(byteScheduledHosts)
+	}
+	for _, key := range []string{pkg.NodeFailuresString, pkg.AvoidanceModeString, pkg.ExcludedDomainsString} {
+		if value, ok := owner.GetAnnotations()[key]; ok {
+			annotations[key] = value
+		}
+	}
+	podWithState := *pod
+	podWithState.Annotations = annotations
+	return &podWithState, true
+}
+
+// podWorkload is the workload rescheduling a pod
+type podWorkload struct {
+	kind  string
+	owner metav1.Object
+	// scheduledHosts are the scheduled hosts of the pod in the workload's state
+	scheduledHosts []string
+	// attempt is the current rescheduling times of the pod in the workload's state
+	attempt int
+}
+
+// workloadState returns the workload rescheduling the pod, it's nil if the pod's workload isn't rescheduled by
+// kse-rescheduler. The error is set if the workload or its state can't be read.
+func (l *workloadListers) workloadState(pod *v1.Pod) (*podWorkload, error) {
+	ownerRef := pod.OwnerReferences[0]
+	switch ownerRef.Kind {
+	case "ReplicaSet":
+		rs, err := l.rsLister.ReplicaSets(pod.Namespace).Get(ownerRef.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the replicaset of the pod, err: %s", err.Error())
+		}
+		if len(rs.OwnerReferences) > 0 && rs.OwnerReferences[0].Kind == "Deployment" {
+			deploy, err := l.deployLister.Deployments(pod.Namespace).Get(rs.OwnerReferences[0].Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the deployment of the pod, err: %s", err.Error())
+			}
+			var deployInfo pkg.DeployInfo
+			if ok, err := readState(deploy, pkg.DeployInfoString, &deployInfo); !ok || err != nil {
+				return nil, err
+			}
+			return &podWorkload{"Deployment", deploy, deployInfo.DeployScheduledHosts, deployInfo.CurrentReschedulingTimes}, nil
+		}
+		var rsInfo pkg.RsInfo
+		if ok, err := readState(rs, pkg.RsInfoString, &rsInfo); !ok || err != nil {
+			return nil, err
+		}
+		return &podWorkload{"ReplicaSet", rs, rsInfo.RsScheduledHosts, rsInfo.CurrentReschedulingTimes}, nil
+	case "StatefulSet":
+		sts, err := l.stsLister.StatefulSets(pod.Namespace).Get(ownerRef.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the statefulset of the pod, err: %s", err.Error())
+		}
+		var stsPodsMap pkg.StsPodsMap
+		if ok, err := readState(sts, pkg.StsPodMapString, &stsPodsMap); !ok || err != nil {
+			return nil, err
+		}
+		podInfo := stsPodsMap[pod.Name]
+		return &podWorkload{"StatefulSet", sts, podInfo.PodScheduledHosts, podInfo.CurrentReschedulingTimes}, nil
+	case "DaemonSet":
+		ds, err := l.dsLister.DaemonSets(pod.Namespace).Get(ownerRef.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the daemonset of the pod, err: %s", err.Error())
+		}
+		// a DaemonSet only keeps its rescheduling times, its pods are bound to their nodes
+		var dsCurrentReschedulingTimes int
+		if ok, err := readState(ds, pkg.CurrentReschedulingTimeString, &dsCurrentReschedulingTimes); !ok || err != nil {
+			return nil, err
+		}
+		return &podWorkload{"DaemonSet", ds, nil, dsCurrentReschedulingTimes}, nil
+	case "Job":
+		jb, err := l.jobLister.Jobs(pod.Namespace).Get(ownerRef.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the job of the pod, err: %s", err.Error())
+		}
+		if len(jb.OwnerReferences) > 0 && jb.OwnerReferences[0].Kind == "CronJob" {
+			cj, err := l.cjLister.CronJobs(pod.Namespace).Get(jb.OwnerReferences[0].Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the cronjob of the pod, err: %s", err.Error())
+			}
+			var cjInfo pkg.CjInfo
+			if ok, err := readState(cj, pkg.CjInfoString, &cjInfo); !ok || err != nil {
+				return nil, err
+			}
+			return &podWorkload{"CronJob", cj, cjInfo.CjScheduledHosts, cjInfo.CurrentReschedulingTimes}, nil
+		}
+		var jobInfo pkg.JobInfo
+		if ok, err := readState(jb, pkg.JobInfoString, &jobInfo); !ok || err != nil {
+			return nil, err
+		}
+		// Indexed Jobs keep the scheduled hosts for every completion index
+		if jb.Spec.CompletionMode != nil && *jb.Spec.CompletionMode == batchv1.IndexedCompletion {
+			indexInfo := jobInfo.IndexReschedulingMap[pod.Annotations[batchv1.JobCompletionIndexAnnotation]]
+			return &podWorkload{"Job", jb, indexInfo.PodScheduledHosts, indexInfo.CurrentReschedulingTimes}, nil
+		}
+		return &podWorkload{"Job", jb, jobInfo.JobScheduledHosts, jobInfo.CurrentReschedulingTimes}, nil
+	}
+	return nil, nil
+}
+
+// readState reads the kse.com state of the workload into state, it's false if the workload isn't rescheduled by
+// kse-rescheduler
+func readState(obj metav1.Object, key string, state interface{}) (bool, error) {
+	annotations := obj.GetAnnotations()
+	if _, ok := annotations[pkg.SchedulingRetrieString]; !ok {
+		return false, nil
+	}
+	value, ok := annotations[key]
+	if !ok {
+		// the workload hasn't been rescheduled yet, its avoidance settings still apply
+		return true, nil
+	}
+	if err := json.Unmarshal([]byte(value), state); err != nil {
+		return false, fmt.Errorf("failed to read the rescheduling state %s of %s/%s, err: %s", key, obj.GetNamespace(), obj.GetName(), err.Error())
+	}
+	return true, nil
+}
@@ -0,0 +1,185 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package podrescheduling
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+	"k8s.io/kubernetes/pkg/scheduler/framework/runtime"
+	"kse/kse-rescheduler/pkg"
+	testutil "kse/kse-rescheduler/test/util"
+	"testing"
+)
+
+func TestWorkloadState(t *testing.T) {
+	indexed := batchv1.IndexedCompletion
+	workloads := []k8sruntime.Object{
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: map[string]string{
+			pkg.SchedulingRetrieString: "3",
+			pkg.DeployInfoString:       `{"currentReschedulingTimes":1,"deployScheduledHosts":["node1"]}`,
+			pkg.NodeFailuresString:     `{"node1":{"count":2,"lastFailureTime":"2023-06-01T00:00:00Z","reason":"OOMKilled"}}`,
+		}}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "nginx-5d4f8", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+			{Kind: "Deployment", Name: "nginx"},
+		}}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: map[string]string{
+			pkg.SchedulingRetrieString: "3",
+			pkg.StsPodMapString:        `{"web-0":{"currentReschedulingTimes":1,"podScheduledHosts":["node2"]}}`,
+		}}},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "pi", Namespace: "default", Annotations: map[string]string{
+				pkg.SchedulingRetrieString: "3",
+				pkg.JobInfoString:          `{"currentReschedulingTimes":1,"jobScheduledHosts":null,"indexReschedulingMap":{"1":{"currentReschedulingTimes":1,"podScheduledHosts":["node1"]}}}`,
+			}},
+			Spec: batchv1.JobSpec{CompletionMode: &indexed},
+		},
+		&batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "hello", Namespace: "default", Annotations: map[string]string{
+			pkg.SchedulingRetrieString: "3",
+			pkg.CjInfoString:           `{"currentReschedulingTimes":1,"cjScheduledHosts":["node2"]}`,
+		}}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "hello-27890", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+			{Kind: "CronJob", Name: "hello"},
+		}}},
+		&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "fluentd", Namespace: "default", Annotations: map[string]string{
+			pkg.SchedulingRetrieString:        "3",
+			pkg.CurrentReschedulingTimeString: "1",
+			pkg.ExcludedDomainsString:         `{"topologyKey":"topology.kubernetes.io/zone","domains":["zone-c"]}`,
+		}}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default", Annotations: map[string]string{
+			pkg.StsPodMapString: `{"db-0":{"currentReschedulingTimes":1,"podScheduledHosts":["node2"]}}`,
+		}}},
+	}
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node3", Labels: map[string]string{"topology.kubernetes.io/zone": "zone-c"}}},
+	}
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		// wantFilterStatuses are the statuses of the rejected nodes
+		wantFilterStatuses map[string]*framework.Status
+		// wantNoState is true if PreFilter skips the pod without writing its state
+		wantNoState bool
+	}{
+		{
+			name: "deployment pod admitted without the webhook",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nginx-5d4f8-x2k9q", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: "nginx-5d4f8"},
+			}}},
+			wantFilterStatuses: map[string]*framework.Status{
+				"node1": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node1 excluded by kse-rescheduler after 2 failures (OOMKilled)"),
+			},
+		},
+		{
+			name: "statefulset pod with a stale scheduled hosts annotation",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default",
+				Annotations:     map[string]string{pkg.SchedulinedHostString: `["node1"]`},
+				OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "web"}},
+			}},
+			wantFilterStatuses: map[string]*framework.Status{
+				"node2": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node2 excluded by kse-rescheduler after the pod failed on it"),
+			},
+		},
+		{
+			name: "indexed job pod",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pi-1-8xv2r", Namespace: "default",
+				Annotations:     map[string]string{batchv1.JobCompletionIndexAnnotation: "1"},
+				OwnerReferences: []metav1.OwnerReference{{Kind: "Job", Name: "pi"}},
+			}},
+			wantFilterStatuses: map[string]*framework.Status{
+				"node1": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node1 excluded by kse-rescheduler after the pod failed on it"),
+			},
+		},
+		{
+			name: "cronjob pod",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "hello-27890-7pl4d", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+				{Kind: "Job", Name: "hello-27890"},
+			}}},
+			wantFilterStatuses: map[string]*framework.Status{
+				"node2": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node2 excluded by kse-rescheduler after the pod failed on it"),
+			},
+		},
+		{
+			name: "daemonset pod",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "fluentd-q8x2v", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+				{Kind: "DaemonSet", Name: "fluentd"},
+			}}},
+			wantFilterStatuses: map[string]*framework.Status{
+				"node3": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node3 excluded by kse-rescheduler with its failure domain topology.kubernetes.io/zone=zone-c"),
+			},
+		},
+		{
+			name: "workload not rescheduled by kse-rescheduler",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "default", OwnerReferences: []metav1.OwnerReference{
+				{Kind: "StatefulSet", Name: "db"},
+			}}},
+			wantNoState: true,
+		},
+		{
+			name:        "pure pod not rescheduled by kse-rescheduler",
+			pod:         &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "busybox", Namespace: "default"}},
+			wantNoState: true,
+		},
+		{
+			name: "workload not found",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "cache-0", Namespace: "default",
+				Annotations:     map[string]string{pkg.SchedulinedHostString: `["node3"]`},
+				OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "cache"}},
+			}},
+			wantFilterStatuses: map[string]*framework.Status{
+				"node3": framework.NewStatus(framework.UnschedulableAndUnresolvable, "node node3 excluded by kse-rescheduler after the pod failed on it"),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			informerFactory := informers.NewSharedInformerFactory(fake.NewSimpleClientset(workloads...), 0)
+			fh, err := runtime.NewFramework(nil, nil,
+				runtime.WithInformerFactory(informerFactory),
+				runtime.WithSnapshotSharedLister(testutil.NewFakeSharedLister(nil, nodes)))
+			if err != nil {
+				t.Fatalf("Creating framework: %v", err)
+			}
+			p, err := New(nil, fh)
+			if err != nil {
+				t.Fatalf("Creating plugin: %v", err)
+			}
+			informerFactory.Start(ctx.Done())
+			informerFactory.WaitForCacheSync(ctx.Done())
+
+			state := framework.NewCycleState()
+			if _, status := p.(framework.PreFilterPlugin).PreFilter(ctx, state, test.pod); !status.IsSuccess() {
+				t.Fatalf("unexpected PreFilter Status: %v", status)
+			}
+			if _, err := state.Read(preFilterStateKey); (err != nil) != test.wantNoState {
+				t.Errorf("unexpected PreFilter state, wantNoState %v, err: %v", test.wantNoState, err)
+			}
+			for _, node := range nodes {
+				nodeInfo := framework.NewNodeInfo()
+				nodeInfo.SetNode(node)
+				gotFilterStatus := p.(framework.FilterPlugin).Filter(ctx, state, test.pod, nodeInfo)
+				if diff := cmp.Diff(test.wantFilterStatuses[node.Name], gotFilterStatus); diff != "" {
+					t.Errorf("unexpected Filter Status of node %s (-want,+got):\n%s", node.Name, diff)
+				}
+			}
+		})
+	}
+}
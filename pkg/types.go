@@ -9,7 +9,10 @@
 
 package pkg
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 //annotations name
 const (
 	SchedulingRetrieString        = "scheduling-retries"
@@ -20,13 +23,80 @@ const (
 	CjInfoString                  = "kse.com/cj"
 	JobInfoString                 = "kse.com/job"
 	SchedulinedHostString         = "kse.com/scheduled-hosts"
+	// RelaxedHostString is the scheduled hosts the scheduler stopped excluding because no other node fits the pod
+	RelaxedHostString             = "kse.com/relaxed-hosts"
 	CurrentReschedulingTimeString = "kse.com/current-retries-times"
+	NodeFailuresString            = "kse.com/node-failures"
+	AvoidanceModeString           = "kse.com/avoidance-mode"
+	// ExclusionTopologyKeyString is the node label the failures of a workload are grouped by, e.g. topology.kubernetes.io/zone
+	ExclusionTopologyKeyString    = "kse.com/exclusion-topology-key"
+	// DomainEscalationFailuresString is how many failures in a domain escalate the exclusion to the whole domain
+	DomainEscalationFailuresString = "kse.com/domain-escalation-failures"
+	ExcludedDomainsString         = "kse.com/excluded-domains"
+	// NodeAffinityExclusionsString is the exclusions the webhook injected into a pod's nodeAffinity, the listFunc
+	// relaxes the required ones of the pods which can't be scheduled
+	NodeAffinityExclusionsString  = "kse.com/node-affinity-exclusions"
+	// PlacementsString is the placements of a workload's pods recorded by the scheduler
+	PlacementsString              = "kse.com/placements"
+	// MaxPlacements is how many latest placements a workload keeps
+	MaxPlacements                 = 50
+	// PlacementFlushPeriod is how often the scheduler writes the queued placements into the workloads
+	PlacementFlushPeriod          = 2 * time.Second
+	DefaultDomainEscalationFailures = 3
 	NAMESPACE                     = "kube-system"
+	IntentJournalString           = "kse-rescheduler-intents"
+	// MaxIntentSnapshotSize bounds the pod or cronjob snapshot of an intent, and MaxJournalSize all the intents in the
+	// journal, a ConfigMap is limited to 1MiB. A reschedule which can't be journaled isn't started.
+	MaxIntentSnapshotSize         = 128 * 1024
+	MaxJournalSize                = 768 * 1024
+	// FieldManagerString is the field manager of the kse.com state writes
+	FieldManagerString            = "kse-rescheduler"
+	// MaxStateSize is the max bytes of a kse.com state annotation, all the annotations of an object are limited to 256KiB
+	MaxStateSize                  = 32 * 1024
+	// MaxStateAnnotationsSize is the max bytes of all the kse.com annotations of an object together, the oldest
+	// placements and node failures are dropped to fit, the rest of the 256KiB is left to the other annotations
+	MaxStateAnnotationsSize       = 128 * 1024
 	RenewDeadlineDuration         = 10 * time.Second
 	LeaseDuration                 = 15 * time.Second
 	RetryPeriod                   = 2 * time.Second
+	// ProfileLeasePrefix is the prefix of the leases in NAMESPACE renewed by the scheduler profiles running Podrescheduling,
+	// the webhook only routes the pods to a profile whose lease is renewed within ProfileLeaseDuration
+	ProfileLeasePrefix            = "kse-rescheduler-profile-"
+	ProfileLeaseDuration          = 60 * time.Second
+	ProfileLeaseRenewPeriod       = 20 * time.Second
+	// MaxSchedulingRetries is the max scheduling-retries accepted by the validating webhook
+	MaxSchedulingRetries          = 100
+	// StateEditGroup and StateEditResource are the virtual resource a SubjectAccessReview checks before a user not in
+	// the --state-editors edits the kse.com state annotations, e.g. granted by update on states.kse.com
+	StateEditGroup                = "kse.com"
+	StateEditResource             = "states"
+	// CAValidity and CertValidity are the validity of the CA and the serving certificate managed by --manage-certs, the
+	// serving certificate is renewed CertRenewBefore it expires, and the CA once it can't outlive a new serving certificate
+	CAValidity                    = 10 * 365 * 24 * time.Hour
+	CertValidity                  = 365 * 24 * time.Hour
+	CertRenewBefore               = 30 * 24 * time.Hour
+	// CertCheckPeriod is how often the managed certificates and the caBundles are checked
+	CertCheckPeriod               = time.Minute
+	// CertReloadPeriod is how often the serving certificate files are checked for changes
+	CertReloadPeriod              = 10 * time.Second
+	// an iteration of the listFunc or the gc running longer than ReconcileStuckTimeout fails the liveness check
+	ReconcileStuckTimeout         = 10 * time.Minute
+	// APIServerCheckTimeout bounds the request of the readiness check to the api server
+	APIServerCheckTimeout         = 5 * time.Second
+	// ConfigReloadPeriod is how often the configuration file is checked for changes
+	ConfigReloadPeriod            = 10 * time.Second
 )
 
+// DefaultStateEditors are the users editing the kse.com state annotations besides kse-rescheduler, the scheduler
+// records the relaxed hosts and the placements, and the deployment controller copies the annotations of a Deployment
+// to its ReplicaSets. The deployment controller runs as its own service account with kube-controller-manager's
+// --use-service-account-credentials, or as system:kube-controller-manager without it.
+var DefaultStateEditors = []string{
+	"system:kube-scheduler",
+	"system:serviceaccount:kube-system:deployment-controller",
+	"system:kube-controller-manager",
+}
+
 // if a pod's createTime max than OutOfTimeToRescheduling, we just need to delete it, we don't have to rescheduling this pod
 // because of the k8s cluster environment may be changed
 const OutOfTimeToRescheduling  = "30m"
@@ -45,28 +115,146 @@ type PodOwnerInfo struct {
 }
 
 type PurePodInfo struct {
-	CurrentReschedulingTimes int `json:"currentReschedulingTimes, omitempty"`
-	PodScheduledHosts []string `json:"podScheduledHosts, omitempty"`
+	CurrentReschedulingTimes int `json:"currentReschedulingTimes"`
+	PodScheduledHosts []string `json:"podScheduledHosts"`
 }
 
 type DeployInfo struct {
-	CurrentReschedulingTimes int `json:"currentReschedulingTimes, omitempty"`
-	DeployScheduledHosts []string `json:"deployScheduledHosts, omitempty"`
+	CurrentReschedulingTimes int `json:"currentReschedulingTimes"`
+	DeployScheduledHosts []string `json:"deployScheduledHosts"`
 }
 
 type RsInfo struct {
-	CurrentReschedulingTimes int `json:"currentReschedulingTimes, omitempty"`
-	RsScheduledHosts []string `json:"rsScheduledHosts, omitempty"`
+	CurrentReschedulingTimes int `json:"currentReschedulingTimes"`
+	RsScheduledHosts []string `json:"rsScheduledHosts"`
 }
 
 type CjInfo struct {
-	CurrentReschedulingTimes int `json:"currentReschedulingTimes, omitempty"`
-	CjScheduledHosts []string `json:"cjScheduledHosts, omitempty"`
+	CurrentReschedulingTimes int `json:"currentReschedulingTimes"`
+	CjScheduledHosts []string `json:"cjScheduledHosts"`
 }
 
 type JobInfo struct {
-	CurrentReschedulingTimes int `json:"currentReschedulingTimes, omitempty"`
-	JobScheduledHosts []string `json:"jobScheduledHosts, omitempty"`
+	CurrentReschedulingTimes int `json:"currentReschedulingTimes"`
+	JobScheduledHosts []string `json:"jobScheduledHosts"`
+	// IndexReschedulingMap keeps the rescheduling info of every completion index for Indexed Jobs, the
+	// retries and scheduled hosts are counted per index instead of the whole Job
+	IndexReschedulingMap map[string]PurePodInfo `json:"indexReschedulingMap,omitempty"`
 }
 
 type StsPodsMap map[string]PurePodInfo
+
+// the steps of a rescheduling intent, an intent is removed from the journal once it's finished or rolled back
+const (
+	// IntentStepPending the intent is journaled, nothing has been changed yet
+	IntentStepPending = "Pending"
+	// IntentStepStateUpdated the kse.com annotation of the pod's owner has been updated, the pod is to be deleted
+	IntentStepStateUpdated = "StateUpdated"
+	// IntentStepDeleted the pure pod or cronjob has been deleted, the snapshot is to be created
+	IntentStepDeleted = "Deleted"
+)
+
+// ReschedulingIntent is journaled before rescheduling a pod, so a reschedule interrupted by an error or a leader change
+// is resumed or rolled back by the next listFunc period, instead of losing the pod or counting the retry twice
+type ReschedulingIntent struct {
+	Step      string `json:"step"`
+	Namespace string `json:"namespace"`
+	PodName   string `json:"podName"`
+	PodUID    string `json:"podUID"`
+	// OwnerKind is the kind of the object which keeps the rescheduling state, "Pod" for pure pods
+	OwnerKind string `json:"ownerKind"`
+	OwnerName string `json:"ownerName"`
+	OwnerUID  string `json:"ownerUID,omitempty"`
+	// AnnotationKey and AnnotationValue are the target rescheduling state of the owner
+	AnnotationKey   string `json:"annotationKey,omitempty"`
+	AnnotationValue string `json:"annotationValue,omitempty"`
+	// Snapshot is the pure pod or cronjob to be created instead of the deleted one
+	Snapshot     json.RawMessage `json:"snapshot,omitempty"`
+	CreationTime time.Time       `json:"creationTime"`
+}
+
+// the pod failure policy of batch/v1 Jobs, the k8s.io/api we build with doesn't have it yet, so we read it
+// from the unstructured Job
+const (
+	PodFailurePolicyActionFailJob = "FailJob"
+	PodFailurePolicyActionIgnore  = "Ignore"
+	PodFailurePolicyActionCount   = "Count"
+
+	PodFailurePolicyOnExitCodesOpIn    = "In"
+	PodFailurePolicyOnExitCodesOpNotIn = "NotIn"
+)
+
+type PodFailurePolicy struct {
+	Rules []PodFailurePolicyRule `json:"rules"`
+}
+
+type PodFailurePolicyRule struct {
+	Action          string                                   `json:"action"`
+	OnExitCodes     *PodFailurePolicyOnExitCodesRequirement  `json:"onExitCodes,omitempty"`
+	OnPodConditions []PodFailurePolicyOnPodConditionsPattern `json:"onPodConditions,omitempty"`
+}
+
+type PodFailurePolicyOnExitCodesRequirement struct {
+	ContainerName *string `json:"containerName,omitempty"`
+	Operator      string  `json:"operator"`
+	Values        []int32 `json:"values"`
+}
+
+type PodFailurePolicyOnPodConditionsPattern struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+// the kse.com/avoidance-mode of a workload, hard excludes the nodes where the workload failed, soft only scores them
+// lower, so the pods may still be scheduled to them if they are the best remaining nodes
+const (
+	AvoidanceModeHard = "hard"
+	AvoidanceModeSoft = "soft"
+)
+
+// the --node-affinity-mode of the webhook, the scheduled hosts and the excluded domains are injected into the pods as a
+// required or preferred nodeAffinity, so they are excluded by the stock kube-scheduler without the Podrescheduling plugin
+const (
+	NodeAffinityModeRequired  = "required"
+	NodeAffinityModePreferred = "preferred"
+)
+
+// NodeFailure records how often and how recently a workload failed on a node
+type NodeFailure struct {
+	Count           int       `json:"count"`
+	LastFailureTime time.Time `json:"lastFailureTime"`
+	// Reason is the reason of the last failure, e.g. OOMKilled
+	Reason string `json:"reason,omitempty"`
+	// Domain is the value of the workload's exclusion topology key on the node
+	Domain string `json:"domain,omitempty"`
+}
+
+// NodeFailures is the kse.com/node-failures keyed by node name
+type NodeFailures map[string]NodeFailure
+
+// Placement records a pod of a workload bound to a node by the scheduler
+type Placement struct {
+	Pod  string    `json:"pod"`
+	Node string    `json:"node"`
+	Time time.Time `json:"time"`
+	// Attempt is the rescheduling times of the pod when it's placed, 0 for the first placement
+	Attempt int `json:"attempt"`
+}
+
+// Placements is the kse.com/placements of a workload, the oldest placement comes first
+type Placements []Placement
+
+// ExcludedDomains is the kse.com/excluded-domains, all the nodes in the domains are avoided like the failed nodes
+type ExcludedDomains struct {
+	TopologyKey string   `json:"topologyKey"`
+	Domains     []string `json:"domains"`
+}
+
+// NodeAffinityExclusions is the kse.com/node-affinity-exclusions, the NotIn requirements of the kubernetes.io/hostname
+// and the TopologyKey labels the webhook injected into the pod's nodeAffinity in Mode, required or preferred
+type NodeAffinityExclusions struct {
+	Mode        string   `json:"mode"`
+	Hostnames   []string `json:"hostnames,omitempty"`
+	TopologyKey string   `json:"topologyKey,omitempty"`
+	Domains     []string `json:"domains,omitempty"`
+}
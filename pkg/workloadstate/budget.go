@@ -0,0 +1,96 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package workloadstate
+
+import (
+	"encoding/json"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"kse/kse-rescheduler/pkg"
+	"sort"
+	"strings"
+)
+
+const stateAnnotationPrefix = "kse.com/"
+
+// fitStateBudget returns the annotations patch of obj with the oldest placements and node failures dropped until all
+// the kse.com annotations of the patched obj fit in pkg.MaxStateAnnotationsSize. Every state annotation is already
+// limited to pkg.MaxStateSize, the scheduled hosts and the rescheduling times are never dropped here.
+func fitStateBudget(obj metav1.Object, annotations map[string]*string) (map[string]*string, error) {
+	state := make(map[string]string)
+	for key, value := range obj.GetAnnotations() {
+		if strings.HasPrefix(key, stateAnnotationPrefix) {
+			state[key] = value
+		}
+	}
+	for key, value := range annotations {
+		if value == nil {
+			delete(state, key)
+		} else if strings.HasPrefix(key, stateAnnotationPrefix) {
+			state[key] = *value
+		}
+	}
+	size := 0
+	for key, value := range state {
+		size += len(key) + len(value)
+	}
+	if size <= pkg.MaxStateAnnotationsSize {
+		return annotations, nil
+	}
+
+	var placements pkg.Placements
+	if err := json.Unmarshal([]byte(state[pkg.PlacementsString]), &placements); err != nil {
+		placements = nil
+	}
+	nodeFailures := make(pkg.NodeFailures)
+	if err := json.Unmarshal([]byte(state[pkg.NodeFailuresString]), &nodeFailures); err != nil {
+		nodeFailures = make(pkg.NodeFailures)
+	}
+	nodes := make([]string, 0, len(nodeFailures))
+	for node := range nodeFailures {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodeFailures[nodes[i]].LastFailureTime.Before(nodeFailures[nodes[j]].LastFailureTime)
+	})
+	// the sizes of the annotations to be trimmed are recomputed after every drop
+	size -= len(state[pkg.PlacementsString]) + len(state[pkg.NodeFailuresString])
+	placementsValue, nodeFailuresValue := state[pkg.PlacementsString], state[pkg.NodeFailuresString]
+	for size+len(placementsValue)+len(nodeFailuresValue) > pkg.MaxStateAnnotationsSize && (len(placements) > 0 || len(nodes) > 0) {
+		if len(nodes) == 0 || len(placements) > 0 && placements[0].Time.Before(nodeFailures[nodes[0]].LastFailureTime) {
+			placements = placements[1:]
+			bytePlacements, err := json.Marshal(placements)
+			if err != nil {
+				return nil, fmt.Errorf("marshal %s kse.com/placements err: %s\n", obj.GetName(), err.Error())
+			}
+			placementsValue = string(bytePlacements)
+		} else {
+			delete(nodeFailures, nodes[0])
+			nodes = nodes[1:]
+			byteNodeFailures, err := json.Marshal(nodeFailures)
+			if err != nil {
+				return nil, fmt.Errorf("marshal %s kse.com/node-failures err: %s\n", obj.GetName(), err.Error())
+			}
+			nodeFailuresValue = string(byteNodeFailures)
+		}
+	}
+
+	fitted := make(map[string]*string, len(annotations)+2)
+	for key, value := range annotations {
+		fitted[key] = value
+	}
+	if placementsValue != state[pkg.PlacementsString] {
+		fitted[pkg.PlacementsString] = &placementsValue
+	}
+	if nodeFailuresValue != state[pkg.NodeFailuresString] {
+		fitted[pkg.NodeFailuresString] = &nodeFailuresValue
+	}
+	return fitted, nil
+}
@@ -0,0 +1,130 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package workloadstate
+
+import (
+	"encoding/json"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"kse/kse-rescheduler/pkg"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFitStateBudget(t *testing.T) {
+	start := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	// the placements and the node failures alternate, every even minute is a placement and every odd one a failure
+	var placements pkg.Placements
+	nodeFailures := make(pkg.NodeFailures)
+	for i := 0; i < 20; i++ {
+		placements = append(placements, pkg.Placement{Pod: fmt.Sprintf("nginx-%d", i), Node: "node1", Time: start.Add(time.Duration(2*i) * time.Minute)})
+		nodeFailures[fmt.Sprintf("node%d", i)] = pkg.NodeFailure{Count: 1, LastFailureTime: start.Add(time.Duration(2*i+1) * time.Minute), Reason: "Error"}
+	}
+	bytePlacements, err := json.Marshal(placements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byteNodeFailures, err := json.Marshal(nodeFailures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployInfo := `{"currentReschedulingTimes":2,"deployScheduledHosts":["node1"]}`
+	tests := []struct {
+		name string
+		// otherSize is the size of another kse.com annotation of the deployment
+		otherSize int
+		// wantTrimmed is true if the oldest entries are dropped, wantEmpty if all the entries are dropped
+		wantTrimmed bool
+		wantEmpty   bool
+	}{
+		{
+			name:      "state within the budget",
+			otherSize: 1024,
+		},
+		{
+			name:        "the oldest entries are dropped",
+			otherSize:   pkg.MaxStateAnnotationsSize - len(bytePlacements) - len(byteNodeFailures)/2,
+			wantTrimmed: true,
+		},
+		{
+			name:        "all the entries are dropped",
+			otherSize:   pkg.MaxStateAnnotationsSize,
+			wantTrimmed: true,
+			wantEmpty:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deploy := &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: map[string]string{
+				pkg.SchedulingRetrieString:      "3",
+				pkg.PlacementsString:            string(bytePlacements),
+				pkg.NodeFailuresString:          string(byteNodeFailures),
+				"kse.com/example":               strings.Repeat("x", test.otherSize),
+				"kubectl.kubernetes.io/example": strings.Repeat("x", pkg.MaxStateAnnotationsSize),
+			}}}
+			annotations := map[string]*string{pkg.DeployInfoString: &deployInfo}
+			fitted, err := fitStateBudget(deploy, annotations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *fitted[pkg.DeployInfoString] != deployInfo {
+				t.Errorf("test changed the patched state: got %v", *fitted[pkg.DeployInfoString])
+			}
+			if !test.wantTrimmed {
+				if len(fitted) != len(annotations) {
+					t.Errorf("test trimmed the state within the budget: got %v", fitted)
+				}
+				return
+			}
+
+			size := 0
+			for key, value := range deploy.Annotations {
+				if strings.HasPrefix(key, "kse.com/") {
+					size += len(key) + len(value)
+				}
+			}
+			for key, value := range fitted {
+				if oldValue, found := deploy.Annotations[key]; found {
+					size -= len(key) + len(oldValue)
+				}
+				size += len(key) + len(*value)
+			}
+			if !test.wantEmpty && size > pkg.MaxStateAnnotationsSize {
+				t.Errorf("test returned %d bytes of state, want at most %d", size, pkg.MaxStateAnnotationsSize)
+			}
+			var gotPlacements pkg.Placements
+			if err := json.Unmarshal([]byte(*fitted[pkg.PlacementsString]), &gotPlacements); err != nil {
+				t.Fatal(err)
+			}
+			gotNodeFailures := make(pkg.NodeFailures)
+			if err := json.Unmarshal([]byte(*fitted[pkg.NodeFailuresString]), &gotNodeFailures); err != nil {
+				t.Fatal(err)
+			}
+			kept := len(gotPlacements) + len(gotNodeFailures)
+			if kept == len(placements)+len(nodeFailures) || test.wantEmpty && kept > 0 {
+				t.Fatalf("test returned wrong kept entries: %d", kept)
+			}
+			// every kept entry is newer than the dropped ones
+			oldestKept := start.Add(time.Duration(40-kept) * time.Minute)
+			for _, placement := range gotPlacements {
+				if placement.Time.Before(oldestKept) {
+					t.Errorf("test kept the placement of %v, older than %v", placement.Time, oldestKept)
+				}
+			}
+			for node, failure := range gotNodeFailures {
+				if failure.LastFailureTime.Before(oldestKept) {
+					t.Errorf("test kept the failure on %s of %v, older than %v", node, failure.LastFailureTime, oldestKept)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package workloadstate
+
+import (
+	"encoding/json"
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+	"kse/kse-rescheduler/pkg"
+	"sync"
+)
+
+// PlacementRecorder records the placements of the pods bound by the Podrescheduling plugin into the kse.com/placements
+// of their workloads. Record only queues the placement, the queued placements of a workload are written by one patch
+// when they're flushed, so binding a pod never waits for an api write, and a workload scaling up is patched once per
+// pkg.PlacementFlushPeriod instead of once per pod.
+type PlacementRecorder struct {
+	objects *Objects
+	mu      sync.Mutex
+	pending map[workloadKey]pkg.Placements
+}
+
+type workloadKey struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+func NewPlacementRecorder(objects *Objects) *PlacementRecorder {
+	return &PlacementRecorder{objects: objects, pending: make(map[workloadKey]pkg.Placements)}
+}
+
+// Record queues the placement of the workload's pod
+func (r *PlacementRecorder) Record(kind, namespace, name string, placement pkg.Placement) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queue(workloadKey{kind, namespace, name}, placement)
+}
+
+// queue appends the placements to the pending placements of the workload, only the latest pkg.MaxPlacements are kept
+func (r *PlacementRecorder) queue(key workloadKey, placements ...pkg.Placement) {
+	pending := append(r.pending[key], placements...)
+	if len(pending) > pkg.MaxPlacements {
+		pending = pending[len(pending)-pkg.MaxPlacements:]
+	}
+	r.pending[key] = pending
+}
+
+// Flush writes the queued placements into their workloads. The placements failed to be written are queued again before
+// the placements recorded since, they're dropped if the workload has gone.
+func (r *PlacementRecorder) Flush() {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[workloadKey]pkg.Placements)
+	r.mu.Unlock()
+
+	for key, placements := range pending {
+		err := r.write(key, placements)
+		if err == nil || apierrors.IsNotFound(err) {
+			continue
+		}
+		klog.ErrorS(err, "failed to record the placements, they're recorded in the next flush", "kind", key.kind, "workload", klog.KRef(key.namespace, key.name))
+		r.mu.Lock()
+		recorded := r.pending[key]
+		r.pending[key] = nil
+		r.queue(key, append(placements, recorded...)...)
+		r.mu.Unlock()
+	}
+}
+
+// write appends the placements to the kse.com/placements of the workload. The placements are read again and merged if
+// they're changed concurrently, e.g. by the placements recorded by another scheduler.
+func (r *PlacementRecorder) write(key workloadKey, placements pkg.Placements) error {
+	return retry.OnError(retry.DefaultRetry, IsStateChanged, func() error {
+		obj, err := r.objects.Get(key.kind, key.namespace, key.name)
+		if err != nil {
+			return err
+		}
+		value, err := AppendPlacements(obj, placements...)
+		if err != nil {
+			return err
+		}
+		return r.objects.UpdateAnnotation(key.kind, obj, pkg.PlacementsString, value)
+	})
+}
+
+// AppendPlacements returns the kse.com/placements of obj with the placements appended, only the latest
+// pkg.MaxPlacements placements are kept
+func AppendPlacements(obj metav1.Object, placements ...pkg.Placement) (string, error) {
+	allPlacements := append(ReadPlacements(obj), placements...)
+	if len(allPlacements) > pkg.MaxPlacements {
+		allPlacements = allPlacements[len(allPlacements)-pkg.MaxPlacements:]
+	}
+	bytePlacements, err := json.Marshal(allPlacements)
+	if err != nil {
+		return "", fmt.Errorf("marshal %s kse.com/placements err: %s\n", obj.GetName(), err.Error())
+	}
+	return string(bytePlacements), nil
+}
+
+func ReadPlacements(obj metav1.Object) pkg.Placements {
+	var placements pkg.Placements
+	if value, found := obj.GetAnnotations()[pkg.PlacementsString]; found {
+		if err := json.Unmarshal([]byte(value), &placements); err != nil {
+			klog.Errorf("unmarshal %s kse.com/placements err: %s, the placements are recorded again\n", obj.GetName(), err.Error())
+			return nil
+		}
+	}
+	return placements
+}
+
+// LastPlacement returns the node the pod was last placed on, it's empty if the placement isn't recorded
+func LastPlacement(obj metav1.Object, podName string) string {
+	placements := ReadPlacements(obj)
+	for i := len(placements) - 1; i >= 0; i-- {
+		if placements[i].Pod == podName {
+			return placements[i].Node
+		}
+	}
+	return ""
+}
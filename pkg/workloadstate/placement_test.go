@@ -0,0 +1,146 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package workloadstate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/capabilities"
+	"testing"
+	"time"
+)
+
+func TestPlacementRecorder(t *testing.T) {
+	now := time.Date(2023, 6, 2, 0, 0, 0, 0, time.UTC)
+	var fullPlacements pkg.Placements
+	for i := 0; i < pkg.MaxPlacements; i++ {
+		fullPlacements = append(fullPlacements, pkg.Placement{Pod: fmt.Sprintf("nginx-%d", i), Node: "node1", Time: now})
+	}
+	byteFullPlacements, err := json.Marshal(fullPlacements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		placements  pkg.Placements
+		// failedPatches are how many patches fail before one succeeds
+		failedPatches  int
+		wantPatches    int
+		wantPlacements int
+		wantFirstPod   string
+	}{
+		{
+			name:           "first placement",
+			annotations:    map[string]string{pkg.SchedulingRetrieString: "3"},
+			placements:     pkg.Placements{{Pod: "nginx-x2k9q", Node: "node2", Time: now, Attempt: 1}},
+			wantPatches:    1,
+			wantPlacements: 1,
+			wantFirstPod:   "nginx-x2k9q",
+		},
+		{
+			name:        "the placements of a workload are written by one patch",
+			annotations: map[string]string{pkg.SchedulingRetrieString: "3"},
+			placements: pkg.Placements{
+				{Pod: "nginx-x2k9q", Node: "node2", Time: now, Attempt: 1},
+				{Pod: "nginx-7pl4d", Node: "node3", Time: now, Attempt: 1},
+			},
+			wantPatches:    1,
+			wantPlacements: 2,
+			wantFirstPod:   "nginx-x2k9q",
+		},
+		{
+			name: "the oldest placement is dropped",
+			annotations: map[string]string{
+				pkg.SchedulingRetrieString: "3",
+				pkg.PlacementsString:       string(byteFullPlacements),
+			},
+			placements:     pkg.Placements{{Pod: "nginx-x2k9q", Node: "node2", Time: now, Attempt: 1}},
+			wantPatches:    1,
+			wantPlacements: pkg.MaxPlacements,
+			wantFirstPod:   "nginx-1",
+		},
+		{
+			name:           "a failed write is retried in the next flush",
+			annotations:    map[string]string{pkg.SchedulingRetrieString: "3"},
+			placements:     pkg.Placements{{Pod: "nginx-x2k9q", Node: "node2", Time: now, Attempt: 1}},
+			failedPatches:  1,
+			wantPatches:    2,
+			wantPlacements: 1,
+			wantFirstPod:   "nginx-x2k9q",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deploy := &appsv1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: test.annotations}}
+			client := fake.NewSimpleClientset(deploy)
+			patches, failedPatches := 0, test.failedPatches
+			client.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				patches++
+				if failedPatches > 0 {
+					failedPatches--
+					return true, nil, apierrors.NewServiceUnavailable("apiserver unavailable")
+				}
+				return false, nil, nil
+			})
+			recorder := NewPlacementRecorder(NewObjects(client, capabilities.CronJobV1))
+			for _, placement := range test.placements {
+				recorder.Record("Deployment", "default", "nginx", placement)
+			}
+			if patches != 0 {
+				t.Fatalf("test patched the workload when recording: %d patches", patches)
+			}
+			for i := 0; i <= test.failedPatches; i++ {
+				recorder.Flush()
+			}
+			if patches != test.wantPatches {
+				t.Errorf("test returned %d patches, want %d", patches, test.wantPatches)
+			}
+			gotDeploy, err := client.AppsV1().Deployments("default").Get(context.TODO(), "nginx", v1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotPlacements pkg.Placements
+			if err := json.Unmarshal([]byte(gotDeploy.Annotations[pkg.PlacementsString]), &gotPlacements); err != nil {
+				t.Fatal(err)
+			}
+			if len(gotPlacements) != test.wantPlacements {
+				t.Fatalf("test returned %d placements, want %d", len(gotPlacements), test.wantPlacements)
+			}
+			if gotPlacements[0].Pod != test.wantFirstPod {
+				t.Errorf("test returned wrong first placement: got %v want %v", gotPlacements[0].Pod, test.wantFirstPod)
+			}
+			if last, want := gotPlacements[len(gotPlacements)-1], test.placements[len(test.placements)-1]; last != want {
+				t.Errorf("test returned wrong last placement: got %v want %v", last, want)
+			}
+			if gotDeploy.Annotations[pkg.SchedulingRetrieString] != "3" {
+				t.Errorf("test overwrote the other annotations: got %v", gotDeploy.Annotations)
+			}
+		})
+	}
+}
+
+func TestPlacementRecorderWorkloadGone(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	recorder := NewPlacementRecorder(NewObjects(client, capabilities.CronJobV1))
+	recorder.Record("Deployment", "default", "nginx", pkg.Placement{Pod: "nginx-x2k9q", Node: "node2"})
+	recorder.Flush()
+	if len(recorder.pending) != 0 {
+		t.Errorf("test kept the placements of a deleted workload: %v", recorder.pending)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ Copyright 2023-KylinSoft Co.,Ltd.
+
+ kse-rescheduler is about rescheduling terminated or crashloopbackoff pods according to the scheduling-retries defined
+ in annotations. some pods scheduled to a specific node, but can't run normally, so we try to reschedule the pods some times according to
+ the scheduling-retries defined in annotations.
+*/
+
+
+package workloadstate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"kse/kse-rescheduler/pkg"
+	"kse/kse-rescheduler/pkg/capabilities"
+)
+
+// The rescheduling state lives in the kse.com annotations of the pods and their owners, it's written by the listFunc
+// and the Podrescheduling plugin. It's written by JSON merge patches which only contain the kse.com annotations and the
+// resourceVersion the state was computed from, so the fields edited by users are never overwritten, and a write based
+// on a stale state is rejected by the apiserver.
+
+// ErrStateChanged means the kse.com state has been changed by others since it was read, it must be recomputed from the
+// objects read again
+var ErrStateChanged = errors.New("the rescheduling state has been changed since it was read")
+
+func IsStateChanged(err error) bool {
+	return errors.Is(err, ErrStateChanged)
+}
+
+// Objects reads and patches the pods and the workloads by their kind
+type Objects struct {
+	Client   kubernetes.Interface
+	CronJobs *capabilities.CronJobClient
+}
+
+func NewObjects(client kubernetes.Interface, cronJobGroupVersion string) *Objects {
+	return &Objects{Client: client, CronJobs: capabilities.NewCronJobClient(client, cronJobGroupVersion)}
+}
+
+// UpdateAnnotation sets the kse.com annotation of obj
+func (o *Objects) UpdateAnnotation(kind string, obj metav1.Object, key, value string) error {
+	return o.PatchStateAnnotations(kind, obj, key, map[string]*string{key: &value})
+}
+
+// PatchStateAnnotations patches the annotations of obj, a nil value removes the annotation. The oldest placements and
+// node failures of obj are dropped with the patch if the kse.com annotations exceed pkg.MaxStateAnnotationsSize. On
+// conflict obj is read again, the patch is retried with the new resourceVersion if only the other fields have changed,
+// or ErrStateChanged is returned if the stateKey annotation or any patched annotation has changed, the patched values
+// were computed from obj.
+func (o *Objects) PatchStateAnnotations(kind string, obj metav1.Object, stateKey string, annotations map[string]*string) error {
+	current := obj
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
+		fitted, err := fitStateBudget(current, annotations)
+		if err != nil {
+			return err
+		}
+		patch, err := annotationsPatch(current.GetResourceVersion(), fitted)
+		if err != nil {
+			return err
+		}
+		patchErr := o.Patch(kind, obj.GetNamespace(), obj.GetName(), patch)
+		if !apierrors.IsConflict(patchErr) {
+			return patchErr
+		}
+		latest, err := o.Get(kind, obj.GetNamespace(), obj.GetName())
+		if err != nil {
+			return err
+		}
+		if annotationChanged(obj, latest, stateKey) {
+			return ErrStateChanged
+		}
+		for key := range annotations {
+			if annotationChanged(obj, latest, key) {
+				return ErrStateChanged
+			}
+		}
+		current = latest
+		return patchErr
+	})
+	if retryErr != nil {
+		return fmt.Errorf("update %s %s %s err: %w\n", kind, obj.GetName(), stateKey, retryErr)
+	}
+	return nil
+}
+
+// annotationChanged is true if the annotation key of latest isn't the one of base
+func annotationChanged(base, latest metav1.Object, key string) bool {
+	baseValue, baseFound := base.GetAnnotations()[key]
+	value, found := latest.GetAnnotations()[key]
+	return found != baseFound || value != baseValue
+}
+
+func annotationsPatch(resourceVersion string, annotations map[string]*string) ([]byte, error) {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": resourceVersion,
+			"annotations":     annotations,
+		},
+	}
+	bytePatch, err := json.Marshal(patch)
+	if err != nil {
+		return nil, fmt.Errorf("marshal annotations patch err: %s\n", err.Error())
+	}
+	return bytePatch, nil
+}
+
+func (o *Objects) Patch(kind, namespace, name string, patch []byte) error {
+	opts := metav1.PatchOptions{FieldManager: pkg.FieldManagerString}
+	var err error
+	switch kind {
+	case "Pod":
+		_, err = o.Client.CoreV1().Pods(namespace).Patch(context.TODO(), name, types.MergePatchType, patch, opts)
+	case "Deployment":
+		_, err = o.Client.AppsV1().Deployments(namespace).Patch(context.TODO(), name, types.MergePatchType, patch, opts)
+	case "ReplicaSet":
+		_, err = o.Client.AppsV1().ReplicaSets(namespace).Patch(context.TODO(), name, types.MergePatchType, patch, opts)
+	case "StatefulSet":
+		_, err = o.Client.AppsV1().StatefulSets(namespace).Patch(context.TODO(), name, types.MergePatchType, patch, opts)
+	case "DaemonSet":
+		_, err = o.Client.AppsV1().DaemonSets(namespace).Patch(context.TODO(), name, types.MergePatchType, patch, opts)
+	case "Job":
+		_, err = o.Client.BatchV1().Jobs(namespace).Patch(context.TODO(), name, types.MergePatchType, patch, opts)
+	case "CronJob":
+		_, err = o.CronJobs.Patch(context.TODO(), namespace, name, types.MergePatchType, patch, opts)
+	default:
+		return fmt.Errorf("unsupported kind %s of %s/%s", kind, namespace, name)
+	}
+	return err
+}
+
+func (o *Objects) Get(kind, namespace, name string) (metav1.Object, error) {
+	switch kind {
+	case "Pod":
+		return o.Client.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	case "Deployment":
+		return o.Client.AppsV1().Deployments(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	case "ReplicaSet":
+		return o.Client.AppsV1().ReplicaSets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	case "StatefulSet":
+		return o.Client.AppsV1().StatefulSets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	case "DaemonSet":
+		return o.Client.AppsV1().DaemonSets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	case "Job":
+		return o.Client.BatchV1().Jobs(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	case "CronJob":
+		return o.CronJobs.Get(context.TODO(), namespace, name, metav1.GetOptions{})
+	default:
+		return nil, fmt.Errorf("unsupported kind %s of %s/%s", kind, namespace, name)
+	}
+}